@@ -0,0 +1,111 @@
+package main
+
+import (
+	"zc-common-go/common"
+	log "zc-common-go/glog"
+	"zc-dm/device"
+	"zc-service-go"
+)
+
+type AccountManagerHandler struct {
+	account *device.AccountManager
+}
+
+func NewAccountManagerHandler(account *device.AccountManager) *AccountManagerHandler {
+	if account == nil {
+		return nil
+	}
+	return &AccountManagerHandler{account: account}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+/// ACCOUNT MANAGER
+////////////////////////////////////////////////////////////////////////////////////////////
+// remove the deleted user member from all the homes, the policy of the owned homes is
+// "transfer" by default or "delete"
+func (this *AccountManagerHandler) handlePurgeUser(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("member")
+	policyName := req.GetString("policy")
+	var policy int
+	switch policyName {
+	case "", "transfer":
+		policy = device.PURGE_TRANSFER
+	case "delete":
+		policy = device.PURGE_DELETE
+	default:
+		resp.SetErr(common.ErrInvalidParam.Error())
+		log.Warningf("check the purge policy failed:domain[%s], uid[%d], policy[%s]", domain, uid, policyName)
+		return
+	}
+	report, err := this.account.Purge(domain, uid, policy)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("purge user failed:domain[%s], uid[%d], policy[%s], err[%v]", domain, uid, policyName, err)
+		return
+	}
+	for _, hid := range report.GetLeft() {
+		resp.AddObject("left", zc.ZObject{"hid": hid})
+	}
+	for hid, owner := range report.GetTransferred() {
+		resp.AddObject("transferred", zc.ZObject{"hid": hid, "owner": owner})
+	}
+	for _, hid := range report.GetDeleted() {
+		resp.AddObject("deleted", zc.ZObject{"hid": hid})
+	}
+	for _, hid := range report.GetFrozen() {
+		resp.AddObject("frozen", zc.ZObject{"hid": hid})
+	}
+	for hid, err := range report.GetFailed() {
+		resp.AddObject("failed", zc.ZObject{"hid": hid, "error": err.Error()})
+	}
+	log.Infof("purge user succ:domain[%s], uid[%d], policy[%s], left[%d], transferred[%d], deleted[%d], failed[%d]",
+		domain, uid, policyName, len(report.GetLeft()), len(report.GetTransferred()), len(report.GetDeleted()), len(report.GetFailed()))
+	resp.SetAck()
+}
+
+// export all the data held about the user as one structured document for the privacy request,
+// the user is the request member exported by the service or the caller self if not set
+func (this *AccountManagerHandler) handleExportUser(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("member")
+	if uid <= 0 {
+		uid = req.GetInt("uid")
+	}
+	export, err := this.account.Export(domain, uid)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("export user failed:domain[%s], uid[%d], err[%v]", domain, uid, err)
+		return
+	}
+	memberships := export.GetMemberships()
+	for i, home := range export.GetHomes() {
+		member := memberships[i]
+		devices := make([]zc.ZObject, 0)
+		for _, dev := range export.GetDevices(home.GetHid()) {
+			devices = append(devices, deviceObject(&dev))
+		}
+		resp.AddObject("homes", zc.ZObject{"id": home.GetHid(), "name": home.GetName(), "owner": home.GetCreateUid(),
+			"status": home.GetStatus(), "parent": home.GetParentHid(), "timezone": home.GetTimezone(), "address": home.GetAddress(),
+			"latitude": home.GetLatitude(), "longitude": home.GetLongitude(),
+			"membership": zc.ZObject{"name": member.GetMemberName(), "role": device.GetRoleName(member.GetMemberType()),
+				"status": member.GetStatus(), "from": getUnixSeconds(member.GetValidFrom()), "until": getUnixSeconds(member.GetValidUntil()),
+				"schedule": member.GetSchedule()},
+			"devices": devices})
+	}
+	for _, invite := range export.GetInvites() {
+		resp.AddObject("invites", inviteObject(&invite))
+	}
+	for _, history := range export.GetHistory() {
+		resp.AddObject("history", zc.ZObject{"submain": history.GetSubDomain(), "deviceid": history.GetDeviceId(),
+			"did": history.GetDid(), "event": history.GetEvent(), "hid": history.GetHid(), "master": history.GetMasterDid(),
+			"time": history.GetCreateTime().Unix()})
+	}
+	for _, audit := range export.GetAudits() {
+		resp.AddObject("audits", zc.ZObject{"hid": audit.GetHid(), "did": audit.GetDid(), "action": audit.GetAction(),
+			"detail": audit.GetDetail(), "time": audit.GetCreateTime().Unix()})
+	}
+	log.Infof("export user succ:domain[%s], uid[%d], homes[%d], history[%d], audits[%d]",
+		domain, uid, len(export.GetHomes()), len(export.GetHistory()), len(export.GetAudits()))
+	resp.SetAck()
+}
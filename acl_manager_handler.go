@@ -0,0 +1,104 @@
+package main
+
+import (
+	"zc-common-go/common"
+	log "zc-common-go/glog"
+	"zc-dm/device"
+	"zc-service-go"
+)
+
+type AclManagerHandler struct {
+	acl *device.AclManager
+}
+
+func NewAclManagerHandler(acl *device.AclManager) *AclManagerHandler {
+	if acl == nil {
+		return nil
+	}
+	return &AclManagerHandler{acl: acl}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+/// DEVICE ACL MANAGER
+////////////////////////////////////////////////////////////////////////////////////////////
+// allow or deny the member or the role to control the device
+func (this *AclManagerHandler) handleGrantDevice(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	did := req.GetInt("did")
+	allow := req.GetBool("allow")
+	subjectType, subject, err := getAclSubject(req)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("parse the acl subject failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return
+	}
+	err = this.acl.Grant(domain, uid, did, subjectType, subject, allow)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("grant device acl failed:domain[%s], uid[%d], did[%d], type[%d], subject[%d], allow[%t], err[%v]",
+			domain, uid, did, subjectType, subject, allow, err)
+		return
+	}
+	log.Infof("grant device acl succ:domain[%s], uid[%d], did[%d], type[%d], subject[%d], allow[%t]",
+		domain, uid, did, subjectType, subject, allow)
+	resp.SetAck()
+}
+
+// remove the acl entry of the member or the role
+func (this *AclManagerHandler) handleRevokeDevice(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	did := req.GetInt("did")
+	subjectType, subject, err := getAclSubject(req)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("parse the acl subject failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return
+	}
+	err = this.acl.Revoke(domain, uid, did, subjectType, subject)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("revoke device acl failed:domain[%s], uid[%d], did[%d], type[%d], subject[%d], err[%v]",
+			domain, uid, did, subjectType, subject, err)
+		return
+	}
+	log.Infof("revoke device acl succ:domain[%s], uid[%d], did[%d], type[%d], subject[%d]", domain, uid, did, subjectType, subject)
+	resp.SetAck()
+}
+
+// list all the acl entries of the device
+func (this *AclManagerHandler) handleListDeviceAcl(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	did := req.GetInt("did")
+	list, err := this.acl.GetAll(domain, did)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("list device acls failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return
+	}
+	for _, acl := range list {
+		object := zc.ZObject{"did": acl.GetDid(), "allow": acl.IsAllowed()}
+		if acl.GetSubjectType() == device.ACL_SUBJECT_USER {
+			object["member"] = acl.GetSubject()
+		} else {
+			object["role"] = device.GetRoleName(int8(acl.GetSubject()))
+		}
+		resp.AddObject("acls", object)
+	}
+	log.Infof("list device acls succ:domain[%s], did[%d], count[%d]", domain, did, len(list))
+	resp.SetAck()
+}
+
+// the acl subject is the member uid if set, otherwise the role name
+func getAclSubject(req *zc.ZMsg) (int8, int64, error) {
+	member := req.GetInt("member")
+	if member > 0 {
+		return device.ACL_SUBJECT_USER, member, nil
+	}
+	role, ok := device.ParseRole(req.GetString("role"))
+	if !ok {
+		return 0, 0, common.ErrInvalidParam
+	}
+	return device.ACL_SUBJECT_ROLE, int64(role), nil
+}
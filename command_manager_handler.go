@@ -0,0 +1,98 @@
+package main
+
+import (
+	"time"
+	"zc-common-go/common"
+	log "zc-common-go/glog"
+	"zc-dm/device"
+	"zc-service-go"
+)
+
+type CommandManagerHandler struct {
+	command *device.CommandManager
+}
+
+func NewCommandManagerHandler(command *device.CommandManager) *CommandManagerHandler {
+	if command == nil {
+		return nil
+	}
+	return &CommandManagerHandler{command: command}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+/// DEVICE COMMAND MANAGER
+////////////////////////////////////////////////////////////////////////////////////////////
+// queue the command to the device until its master fetched, the ttl in seconds
+func (this *CommandManagerHandler) handleEnqueueCommand(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	did := req.GetInt("did")
+	payload := req.GetString("payload")
+	ttl := req.GetInt("ttl")
+	if len(domain) <= 0 || uid <= 0 || did <= 0 || ttl < 0 {
+		resp.SetErr(common.ErrInvalidRequest.Error())
+		log.Warningf("check request invalid:domain[%s], uid[%d], did[%d], ttl[%d]", domain, uid, did, ttl)
+		return
+	}
+	id, err := this.command.Enqueue(uid, domain, did, payload, time.Duration(ttl)*time.Second)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("enqueue device command failed:domain[%s], uid[%d], did[%d], err[%v]", domain, uid, did, err)
+		return
+	}
+	resp.AddObject("command", zc.ZObject{"id": id, "did": did})
+	log.Infof("enqueue device command succ:domain[%s], uid[%d], did[%d], id[%d]", domain, uid, did, id)
+	resp.SetAck()
+}
+
+// the master device fetch the queued commands after reconnected
+func (this *CommandManagerHandler) handleFetchCommands(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	subDomain := req.GetString("submain")
+	deviceId := req.GetString("deviceid")
+	limit := req.GetInt("limit")
+	list, err := this.command.Fetch(domain, subDomain, deviceId, int(limit))
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("fetch device commands failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return
+	}
+	for _, command := range list {
+		resp.AddObject("commands", zc.ZObject{"id": command.GetId(), "did": command.GetDid(), "uid": command.GetUid(),
+			"payload": command.GetPayload(), "attempts": command.GetAttempts(), "expire": command.GetExpireTime().Unix()})
+	}
+	log.Infof("fetch device commands succ:domain[%s], device[%s:%s], count[%d]", domain, subDomain, deviceId, len(list))
+	resp.SetAck()
+}
+
+// the master device executed the command
+func (this *CommandManagerHandler) handleAckCommand(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	subDomain := req.GetString("submain")
+	deviceId := req.GetString("deviceid")
+	id := req.GetInt("id")
+	err := this.command.Ack(domain, subDomain, deviceId, id)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("ack device command failed:domain[%s], device[%s:%s], id[%d], err[%v]", domain, subDomain, deviceId, id, err)
+		return
+	}
+	log.Infof("ack device command succ:domain[%s], device[%s:%s], id[%d]", domain, subDomain, deviceId, id)
+	resp.SetAck()
+}
+
+// the master device failed to execute the command, delivered again later
+func (this *CommandManagerHandler) handleNackCommand(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	subDomain := req.GetString("submain")
+	deviceId := req.GetString("deviceid")
+	id := req.GetInt("id")
+	err := this.command.Nack(domain, subDomain, deviceId, id)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("nack device command failed:domain[%s], device[%s:%s], id[%d], err[%v]", domain, subDomain, deviceId, id, err)
+		return
+	}
+	log.Infof("nack device command succ:domain[%s], device[%s:%s], id[%d]", domain, subDomain, deviceId, id)
+	resp.SetAck()
+}
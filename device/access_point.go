@@ -0,0 +1,32 @@
+package device
+
+// the access point of one device, the master device subdomain + deviceid or the error
+type AccessPoint struct {
+	did       int64
+	subDomain string
+	deviceId  string
+	grant     string
+	err       error
+}
+
+func (this *AccessPoint) GetDid() int64 {
+	return this.did
+}
+
+func (this *AccessPoint) GetSubDomain() string {
+	return this.subDomain
+}
+
+func (this *AccessPoint) GetDeviceId() string {
+	return this.deviceId
+}
+
+// the signed access grant, empty if no signer set
+func (this *AccessPoint) GetGrant() string {
+	return this.grant
+}
+
+// the error of resolving the device access point, nil if succ
+func (this *AccessPoint) GetError() error {
+	return this.err
+}
@@ -1,105 +1,446 @@
 package device
 
 import (
+	"time"
 	"zc-common-go/common"
 	log "zc-common-go/glog"
 )
 
+// max dids of one batch access points request
+const MAX_BATCH_ACCESS_POINTS = 64
+
 type AccessRouter struct {
-	deviceManager *DeviceManager
-	bindManager   *BindingManager
-	homeManager   *HomeManager
-	memberManager *MemberManager
+	deviceManager   *DeviceManager
+	bindManager     *BindingManager
+	homeManager     *HomeManager
+	memberManager   *MemberManager
+	aclManager      *AclManager
+	presenceManager *PresenceManager
+	// mint the access grant if set
+	signer *GrantSigner
 }
 
 func NewAccessRouter(store *DeviceStorage) *AccessRouter {
 	return &AccessRouter{deviceManager: NewDeviceManager(store), bindManager: NewBindingManager(store),
-		homeManager: NewHomeManager(store), memberManager: NewMemberManager(store)}
+		homeManager: NewHomeManager(store), memberManager: NewMemberManager(store),
+		aclManager: NewAclManager(store), presenceManager: NewPresenceManager(store)}
 }
 
 func (this *AccessRouter) Validate() bool {
-	return this.deviceManager != nil && this.bindManager != nil && this.homeManager != nil && this.memberManager != nil
+	return this.deviceManager != nil && this.bindManager != nil && this.homeManager != nil &&
+		this.memberManager != nil && this.aclManager != nil && this.presenceManager != nil
+}
+
+// set the signer of the access grants, the grant not minted if nil
+func (this *AccessRouter) SetGrantSigner(signer *GrantSigner) {
+	this.signer = signer
+}
+
+// give device inner id get the master device info(did) and the signed access grant,
+// the grant is empty if no signer set
+func (this *AccessRouter) GetAccessPoint(uid int64, domain string, did int64) (string, string, string, error) {
+	var invalidString string
+	if !this.Validate() {
+		log.Error("check access router internal member failed")
+		return invalidString, invalidString, invalidString, common.ErrUnknown
+	}
+	return this.getAccessPoint(newAccessCache(uid), domain, did)
 }
 
-// give device inner id get the master device info(did)
-func (this *AccessRouter) GetAccessPoint(uid int64, domain string, did int64) (string, string, error) {
+// get the access point as GetAccessPoint but fail fast if the master device offline
+func (this *AccessRouter) GetOnlineAccessPoint(uid int64, domain string, did int64) (string, string, string, error) {
 	var invalidString string
 	if !this.Validate() {
 		log.Error("check access router internal member failed")
-		return invalidString, invalidString, common.ErrUnknown
+		return invalidString, invalidString, invalidString, common.ErrUnknown
+	}
+	cache := newAccessCache(uid)
+	cache.online = true
+	return this.getAccessPoint(cache, domain, did)
+}
+
+// resolve the access points of the devices for the user, the devices, the master bindings
+// and the member check of every home are shared, return the result or error of every did
+func (this *AccessRouter) GetAccessPoints(uid int64, domain string, dids []int64) ([]AccessPoint, error) {
+	if !this.Validate() {
+		log.Error("check access router internal member failed")
+		return nil, common.ErrUnknown
+	} else if len(dids) <= 0 || len(dids) > MAX_BATCH_ACCESS_POINTS {
+		log.Warningf("check the dids count failed:domain[%s], uid[%d], count[%d]", domain, uid, len(dids))
+		return nil, common.ErrInvalidParam
+	}
+	cache := newAccessCache(uid)
+	list := make([]AccessPoint, 0, len(dids))
+	for _, did := range dids {
+		subDomain, deviceId, grant, err := this.getAccessPoint(cache, domain, did)
+		list = append(list, AccessPoint{did: did, subDomain: subDomain, deviceId: deviceId, grant: grant, err: err})
+	}
+	return list, nil
+}
+
+// get the audience of the device by the physical id, the active members of the device home
+// or inherited from the ancestor homes who can control the device now and allowed by the acl,
+// if no member return empty list, the expired members are skipped but not deleted
+func (this *AccessRouter) GetAudience(domain, subDomain, deviceId string) ([]Member, error) {
+	if !this.Validate() {
+		log.Error("check access router internal member failed")
+		return nil, common.ErrUnknown
+	}
+	bind, err := this.bindManager.GetBindingInfo(domain, subDomain, deviceId)
+	if err == common.ErrEntryNotExist {
+		log.Warningf("device mapping not exist:domain[%s], subdomain[%s], deviceid[%s]", domain, subDomain, deviceId)
+		return nil, ErrBindingNotExist
+	} else if err != nil {
+		log.Warningf("get binding info failed:domain[%s], subdomain[%s], deviceid[%s], err[%v]", domain, subDomain, deviceId, err)
+		return nil, err
+	}
+	cache := newAccessCache(0)
+	device, err := this.checkDevice(cache, domain, bind.did)
+	if err != nil {
+		return nil, err
+	}
+	err = this.checkMaster(cache, domain, device)
+	if err != nil {
+		return nil, err
+	}
+	path, err := this.checkHome(domain, device.GetHid())
+	if err != nil {
+		return nil, err
+	}
+	// the member of the nearest home takes precedence over the ancestor homes
+	now := time.Now()
+	found := make(map[int64]bool)
+	list := make([]Member, 0)
+	for _, home := range path {
+		members, err := this.memberManager.GetAllMembers(domain, home.GetHid())
+		if err != nil {
+			log.Warningf("get home all members failed:domain[%s], hid[%d], err[%v]", domain, home.GetHid(), err)
+			return nil, err
+		}
+		for i := range members {
+			member := &members[i]
+			if found[member.GetUid()] {
+				continue
+			}
+			found[member.GetUid()] = true
+			if member.GetStatus() != ACTIVE || !member.HasPermission(PERM_CONTROL) ||
+				!member.IsValidAt(now, home.GetLocation()) {
+				continue
+			}
+			err = this.aclManager.CheckAccess(domain, device, member)
+			if err == ErrAccessDenied {
+				continue
+			} else if err != nil {
+				log.Warningf("check the device acl failed:domain[%s], did[%d], uid[%d], err[%v]", domain, device.GetDid(), member.GetUid(), err)
+				return nil, err
+			}
+			list = append(list, *member)
+		}
 	}
+	return list, nil
+}
+
+// explain the access decision of the user to the device step by step, every step has
+// its outcome, the step depends on the failed step is not checked, nothing is modified
+func (this *AccessRouter) ExplainAccess(uid int64, domain string, did int64) ([]AccessStep, error) {
+	if !this.Validate() {
+		log.Error("check access router internal member failed")
+		return nil, common.ErrUnknown
+	}
+	cache := newAccessCache(uid)
+	steps := []AccessStep{{name: ACCESS_STEP_DEVICE}, {name: ACCESS_STEP_MASTER}, {name: ACCESS_STEP_BINDING},
+		{name: ACCESS_STEP_HOME}, {name: ACCESS_STEP_MEMBER}, {name: ACCESS_STEP_ACL}}
+	device, err := this.checkDevice(cache, domain, did)
+	steps[0].finish(err)
+	if err != nil {
+		return steps, nil
+	}
+	steps[1].finish(this.checkMaster(cache, domain, device))
+	_, err = this.checkBinding(cache, domain, device.GetMasterDid())
+	steps[2].finish(err)
+	path, err := this.checkHome(domain, device.GetHid())
+	steps[3].finish(err)
+	if len(path) == 0 {
+		return steps, nil
+	}
+	member, _, err := this.checkUser(domain, path, uid)
+	steps[4].finish(err)
+	if err != nil {
+		return steps, nil
+	}
+	steps[5].finish(this.checkAcl(domain, device, member))
+	return steps, nil
+}
+
+func (this *AccessRouter) getAccessPoint(cache *accessCache, domain string, did int64) (string, string, string, error) {
+	var invalidString string
+	device, bind, member, err := this.checkAccess(cache, domain, did)
+	if err != nil {
+		return invalidString, invalidString, invalidString, err
+	}
+	// step 8. mint the access grant of the member
+	var grant string
+	if this.signer != nil {
+		home := cache.members[device.GetHid()].home
+		grant, err = this.signer.mint(member, home.GetLocation(), device, bind, time.Now())
+		if err != nil {
+			log.Errorf("mint the access grant failed:domain[%s], did[%d], uid[%d], err[%v]", domain, did, cache.uid, err)
+			return invalidString, invalidString, invalidString, err
+		}
+	}
+	return bind.subDomain, bind.deviceId, grant, nil
+}
+
+// check the user can control the device, return the device, the master binding and the member if passed
+func (this *AccessRouter) checkAccess(cache *accessCache, domain string, did int64) (*DeviceInfo, *BindingInfo, *Member, error) {
+	uid := cache.uid
 	// step 0. TODO check the mapping is valid
 	// step 1. get the device info check it is master or normal device
-	device, err := this.deviceManager.Get(domain, did)
+	device, err := this.checkDevice(cache, domain, did)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// step 2. check the master status and the master online if required
+	err = this.checkMaster(cache, domain, device)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if cache.online {
+		err = this.checkOnline(domain, device.GetMasterDid())
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	// step 3. get master device subdomain + deviceid
+	bind, err := this.checkBinding(cache, domain, device.GetMasterDid())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// step 4-6. check the home and the member once for all the devices of the home
+	hid := device.GetHid()
+	check, ok := cache.members[hid]
+	if !ok {
+		check.member, check.home, check.err = this.checkMember(domain, hid, uid)
+		cache.members[hid] = check
+	}
+	if check.err != nil {
+		return nil, nil, nil, check.err
+	}
+
+	// step 7. check the device acl entries allow the member
+	err = this.checkAcl(domain, device, check.member)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return device, bind, check.member, nil
+}
+
+// check the device exist, active and binded to a home
+func (this *AccessRouter) checkDevice(cache *accessCache, domain string, did int64) (*DeviceInfo, error) {
+	device, err := this.getDevice(cache, domain, did)
 	if err != nil {
 		log.Warningf("get device info failed:domain[%s], did[%d], err[%v]", domain, did, err)
-		return invalidString, invalidString, err
+		return nil, err
 	} else if device == nil {
 		log.Warningf("not find the device:domain[%s], did[%d]", domain, did)
-		return invalidString, invalidString, common.ErrEntryNotExist
+		return nil, ErrDeviceNotExist
 	} else if device.GetStatus() != ACTIVE {
 		log.Warningf("the device status not invalid:domain[%s], did[%d], status[%d]", domain, did, device.GetStatus())
-		return invalidString, invalidString, common.ErrInvalidStatus
+		return nil, ErrDeviceNotActive
 	}
 	// get device's master did and home id
+	if device.GetHid() <= 0 {
+		log.Warningf("check home id failed:domain[%s], did[%d], hid[%d]", domain, did, device.GetHid())
+		return nil, common.ErrNotYetBinded
+	} else if device.IsDetached() {
+		// the detached slave device can not be accessed until moved to a master
+		log.Warningf("the slave device detached:domain[%s], did[%d], hid[%d]", domain, did, device.GetHid())
+		return nil, common.ErrMasterNotExist
+	}
+	return device, nil
+}
+
+// check the master of the slave device exist and active
+func (this *AccessRouter) checkMaster(cache *accessCache, domain string, device *DeviceInfo) error {
+	if device.IsMasterDevice() {
+		return nil
+	}
 	masterDid := device.GetMasterDid()
-	hid := device.GetHid()
-	if masterDid <= 0 || hid <= 0 {
-		log.Warningf("check master did or home id failed:domain[%s], did[%d], master[%d], hid[%d]",
-			domain, did, masterDid, hid)
-		return invalidString, invalidString, common.ErrUnknown
+	master, err := this.getDevice(cache, domain, masterDid)
+	if err != nil {
+		log.Warningf("get master device info failed:domain[%s], did[%d], err[%v]", domain, masterDid, err)
+		return err
+	} else if master == nil {
+		log.Warningf("master device not exist:domain[%s], did[%d]", domain, masterDid)
+		return common.ErrMasterNotExist
+	} else if master.GetStatus() != ACTIVE {
+		log.Warningf("master device status not active:domain[%s], did[%d], status[%d]", domain, masterDid, master.GetStatus())
+		return ErrMasterNotActive
 	}
+	return nil
+}
 
-	// step 2. check the master status
-	if !device.IsMasterDevice() {
-		master, err := this.deviceManager.Get(domain, masterDid)
-		if err != nil {
-			log.Warningf("get master device info failed:domain[%s], did[%d], err[%v]", domain, masterDid, err)
-			return invalidString, invalidString, err
-		} else if master == nil {
-			log.Warningf("master device not exist:domain[%s], did[%d]", domain, masterDid)
-			return invalidString, invalidString, err
-		} else if master.GetStatus() != ACTIVE {
-			log.Warningf("master device status not active:domain[%s], did[%d], status[%d]", domain, masterDid, device.GetStatus())
-			return invalidString, invalidString, common.ErrInvalidStatus
-		}
+// check the master device heartbeat received in the online timeout
+func (this *AccessRouter) checkOnline(domain string, masterDid int64) error {
+	presence, err := this.presenceManager.Get(domain, masterDid)
+	if err != nil {
+		log.Warningf("get master presence failed:domain[%s], did[%d], err[%v]", domain, masterDid, err)
+		return err
+	} else if presence == nil || !presence.IsOnline() {
+		log.Warningf("the master device offline:domain[%s], did[%d]", domain, masterDid)
+		return ErrDeviceOffline
 	}
+	return nil
+}
 
-	// step 3. get master device subdomain + deviceid
-	bind, err := this.bindManager.Get(domain, masterDid)
+// get the master device mapping binding info
+func (this *AccessRouter) checkBinding(cache *accessCache, domain string, masterDid int64) (*BindingInfo, error) {
+	bind, err := this.getBinding(cache, domain, masterDid)
 	if err != nil {
 		log.Warningf("get master mapping binding info failed:domain[%s], did[%d], err[%v]", domain, masterDid, err)
-		return invalidString, invalidString, err
+		return nil, err
 	} else if bind == nil {
 		log.Warningf("master device mapping not exist:domain[%s], did[%d]", domain, masterDid)
-		return invalidString, invalidString, err
+		return nil, ErrBindingNotExist
+	}
+	return bind, nil
+}
+
+// check the home status and the user member of the home can control the devices,
+// the expired members of the home path deleted at once on the access path
+func (this *AccessRouter) checkMember(domain string, hid, uid int64) (*Member, *Home, error) {
+	path, err := this.checkHome(domain, hid)
+	if err != nil {
+		return nil, nil, err
+	}
+	member, home, err := this.checkUser(domain, path, uid)
+	if err == ErrMemberExpired {
+		for _, node := range path {
+			if err := this.memberManager.DeleteExpired(domain, node.GetHid()); err != nil {
+				log.Warningf("delete expired members failed:domain[%s], hid[%d], err[%v]", domain, node.GetHid(), err)
+			}
+		}
 	}
+	return member, home, err
+}
 
-	// step 4. check the home status ok
-	home, err := this.homeManager.Get(domain, hid)
+// step 4. check the home and all its ancestor homes status ok, return the home path
+// from the home to the root if got
+func (this *AccessRouter) checkHome(domain string, hid int64) ([]Home, error) {
+	path, err := this.homeManager.GetAncestors(domain, hid)
 	if err != nil {
-		log.Warningf("get home info failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, uid, err)
-		return invalidString, invalidString, err
-	} else if home == nil {
-		log.Warningf("not find the home:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, uid, err)
-		return invalidString, invalidString, common.ErrEntryNotExist
-	} else if home.GetStatus() != ACTIVE {
-		log.Warningf("the home status not active:domain[%s], hid[%d]", domain, hid)
-		return invalidString, invalidString, common.ErrInvalidStatus
+		log.Warningf("get home info failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	} else if len(path) == 0 {
+		log.Warningf("not find the home:domain[%s], hid[%d]", domain, hid)
+		return nil, ErrHomeNotExist
+	}
+	for _, home := range path {
+		if home.GetStatus() != ACTIVE {
+			log.Warningf("the home status not active:domain[%s], hid[%d], node[%d]", domain, hid, home.GetHid())
+			return path, ErrHomeNotActive
+		}
 	}
+	return path, nil
+}
 
-	// step 5. check the uid in the same home and status ok
-	member, err := this.memberManager.Get(domain, hid, uid)
+// step 5-6. check the user member of the home path can control the devices now, return
+// the member and the home it belongs to
+func (this *AccessRouter) checkUser(domain string, path []Home, uid int64) (*Member, *Home, error) {
+	// step 5. check the uid in the same home or inherited from the ancestors and status ok
+	hid := path[0].GetHid()
+	member, err := this.memberManager.GetInherited(domain, hid, uid)
 	if err != nil {
 		log.Warningf("get user member failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, uid, err)
-		return invalidString, invalidString, err
+		return nil, nil, err
 	} else if member == nil {
 		log.Warningf("not find the user:domain[%s], hid[%d], uid[%d]", domain, hid, uid)
-		return invalidString, invalidString, common.ErrNoPrivelige
+		return nil, nil, ErrNotHomeMember
 	} else if member.GetStatus() != ACTIVE {
 		log.Warningf("the user status not active:domain[%s], hid[%d], uid[%d]", domain, hid, uid)
-		return invalidString, invalidString, common.ErrNotAllowed
+		return nil, nil, ErrMemberNotActive
+	} else if !member.HasPermission(PERM_CONTROL) {
+		log.Warningf("check the control permission failed:domain[%s], hid[%d], uid[%d], role[%d]",
+			domain, hid, uid, member.GetMemberType())
+		return nil, nil, ErrNoControlPermission
+	}
+
+	// step 6. check the member time-bound and scheduled access in the member home timezone
+	now := time.Now()
+	if member.IsExpired(now) {
+		log.Warningf("the member access expired:domain[%s], hid[%d], uid[%d]", domain, member.GetHid(), uid)
+		return nil, nil, ErrMemberExpired
+	}
+	for i := range path {
+		home := &path[i]
+		if home.GetHid() != member.GetHid() {
+			continue
+		} else if !member.IsValidAt(now, home.GetLocation()) {
+			log.Warningf("the member not in valid time:domain[%s], hid[%d], uid[%d]", domain, member.GetHid(), uid)
+			return nil, nil, ErrMemberOutOfTime
+		}
+		return member, home, nil
+	}
+	log.Errorf("not find the member home:domain[%s], hid[%d], uid[%d]", domain, member.GetHid(), uid)
+	return nil, nil, ErrNotHomeMember
+}
+
+// step 7. check the device acl entries allow the member
+func (this *AccessRouter) checkAcl(domain string, device *DeviceInfo, member *Member) error {
+	err := this.aclManager.CheckAccess(domain, device, member)
+	if err != nil {
+		log.Warningf("check the device acl failed:domain[%s], did[%d], uid[%d], err[%v]", domain, device.GetDid(), member.GetUid(), err)
+		return err
+	}
+	return nil
+}
+
+func (this *AccessRouter) getDevice(cache *accessCache, domain string, did int64) (*DeviceInfo, error) {
+	if device, ok := cache.devices[did]; ok {
+		return device, nil
+	}
+	device, err := this.deviceManager.Get(domain, did)
+	if err != nil {
+		return nil, err
 	}
+	cache.devices[did] = device
+	return device, nil
+}
+
+func (this *AccessRouter) getBinding(cache *accessCache, domain string, masterDid int64) (*BindingInfo, error) {
+	if bind, ok := cache.binds[masterDid]; ok {
+		return bind, nil
+	}
+	bind, err := this.bindManager.Get(domain, masterDid)
+	if err != nil {
+		return nil, err
+	}
+	cache.binds[masterDid] = bind
+	return bind, nil
+}
+
+// the shared lookups of resolving the access points for one user
+type accessCache struct {
+	uid     int64
+	devices map[int64]*DeviceInfo
+	binds   map[int64]*BindingInfo
+	members map[int64]memberCheck
+	// fail fast if the master offline
+	online bool
+}
+
+// the member check result of one home
+type memberCheck struct {
+	member *Member
+	// the home the member belongs to in the home path
+	home *Home
+	err  error
+}
 
-	return bind.subDomain, bind.deviceId, nil
+func newAccessCache(uid int64) *accessCache {
+	return &accessCache{uid: uid, devices: make(map[int64]*DeviceInfo), binds: make(map[int64]*BindingInfo),
+		members: make(map[int64]memberCheck)}
 }
@@ -2,6 +2,7 @@ package device
 
 import (
 	"testing"
+	"time"
 )
 
 func TestGetAccessPoint(t *testing.T) {
@@ -34,7 +35,7 @@ func TestGetAccessPoint(t *testing.T) {
 			t.Error("check all devices count failed", len(devList))
 		}
 		for _, dev := range devList {
-			subDomain, deviceId, err := router.GetAccessPoint(uid, domain, dev.did)
+			subDomain, deviceId, _, err := router.GetAccessPoint(uid, domain, dev.did)
 			if err != nil {
 				t.Error("get access point failed", err)
 			} else if dev.IsMasterDevice() {
@@ -51,15 +52,336 @@ func TestGetAccessPoint(t *testing.T) {
 		}
 	}
 	// invalid account
-	_, _, err = router.GetAccessPoint(invalidUid, domain, validDid)
+	_, _, _, err = router.GetAccessPoint(invalidUid, domain, validDid)
 	if err == nil {
 		t.Error("invalid user get access point succ")
 	}
 	// invalid did
 	var invalidDid int64 = 1000000
-	_, _, err = router.GetAccessPoint(uid, domain, invalidDid)
+	_, _, _, err = router.GetAccessPoint(uid, domain, invalidDid)
 	if err == nil {
 		t.Error("get access point failed")
 	}
 	cleanAll(store)
 }
+
+func TestInheritedAccess(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	prepare(store)
+	home := NewHomeManager(store)
+	var uid int64 = 100
+	list, err := home.GetAllHome(domain, uid)
+	if err != nil || len(list) != 5 {
+		t.Errorf("get user all home failed:err[%v], len[%d]", err, len(list))
+	}
+	// building > floor(list[0])
+	err = home.Create(domain, uid, "building")
+	if err != nil {
+		t.Error("create building failed", err)
+	}
+	all, err := home.GetAllHome(domain, uid)
+	if err != nil || len(all) != 6 {
+		t.Errorf("get user all home failed:err[%v], len[%d]", err, len(all))
+	}
+	var building int64
+	for _, node := range all {
+		if node.GetName() == "building" {
+			building = node.GetHid()
+		}
+	}
+	err = home.SetParent(domain, uid, list[0].hid, building)
+	if err != nil {
+		t.Error("set home parent failed", err)
+	}
+	var guest int64 = 200
+	member := NewMemberManager(store)
+	err = member.AddMember(domain, building, guest, "guest")
+	if err != nil {
+		t.Error("add building member failed", err)
+	}
+	router := NewAccessRouter(store)
+	device := NewDeviceManager(store)
+	floorDevs, err := device.GetAllDevices(domain, list[0].hid)
+	if err != nil || len(floorDevs) != 8 {
+		t.Errorf("get all devices failed:err[%v], len[%d]", err, len(floorDevs))
+	}
+	otherDevs, err := device.GetAllDevices(domain, list[1].hid)
+	if err != nil || len(otherDevs) != 8 {
+		t.Errorf("get all devices failed:err[%v], len[%d]", err, len(otherDevs))
+	}
+	for _, dev := range floorDevs {
+		_, _, _, err = router.GetAccessPoint(guest, domain, dev.did)
+		if err != nil {
+			t.Error("get inherited access point failed", err)
+		}
+	}
+	for _, dev := range otherDevs {
+		_, _, _, err = router.GetAccessPoint(guest, domain, dev.did)
+		if err == nil {
+			t.Error("get not inherited access point succ")
+		}
+	}
+	// the frozen building deny all the floors
+	err = home.Disable(domain, building)
+	if err != nil {
+		t.Error("disable building failed", err)
+	}
+	_, _, _, err = router.GetAccessPoint(uid, domain, floorDevs[0].did)
+	if err == nil {
+		t.Error("get access point in frozen building succ")
+	}
+	cleanAll(store)
+}
+
+func TestGetAccessPoints(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	prepare(store)
+	home := NewHomeManager(store)
+	var uid int64 = 100
+	list, err := home.GetAllHome(domain, uid)
+	if err != nil || len(list) != 5 {
+		t.Errorf("get user all home failed:err[%v], len[%d]", err, len(list))
+	}
+	device := NewDeviceManager(store)
+	dids := make([]int64, 0)
+	for _, home := range list {
+		devList, err := device.GetAllDevices(domain, home.hid)
+		if err != nil {
+			t.Error("get all devices failed", err)
+		}
+		for _, dev := range devList {
+			dids = append(dids, dev.did)
+		}
+	}
+	var invalidDid int64 = 1000000
+	dids = append(dids, invalidDid)
+	router := NewAccessRouter(store)
+	points, err := router.GetAccessPoints(uid, domain, dids)
+	if err != nil || len(points) != len(dids) {
+		t.Fatalf("get access points failed:err[%v], len[%d]", err, len(points))
+	}
+	for _, point := range points {
+		subDomain, deviceId, _, err := router.GetAccessPoint(uid, domain, point.GetDid())
+		if point.GetDid() == invalidDid {
+			if point.GetError() == nil {
+				t.Error("get invalid did access point succ")
+			}
+		} else if point.GetError() != nil || err != nil {
+			t.Error("get access point failed", point.GetError(), err)
+		} else if point.GetSubDomain() != subDomain || point.GetDeviceId() != deviceId {
+			t.Error("check the batch access point failed", point.GetDid())
+		}
+	}
+	// the invalid user get errors of all the dids
+	points, err = router.GetAccessPoints(10000000, domain, dids[:8])
+	if err != nil {
+		t.Error("get access points failed", err)
+	}
+	for _, point := range points {
+		if point.GetError() == nil {
+			t.Error("invalid user get access point succ", point.GetDid())
+		}
+	}
+	// too many dids
+	_, err = router.GetAccessPoints(uid, domain, make([]int64, MAX_BATCH_ACCESS_POINTS+1))
+	if err == nil {
+		t.Error("get too many access points succ")
+	}
+	cleanAll(store)
+}
+
+func TestExplainAccess(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	prepare(store)
+	home := NewHomeManager(store)
+	var uid int64 = 100
+	list, err := home.GetAllHome(domain, uid)
+	if err != nil || len(list) != 5 {
+		t.Errorf("get user all home failed:err[%v], len[%d]", err, len(list))
+	}
+	device := NewDeviceManager(store)
+	devList, err := device.GetAllDevices(domain, list[0].hid)
+	if err != nil || len(devList) != 8 {
+		t.Errorf("get all devices failed:err[%v], len[%d]", err, len(devList))
+	}
+	var slave *DeviceInfo
+	for i := range devList {
+		if !devList[i].IsMasterDevice() {
+			slave = &devList[i]
+			break
+		}
+	}
+	router := NewAccessRouter(store)
+	// all the steps passed
+	steps, err := router.ExplainAccess(uid, domain, slave.did)
+	if err != nil || len(steps) != 6 {
+		t.Fatalf("explain access failed:err[%v], len[%d]", err, len(steps))
+	}
+	for _, step := range steps {
+		if !step.IsChecked() || step.GetError() != nil {
+			t.Error("check step passed failed", step.GetName(), step.GetError())
+		}
+	}
+	// not the home member
+	var other int64 = 10000000
+	steps, err = router.ExplainAccess(other, domain, slave.did)
+	if err != nil || steps[4].GetName() != ACCESS_STEP_MEMBER || steps[4].GetError() != ErrNotHomeMember {
+		t.Error("check member step failed", err)
+	} else if steps[5].IsChecked() {
+		t.Error("check acl step not checked failed")
+	}
+	_, _, _, err = router.GetAccessPoint(other, domain, slave.did)
+	if err != ErrNotHomeMember {
+		t.Error("check not member error failed", err)
+	}
+	// the expired member explained without deleted
+	var guest int64 = 200
+	member := NewMemberManager(store)
+	err = member.AddMember(domain, list[0].hid, guest, "guest")
+	if err != nil {
+		t.Error("add member failed", err)
+	}
+	err = member.SetValidity(domain, list[0].hid, uid, guest, time.Time{}, time.Now().Add(time.Second), "")
+	if err != nil {
+		t.Error("set valid until failed", err)
+	}
+	time.Sleep(2 * time.Second)
+	steps, err = router.ExplainAccess(guest, domain, slave.did)
+	if err != nil || steps[4].GetError() != ErrMemberExpired {
+		t.Error("check expired member step failed", err)
+	}
+	expired, err := member.Get(domain, list[0].hid, guest)
+	if err != nil || expired == nil {
+		t.Error("the expired member deleted by explain", err)
+	}
+	// not exist device
+	steps, err = router.ExplainAccess(uid, domain, 1000000)
+	if err != nil || steps[0].GetError() != ErrDeviceNotExist || steps[1].IsChecked() {
+		t.Error("check device step failed", err)
+	}
+	// the frozen master fail the slave but the other steps still checked
+	err = device.Disable(domain, slave.GetMasterDid())
+	if err != nil {
+		t.Error("disable master failed", err)
+	}
+	steps, err = router.ExplainAccess(uid, domain, slave.did)
+	if err != nil || steps[1].GetError() != ErrMasterNotActive {
+		t.Error("check master step failed", err)
+	} else if steps[2].GetError() != nil || steps[3].GetError() != nil || steps[4].GetError() != nil {
+		t.Error("check other steps failed")
+	}
+	_, _, _, err = router.GetAccessPoint(uid, domain, slave.did)
+	if err != ErrMasterNotActive {
+		t.Error("check master not active error failed", err)
+	}
+	// the frozen home
+	err = home.Disable(domain, list[0].hid)
+	if err != nil {
+		t.Error("disable home failed", err)
+	}
+	steps, err = router.ExplainAccess(uid, domain, slave.GetMasterDid())
+	if err != nil || steps[0].GetError() != ErrDeviceNotActive || steps[3].IsChecked() {
+		t.Error("check frozen master device step failed", err)
+	}
+	steps, err = router.ExplainAccess(uid, domain, slave.did)
+	if err != nil || steps[3].GetError() != ErrHomeNotActive || !steps[4].IsChecked() {
+		t.Error("check home step failed", err)
+	}
+	cleanAll(store)
+}
+
+func TestDeviceAudience(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	prepare(store)
+	home := NewHomeManager(store)
+	var uid int64 = 100
+	list, err := home.GetAllHome(domain, uid)
+	if err != nil || len(list) != 5 {
+		t.Errorf("get user all home failed:err[%v], len[%d]", err, len(list))
+	}
+	hid := list[0].hid
+	device := NewDeviceManager(store)
+	devList, err := device.GetAllDevices(domain, hid)
+	if err != nil || len(devList) != 8 {
+		t.Errorf("get all devices failed:err[%v], len[%d]", err, len(devList))
+	}
+	var master int64
+	for _, dev := range devList {
+		if dev.IsMasterDevice() {
+			master = dev.did
+			break
+		}
+	}
+	bind, err := NewBindingManager(store).Get(domain, master)
+	if err != nil || bind == nil {
+		t.Fatal("get master binding failed", err)
+	}
+	member := NewMemberManager(store)
+	var kid, frozen, denied int64 = 200, 201, 202
+	for _, other := range []int64{kid, frozen, denied} {
+		err = member.AddMember(domain, hid, other, "member")
+		if err != nil {
+			t.Error("add member failed", err)
+		}
+	}
+	err = member.Disable(domain, hid, frozen)
+	if err != nil {
+		t.Error("disable member failed", err)
+	}
+	err = NewAclManager(store).Grant(domain, uid, master, ACL_SUBJECT_USER, denied, false)
+	if err != nil {
+		t.Error("grant device acl failed", err)
+	}
+	router := NewAccessRouter(store)
+	audience, err := router.GetAudience(domain, bind.subDomain, bind.deviceId)
+	if err != nil || len(audience) != 2 {
+		t.Fatalf("get device audience failed:err[%v], len[%d]", err, len(audience))
+	}
+	for _, one := range audience {
+		if one.GetUid() == uid && one.GetMemberType() != ROLE_OWNER {
+			t.Error("check owner role failed", one.GetMemberType())
+		} else if one.GetUid() != uid && one.GetUid() != kid {
+			t.Error("check audience member failed", one.GetUid())
+		}
+	}
+	// the expired member skipped without deleted
+	var guest int64 = 203
+	err = member.AddMember(domain, hid, guest, "member")
+	if err != nil {
+		t.Error("add member failed", err)
+	}
+	err = member.SetValidity(domain, hid, uid, guest, time.Time{}, time.Now().Add(time.Second), "")
+	if err != nil {
+		t.Error("set valid until failed", err)
+	}
+	time.Sleep(2 * time.Second)
+	audience, err = router.GetAudience(domain, bind.subDomain, bind.deviceId)
+	if err != nil || len(audience) != 2 {
+		t.Errorf("get device audience failed:err[%v], len[%d]", err, len(audience))
+	}
+	expired, err := member.Get(domain, hid, guest)
+	if err != nil || expired == nil {
+		t.Error("the expired member deleted by audience", err)
+	}
+	_, err = router.GetAudience(domain, bind.subDomain, "not exist device")
+	if err != ErrBindingNotExist {
+		t.Error("get not exist device audience succ", err)
+	}
+	cleanAll(store)
+}
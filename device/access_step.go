@@ -0,0 +1,36 @@
+package device
+
+// the access check steps
+const (
+	ACCESS_STEP_DEVICE  = "device"
+	ACCESS_STEP_MASTER  = "master"
+	ACCESS_STEP_BINDING = "binding"
+	ACCESS_STEP_HOME    = "home"
+	ACCESS_STEP_MEMBER  = "member"
+	ACCESS_STEP_ACL     = "acl"
+)
+
+// the outcome of one access check step, not checked if the step it depends on failed
+type AccessStep struct {
+	name    string
+	checked bool
+	err     error
+}
+
+func (this *AccessStep) GetName() string {
+	return this.name
+}
+
+func (this *AccessStep) IsChecked() bool {
+	return this.checked
+}
+
+// the reason of the step failed, nil if passed or not checked
+func (this *AccessStep) GetError() error {
+	return this.err
+}
+
+func (this *AccessStep) finish(err error) {
+	this.checked = true
+	this.err = err
+}
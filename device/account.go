@@ -0,0 +1,98 @@
+package device
+
+// the owned homes policy of purging the user
+const (
+	// transfer the home to the admin or member, delete it if no one can take over
+	PURGE_TRANSFER = 1
+	// delete all the owned homes
+	PURGE_DELETE = 2
+)
+
+// the result of purging the user from all the homes of the domain
+type PurgeReport struct {
+	uid         int64
+	left        []int64
+	transferred map[int64]int64
+	deleted     []int64
+	frozen      []int64
+	failed      map[int64]error
+}
+
+func newPurgeReport(uid int64) *PurgeReport {
+	return &PurgeReport{uid: uid, left: make([]int64, 0), transferred: make(map[int64]int64),
+		deleted: make([]int64, 0), frozen: make([]int64, 0), failed: make(map[int64]error)}
+}
+
+func (this *PurgeReport) GetUid() int64 {
+	return this.uid
+}
+
+// the homes the user membership removed
+func (this *PurgeReport) GetLeft() []int64 {
+	return this.left
+}
+
+// the owned homes and their new owners
+func (this *PurgeReport) GetTransferred() map[int64]int64 {
+	return this.transferred
+}
+
+// the owned homes deleted
+func (this *PurgeReport) GetDeleted() []int64 {
+	return this.deleted
+}
+
+// the frozen owned homes transferred and still frozen
+func (this *PurgeReport) GetFrozen() []int64 {
+	return this.frozen
+}
+
+// the homes failed to purge and the errors
+func (this *PurgeReport) GetFailed() map[int64]error {
+	return this.failed
+}
+
+// all the data held about the user in the domain for the privacy request
+type UserExport struct {
+	uid         int64
+	homes       []Home
+	memberships []Member
+	devices     map[int64][]DeviceInfo
+	invites     []Invite
+	history     []BindingHistory
+	audits      []AuditLog
+}
+
+func (this *UserExport) GetUid() int64 {
+	return this.uid
+}
+
+// the homes the user is member of
+func (this *UserExport) GetHomes() []Home {
+	return this.homes
+}
+
+// the user membership of every home in the same order of the homes
+func (this *UserExport) GetMemberships() []Member {
+	return this.memberships
+}
+
+// the devices of the home
+func (this *UserExport) GetDevices(hid int64) []DeviceInfo {
+	return this.devices[hid]
+}
+
+// the pending invites sent to the user
+func (this *UserExport) GetInvites() []Invite {
+	return this.invites
+}
+
+// the binding history done by the user
+func (this *UserExport) GetHistory() []BindingHistory {
+	return this.history
+}
+
+// the audit logs of the user actions
+func (this *UserExport) GetAudits() []AuditLog {
+	return this.audits
+}
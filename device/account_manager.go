@@ -0,0 +1,174 @@
+package device
+
+import (
+	"sort"
+	"zc-common-go/common"
+	log "zc-common-go/glog"
+)
+
+// the user account related operations across all the homes of the domain
+type AccountManager struct {
+	store *DeviceStorage
+}
+
+func NewAccountManager(store *DeviceStorage) *AccountManager {
+	return &AccountManager{store: store}
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// public interface
+////////////////////////////////////////////////////////////////////////////////////
+// remove the deleted user from all the homes, the owned homes transferred or deleted by the
+// policy, the failed homes recorded in the report and continue with the others
+func (this *AccountManager) Purge(domain string, uid int64, policy int) (*PurgeReport, error) {
+	common.CheckParam(this.store != nil)
+	if policy != PURGE_TRANSFER && policy != PURGE_DELETE {
+		log.Warningf("check the purge policy failed:domain[%s], uid[%d], policy[%d]", domain, uid, policy)
+		return nil, common.ErrInvalidParam
+	}
+	homeManager := NewHomeManager(this.store)
+	list, err := homeManager.GetAllHome(domain, uid)
+	if err != nil {
+		log.Warningf("get user all homes failed:domain[%s], uid[%d], err[%v]", domain, uid, err)
+		return nil, err
+	}
+	report := newPurgeReport(uid)
+	memberManager := NewMemberManager(this.store)
+	owned := make([]Home, 0)
+	for _, home := range list {
+		if home.GetCreateUid() == uid {
+			owned = append(owned, home)
+			continue
+		}
+		err = memberManager.removeMember(domain, home.GetHid(), uid)
+		if err != nil {
+			log.Warningf("remove the member failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, home.GetHid(), uid, err)
+			report.failed[home.GetHid()] = err
+			continue
+		}
+		report.left = append(report.left, home.GetHid())
+	}
+	// the child homes deleted before their parents
+	depth := make(map[int64]int)
+	for _, home := range owned {
+		path, err := homeManager.GetAncestors(domain, home.GetHid())
+		if err != nil {
+			log.Warningf("get home ancestors failed:domain[%s], hid[%d], err[%v]", domain, home.GetHid(), err)
+			return nil, err
+		}
+		depth[home.GetHid()] = len(path)
+	}
+	sort.SliceStable(owned, func(i, j int) bool {
+		return depth[owned[i].GetHid()] > depth[owned[j].GetHid()]
+	})
+	for _, home := range owned {
+		hid := home.GetHid()
+		if policy == PURGE_TRANSFER {
+			newUid, err := this.getSuccessor(domain, hid, uid)
+			if err != nil {
+				report.failed[hid] = err
+				continue
+			} else if newUid > 0 {
+				// the frozen home transferred and keeps frozen
+				err = homeManager.transferOwner(domain, &home, uid, newUid, false)
+				if err != nil {
+					log.Warningf("transfer home failed:domain[%s], hid[%d], uid[%d], new[%d], err[%v]", domain, hid, uid, newUid, err)
+					report.failed[hid] = err
+					continue
+				}
+				report.transferred[hid] = newUid
+				if home.GetStatus() != ACTIVE {
+					report.frozen = append(report.frozen, hid)
+				}
+				continue
+			}
+		}
+		err = homeManager.Delete(uid, domain, hid)
+		if err != nil {
+			log.Warningf("delete home failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, uid, err)
+			report.failed[hid] = err
+			continue
+		}
+		report.deleted = append(report.deleted, hid)
+	}
+	// the access grants of the purged user are revoked
+	err = NewRevocationManager(this.store).RevokeUser(domain, uid)
+	if err != nil {
+		log.Warningf("revoke the user grants failed:domain[%s], uid[%d], err[%v]", domain, uid, err)
+		return nil, err
+	}
+	return report, nil
+}
+
+// export all the data held about the user in the domain, including the homes, the memberships,
+// the devices in the homes, the pending invites, the binding history and the audit logs of the user
+func (this *AccountManager) Export(domain string, uid int64) (*UserExport, error) {
+	common.CheckParam(this.store != nil)
+	memberManager := NewMemberManager(this.store)
+	homeIds, err := memberManager.GetAllHomeIds(domain, uid)
+	if err != nil {
+		log.Warningf("get user all home ids failed:domain[%s], uid[%d], err[%v]", domain, uid, err)
+		return nil, err
+	}
+	export := &UserExport{uid: uid, homes: make([]Home, 0), memberships: make([]Member, 0), devices: make(map[int64][]DeviceInfo)}
+	homeManager := NewHomeManager(this.store)
+	deviceManager := NewDeviceManager(this.store)
+	for _, hid := range homeIds {
+		home, err := homeManager.Get(domain, hid)
+		if err != nil {
+			log.Warningf("get home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+			return nil, err
+		}
+		member, err := memberManager.Get(domain, hid, uid)
+		if err != nil {
+			log.Warningf("get member failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, uid, err)
+			return nil, err
+		} else if home == nil || member == nil {
+			// deleted after got the home ids
+			continue
+		}
+		devices, err := deviceManager.GetAllDevices(domain, hid)
+		if err != nil {
+			log.Warningf("get home all devices failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+			return nil, err
+		}
+		export.homes = append(export.homes, *home)
+		export.memberships = append(export.memberships, *member)
+		export.devices[hid] = devices
+	}
+	export.invites, err = NewInviteManager(this.store).GetPending(domain, uid)
+	if err != nil {
+		log.Warningf("get user pending invites failed:domain[%s], uid[%d], err[%v]", domain, uid, err)
+		return nil, err
+	}
+	export.history, err = NewHistoryManager(this.store).GetUserAll(domain, uid)
+	if err != nil {
+		log.Warningf("get user binding history failed:domain[%s], uid[%d], err[%v]", domain, uid, err)
+		return nil, err
+	}
+	export.audits, err = NewAuditManager(this.store).GetUserAll(domain, uid)
+	if err != nil {
+		log.Warningf("get user audit logs failed:domain[%s], uid[%d], err[%v]", domain, uid, err)
+		return nil, err
+	}
+	return export, nil
+}
+
+// the active admin at first then the active member without time limit take over the home,
+// return 0 if no one
+func (this *AccountManager) getSuccessor(domain string, hid, uid int64) (int64, error) {
+	members, err := NewMemberManager(this.store).GetAllMembers(domain, hid)
+	if err != nil {
+		log.Warningf("get home all members failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return -1, err
+	}
+	for _, role := range []int8{ROLE_ADMIN, ROLE_MEMBER} {
+		for _, member := range members {
+			if member.GetUid() != uid && member.GetMemberType() == role && member.GetStatus() == ACTIVE &&
+				member.GetValidUntil().IsZero() {
+				return member.GetUid(), nil
+			}
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,144 @@
+package device
+
+import (
+	"testing"
+	"zc-common-go/common"
+)
+
+func TestPurgeUser(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	prepare(store)
+	home := NewHomeManager(store)
+	var uid, admin, guest, other int64 = 100, 200, 300, 400
+	list, err := home.GetAllHome(domain, uid)
+	if err != nil || len(list) != 5 {
+		t.Fatalf("get user all home failed:err[%v], len[%d]", err, len(list))
+	}
+	member := NewMemberManager(store)
+	err = member.AddMember(domain, list[0].hid, admin, "admin")
+	if err != nil {
+		t.Error("add member failed", err)
+	}
+	err = member.ModifyRole(domain, list[0].hid, uid, admin, ROLE_ADMIN)
+	if err != nil {
+		t.Error("modify role failed", err)
+	}
+	// the guest can not take over the home
+	err = member.AddMember(domain, list[1].hid, guest, "guest")
+	if err != nil {
+		t.Error("add member failed", err)
+	}
+	err = member.ModifyRole(domain, list[1].hid, uid, guest, ROLE_GUEST)
+	if err != nil {
+		t.Error("modify role failed", err)
+	}
+	err = home.Create(domain, other, "other")
+	if err != nil {
+		t.Error("create home failed", err)
+	}
+	homes, err := home.GetAllHome(domain, other)
+	if err != nil || len(homes) != 1 {
+		t.Fatalf("get user all home failed:err[%v], len[%d]", err, len(homes))
+	}
+	err = member.AddMember(domain, homes[0].hid, uid, "member")
+	if err != nil {
+		t.Error("add member failed", err)
+	}
+	// the owner can not leave without transfer
+	err = member.Leave(domain, list[0].hid, uid)
+	if err != common.ErrNotAllowed {
+		t.Error("the owner leave the home", err)
+	}
+	// the frozen home transferred and keeps frozen
+	err = home.Disable(domain, list[0].hid)
+	if err != nil {
+		t.Error("disable home failed", err)
+	}
+	account := NewAccountManager(store)
+	_, err = account.Purge(domain, uid, 0)
+	if err != common.ErrInvalidParam {
+		t.Error("purge with invalid policy", err)
+	}
+	report, err := account.Purge(domain, uid, PURGE_TRANSFER)
+	if err != nil {
+		t.Fatal("purge user failed", err)
+	}
+	if len(report.GetLeft()) != 1 || report.GetLeft()[0] != homes[0].hid {
+		t.Error("check the left homes failed", report.GetLeft())
+	}
+	if len(report.GetTransferred()) != 1 || report.GetTransferred()[list[0].hid] != admin {
+		t.Error("check the transferred homes failed", report.GetTransferred())
+	}
+	if len(report.GetFrozen()) != 1 || report.GetFrozen()[0] != list[0].hid {
+		t.Error("check the frozen homes failed", report.GetFrozen())
+	}
+	if len(report.GetDeleted()) != 4 || len(report.GetFailed()) != 0 {
+		t.Errorf("check the deleted homes failed:deleted[%d], failed[%d]", len(report.GetDeleted()), len(report.GetFailed()))
+	}
+	left, err := home.GetAllHome(domain, uid)
+	if err != nil || len(left) != 0 {
+		t.Errorf("get purged user homes failed:err[%v], len[%d]", err, len(left))
+	}
+	owned, err := home.Get(domain, list[0].hid)
+	if err != nil || owned == nil || owned.GetCreateUid() != admin || owned.GetStatus() != FROZEN {
+		t.Error("check the new owner failed", err)
+	}
+	// the admin leave the other home as a normal member
+	err = member.AddMember(domain, homes[0].hid, admin, "member")
+	if err != nil {
+		t.Error("add member failed", err)
+	}
+	err = member.Leave(domain, homes[0].hid, admin)
+	if err != nil {
+		t.Error("leave home failed", err)
+	}
+	err = member.Leave(domain, homes[0].hid, admin)
+	if err != common.ErrEntryNotExist {
+		t.Error("leave home twice", err)
+	}
+	cleanAll(store)
+}
+
+func TestExportUser(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	prepare(store)
+	var uid, other int64 = 100, 200
+	account := NewAccountManager(store)
+	export, err := account.Export(domain, uid)
+	if err != nil {
+		t.Fatal("export user failed", err)
+	}
+	if len(export.GetHomes()) != 5 || len(export.GetMemberships()) != 5 {
+		t.Errorf("check the exported homes failed:homes[%d], memberships[%d]", len(export.GetHomes()), len(export.GetMemberships()))
+	}
+	for i, home := range export.GetHomes() {
+		if export.GetMemberships()[i].GetMemberType() != ROLE_OWNER {
+			t.Error("check the exported membership failed", home.GetHid())
+		}
+		if len(export.GetDevices(home.GetHid())) != 8 {
+			t.Error("check the exported devices failed", home.GetHid())
+		}
+	}
+	for _, history := range export.GetHistory() {
+		if history.GetUid() != uid {
+			t.Error("check the exported history failed", history.GetId())
+		}
+	}
+	// no data of the unknown user
+	export, err = account.Export(domain, other)
+	if err != nil {
+		t.Fatal("export user failed", err)
+	}
+	if len(export.GetHomes()) != 0 || len(export.GetHistory()) != 0 || len(export.GetAudits()) != 0 {
+		t.Error("check the empty export failed")
+	}
+	cleanAll(store)
+}
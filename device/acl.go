@@ -0,0 +1,46 @@
+package device
+
+// acl subject type
+const (
+	ACL_SUBJECT_USER = 1
+	ACL_SUBJECT_ROLE = 2
+)
+
+// one allow/deny entry of the device access control list, the subject is
+// the member uid or the member role, only valid in the home it created in
+type DeviceAcl struct {
+	did         int64
+	hid         int64
+	subjectType int8
+	subject     int64
+	allow       bool
+}
+
+func (this *DeviceAcl) GetDid() int64 {
+	return this.did
+}
+
+func (this *DeviceAcl) GetHid() int64 {
+	return this.hid
+}
+
+func (this *DeviceAcl) GetSubjectType() int8 {
+	return this.subjectType
+}
+
+// the member uid or role according to the subject type
+func (this *DeviceAcl) GetSubject() int64 {
+	return this.subject
+}
+
+func (this *DeviceAcl) IsAllowed() bool {
+	return this.allow
+}
+
+// check the entry matched the member
+func (this *DeviceAcl) match(member *Member) bool {
+	if this.subjectType == ACL_SUBJECT_USER {
+		return this.subject == member.GetUid()
+	}
+	return this.subjectType == ACL_SUBJECT_ROLE && this.subject == int64(member.GetMemberType())
+}
@@ -0,0 +1,277 @@
+package device
+
+import (
+	"fmt"
+	"zc-common-go/common"
+	log "zc-common-go/glog"
+	_ "zc-common-go/mysql"
+)
+
+const (
+	// max acl entries of one device
+	MAX_DEVICE_ACL = 64
+)
+
+type AclManager struct {
+	store *DeviceStorage
+}
+
+func NewAclManager(store *DeviceStorage) *AclManager {
+	return &AclManager{store: store}
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// public interface
+////////////////////////////////////////////////////////////////////////////////////
+// get all the acl entries of the device in its current home, if no entry return empty list
+func (this *AclManager) GetAll(domain string, did int64) ([]DeviceAcl, error) {
+	common.CheckParam(this.store != nil)
+	device, err := NewDeviceManager(this.store).Get(domain, did)
+	if err != nil {
+		log.Warningf("get device failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return nil, err
+	} else if device == nil {
+		log.Warningf("device not exist:domain[%s], did[%d]", domain, did)
+		return nil, common.ErrEntryNotExist
+	}
+	list, err := this.getAllAcls(domain, did, device.GetHid())
+	if err != nil {
+		log.Warningf("get device all acls failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return nil, err
+	}
+	return list, nil
+}
+
+// the user who can manage members allow or deny the subject user or role to control the device
+func (this *AclManager) Grant(domain string, uid, did int64, subjectType int8, subject int64, allow bool) error {
+	common.CheckParam(this.store != nil)
+	hid, err := this.checkManager(domain, uid, did, subjectType, subject)
+	if err != nil {
+		return err
+	}
+	err = this.insertAcl(domain, did, hid, subjectType, subject, allow)
+	if err != nil {
+		log.Warningf("insert device acl failed:domain[%s], did[%d], type[%d], subject[%d], err[%v]",
+			domain, did, subjectType, subject, err)
+		return err
+	}
+	// the access grants of the device issued before denied are revoked
+	if !allow {
+		return NewRevocationManager(this.store).RevokeDevice(domain, did)
+	}
+	return nil
+}
+
+// remove the acl entry of the subject, ok if the entry not exist
+func (this *AclManager) Revoke(domain string, uid, did int64, subjectType int8, subject int64) error {
+	common.CheckParam(this.store != nil)
+	hid, err := this.checkManager(domain, uid, did, subjectType, subject)
+	if err != nil {
+		return err
+	}
+	err = this.deleteAcl(domain, did, hid, subjectType, subject)
+	if err != nil {
+		log.Warningf("delete device acl failed:domain[%s], did[%d], type[%d], subject[%d], err[%v]",
+			domain, did, subjectType, subject, err)
+		return err
+	}
+	// the removed entry may allow the subject overriding a deny entry
+	return NewRevocationManager(this.store).RevokeDevice(domain, did)
+}
+
+// delete all the user acl entries of the home devices when the user left the home
+func (this *AclManager) DeleteUser(domain string, hid, uid int64) error {
+	common.CheckParam(this.store != nil)
+	err := this.deleteUserAcls(domain, hid, uid)
+	if err != nil {
+		log.Warningf("delete user acls failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, uid, err)
+		return err
+	}
+	return nil
+}
+
+// check the member can control the device, the owner always allowed, the user entry
+// takes precedence over the role entry, the slave device without matched entry inherits
+// the entries of its master, allowed if no entry matched
+func (this *AclManager) CheckAccess(domain string, device *DeviceInfo, member *Member) error {
+	common.CheckParam(this.store != nil && device != nil && member != nil)
+	if member.GetMemberType() == ROLE_OWNER {
+		return nil
+	}
+	did := device.GetDid()
+	for {
+		list, err := this.getAllAcls(domain, did, device.GetHid())
+		if err != nil {
+			log.Warningf("get device all acls failed:domain[%s], did[%d], err[%v]", domain, did, err)
+			return err
+		}
+		allow, found := matchAcls(list, member)
+		if found {
+			if !allow {
+				log.Warningf("the member denied by acl:domain[%s], did[%d], uid[%d]", domain, did, member.GetUid())
+				return ErrAccessDenied
+			}
+			return nil
+		}
+		if did == device.GetMasterDid() || device.GetMasterDid() <= 0 {
+			return nil
+		}
+		did = device.GetMasterDid()
+	}
+}
+
+func matchAcls(list []DeviceAcl, member *Member) (allow, found bool) {
+	for _, subjectType := range []int8{ACL_SUBJECT_USER, ACL_SUBJECT_ROLE} {
+		for _, acl := range list {
+			if acl.subjectType == subjectType && acl.match(member) {
+				return acl.allow, true
+			}
+		}
+	}
+	return false, false
+}
+
+// check the subject and the caller permission, return the device home id
+func (this *AclManager) checkManager(domain string, uid, did int64, subjectType int8, subject int64) (int64, error) {
+	if subjectType == ACL_SUBJECT_USER {
+		if subject <= 0 {
+			log.Warningf("check the acl user failed:domain[%s], did[%d], subject[%d]", domain, did, subject)
+			return -1, common.ErrInvalidParam
+		}
+	} else if subjectType == ACL_SUBJECT_ROLE {
+		if !IsValidRole(int8(subject)) || subject == ROLE_OWNER {
+			log.Warningf("check the acl role failed:domain[%s], did[%d], subject[%d]", domain, did, subject)
+			return -1, common.ErrInvalidParam
+		}
+	} else {
+		log.Warningf("check the acl subject type failed:domain[%s], did[%d], type[%d]", domain, did, subjectType)
+		return -1, common.ErrInvalidParam
+	}
+	device, err := NewDeviceManager(this.store).Get(domain, did)
+	if err != nil {
+		log.Warningf("get device failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return -1, err
+	} else if device == nil {
+		log.Warningf("device not exist:domain[%s], did[%d]", domain, did)
+		return -1, common.ErrEntryNotExist
+	}
+	hid := device.GetHid()
+	_, err = NewMemberManager(this.store).CheckPermission(domain, hid, uid, PERM_MANAGE_MEMBER)
+	if err != nil {
+		log.Warningf("check the acl permission failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, uid, err)
+		return -1, err
+	}
+	return hid, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// database related private interface
+////////////////////////////////////////////////////////////////////////////////////
+func (this *AclManager) getAllAcls(domain string, did, hid int64) ([]DeviceAcl, error) {
+	SQL := fmt.Sprintf("SELECT did, hid, subject_type, subject, allow FROM %s_device_acl WHERE did = ? AND hid = ?", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(did, hid)
+	if err != nil {
+		log.Errorf("query all acls failed:domain[%s], did[%d], hid[%d], err[%v]", domain, did, hid, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var acl DeviceAcl
+	list := make([]DeviceAcl, 0)
+	for rows.Next() {
+		err = rows.Scan(&acl.did, &acl.hid, &acl.subjectType, &acl.subject, &acl.allow)
+		if err != nil {
+			log.Errorf("parse the acl failed:domain[%s], did[%d], err[%v]", domain, did, err)
+			return nil, err
+		}
+		list = append(list, acl)
+	}
+	return list, nil
+}
+
+// replace the acl entry and check the device acl count in a transaction
+func (this *AclManager) insertAcl(domain string, did, hid int64, subjectType int8, subject int64, allow bool) (err error) {
+	SQL1 := fmt.Sprintf("REPLACE INTO %s_device_acl(did, hid, subject_type, subject, allow, create_time) VALUES(?,?,?,?,?,NOW())", domain)
+	stmt1, err := this.store.db.Prepare(SQL1)
+	if err != nil {
+		log.Errorf("prepare replace acl failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	defer stmt1.Close()
+	SQL2 := fmt.Sprintf("SELECT COUNT(*) FROM %s_device_acl WHERE did = ? AND hid = ?", domain)
+	stmt2, err := this.store.db.Prepare(SQL2)
+	if err != nil {
+		log.Errorf("prepare count acl failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	defer stmt2.Close()
+
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	defer rollback(&err, tx)
+	err = lockHome(tx, domain, hid)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Stmt(stmt1).Exec(did, hid, subjectType, subject, allow)
+	if err != nil {
+		log.Errorf("replace acl failed:domain[%s], did[%d], type[%d], subject[%d], err[%v]", domain, did, subjectType, subject, err)
+		return err
+	}
+	var count int64
+	err = tx.Stmt(stmt2).QueryRow(did, hid).Scan(&count)
+	if err != nil {
+		log.Errorf("count acl failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	} else if count > MAX_DEVICE_ACL {
+		log.Warningf("check the acl count failed:domain[%s], did[%d], count[%d]", domain, did, count)
+		err = ErrQuotaExceeded
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	return nil
+}
+
+func (this *AclManager) deleteAcl(domain string, did, hid int64, subjectType int8, subject int64) error {
+	SQL := fmt.Sprintf("DELETE FROM %s_device_acl WHERE did = ? AND hid = ? AND subject_type = ? AND subject = ?", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(did, hid, subjectType, subject)
+	if err != nil {
+		log.Errorf("delete acl failed:domain[%s], did[%d], type[%d], subject[%d], err[%v]", domain, did, subjectType, subject, err)
+		return err
+	}
+	return nil
+}
+
+func (this *AclManager) deleteUserAcls(domain string, hid, uid int64) error {
+	SQL := fmt.Sprintf("DELETE FROM %s_device_acl WHERE hid = ? AND subject_type = ? AND subject = ?", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(hid, ACL_SUBJECT_USER, uid)
+	if err != nil {
+		log.Errorf("delete user acls failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, uid, err)
+		return err
+	}
+	return nil
+}
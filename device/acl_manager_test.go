@@ -0,0 +1,110 @@
+package device
+
+import (
+	"testing"
+)
+
+func TestDeviceAcl(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	prepare(store)
+	home := NewHomeManager(store)
+	var uid int64 = 100
+	list, err := home.GetAllHome(domain, uid)
+	if err != nil || len(list) != 5 {
+		t.Errorf("get user all home failed:err[%v], len[%d]", err, len(list))
+	}
+	hid := list[0].hid
+	var kid int64 = 200
+	member := NewMemberManager(store)
+	err = member.AddMember(domain, hid, kid, "kid")
+	if err != nil {
+		t.Error("add member failed", err)
+	}
+	device := NewDeviceManager(store)
+	devList, err := device.GetAllDevices(domain, hid)
+	if err != nil || len(devList) != 8 {
+		t.Errorf("get all devices failed:err[%v], len[%d]", err, len(devList))
+	}
+	var master, slave int64
+	for _, dev := range devList {
+		if dev.IsMasterDevice() {
+			master = dev.did
+		}
+	}
+	for _, dev := range devList {
+		if !dev.IsMasterDevice() && dev.GetMasterDid() == master {
+			slave = dev.did
+		}
+	}
+	router := NewAccessRouter(store)
+	acl := NewAclManager(store)
+	_, _, _, err = router.GetAccessPoint(kid, domain, master)
+	if err != nil {
+		t.Error("get access point without acl failed", err)
+	}
+	// the normal member can not manage the acl
+	err = acl.Grant(domain, kid, master, ACL_SUBJECT_ROLE, ROLE_MEMBER, false)
+	if err == nil {
+		t.Error("normal member grant acl succ")
+	}
+	// the owner role can not be denied
+	err = acl.Grant(domain, uid, master, ACL_SUBJECT_ROLE, ROLE_OWNER, false)
+	if err == nil {
+		t.Error("grant owner role acl succ")
+	}
+	// deny the member role on the master, the slave inherits it
+	err = acl.Grant(domain, uid, master, ACL_SUBJECT_ROLE, ROLE_MEMBER, false)
+	if err != nil {
+		t.Error("grant role acl failed", err)
+	}
+	_, _, _, err = router.GetAccessPoint(kid, domain, master)
+	if err == nil {
+		t.Error("get denied master access point succ")
+	}
+	_, _, _, err = router.GetAccessPoint(kid, domain, slave)
+	if err == nil {
+		t.Error("get denied slave access point succ")
+	}
+	_, _, _, err = router.GetAccessPoint(uid, domain, master)
+	if err != nil {
+		t.Error("get owner access point failed", err)
+	}
+	// allow the user on the slave only
+	err = acl.Grant(domain, uid, slave, ACL_SUBJECT_USER, kid, true)
+	if err != nil {
+		t.Error("grant user acl failed", err)
+	}
+	_, _, _, err = router.GetAccessPoint(kid, domain, slave)
+	if err != nil {
+		t.Error("get allowed slave access point failed", err)
+	}
+	acls, err := acl.GetAll(domain, master)
+	if err != nil || len(acls) != 1 {
+		t.Errorf("get device acls failed:err[%v], len[%d]", err, len(acls))
+	} else if acls[0].GetSubjectType() != ACL_SUBJECT_ROLE || acls[0].IsAllowed() {
+		t.Error("check device acl failed")
+	}
+	// revoke the role entry
+	err = acl.Revoke(domain, uid, master, ACL_SUBJECT_ROLE, ROLE_MEMBER)
+	if err != nil {
+		t.Error("revoke role acl failed", err)
+	}
+	_, _, _, err = router.GetAccessPoint(kid, domain, master)
+	if err != nil {
+		t.Error("get revoked master access point failed", err)
+	}
+	// the acl deleted with the device
+	err = device.DeleteDevice(uid, domain, hid, slave)
+	if err != nil {
+		t.Error("delete device failed", err)
+	}
+	acls, err = acl.getAllAcls(domain, slave, hid)
+	if err != nil || len(acls) != 0 {
+		t.Errorf("check deleted device acls failed:err[%v], len[%d]", err, len(acls))
+	}
+	cleanAll(store)
+}
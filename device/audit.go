@@ -0,0 +1,53 @@
+package device
+
+import (
+	"database/sql"
+	"time"
+	"zc-common-go/mysql"
+)
+
+// audit action types
+const (
+	AUDIT_HIJACK = "hijack"
+)
+
+// one audit record of the home for the owner
+type AuditLog struct {
+	id         int64
+	hid        int64
+	uid        int64
+	did        int64
+	action     string
+	detail     sql.NullString
+	createTime mysql.NullTime
+}
+
+func (this *AuditLog) GetId() int64 {
+	return this.id
+}
+
+func (this *AuditLog) GetHid() int64 {
+	return this.hid
+}
+
+// the user who did the action
+func (this *AuditLog) GetUid() int64 {
+	return this.uid
+}
+
+// the related device did, 0 if not device related
+func (this *AuditLog) GetDid() int64 {
+	return this.did
+}
+
+func (this *AuditLog) GetAction() string {
+	return this.action
+}
+
+func (this *AuditLog) GetDetail() string {
+	return this.detail.String
+}
+
+func (this *AuditLog) GetCreateTime() time.Time {
+	return this.createTime.Time
+}
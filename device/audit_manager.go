@@ -0,0 +1,103 @@
+package device
+
+import (
+	"fmt"
+	"zc-common-go/common"
+	log "zc-common-go/glog"
+	_ "zc-common-go/mysql"
+)
+
+type AuditManager struct {
+	store *DeviceStorage
+}
+
+func NewAuditManager(store *DeviceStorage) *AuditManager {
+	return &AuditManager{store: store}
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// public interface
+////////////////////////////////////////////////////////////////////////////////////
+// record one action of the home for the owner
+func (this *AuditManager) Record(domain string, hid, uid, did int64, action, detail string) error {
+	common.CheckParam(this.store != nil)
+	if hid <= 0 || len(action) <= 0 {
+		log.Warningf("check audit param failed:domain[%s], hid[%d], action[%s]", domain, hid, action)
+		return common.ErrInvalidParam
+	}
+	err := this.insertAuditLog(domain, hid, uid, did, action, detail)
+	if err != nil {
+		log.Warningf("insert audit log failed:domain[%s], hid[%d], uid[%d], did[%d], action[%s], err[%v]",
+			domain, hid, uid, did, action, err)
+		return err
+	}
+	return nil
+}
+
+// get all audit logs of the home order by time, if no log return empty list
+func (this *AuditManager) GetAll(domain string, hid int64) ([]AuditLog, error) {
+	common.CheckParam(this.store != nil)
+	list, err := this.getAllAuditLogs(domain, "hid", hid)
+	if err != nil {
+		log.Warningf("get home all audit logs failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	return list, nil
+}
+
+// get all audit logs of the user actions order by time, if no log return empty list
+func (this *AuditManager) GetUserAll(domain string, uid int64) ([]AuditLog, error) {
+	common.CheckParam(this.store != nil)
+	list, err := this.getAllAuditLogs(domain, "uid", uid)
+	if err != nil {
+		log.Warningf("get user all audit logs failed:domain[%s], uid[%d], err[%v]", domain, uid, err)
+		return nil, err
+	}
+	return list, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// database related private interface
+////////////////////////////////////////////////////////////////////////////////////
+func (this *AuditManager) insertAuditLog(domain string, hid, uid, did int64, action, detail string) error {
+	SQL := fmt.Sprintf("INSERT INTO %s_home_audit(hid, uid, did, action, detail, create_time) VALUES(?,?,?,?,?,NOW())", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], err[%v]", domain, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(hid, uid, did, action, detail)
+	if err != nil {
+		log.Warningf("insert audit log failed:domain[%s], hid[%d], action[%s], err[%v]", domain, hid, action, err)
+		return err
+	}
+	return nil
+}
+
+func (this *AuditManager) getAllAuditLogs(domain, key string, value int64) ([]AuditLog, error) {
+	SQL := fmt.Sprintf("SELECT id, hid, uid, did, action, detail, create_time FROM %s_home_audit WHERE %s = ? ORDER BY id", domain, key)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], %s[%d], err[%v]", domain, key, value, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(value)
+	if err != nil {
+		log.Errorf("query all audit logs failed:domain[%s], %s[%d], err[%v]", domain, key, value, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var audit AuditLog
+	list := make([]AuditLog, 0)
+	for rows.Next() {
+		err = rows.Scan(&audit.id, &audit.hid, &audit.uid, &audit.did, &audit.action, &audit.detail, &audit.createTime)
+		if err != nil {
+			log.Errorf("parse the audit log failed:domain[%s], %s[%d], err[%v]", domain, key, value, err)
+			return nil, err
+		}
+		list = append(list, audit)
+	}
+	return list, nil
+}
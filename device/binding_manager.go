@@ -1,10 +1,24 @@
 package device
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
 	"zc-common-go/common"
 	log "zc-common-go/glog"
 )
 
+const (
+	// the bind token valid time after the device factory reset
+	BIND_TOKEN_EXPIRE = 10 * time.Minute
+	// the transfer approved by the home owner valid time
+	TRANSFER_EXPIRE = 24 * time.Hour
+)
+
+// max slave devices count of one batch binding request
+const MAX_BATCH_BINDING = 64
+
 type BindingManager struct {
 	store     *DeviceStorage
 	warehouse *DeviceWarehouse
@@ -45,33 +59,175 @@ func (this *BindingManager) GetBindingInfo(domain, subDomain, deviceId string) (
 }
 
 // binding one device to one home, if masterDid < 0 it's master device, otherwise it's slave device
-func (this *BindingManager) Binding(domain, subDomain, deviceId, deviceName string, hid, masterDid int64) error {
+// if the device already binded by other home, the token got by factory reset or the transfer
+// approved by the other home owner is required
+func (this *BindingManager) Binding(uid int64, domain, subDomain, deviceId, deviceName, token string, hid, masterDid int64) error {
 	common.CheckParam(this.proxy != nil && this.warehouse != nil)
+	// step 0. check the user can bind devices to the home
+	_, err := NewMemberManager(this.store).CheckPermission(domain, hid, uid, PERM_BIND)
+	if err != nil {
+		log.Warningf("check the binding permission failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, uid, err)
+		return err
+	}
 	// step 1. check the device basic info is valid
-	err := this.checkDeviceInfo(domain, subDomain, deviceId, masterDid < 0)
+	err = this.checkDeviceInfo(domain, subDomain, deviceId, masterDid < 0)
 	if err != nil {
 		log.Warningf("check the binding device failed:err[%v]", err)
 		return err
 	}
-	// step 2. check the master device is binding ok
+	// step 2. check the master device is binding ok in the same home and slave count limit
 	if masterDid > 0 {
 		_, err = this.proxy.GetBindingByDid(domain, masterDid)
 		if err != nil {
 			log.Warningf("check the master device not active:domain[%s], did[%d], err[%v]", domain, masterDid, err)
 			return err
 		}
+		err = this.checkSlaveBinding(domain, subDomain, deviceId, hid, masterDid)
+		if err != nil {
+			log.Warningf("check the slave binding failed:domain[%s], device[%s:%s], master[%d], err[%v]",
+				domain, subDomain, deviceId, masterDid, err)
+			return err
+		}
 	}
 	// step 3. build mapping device ids, if already exist return succ for rebinding...
-	err = this.proxy.BindingDevice(domain, subDomain, deviceId, deviceName, hid, masterDid)
+	// the device binded by other home is checked in the binding transaction
+	transfer, err := this.proxy.BindingDevice(uid, domain, subDomain, deviceId, deviceName, token, hid, masterDid)
 	if err != nil {
-		log.Warningf("binding device failed:domain[%s], device[%s:%s], master[%d]", domain, subDomain, deviceId, masterDid)
+		log.Warningf("binding device failed:domain[%s], device[%s:%s], master[%d], err[%v]", domain, subDomain, deviceId, masterDid, err)
+		if err == ErrBindedByOtherHome {
+			this.checkRebinding(uid, domain, subDomain, deviceId, hid)
+		}
 		return err
 	}
+	// the access grants of the old home members are revoked after the device moved
+	if transfer {
+		bind, err := this.proxy.GetBindingInfo(domain, subDomain, deviceId)
+		if err != nil {
+			log.Warningf("get binding info failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+			return err
+		}
+		return NewRevocationManager(this.store).RevokeDevice(domain, bind.did)
+	}
+	return nil
+}
+
+// binding a batch of slave devices to one master, if bestEffort is false all the devices
+// binded in one transaction or none of them, otherwise the valid devices binded and the
+// failed reason set to every failed entry
+func (this *BindingManager) BatchBinding(uid int64, domain string, hid, masterDid int64, entries []*BindingEntry, bestEffort bool) error {
+	common.CheckParam(this.proxy != nil && this.warehouse != nil)
+	if len(entries) <= 0 || len(entries) > MAX_BATCH_BINDING {
+		log.Warningf("check the batch count failed:domain[%s], master[%d], count[%d]", domain, masterDid, len(entries))
+		return common.ErrInvalidParam
+	}
+	_, err := NewMemberManager(this.store).CheckPermission(domain, hid, uid, PERM_BIND)
+	if err != nil {
+		log.Warningf("check the binding permission failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, uid, err)
+		return err
+	}
+	// step 1. check the master device only once
+	_, err = this.proxy.GetBindingByDid(domain, masterDid)
+	if err != nil {
+		log.Warningf("check the master device not active:domain[%s], did[%d], err[%v]", domain, masterDid, err)
+		return err
+	}
+	deviceManager := NewDeviceManager(this.store)
+	err = deviceManager.checkMaster(domain, hid, masterDid)
+	if err != nil {
+		log.Warningf("check the master device failed:domain[%s], hid[%d], did[%d], err[%v]", domain, hid, masterDid, err)
+		return err
+	}
+	count, err := deviceManager.countSlaves(domain, masterDid)
+	if err != nil {
+		log.Warningf("count the slave devices failed:domain[%s], did[%d], err[%v]", domain, masterDid, err)
+		return err
+	}
+	quota, err := NewQuotaManager(this.store).Get(domain)
+	if err != nil {
+		log.Warningf("get domain quota failed:domain[%s], err[%v]", domain, err)
+		return err
+	}
+	// step 2. check every slave device in warehouse and not binded by other home
+	valid := make([]*BindingEntry, 0, len(entries))
+	exist := make(map[DeviceKey]bool)
+	for _, entry := range entries {
+		key := DeviceKey{domain: domain, subDomain: entry.subDomain, deviceId: entry.deviceId}
+		if exist[key] {
+			entry.err = common.ErrInvalidParam
+		} else {
+			exist[key] = true
+			entry.err = this.checkBatchEntry(uid, domain, hid, masterDid, entry, &count, quota.GetSlaves())
+		}
+		if entry.err != nil {
+			log.Warningf("check the batch binding device failed:domain[%s], device[%s:%s], master[%d], err[%v]",
+				domain, entry.subDomain, entry.deviceId, masterDid, entry.err)
+			if !bestEffort {
+				abortBatch(entries, entry.err)
+				return entry.err
+			}
+			continue
+		}
+		valid = append(valid, entry)
+	}
+	if len(valid) == 0 {
+		return nil
+	}
+	// step 3. binding all the valid devices in one transaction
+	err = this.proxy.BatchBindingDevices(uid, domain, hid, masterDid, valid)
+	if err != nil {
+		log.Warningf("batch binding devices failed:domain[%s], hid[%d], master[%d], err[%v]", domain, hid, masterDid, err)
+		for _, entry := range valid {
+			entry.err = err
+		}
+		return err
+	}
+	return nil
+}
+
+// the entries not failed are not binded if the all or nothing batch aborted
+func abortBatch(entries []*BindingEntry, err error) {
+	for _, entry := range entries {
+		if entry.err == nil {
+			entry.err = err
+		}
+	}
+}
+
+// check one slave device of the batch binding, increase the slave count if it is new to the master
+func (this *BindingManager) checkBatchEntry(uid int64, domain string, hid, masterDid int64, entry *BindingEntry, count *int64, limit int64) error {
+	if len(entry.deviceName) <= 0 {
+		return common.ErrInvalidName
+	}
+	err := this.checkDeviceInfo(domain, entry.subDomain, entry.deviceId, false)
+	if err != nil {
+		return err
+	}
+	bind, err := this.proxy.GetBindingInfo(domain, entry.subDomain, entry.deviceId)
+	if err == nil {
+		device, err := NewDeviceManager(this.store).Get(domain, bind.did)
+		if err != nil {
+			return err
+		} else if device != nil && device.GetHid() != hid {
+			// the transferred device must be binded one by one for consuming the approve
+			// or the reset token, the attempt logged for the owner
+			this.recordRebinding(uid, domain, entry.subDomain, entry.deviceId, bind.did, device.GetHid(), hid)
+			return ErrBindedByOtherHome
+		} else if device != nil && device.GetMasterDid() == masterDid {
+			return nil
+		}
+	} else if err != common.ErrEntryNotExist {
+		return err
+	}
+	if *count >= limit {
+		log.Warningf("check the slave count failed:domain[%s], master[%d], count[%d]", domain, masterDid, *count)
+		return ErrQuotaExceeded
+	}
+	*count++
 	return nil
 }
 
 // change the slave or master device, the old must valid
-func (this *BindingManager) ChangeBinding(did int64, domain, subDomain, deviceId string) error {
+func (this *BindingManager) ChangeBinding(uid, did int64, domain, subDomain, deviceId string) error {
 	common.CheckParam(this.proxy != nil && this.warehouse != nil)
 	// step 1. check the old did must be register succ
 	var device DeviceInfo
@@ -81,6 +237,11 @@ func (this *BindingManager) ChangeBinding(did int64, domain, subDomain, deviceId
 		log.Warningf("get master device failed:domain[%s], did[%d], err[%v]", domain, did, err)
 		return err
 	}
+	_, err = NewMemberManager(this.store).CheckPermission(domain, device.GetHid(), uid, PERM_BIND)
+	if err != nil {
+		log.Warningf("check the binding permission failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, device.GetHid(), uid, err)
+		return err
+	}
 	// step 2 check the old did must be binging ok
 	var exist bool
 	err = this.proxy.IsBindingExist(domain, did, &exist)
@@ -112,15 +273,212 @@ func (this *BindingManager) ChangeBinding(did int64, domain, subDomain, deviceId
 		return common.ErrAlreadyBinded
 	}
 	// step 5. change the mapping relation
-	err = this.proxy.ChangeDeviceBinding(did, domain, subDomain, deviceId)
+	err = this.proxy.ChangeDeviceBinding(uid, did, domain, subDomain, deviceId)
 	if err != nil {
 		log.Warningf("do change the device mapping binding info failed:domain[%s], device[%s:%s], err[%v]",
 			domain, subDomain, deviceId, err)
 		return err
 	}
+	// the access grants of the old physical device are revoked
+	return NewRevocationManager(this.store).RevokeDevice(domain, did)
+}
+
+// replace the old master gateway with a new one, all the slave devices are moved to
+// the new master, return the new master did and the moved slave devices
+func (this *BindingManager) ReplaceGateway(uid int64, domain string, did int64, subDomain, deviceId string) (int64, []int64, error) {
+	common.CheckParam(this.proxy != nil && this.warehouse != nil)
+	// step 1. check the old device is a binded master device
+	deviceManager := NewDeviceManager(this.store)
+	old, err := deviceManager.Get(domain, did)
+	if err != nil {
+		log.Warningf("get old master device failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return -1, nil, err
+	} else if old == nil || !old.IsMasterDevice() {
+		log.Warningf("check the old master device failed:domain[%s], did[%d]", domain, did)
+		return -1, nil, common.ErrMasterNotExist
+	}
+	_, err = NewMemberManager(this.store).CheckPermission(domain, old.GetHid(), uid, PERM_BIND)
+	if err != nil {
+		log.Warningf("check the binding permission failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, old.GetHid(), uid, err)
+		return -1, nil, err
+	}
+	// step 2. check the new device is a valid master device in warehouse
+	err = this.checkDeviceInfo(domain, subDomain, deviceId, true)
+	if err != nil {
+		log.Warningf("check new master device failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return -1, nil, err
+	}
+	// step 3. check the new device not binded by any home, reuse the mapping if activated before
+	var newDid int64
+	bind, err := this.proxy.GetBindingInfo(domain, subDomain, deviceId)
+	if err == nil {
+		newDid = bind.did
+		device, err := deviceManager.Get(domain, newDid)
+		if err != nil {
+			log.Warningf("get new master device failed:domain[%s], did[%d], err[%v]", domain, newDid, err)
+			return -1, nil, err
+		} else if device != nil {
+			log.Warningf("check the new master already binded:domain[%s], device[%s:%s], did[%d], hid[%d]",
+				domain, subDomain, deviceId, newDid, device.GetHid())
+			return -1, nil, common.ErrAlreadyBinded
+		}
+	} else if err != common.ErrEntryNotExist {
+		log.Warningf("get new master binding info failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return -1, nil, err
+	}
+	// step 4. swap the master and move all the slaves in one transaction
+	newDid, slaves, err := this.proxy.ReplaceMasterDevice(uid, domain, old, newDid, subDomain, deviceId)
+	if err != nil {
+		log.Warningf("replace master device failed:domain[%s], did[%d], device[%s:%s], err[%v]",
+			domain, did, subDomain, deviceId, err)
+		return -1, nil, err
+	}
+	// the access grants through the old master are revoked
+	err = NewRevocationManager(this.store).RevokeDevice(domain, did)
+	if err != nil {
+		return -1, nil, err
+	}
+	return newDid, slaves, nil
+}
+
+// the current home owner approve the device transfer to another home
+func (this *BindingManager) ApproveTransfer(uid int64, domain string, did, toHid int64) error {
+	common.CheckParam(this.proxy != nil && this.warehouse != nil)
+	// step 1. get the device current home
+	deviceManager := NewDeviceManager(this.store)
+	device, err := deviceManager.Get(domain, did)
+	if err != nil {
+		log.Warningf("get device info failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	} else if device == nil {
+		log.Warningf("device not exist:domain[%s], did[%d]", domain, did)
+		return common.ErrEntryNotExist
+	} else if device.GetHid() == toHid {
+		log.Warningf("device already in the home:domain[%s], did[%d], hid[%d]", domain, did, toHid)
+		return common.ErrInvalidParam
+	}
+	// step 2. only the current home owner can approve
+	homeManager := NewHomeManager(this.store)
+	home, err := homeManager.Get(domain, device.GetHid())
+	if err != nil {
+		log.Warningf("get home failed:domain[%s], hid[%d], err[%v]", domain, device.GetHid(), err)
+		return err
+	} else if home == nil {
+		log.Warningf("home not exist:domain[%s], hid[%d]", domain, device.GetHid())
+		return common.ErrEntryNotExist
+	} else if home.GetCreateUid() != uid {
+		log.Warningf("check the home owner failed:domain[%s], hid[%d], uid[%d]", domain, device.GetHid(), uid)
+		return common.ErrNoPrivelige
+	}
+	// step 3. record the transfer
+	err = this.proxy.InsertTransfer(domain, did, device.GetHid(), toHid, uid, time.Now().Add(TRANSFER_EXPIRE))
+	if err != nil {
+		log.Warningf("insert transfer failed:domain[%s], did[%d], from[%d], to[%d], err[%v]",
+			domain, did, device.GetHid(), toHid, err)
+		return err
+	}
+	return nil
+}
+
+// the device report factory reset, return the one-off token for rebinding to any home
+func (this *BindingManager) ResetDevice(domain, subDomain, deviceId string) (string, error) {
+	common.CheckParam(this.proxy != nil && this.warehouse != nil)
+	bind, err := this.proxy.GetBindingInfo(domain, subDomain, deviceId)
+	if err != nil {
+		if err == common.ErrEntryNotExist {
+			return "", common.ErrNotYetBinded
+		}
+		log.Warningf("get binding info failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return "", err
+	}
+	token, err := newBindToken()
+	if err != nil {
+		log.Errorf("generate bind token failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return "", err
+	}
+	err = this.proxy.SetBindToken(domain, bind.did, token, time.Now().Add(BIND_TOKEN_EXPIRE))
+	if err != nil {
+		log.Warningf("set bind token failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return "", err
+	}
+	// the access grants issued before the factory reset are revoked
+	err = NewRevocationManager(this.store).RevokeDevice(domain, bind.did)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// get the current home of the device binded by other home and log the rebinding attempt
+func (this *BindingManager) checkRebinding(uid int64, domain, subDomain, deviceId string, hid int64) {
+	bind, err := this.proxy.GetBindingInfo(domain, subDomain, deviceId)
+	if err != nil {
+		log.Warningf("get binding info failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return
+	}
+	device, err := NewDeviceManager(this.store).Get(domain, bind.did)
+	if err != nil || device == nil {
+		log.Warningf("get device info failed:domain[%s], did[%d], err[%v]", domain, bind.did, err)
+		return
+	}
+	this.recordRebinding(uid, domain, subDomain, deviceId, bind.did, device.GetHid(), hid)
+}
+
+// log the rebinding attempt of the device binded by other home for the owner
+func (this *BindingManager) recordRebinding(uid int64, domain, subDomain, deviceId string, did, owner, hid int64) {
+	log.Warningf("device binded by other home:uid[%d], domain[%s], did[%d], owner[%d], hid[%d]",
+		uid, domain, did, owner, hid)
+	audit := NewAuditManager(this.store)
+	err := audit.Record(domain, owner, uid, did, AUDIT_HIJACK,
+		fmt.Sprintf("rebinding device[%s:%s] to home[%d]", subDomain, deviceId, hid))
+	if err != nil {
+		log.Warningf("record the rebinding attempt failed:domain[%s], did[%d], err[%v]", domain, did, err)
+	}
+}
+
+// the master must be active in the same home, and the slave count not exceed the limit
+// if the device is not already the slave of the master
+func (this *BindingManager) checkSlaveBinding(domain, subDomain, deviceId string, hid, masterDid int64) error {
+	deviceManager := NewDeviceManager(this.store)
+	err := deviceManager.checkMaster(domain, hid, masterDid)
+	if err != nil {
+		return err
+	}
+	bind, err := this.proxy.GetBindingInfo(domain, subDomain, deviceId)
+	if err == nil {
+		device, err := deviceManager.Get(domain, bind.did)
+		if err != nil {
+			return err
+		} else if device != nil && device.GetMasterDid() == masterDid {
+			return nil
+		}
+	} else if err != common.ErrEntryNotExist {
+		return err
+	}
+	quota, err := NewQuotaManager(this.store).Get(domain)
+	if err != nil {
+		return err
+	}
+	count, err := deviceManager.countSlaves(domain, masterDid)
+	if err != nil {
+		return err
+	} else if count >= quota.GetSlaves() {
+		log.Warningf("check the slave count failed:domain[%s], master[%d], count[%d]", domain, masterDid, count)
+		return ErrQuotaExceeded
+	}
 	return nil
 }
 
+// random one-off bind token
+func newBindToken() (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
 // check basic device info from device warehouse
 // binding one device to one home, if masterDid < 0 it's master device, otherwise it's slave device
 func (this *BindingManager) checkDeviceInfo(domain, subDomain, deviceId string, isMaster bool) error {
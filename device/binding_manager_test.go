@@ -3,6 +3,7 @@ package device
 import (
 	"fmt"
 	"testing"
+	"zc-common-go/common"
 )
 
 func cleanAll(store *DeviceStorage) {
@@ -11,6 +12,18 @@ func cleanAll(store *DeviceStorage) {
 	store.Clean(domain, "device_mapping")
 	store.Clean(domain, "home_info")
 	store.Clean(domain, "home_members")
+	store.Clean(domain, "home_audit")
+	store.Clean(domain, "device_transfer")
+	store.Clean(domain, "device_history")
+	store.Clean(domain, "home_room")
+	store.Clean(domain, "quota_config")
+	store.Clean(domain, "home_metadata")
+	store.Clean(domain, "home_invite")
+	store.Clean(domain, "device_acl")
+	store.Clean(domain, "grant_revocation")
+	store.Clean(domain, "device_presence")
+	store.Clean(domain, "device_shadow")
+	store.Clean(domain, "device_command")
 }
 
 // can binding one device more than one times
@@ -62,7 +75,7 @@ func TestBinding(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		id := fmt.Sprintf("20151017%d", i)
 		name := fmt.Sprintf("master%d", i)
-		err := binding.Binding(domain, subDomain, id, name, list[i%5].hid, -1)
+		err := binding.Binding(uid, domain, subDomain, id, name, "", list[i%5].hid, -1)
 		if err == nil {
 			t.Errorf("binding master device failed:err[%v]", err)
 		}
@@ -72,7 +85,7 @@ func TestBinding(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		id := fmt.Sprintf("20141017%d", i)
 		name := fmt.Sprintf("master%d", i)
-		err = binding.Binding(domain, subDomain, id, name, list[i%5].hid, -1)
+		err = binding.Binding(uid, domain, subDomain, id, name, "", list[i%5].hid, -1)
 		if err != nil {
 			t.Errorf("binding master device failed:err[%v]", err)
 		}
@@ -83,7 +96,7 @@ func TestBinding(t *testing.T) {
 			master = append(master, bind.did)
 		}
 		// binding again
-		err = binding.Binding(domain, subDomain, id, name, list[i%5].hid, -1)
+		err = binding.Binding(uid, domain, subDomain, id, name, "", list[i%5].hid, -1)
 		if err != nil {
 			t.Errorf("rebinding master device failed:err[%v]", err)
 		}
@@ -99,7 +112,7 @@ func TestBinding(t *testing.T) {
 	for i := 0; i < 30; i++ {
 		id := fmt.Sprintf("20151017%d", i)
 		name := fmt.Sprintf("slave%d", i)
-		err := binding.Binding(domain, subDomain, id, name, list[i%5].hid, invalidDid)
+		err := binding.Binding(uid, domain, subDomain, id, name, "", list[i%5].hid, invalidDid)
 		if err == nil {
 			t.Errorf("binding master device failed:err[%v]", err)
 		}
@@ -109,11 +122,11 @@ func TestBinding(t *testing.T) {
 		id := fmt.Sprintf("20151017%d", i)
 		name := fmt.Sprintf("slave%d", i)
 		// bind as master
-		err := binding.Binding(domain, subDomain, id, name, list[i%5].hid, -1)
+		err := binding.Binding(uid, domain, subDomain, id, name, "", list[i%5].hid, -1)
 		if err == nil {
 			t.Errorf("binding master device failed:err[%v]", err)
 		}
-		err = binding.Binding(domain, subDomain, id, name, list[i%5].hid, master[i%10])
+		err = binding.Binding(uid, domain, subDomain, id, name, "", list[i%5].hid, master[i%10])
 		if err != nil {
 			t.Errorf("binding master device failed:err[%v]", err)
 		}
@@ -122,7 +135,7 @@ func TestBinding(t *testing.T) {
 			t.Errorf("get binding info failed:err[%v]", err)
 		}
 		// bind again
-		err = binding.Binding(domain, subDomain, id, name, list[i%5].hid, master[i%10])
+		err = binding.Binding(uid, domain, subDomain, id, name, "", list[i%5].hid, master[i%10])
 		if err != nil {
 			t.Errorf("binding master device failed:err[%v]", err)
 		}
@@ -184,7 +197,7 @@ func TestChangeBinding(t *testing.T) {
 	for i := 0; i < 5; i++ {
 		id := fmt.Sprintf("20141017%d", i)
 		name := fmt.Sprintf("master%d", i)
-		err := binding.Binding(domain, subDomain, id, name, list[i%5].hid, -1)
+		err := binding.Binding(uid, domain, subDomain, id, name, "", list[i%5].hid, -1)
 		if err != nil {
 			t.Errorf("binding master device failed:err[%v]", err)
 		}
@@ -195,7 +208,7 @@ func TestChangeBinding(t *testing.T) {
 			master = append(master, bind.did)
 		}
 		// binding again succ
-		err = binding.Binding(domain, subDomain, id, name, list[i%5].hid, -1)
+		err = binding.Binding(uid, domain, subDomain, id, name, "", list[i%5].hid, -1)
 		if err != nil {
 			t.Errorf("rebinding master device failed:err[%v]", err)
 		}
@@ -206,27 +219,36 @@ func TestChangeBinding(t *testing.T) {
 	}
 
 	// change master device to new master
+	command := NewCommandManager(store)
 	var invalidDid int64 = 100000
 	for i := 0; i < 5; i++ {
 		id := fmt.Sprintf("20141017%d", i+5)
 		// invalid id
-		err := binding.ChangeBinding(invalidDid, domain, subDomain, id)
+		err := binding.ChangeBinding(uid, invalidDid, domain, subDomain, id)
 		if err == nil {
 			t.Errorf("change binding failed:err[%v]", err)
 		}
 		// new device not valid
 		id = fmt.Sprintf("20151017%d", i+5)
-		err = binding.ChangeBinding(master[i], domain, subDomain, id)
+		err = binding.ChangeBinding(uid, master[i], domain, subDomain, id)
 		if err == nil {
 			t.Errorf("change binding failed:err[%v]", err)
 		}
 
-		// succ
+		// succ and the queued commands of the old device deleted
+		_, err = command.Enqueue(uid, domain, master[i], "on", 0)
+		if err != nil {
+			t.Errorf("enqueue command failed:err[%v]", err)
+		}
 		id = fmt.Sprintf("20141017%d", i+5)
-		err = binding.ChangeBinding(master[i], domain, subDomain, id)
+		err = binding.ChangeBinding(uid, master[i], domain, subDomain, id)
 		if err != nil {
 			t.Errorf("change binding failed:err[%v]", err)
 		}
+		commands, err := command.Fetch(domain, subDomain, id, 0)
+		if err != nil || len(commands) != 0 {
+			t.Errorf("fetch the old device commands failed:err[%v], len[%d]", err, len(commands))
+		}
 		bind, err := binding.GetBindingInfo(domain, subDomain, id)
 		if err != nil || bind == nil {
 			t.Errorf("get binding info failed:err[%v]", err)
@@ -234,10 +256,301 @@ func TestChangeBinding(t *testing.T) {
 			t.Errorf("check binding info error:old[%d], new[%d]", master[i], bind.did)
 		}
 		// already binded failed
-		err = binding.ChangeBinding(master[i], domain, subDomain, id)
+		err = binding.ChangeBinding(uid, master[i], domain, subDomain, id)
 		if err == nil {
 			t.Errorf("change binding failed:err[%v]", err)
 		}
 	}
 	cleanAll(store)
 }
+
+// rebinding to other home need transfer approved or factory reset token
+func TestRebindingOtherHome(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	// 5 home, 2 master/home, 3 slave/master
+	prepare(store)
+	home := NewHomeManager(store)
+	var uid int64 = 100
+	list, err := home.GetAllHome(domain, uid)
+	if err != nil || len(list) != 5 {
+		t.Errorf("get user all home failed:err[%v], len[%d]", err, len(list))
+	}
+	binding := NewBindingManager(store)
+	device := NewDeviceManager(store)
+	audit := NewAuditManager(store)
+	subDomain := "flying"
+	id := "201410170"
+	bind, err := binding.GetBindingInfo(domain, subDomain, id)
+	if err != nil || bind == nil {
+		t.Errorf("get binding info failed:err[%v]", err)
+	}
+	// the user not member of the home can not bind
+	var invalidUid int64 = 10000000
+	err = binding.Binding(invalidUid, domain, subDomain, id, "master", "", list[1].hid, -1)
+	if err != common.ErrNoPrivelige {
+		t.Errorf("binding by not member succ:err[%v]", err)
+	}
+	// rebinding to other home without approve
+	err = binding.Binding(uid, domain, subDomain, id, "master", "", list[1].hid, -1)
+	if err != ErrBindedByOtherHome {
+		t.Errorf("rebinding to other home succ:err[%v]", err)
+	}
+	logs, err := audit.GetAll(domain, list[0].hid)
+	if err != nil || len(logs) != 1 {
+		t.Errorf("get audit logs failed:err[%v], len[%d]", err, len(logs))
+	} else if logs[0].GetUid() != uid || logs[0].GetAction() != AUDIT_HIJACK || logs[0].GetDid() != bind.did {
+		t.Error("check audit log failed")
+	}
+
+	// only the owner can approve
+	err = binding.ApproveTransfer(invalidUid, domain, bind.did, list[1].hid)
+	if err == nil {
+		t.Error("not owner approve transfer succ")
+	}
+	err = binding.ApproveTransfer(uid, domain, bind.did, list[1].hid)
+	if err != nil {
+		t.Errorf("approve transfer failed:err[%v]", err)
+	}
+	shadow := NewShadowManager(store)
+	_, err = shadow.Report(domain, subDomain, id, map[string]interface{}{"power": "on"}, 0)
+	if err != nil {
+		t.Errorf("report shadow failed:err[%v]", err)
+	}
+	command := NewCommandManager(store)
+	_, err = command.Enqueue(uid, domain, bind.did, "on", 0)
+	if err != nil {
+		t.Errorf("enqueue command failed:err[%v]", err)
+	}
+	// approved to other home
+	err = binding.Binding(uid, domain, subDomain, id, "master", "", list[2].hid, -1)
+	if err != ErrBindedByOtherHome {
+		t.Errorf("rebinding to not approved home succ:err[%v]", err)
+	}
+	err = binding.Binding(uid, domain, subDomain, id, "master", "", list[1].hid, -1)
+	if err != nil {
+		t.Errorf("rebinding approved device failed:err[%v]", err)
+	}
+	// the slave devices moved with the master
+	devList, err := device.GetAllDevices(domain, list[1].hid)
+	if err != nil || len(devList) != 12 {
+		t.Errorf("check moved devices failed:err[%v], len[%d]", err, len(devList))
+	}
+	// the shadow of the old home deleted
+	state, err := shadow.getShadow(domain, bind.did)
+	if err != nil || state != nil {
+		t.Errorf("check the moved device shadow deleted failed:err[%v]", err)
+	}
+	// the commands queued by the old home deleted
+	commands, err := command.Fetch(domain, subDomain, id, 0)
+	if err != nil || len(commands) != 0 {
+		t.Errorf("fetch the old home commands failed:err[%v], len[%d]", err, len(commands))
+	}
+	// the grants of the old home members revoked
+	revocations, err := NewRevocationManager(store).GetAll(domain)
+	if err != nil || len(revocations) != 1 || revocations[0].GetSubjectType() != REVOKE_SUBJECT_DEVICE ||
+		revocations[0].GetSubject() != bind.did {
+		t.Errorf("check the moved device revoked failed:err[%v], len[%d]", err, len(revocations))
+	}
+	// the approve can only be used once
+	var approved bool
+	err = binding.proxy.IsTransferApproved(domain, bind.did, list[0].hid, list[1].hid, &approved)
+	if err != nil || approved {
+		t.Errorf("check the approve consumed failed:err[%v], approved[%v]", err, approved)
+	}
+	err = binding.ApproveTransfer(uid, domain, bind.did, list[0].hid)
+	if err != nil {
+		t.Errorf("approve transfer back failed:err[%v]", err)
+	}
+	err = binding.Binding(uid, domain, subDomain, id, "master", "", list[0].hid, -1)
+	if err != nil {
+		t.Errorf("rebinding approved device back failed:err[%v]", err)
+	}
+	err = binding.Binding(uid, domain, subDomain, id, "master", "", list[1].hid, -1)
+	if err != ErrBindedByOtherHome {
+		t.Errorf("rebinding by the used approve succ:err[%v]", err)
+	}
+
+	// factory reset
+	token, err := binding.ResetDevice(domain, subDomain, id)
+	if err != nil || len(token) == 0 {
+		t.Errorf("reset device failed:err[%v]", err)
+	}
+	err = binding.Binding(uid, domain, subDomain, id, "master", "invalid", list[2].hid, -1)
+	if err != ErrBindedByOtherHome {
+		t.Errorf("rebinding with invalid token succ:err[%v]", err)
+	}
+	err = binding.Binding(uid, domain, subDomain, id, "master", token, list[2].hid, -1)
+	if err != nil {
+		t.Errorf("rebinding with reset token failed:err[%v]", err)
+	}
+	dev, err := device.Get(domain, bind.did)
+	if err != nil || dev == nil || dev.GetHid() != list[2].hid {
+		t.Errorf("check rebinding device home failed:err[%v]", err)
+	}
+	err = binding.Binding(uid, domain, subDomain, id, "master", token, list[3].hid, -1)
+	if err != ErrBindedByOtherHome {
+		t.Errorf("rebinding with used token succ:err[%v]", err)
+	}
+	cleanAll(store)
+}
+
+// replace master gateway with all the slave devices moved
+func TestReplaceGateway(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	// 5 home, 2 master/home, 3 slave/master
+	prepare(store)
+	subDomain := "flying"
+	warehouse := NewDeviceWarehouse(store)
+	err := warehouse.Register(domain, subDomain, "2014101799", "publicKey99", true)
+	if err != nil {
+		t.Error("register master device failed", err)
+	}
+	var uid int64 = 100
+	binding := NewBindingManager(store)
+	device := NewDeviceManager(store)
+	bind, err := binding.GetBindingInfo(domain, subDomain, "201410170")
+	if err != nil || bind == nil {
+		t.Errorf("get binding info failed:err[%v]", err)
+	}
+	old, err := device.Get(domain, bind.did)
+	if err != nil || old == nil {
+		t.Errorf("get old master failed:err[%v]", err)
+	}
+	// new device is slave or already binded
+	_, _, err = binding.ReplaceGateway(uid, domain, bind.did, subDomain, "201510170")
+	if err == nil {
+		t.Error("replace gateway with slave device succ")
+	}
+	_, _, err = binding.ReplaceGateway(uid, domain, bind.did, subDomain, "201410171")
+	if err == nil {
+		t.Error("replace gateway with binded device succ")
+	}
+	// old device not master
+	slave, err := binding.GetBindingInfo(domain, subDomain, "201510170")
+	if err != nil || slave == nil {
+		t.Errorf("get binding info failed:err[%v]", err)
+	}
+	_, _, err = binding.ReplaceGateway(uid, domain, slave.did, subDomain, "2014101799")
+	if err == nil {
+		t.Error("replace slave device as gateway succ")
+	}
+	// succ
+	newDid, slaves, err := binding.ReplaceGateway(uid, domain, bind.did, subDomain, "2014101799")
+	if err != nil {
+		t.Errorf("replace gateway failed:err[%v]", err)
+	} else if len(slaves) != 3 {
+		t.Errorf("check moved slave count failed:len[%d]", len(slaves))
+	}
+	for _, did := range slaves {
+		dev, err := device.Get(domain, did)
+		if err != nil || dev == nil || dev.GetMasterDid() != newDid || dev.GetHid() != old.GetHid() {
+			t.Errorf("check moved slave failed:did[%d], err[%v]", did, err)
+		}
+	}
+	dev, err := device.Get(domain, newDid)
+	if err != nil || dev == nil || !dev.IsMasterDevice() || dev.GetDeviceName() != old.GetDeviceName() {
+		t.Errorf("check new master failed:did[%d], err[%v]", newDid, err)
+	}
+	dev, err = device.Get(domain, bind.did)
+	if err != nil || dev != nil {
+		t.Errorf("check old master deleted failed:did[%d], err[%v]", bind.did, err)
+	}
+	_, err = binding.GetBindingInfo(domain, subDomain, "201410170")
+	if err != common.ErrEntryNotExist {
+		t.Errorf("check old master mapping deleted failed:err[%v]", err)
+	}
+	cleanAll(store)
+}
+
+// batch binding slave devices to one master
+func TestBatchBinding(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	warehouse := NewDeviceWarehouse(store)
+	subDomain := "flying"
+	err := warehouse.Register(domain, subDomain, "30141017", "publicKey", true)
+	if err != nil {
+		t.Error("register master device failed", err)
+	}
+	for i := 0; i < 6; i++ {
+		id := fmt.Sprintf("30151017%d", i)
+		err := warehouse.Register(domain, subDomain, id, "", false)
+		if err != nil {
+			t.Error("register slave device failed", err)
+		}
+	}
+	var uid int64 = 100
+	hid, err := CreateHome(uid, store)
+	if err != nil {
+		t.Error("create home failed", err)
+	}
+	binding := NewBindingManager(store)
+	err = binding.Binding(uid, domain, subDomain, "30141017", "master", "", hid, -1)
+	if err != nil {
+		t.Error("binding master device failed", err)
+	}
+	bind, err := binding.GetBindingInfo(domain, subDomain, "30141017")
+	if err != nil || bind == nil {
+		t.Fatalf("get binding info failed:err[%v]", err)
+	}
+	newEntries := func() []*BindingEntry {
+		entries := make([]*BindingEntry, 0)
+		for i := 0; i < 6; i++ {
+			entries = append(entries, NewBindingEntry(subDomain, fmt.Sprintf("30151017%d", i), fmt.Sprintf("slave%d", i)))
+		}
+		// not registered in warehouse
+		return append(entries, NewBindingEntry(subDomain, "notexist", "slave"))
+	}
+	device := NewDeviceManager(store)
+	// all or nothing, every entry failed by the aborting error
+	entries := newEntries()
+	entries[0], entries[6] = entries[6], entries[0]
+	err = binding.BatchBinding(uid, domain, hid, bind.did, entries, false)
+	if err == nil {
+		t.Error("batch binding with invalid device succ")
+	}
+	for i, entry := range entries {
+		if entry.GetError() != err || entry.GetDid() > 0 {
+			t.Errorf("check aborted binding entry failed:index[%d], err[%v]", i, entry.GetError())
+		}
+	}
+	slaves, err := device.GetAllSlaves(domain, bind.did)
+	if err != nil || len(slaves) != 0 {
+		t.Errorf("check no slave binded failed:err[%v], len[%d]", err, len(slaves))
+	}
+	// best effort
+	entries = newEntries()
+	err = binding.BatchBinding(uid, domain, hid, bind.did, entries, true)
+	if err != nil {
+		t.Error("batch binding best effort failed", err)
+	}
+	for i, entry := range entries {
+		if i < 6 && (entry.GetError() != nil || entry.GetDid() <= 0) {
+			t.Errorf("check binding entry failed:index[%d], err[%v]", i, entry.GetError())
+		} else if i == 6 && (entry.GetError() == nil || entry.GetDid() > 0) {
+			t.Error("check invalid binding entry failed")
+		}
+	}
+	slaves, err = device.GetAllSlaves(domain, bind.did)
+	if err != nil || len(slaves) != 6 {
+		t.Errorf("check slave binded failed:err[%v], len[%d]", err, len(slaves))
+	}
+	// master not in the home
+	entries = newEntries()
+	err = binding.BatchBinding(uid, domain, hid+1, bind.did, entries[:6], false)
+	if err == nil {
+		t.Error("batch binding to other home master succ")
+	}
+	cleanAll(store)
+}
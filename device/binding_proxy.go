@@ -3,8 +3,10 @@ package device
 import (
 	"database/sql"
 	"fmt"
+	"time"
 	"zc-common-go/common"
 	log "zc-common-go/glog"
+	"zc-common-go/mysql"
 )
 
 type BindingProxy struct {
@@ -113,7 +115,8 @@ func (this *BindingProxy) IsBindingExist(domain string, did int64, exist *bool)
 	return nil
 }
 
-func (this *BindingProxy) ChangeDeviceBinding(did int64, domain, subDomain, deviceId string) error {
+// change the mapping of the did to the new device, the history of the old and new device recorded
+func (this *BindingProxy) ChangeDeviceBinding(uid, did int64, domain, subDomain, deviceId string) (err error) {
 	if this.cacheOn {
 		this.cache.Delete(domain, did)
 	}
@@ -124,7 +127,65 @@ func (this *BindingProxy) ChangeDeviceBinding(did int64, domain, subDomain, devi
 		return err
 	}
 	defer stmt.Close()
-	result, err := stmt.Exec(subDomain, deviceId, did)
+	stmt2, err := this.store.db.Prepare(copyHistorySQL(domain, "i.did = ?"))
+	if err != nil {
+		log.Errorf("prepare insert history failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return err
+	}
+	defer stmt2.Close()
+	// the shadow of the old device deleted
+	SQL3 := fmt.Sprintf("DELETE FROM %s_device_shadow WHERE did = ?", domain)
+	stmt3, err := this.store.db.Prepare(SQL3)
+	if err != nil {
+		log.Errorf("prepare delete shadow failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	defer stmt3.Close()
+	// the presence of the old device deleted
+	SQL4 := fmt.Sprintf("DELETE FROM %s_device_presence WHERE did = ?", domain)
+	stmt4, err := this.store.db.Prepare(SQL4)
+	if err != nil {
+		log.Errorf("prepare delete presence failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	defer stmt4.Close()
+	// the queued commands to the old device or through the old master deleted
+	SQL5 := fmt.Sprintf("DELETE FROM %s_device_command WHERE did = ? OR master_did = ?", domain)
+	stmt5, err := this.store.db.Prepare(SQL5)
+	if err != nil {
+		log.Errorf("prepare delete commands failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	defer stmt5.Close()
+
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return err
+	}
+	defer rollback(&err, tx)
+	// the old device unbind history
+	_, err = tx.Stmt(stmt2).Exec(HISTORY_UNBIND, uid, did)
+	if err != nil {
+		log.Errorf("insert unbind history failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	_, err = tx.Stmt(stmt3).Exec(did)
+	if err != nil {
+		log.Errorf("delete shadow failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	_, err = tx.Stmt(stmt4).Exec(did)
+	if err != nil {
+		log.Errorf("delete presence failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	_, err = tx.Stmt(stmt5).Exec(did, did)
+	if err != nil {
+		log.Errorf("delete commands failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	result, err := tx.Stmt(stmt).Exec(subDomain, deviceId, did)
 	if err != nil {
 		log.Errorf("execute update failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
 		return err
@@ -136,13 +197,182 @@ func (this *BindingProxy) ChangeDeviceBinding(did int64, domain, subDomain, devi
 	}
 	if affect != 1 {
 		log.Errorf("check affected rows failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
-		return common.ErrEntryNotExist
+		err = common.ErrEntryNotExist
+		return err
+	}
+	// the new device change history
+	_, err = tx.Stmt(stmt2).Exec(HISTORY_CHANGE, uid, did)
+	if err != nil {
+		log.Errorf("insert change history failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], did[%d], device[%s:%s], err[%v]", domain, did, subDomain, deviceId, err)
+		return err
+	}
+	return nil
+}
+
+// set the one-off bind token after the device factory reset, the presence of the reset
+// device deleted until the next heartbeat
+func (this *BindingProxy) SetBindToken(domain string, did int64, token string, expire time.Time) (err error) {
+	if this.cacheOn {
+		this.cache.Delete(domain, did)
+	}
+	SQL := fmt.Sprintf("UPDATE %s_device_mapping SET bind_token = ?, expire_time = ? WHERE did = ?", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare update bind token failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	defer stmt.Close()
+	SQL2 := fmt.Sprintf("DELETE FROM %s_device_presence WHERE did = ?", domain)
+	stmt2, err := this.store.db.Prepare(SQL2)
+	if err != nil {
+		log.Errorf("prepare delete presence failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	defer stmt2.Close()
+
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	defer rollback(&err, tx)
+	result, err := tx.Stmt(stmt).Exec(token, expire, did)
+	if err != nil {
+		log.Errorf("execute update bind token failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	affect, err := result.RowsAffected()
+	if err != nil {
+		log.Warningf("get affected rows failed:err[%v]", err)
+		return err
+	}
+	if affect != 1 {
+		log.Warningf("check affected rows failed:domain[%s], did[%d], row[%d]", domain, did, affect)
+		err = common.ErrEntryNotExist
+		return err
+	}
+	_, err = tx.Stmt(stmt2).Exec(did)
+	if err != nil {
+		log.Errorf("delete presence failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	return nil
+}
+
+// insert or replace the transfer approved by the current home owner
+func (this *BindingProxy) InsertTransfer(domain string, did, fromHid, toHid, uid int64, expire time.Time) error {
+	SQL := fmt.Sprintf("REPLACE INTO %s_device_transfer(did, from_hid, to_hid, approve_uid, expire_time, create_time) VALUES(?,?,?,?,?,NOW())", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare replace transfer failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(did, fromHid, toHid, uid, expire)
+	if err != nil {
+		log.Errorf("replace transfer failed:domain[%s], did[%d], from[%d], to[%d], err[%v]", domain, did, fromHid, toHid, err)
+		return err
 	}
 	return nil
 }
 
-// binding device main routine
-func (this *BindingProxy) BindingDevice(domain, subDomain, deviceId, deviceName string, hid, masterDid int64) (err error) {
+// check the transfer approved and not expired, if not exist return false + nil
+func (this *BindingProxy) IsTransferApproved(domain string, did, fromHid, toHid int64, approved *bool) error {
+	SQL := fmt.Sprintf("SELECT expire_time FROM %s_device_transfer WHERE did = ? AND from_hid = ? AND to_hid = ?", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query transfer failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	defer stmt.Close()
+	var expire mysql.NullTime
+	err = stmt.QueryRow(did, fromHid, toHid).Scan(&expire)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			*approved = false
+			return nil
+		}
+		log.Warningf("query transfer failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	*approved = expire.Valid && time.Now().Before(expire.Time)
+	return nil
+}
+
+// check the device rebinding with the device info, mapping and transfer rows locked in the
+// transaction, return true + nil if the device binded by other home and the rebinding is proved
+// by the factory reset token or approved by the owner, return false + nil if not binded by other home
+func lockRebinding(tx *sql.Tx, domain string, did, hid int64, token string) (bool, error) {
+	var fromHid int64
+	SQL1 := fmt.Sprintf("SELECT hid FROM %s_device_info WHERE did = ? FOR UPDATE", domain)
+	err := tx.QueryRow(SQL1, did).Scan(&fromHid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		log.Errorf("lock the device info failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return false, err
+	} else if fromHid == hid {
+		return false, nil
+	}
+	// factory reset token
+	var bindToken sql.NullString
+	var expire mysql.NullTime
+	SQL2 := fmt.Sprintf("SELECT bind_token, expire_time FROM %s_device_mapping WHERE did = ? FOR UPDATE", domain)
+	err = tx.QueryRow(SQL2, did).Scan(&bindToken, &expire)
+	if err != nil {
+		log.Errorf("lock the device mapping failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return false, err
+	}
+	if len(token) > 0 && bindToken.Valid && bindToken.String == token && expire.Valid && time.Now().Before(expire.Time) {
+		log.Infof("device rebinding by reset token:domain[%s], did[%d], from[%d], to[%d]", domain, did, fromHid, hid)
+		return true, nil
+	}
+	// approved by the current home owner
+	SQL3 := fmt.Sprintf("SELECT expire_time FROM %s_device_transfer WHERE did = ? AND from_hid = ? AND to_hid = ? FOR UPDATE", domain)
+	err = tx.QueryRow(SQL3, did, fromHid, hid).Scan(&expire)
+	if err == nil && expire.Valid && time.Now().Before(expire.Time) {
+		log.Infof("device rebinding by transfer:domain[%s], did[%d], from[%d], to[%d]", domain, did, fromHid, hid)
+		return true, nil
+	} else if err != nil && err != sql.ErrNoRows {
+		log.Errorf("lock the device transfer failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return false, err
+	}
+	return false, ErrBindedByOtherHome
+}
+
+// the room of the device kept if rebinding in the same home, otherwise the device not assigned
+func getBindingRoom(tx *sql.Tx, domain string, did, hid int64) (int64, error) {
+	var current, room int64
+	SQL := fmt.Sprintf("SELECT hid, room_id FROM %s_device_info WHERE did = ?", domain)
+	err := tx.QueryRow(SQL, did).Scan(&current, &room)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		log.Errorf("get the device room failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return 0, err
+	} else if current != hid {
+		return 0, nil
+	}
+	return room, nil
+}
+
+// binding device main routine, if the device binded by other home it is moved with its slave
+// devices only by the factory reset token or the transfer approved by the owner, and the approved
+// transfer and bind token are consumed, otherwise return binded by other home error, return
+// true if the device moved from other home
+func (this *BindingProxy) BindingDevice(uid int64, domain, subDomain, deviceId, deviceName, token string, hid, masterDid int64) (transfer bool, err error) {
 	// step 1. check the mapping exist or not
 	var did int64
 	var stmt1 *sql.Stmt
@@ -157,36 +387,106 @@ func (this *BindingProxy) BindingDevice(domain, subDomain, deviceId, deviceName
 		if err != nil {
 			log.Errorf("prepare insert mapping failed:domain[%s], device[%s:%s], err[%v]",
 				domain, subDomain, deviceId, err)
-			return err
+			return false, err
 		}
 		defer stmt1.Close()
 	} else {
 		log.Warningf("get binding info failed:domain[%s], device[%s:%s], err[%v]",
 			domain, subDomain, deviceId, err)
-		return err
+		return false, err
 	}
 	// WARNING: TODO device info cache should be updated(deleted) it at first
 	// step 2. replace into the device info if exist replace, if not insert
 	// the home->devices list cache should be updated....
-	SQL2 := fmt.Sprintf("REPLACE INTO %s_device_info(did, hid, name, status, master_did) VALUES(?, ?, ?, ?, ?)", domain)
+	SQL2 := fmt.Sprintf("REPLACE INTO %s_device_info(did, hid, name, status, master_did, room_id) VALUES(?, ?, ?, ?, ?, ?)", domain)
 	stmt2, err := this.store.db.Prepare(SQL2)
 	if err != nil {
 		log.Errorf("prepare replace device info failed:domain[%s], device[%s:%s], err[%v]",
 			domain, subDomain, deviceId, err)
-		return err
+		return false, err
 	}
 	defer stmt2.Close()
+	SQL6 := insertHistorySQL(domain)
+	stmt6, err := this.store.db.Prepare(SQL6)
+	if err != nil {
+		log.Errorf("prepare insert history failed:domain[%s], device[%s:%s], err[%v]",
+			domain, subDomain, deviceId, err)
+		return false, err
+	}
+	defer stmt6.Close()
+	// step 3. clean the transfer status and move the slave devices to the new home
+	SQL3 := fmt.Sprintf("DELETE FROM %s_device_transfer WHERE did = ?", domain)
+	stmt3, err := this.store.db.Prepare(SQL3)
+	if err != nil {
+		log.Errorf("prepare delete transfer failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return false, err
+	}
+	defer stmt3.Close()
+	SQL4 := fmt.Sprintf("UPDATE %s_device_mapping SET bind_token = NULL, expire_time = NULL WHERE did = ?", domain)
+	stmt4, err := this.store.db.Prepare(SQL4)
+	if err != nil {
+		log.Errorf("prepare clean bind token failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return false, err
+	}
+	defer stmt4.Close()
+	// the rooms of the old home not kept by the moved slave devices
+	SQL5 := fmt.Sprintf("UPDATE %s_device_info SET hid = ?, room_id = 0 WHERE master_did = ? AND did != master_did", domain)
+	stmt5, err := this.store.db.Prepare(SQL5)
+	if err != nil {
+		log.Errorf("prepare move slave devices failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return false, err
+	}
+	defer stmt5.Close()
+	// the shadow of the device and the moved slave devices not visible to the new home
+	SQL7 := fmt.Sprintf("DELETE FROM %s_device_shadow WHERE did = ? OR did IN (SELECT did FROM %s_device_info WHERE master_did = ?)", domain, domain)
+	stmt7, err := this.store.db.Prepare(SQL7)
+	if err != nil {
+		log.Errorf("prepare delete shadow failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return false, err
+	}
+	defer stmt7.Close()
+	// the queued commands of the old home not delivered in the new home
+	SQL8 := fmt.Sprintf("DELETE FROM %s_device_command WHERE did = ? OR master_did = ?", domain)
+	stmt8, err := this.store.db.Prepare(SQL8)
+	if err != nil {
+		log.Errorf("prepare delete commands failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return false, err
+	}
+	defer stmt8.Close()
+	if this.cacheOn && did > 0 {
+		this.cache.Delete(domain, did)
+	}
+
+	quota, err := NewQuotaManager(this.store).Get(domain)
+	if err != nil {
+		log.Warningf("get domain quota failed:domain[%s], err[%v]", domain, err)
+		return false, err
+	}
 
 	// begin the transaction update mapping and device info table
 	tx, err := this.store.db.Begin()
 	if err != nil {
 		log.Errorf("begin transaction failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
-		return err
+		return false, err
 	}
-	return func() error {
+	err = func() error {
 		defer rollback(&err, tx)
+		err = lockHome(tx, domain, hid)
+		if err != nil {
+			return err
+		}
 		var result sql.Result
-		if did <= 0 {
+		var room int64
+		if did > 0 {
+			transfer, err = lockRebinding(tx, domain, did, hid, token)
+			if err != nil {
+				return err
+			}
+			room, err = getBindingRoom(tx, domain, did, hid)
+			if err != nil {
+				return err
+			}
+		} else {
 			result, err = tx.Stmt(stmt1).Exec(subDomain, deviceId)
 			if err != nil {
 				log.Errorf("insert mapping failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
@@ -198,12 +498,67 @@ func (this *BindingProxy) BindingDevice(domain, subDomain, deviceId, deviceName
 				return err
 			}
 		}
-		_, err = tx.Stmt(stmt2).Exec(did, hid, deviceName, ACTIVE, getMasterDid(masterDid, did))
+		result, err = tx.Stmt(stmt2).Exec(did, hid, deviceName, ACTIVE, getMasterDid(masterDid, did), room)
 		if err != nil {
 			log.Errorf("replace device info failed:domain[%s], device[%s:%s], hid[%d], masterDid[%d], err[%v]",
 				domain, subDomain, deviceId, hid, masterDid, err)
 			return err
 		}
+		// replace into return 2 affected rows if the device info already exist
+		var affect int64
+		affect, err = result.RowsAffected()
+		if err != nil {
+			log.Errorf("get affected rows failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+			return err
+		}
+		event := HISTORY_BIND
+		if affect > 1 {
+			event = HISTORY_REBIND
+		}
+		_, err = tx.Stmt(stmt6).Exec(subDomain, deviceId, did, event, hid, getMasterDid(masterDid, did), uid)
+		if err != nil {
+			log.Errorf("insert binding history failed:domain[%s], device[%s:%s], did[%d], err[%v]", domain, subDomain, deviceId, did, err)
+			return err
+		}
+		if transfer {
+			_, err = tx.Stmt(stmt3).Exec(did)
+			if err != nil {
+				log.Errorf("delete transfer failed:domain[%s], device[%s:%s], did[%d], err[%v]", domain, subDomain, deviceId, did, err)
+				return err
+			}
+			_, err = tx.Stmt(stmt4).Exec(did)
+			if err != nil {
+				log.Errorf("clean bind token failed:domain[%s], device[%s:%s], did[%d], err[%v]", domain, subDomain, deviceId, did, err)
+				return err
+			}
+			_, err = tx.Stmt(stmt5).Exec(hid, did)
+			if err != nil {
+				log.Errorf("move slave devices failed:domain[%s], device[%s:%s], did[%d], hid[%d], err[%v]",
+					domain, subDomain, deviceId, did, hid, err)
+				return err
+			}
+			_, err = tx.Stmt(stmt7).Exec(did, did)
+			if err != nil {
+				log.Errorf("delete shadow failed:domain[%s], device[%s:%s], did[%d], err[%v]", domain, subDomain, deviceId, did, err)
+				return err
+			}
+			_, err = tx.Stmt(stmt8).Exec(did, did)
+			if err != nil {
+				log.Errorf("delete commands failed:domain[%s], device[%s:%s], did[%d], err[%v]", domain, subDomain, deviceId, did, err)
+				return err
+			}
+		}
+		// check the home devices and master slaves quota after binding
+		err = checkQuota(tx, domain, QUOTA_DEVICES, hid, quota.GetDevices())
+		if err != nil {
+			return err
+		}
+		if masterDid > 0 {
+			err = checkQuota(tx, domain, QUOTA_SLAVES, masterDid, quota.GetSlaves())
+			if err != nil {
+				return err
+			}
+		}
 		newErr := tx.Commit()
 		if newErr != nil {
 			log.Errorf("commit failed:domain[%s], device[%s:%s], hid[%d], masterDid[%d], err[%v]",
@@ -214,6 +569,304 @@ func (this *BindingProxy) BindingDevice(domain, subDomain, deviceId, deviceName
 			domain, subDomain, deviceId, did, deviceName, hid, masterDid)
 		return nil
 	}()
+	if err != nil {
+		return false, err
+	}
+	return transfer, nil
+}
+
+// binding all the slave devices to the master in one transaction, set the did of every entry
+func (this *BindingProxy) BatchBindingDevices(uid int64, domain string, hid, masterDid int64, entries []*BindingEntry) (err error) {
+	SQL1 := fmt.Sprintf("SELECT did FROM %s_device_mapping WHERE sub_domain = ? AND device_id = ?", domain)
+	stmt1, err := this.store.db.Prepare(SQL1)
+	if err != nil {
+		log.Errorf("prepare query mapping failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return err
+	}
+	defer stmt1.Close()
+	SQL2 := fmt.Sprintf("INSERT INTO %s_device_mapping(sub_domain, device_id) VALUES(?,?)", domain)
+	stmt2, err := this.store.db.Prepare(SQL2)
+	if err != nil {
+		log.Errorf("prepare insert mapping failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return err
+	}
+	defer stmt2.Close()
+	SQL3 := fmt.Sprintf("REPLACE INTO %s_device_info(did, hid, name, status, master_did, room_id) VALUES(?, ?, ?, ?, ?, ?)", domain)
+	stmt3, err := this.store.db.Prepare(SQL3)
+	if err != nil {
+		log.Errorf("prepare replace device info failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return err
+	}
+	defer stmt3.Close()
+	stmt4, err := this.store.db.Prepare(insertHistorySQL(domain))
+	if err != nil {
+		log.Errorf("prepare insert history failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return err
+	}
+	defer stmt4.Close()
+	quota, err := NewQuotaManager(this.store).Get(domain)
+	if err != nil {
+		log.Warningf("get domain quota failed:domain[%s], err[%v]", domain, err)
+		return err
+	}
+
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return err
+	}
+	defer rollback(&err, tx)
+	err = lockHome(tx, domain, hid)
+	if err != nil {
+		return err
+	}
+	var result sql.Result
+	var affect int64
+	for _, entry := range entries {
+		var did, room int64
+		err = tx.Stmt(stmt1).QueryRow(entry.subDomain, entry.deviceId).Scan(&did)
+		if err == sql.ErrNoRows {
+			result, err = tx.Stmt(stmt2).Exec(entry.subDomain, entry.deviceId)
+			if err != nil {
+				log.Errorf("insert mapping failed:domain[%s], device[%s:%s], err[%v]", domain, entry.subDomain, entry.deviceId, err)
+				return err
+			}
+			did, err = result.LastInsertId()
+		} else if err == nil {
+			// the transferred device must be binded one by one
+			var transfer bool
+			transfer, err = lockRebinding(tx, domain, did, hid, "")
+			if err == nil && transfer {
+				err = ErrBindedByOtherHome
+			} else if err == nil {
+				room, err = getBindingRoom(tx, domain, did, hid)
+			}
+		}
+		if err != nil {
+			log.Errorf("get device did failed:domain[%s], device[%s:%s], err[%v]", domain, entry.subDomain, entry.deviceId, err)
+			return err
+		}
+		result, err = tx.Stmt(stmt3).Exec(did, hid, entry.deviceName, ACTIVE, masterDid, room)
+		if err != nil {
+			log.Errorf("replace device info failed:domain[%s], device[%s:%s], hid[%d], masterDid[%d], err[%v]",
+				domain, entry.subDomain, entry.deviceId, hid, masterDid, err)
+			return err
+		}
+		affect, err = result.RowsAffected()
+		if err != nil {
+			log.Errorf("get affected rows failed:domain[%s], device[%s:%s], err[%v]", domain, entry.subDomain, entry.deviceId, err)
+			return err
+		}
+		event := HISTORY_BIND
+		if affect > 1 {
+			event = HISTORY_REBIND
+		}
+		_, err = tx.Stmt(stmt4).Exec(entry.subDomain, entry.deviceId, did, event, hid, masterDid, uid)
+		if err != nil {
+			log.Errorf("insert binding history failed:domain[%s], device[%s:%s], did[%d], err[%v]",
+				domain, entry.subDomain, entry.deviceId, did, err)
+			return err
+		}
+		entry.did = did
+	}
+	err = checkQuota(tx, domain, QUOTA_DEVICES, hid, quota.GetDevices())
+	if err != nil {
+		return err
+	}
+	err = checkQuota(tx, domain, QUOTA_SLAVES, masterDid, quota.GetSlaves())
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], hid[%d], masterDid[%d], err[%v]", domain, hid, masterDid, err)
+		for _, entry := range entries {
+			entry.did = -1
+		}
+		return err
+	}
+	log.Infof("batch binding devices succ:domain[%s], hid[%d], masterDid[%d], count[%d]", domain, hid, masterDid, len(entries))
+	return nil
+}
+
+// replace the old master device with a new master device in one transaction, the new master
+// inherit the old device info and all the slave devices, return the new did and the moved slaves
+func (this *BindingProxy) ReplaceMasterDevice(uid int64, domain string, old *DeviceInfo, newDid int64, subDomain, deviceId string) (int64, []int64, error) {
+	var err error
+	var stmt1 *sql.Stmt
+	if newDid <= 0 {
+		SQL1 := fmt.Sprintf("INSERT INTO %s_device_mapping(sub_domain, device_id) VALUES(?,?)", domain)
+		stmt1, err = this.store.db.Prepare(SQL1)
+		if err != nil {
+			log.Errorf("prepare insert mapping failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+			return -1, nil, err
+		}
+		defer stmt1.Close()
+	}
+	SQL2 := fmt.Sprintf("INSERT INTO %s_device_info(did, hid, name, status, master_did, room_id) VALUES(?, ?, ?, ?, ?, ?)", domain)
+	stmt2, err := this.store.db.Prepare(SQL2)
+	if err != nil {
+		log.Errorf("prepare insert device info failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return -1, nil, err
+	}
+	defer stmt2.Close()
+	SQL3 := fmt.Sprintf("SELECT did FROM %s_device_info WHERE master_did = ? AND did != master_did FOR UPDATE", domain)
+	stmt3, err := this.store.db.Prepare(SQL3)
+	if err != nil {
+		log.Errorf("prepare query slave devices failed:domain[%s], did[%d], err[%v]", domain, old.did, err)
+		return -1, nil, err
+	}
+	defer stmt3.Close()
+	SQL4 := fmt.Sprintf("UPDATE %s_device_info SET master_did = ? WHERE master_did = ? AND did != master_did", domain)
+	stmt4, err := this.store.db.Prepare(SQL4)
+	if err != nil {
+		log.Errorf("prepare move slave devices failed:domain[%s], did[%d], err[%v]", domain, old.did, err)
+		return -1, nil, err
+	}
+	defer stmt4.Close()
+	SQL5 := fmt.Sprintf("DELETE FROM %s_device_info WHERE did = ?", domain)
+	stmt5, err := this.store.db.Prepare(SQL5)
+	if err != nil {
+		log.Errorf("prepare delete old master failed:domain[%s], did[%d], err[%v]", domain, old.did, err)
+		return -1, nil, err
+	}
+	defer stmt5.Close()
+	stmt6, err := this.store.db.Prepare(copyHistorySQL(domain, "i.did = ?"))
+	if err != nil {
+		log.Errorf("prepare insert history failed:domain[%s], did[%d], err[%v]", domain, old.did, err)
+		return -1, nil, err
+	}
+	defer stmt6.Close()
+	SQL7 := fmt.Sprintf("DELETE FROM %s_device_shadow WHERE did = ?", domain)
+	stmt7, err := this.store.db.Prepare(SQL7)
+	if err != nil {
+		log.Errorf("prepare delete old master shadow failed:domain[%s], did[%d], err[%v]", domain, old.did, err)
+		return -1, nil, err
+	}
+	defer stmt7.Close()
+	// the old gateway can be binded as a new device after replaced
+	SQL8 := fmt.Sprintf("DELETE FROM %s_device_mapping WHERE did = ?", domain)
+	stmt8, err := this.store.db.Prepare(SQL8)
+	if err != nil {
+		log.Errorf("prepare delete old master mapping failed:domain[%s], did[%d], err[%v]", domain, old.did, err)
+		return -1, nil, err
+	}
+	defer stmt8.Close()
+	SQL9 := fmt.Sprintf("DELETE FROM %s_device_presence WHERE did = ?", domain)
+	stmt9, err := this.store.db.Prepare(SQL9)
+	if err != nil {
+		log.Errorf("prepare delete old master presence failed:domain[%s], did[%d], err[%v]", domain, old.did, err)
+		return -1, nil, err
+	}
+	defer stmt9.Close()
+	// the queued commands through the old master deleted
+	SQL10 := fmt.Sprintf("DELETE FROM %s_device_command WHERE master_did = ?", domain)
+	stmt10, err := this.store.db.Prepare(SQL10)
+	if err != nil {
+		log.Errorf("prepare delete old master commands failed:domain[%s], did[%d], err[%v]", domain, old.did, err)
+		return -1, nil, err
+	}
+	defer stmt10.Close()
+	if this.cacheOn {
+		this.cache.Delete(domain, old.did)
+	}
+
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], did[%d], err[%v]", domain, old.did, err)
+		return -1, nil, err
+	}
+	defer rollback(&err, tx)
+	if newDid <= 0 {
+		var result sql.Result
+		result, err = tx.Stmt(stmt1).Exec(subDomain, deviceId)
+		if err != nil {
+			log.Errorf("insert mapping failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+			return -1, nil, err
+		}
+		newDid, err = result.LastInsertId()
+		if err != nil {
+			log.Errorf("get insert id failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+			return -1, nil, err
+		}
+	}
+	_, err = tx.Stmt(stmt2).Exec(newDid, old.hid, old.deviceName, old.status, newDid, old.roomId)
+	if err != nil {
+		log.Errorf("insert new master failed:domain[%s], did[%d], hid[%d], err[%v]", domain, newDid, old.hid, err)
+		return -1, nil, err
+	}
+	rows, err := tx.Stmt(stmt3).Query(old.did)
+	if err != nil {
+		log.Errorf("query slave devices failed:domain[%s], did[%d], err[%v]", domain, old.did, err)
+		return -1, nil, err
+	}
+	var did int64
+	slaves := make([]int64, 0)
+	for rows.Next() {
+		err = rows.Scan(&did)
+		if err != nil {
+			rows.Close()
+			log.Errorf("parse slave did failed:domain[%s], did[%d], err[%v]", domain, old.did, err)
+			return -1, nil, err
+		}
+		slaves = append(slaves, did)
+	}
+	rows.Close()
+	_, err = tx.Stmt(stmt4).Exec(newDid, old.did)
+	if err != nil {
+		log.Errorf("move slave devices failed:domain[%s], old[%d], new[%d], err[%v]", domain, old.did, newDid, err)
+		return -1, nil, err
+	}
+	_, err = tx.Stmt(stmt6).Exec(HISTORY_UNBIND, uid, old.did)
+	if err != nil {
+		log.Errorf("insert unbind history failed:domain[%s], did[%d], err[%v]", domain, old.did, err)
+		return -1, nil, err
+	}
+	_, err = tx.Stmt(stmt5).Exec(old.did)
+	if err != nil {
+		log.Errorf("delete old master failed:domain[%s], did[%d], err[%v]", domain, old.did, err)
+		return -1, nil, err
+	}
+	_, err = tx.Stmt(stmt7).Exec(old.did)
+	if err != nil {
+		log.Errorf("delete old master shadow failed:domain[%s], did[%d], err[%v]", domain, old.did, err)
+		return -1, nil, err
+	}
+	_, err = tx.Stmt(stmt8).Exec(old.did)
+	if err != nil {
+		log.Errorf("delete old master mapping failed:domain[%s], did[%d], err[%v]", domain, old.did, err)
+		return -1, nil, err
+	}
+	_, err = tx.Stmt(stmt9).Exec(old.did)
+	if err != nil {
+		log.Errorf("delete old master presence failed:domain[%s], did[%d], err[%v]", domain, old.did, err)
+		return -1, nil, err
+	}
+	_, err = tx.Stmt(stmt10).Exec(old.did)
+	if err != nil {
+		log.Errorf("delete old master commands failed:domain[%s], did[%d], err[%v]", domain, old.did, err)
+		return -1, nil, err
+	}
+	_, err = tx.Stmt(stmt6).Exec(HISTORY_CHANGE, uid, newDid)
+	if err != nil {
+		log.Errorf("insert change history failed:domain[%s], did[%d], err[%v]", domain, newDid, err)
+		return -1, nil, err
+	}
+	for _, did := range slaves {
+		_, err = tx.Stmt(stmt6).Exec(HISTORY_MOVE, uid, did)
+		if err != nil {
+			log.Errorf("insert move history failed:domain[%s], did[%d], err[%v]", domain, did, err)
+			return -1, nil, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], old[%d], new[%d], err[%v]", domain, old.did, newDid, err)
+		return -1, nil, err
+	}
+	log.Infof("replace master device succ:domain[%s], old[%d], new[%d], device[%s:%s], slaves[%d]",
+		domain, old.did, newDid, subDomain, deviceId, len(slaves))
+	return newDid, slaves, nil
 }
 
 //////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,89 @@
+package device
+
+import (
+	"time"
+	"zc-common-go/mysql"
+)
+
+// device command status
+const (
+	COMMAND_PENDING   = 1
+	COMMAND_DELIVERED = 2
+	COMMAND_ACKED     = 3
+	COMMAND_FAILED    = 4
+	COMMAND_EXPIRED   = 5
+)
+
+const (
+	// the default and max ttl of the queued command
+	DEFAULT_COMMAND_TTL = time.Hour
+	MAX_COMMAND_TTL     = 24 * time.Hour
+	// the delivered command fetched again if not acked in the timeout
+	COMMAND_ACK_TIMEOUT = time.Minute
+	// the command failed after max delivery attempts
+	MAX_COMMAND_ATTEMPTS = 3
+	// max pending commands of one master device
+	MAX_PENDING_COMMANDS = 128
+	// max commands of one fetch
+	MAX_FETCH_COMMANDS = 32
+	// max length of the command payload
+	MAX_COMMAND_PAYLOAD_LEN = 4096
+)
+
+// the command of the user queued for the device, delivered to its master device when
+// the master fetched the queue after reconnected
+type DeviceCommand struct {
+	id         int64
+	hid        int64
+	masterDid  int64
+	did        int64
+	uid        int64
+	payload    string
+	status     int8
+	attempts   int
+	expireTime mysql.NullTime
+	createTime mysql.NullTime
+}
+
+func (this *DeviceCommand) GetId() int64 {
+	return this.id
+}
+
+func (this *DeviceCommand) GetHid() int64 {
+	return this.hid
+}
+
+func (this *DeviceCommand) GetMasterDid() int64 {
+	return this.masterDid
+}
+
+// the target device of the command
+func (this *DeviceCommand) GetDid() int64 {
+	return this.did
+}
+
+// the user who sent the command
+func (this *DeviceCommand) GetUid() int64 {
+	return this.uid
+}
+
+func (this *DeviceCommand) GetPayload() string {
+	return this.payload
+}
+
+func (this *DeviceCommand) GetStatus() int8 {
+	return this.status
+}
+
+// the delivery attempts count
+func (this *DeviceCommand) GetAttempts() int {
+	return this.attempts
+}
+
+func (this *DeviceCommand) GetExpireTime() time.Time {
+	return this.expireTime.Time
+}
+
+func (this *DeviceCommand) GetCreateTime() time.Time {
+	return this.createTime.Time
+}
@@ -0,0 +1,330 @@
+package device
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+	"zc-common-go/common"
+	log "zc-common-go/glog"
+	_ "zc-common-go/mysql"
+)
+
+type CommandManager struct {
+	store  *DeviceStorage
+	router *AccessRouter
+}
+
+func NewCommandManager(store *DeviceStorage) *CommandManager {
+	return &CommandManager{store: store, router: NewAccessRouter(store)}
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// public interface
+////////////////////////////////////////////////////////////////////////////////////
+// queue the command of the user to the device until its master fetched, the user must
+// pass the same access check of the access router, the default ttl used if zero
+func (this *CommandManager) Enqueue(uid int64, domain string, did int64, payload string, ttl time.Duration) (int64, error) {
+	common.CheckParam(this.store != nil && this.router != nil)
+	if ttl == 0 {
+		ttl = DEFAULT_COMMAND_TTL
+	}
+	if len(payload) == 0 || len(payload) > MAX_COMMAND_PAYLOAD_LEN || ttl < time.Second || ttl > MAX_COMMAND_TTL {
+		log.Warningf("check the command failed:domain[%s], did[%d], uid[%d], len[%d], ttl[%v]", domain, did, uid, len(payload), ttl)
+		return -1, common.ErrInvalidParam
+	}
+	device, _, _, err := this.router.checkAccess(newAccessCache(uid), domain, did)
+	if err != nil {
+		log.Warningf("check the device access failed:domain[%s], did[%d], uid[%d], err[%v]", domain, did, uid, err)
+		return -1, err
+	}
+	id, err := this.insertCommand(domain, device, uid, payload, ttl)
+	if err != nil {
+		log.Warningf("insert command failed:domain[%s], did[%d], uid[%d], err[%v]", domain, did, uid, err)
+		return -1, err
+	}
+	return id, nil
+}
+
+// fetch the pending commands and the delivered commands not acked in time by the master device,
+// the expired commands, the commands of the users who lost the access and the commands queued
+// before the device moved to other home or master are not delivered, the commands locked in one
+// transaction so the concurrent fetches never deliver the same command
+func (this *CommandManager) Fetch(domain, subDomain, deviceId string, limit int) (commands []DeviceCommand, err error) {
+	common.CheckParam(this.store != nil && this.router != nil)
+	if limit <= 0 || limit > MAX_FETCH_COMMANDS {
+		limit = MAX_FETCH_COMMANDS
+	}
+	master, err := NewDeviceManager(this.store).getMappedMaster(domain, subDomain, deviceId)
+	if err != nil {
+		return nil, err
+	} else if master.GetStatus() != ACTIVE {
+		log.Warningf("the master device not active:domain[%s], did[%d]", domain, master.GetDid())
+		return nil, ErrDeviceNotActive
+	}
+	masterDid := master.GetDid()
+	err = this.expireCommands(domain, masterDid)
+	if err != nil {
+		log.Warningf("expire commands failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return nil, err
+	}
+
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return nil, err
+	}
+	defer rollback(&err, tx)
+	list, err := getDeliverableCommands(tx, domain, masterDid, limit)
+	if err != nil {
+		log.Warningf("get deliverable commands failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return nil, err
+	}
+	caches := make(map[int64]*accessCache)
+	commands = make([]DeviceCommand, 0, len(list))
+	for _, command := range list {
+		cache, ok := caches[command.uid]
+		if !ok {
+			cache = newAccessCache(command.uid)
+			caches[command.uid] = cache
+		}
+		status := int8(COMMAND_DELIVERED)
+		if device, _, _, err := this.router.checkAccess(cache, domain, command.did); err != nil {
+			log.Warningf("the command user lost access:domain[%s], id[%d], uid[%d], err[%v]", domain, command.id, command.uid, err)
+			status = COMMAND_FAILED
+		} else if device.GetHid() != command.hid || device.GetMasterDid() != masterDid {
+			log.Warningf("the command device moved:domain[%s], id[%d], hid[%d], current[%d], master[%d]",
+				domain, command.id, command.hid, device.GetHid(), device.GetMasterDid())
+			status = COMMAND_FAILED
+		}
+		err = deliverCommand(tx, domain, masterDid, command.id, status)
+		if err != nil {
+			log.Warningf("deliver command failed:domain[%s], master[%d], id[%d], err[%v]", domain, masterDid, command.id, err)
+			return nil, err
+		}
+		if status == COMMAND_DELIVERED {
+			command.status = status
+			command.attempts++
+			commands = append(commands, command)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return nil, err
+	}
+	return commands, nil
+}
+
+// the master device executed the delivered command
+func (this *CommandManager) Ack(domain, subDomain, deviceId string, id int64) error {
+	common.CheckParam(this.store != nil)
+	return this.finish(domain, subDomain, deviceId, id, true)
+}
+
+// the master device failed to execute the delivered command, it will be delivered
+// again until the max attempts
+func (this *CommandManager) Nack(domain, subDomain, deviceId string, id int64) error {
+	common.CheckParam(this.store != nil)
+	return this.finish(domain, subDomain, deviceId, id, false)
+}
+
+func (this *CommandManager) finish(domain, subDomain, deviceId string, id int64, ack bool) error {
+	master, err := NewDeviceManager(this.store).getMappedMaster(domain, subDomain, deviceId)
+	if err != nil {
+		return err
+	}
+	err = this.finishCommand(domain, master.GetDid(), id, ack)
+	if err != nil {
+		log.Warningf("finish command failed:domain[%s], master[%d], id[%d], ack[%t], err[%v]", domain, master.GetDid(), id, ack, err)
+		return err
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// database related private interface
+////////////////////////////////////////////////////////////////////////////////////
+// insert the command and check the master pending commands count in a transaction
+func (this *CommandManager) insertCommand(domain string, device *DeviceInfo, uid int64, payload string, ttl time.Duration) (id int64, err error) {
+	hid := device.GetHid()
+	masterDid := device.GetMasterDid()
+	SQL1 := fmt.Sprintf("INSERT INTO %s_device_command(hid, master_did, did, uid, payload, status, attempts, expire_time, create_time, modify_time) VALUES(?,?,?,?,?,?,0,DATE_ADD(NOW(), INTERVAL ? SECOND),NOW(),NOW())", domain)
+	stmt1, err := this.store.db.Prepare(SQL1)
+	if err != nil {
+		log.Errorf("prepare insert command failed:domain[%s], did[%d], err[%v]", domain, device.GetDid(), err)
+		return -1, err
+	}
+	defer stmt1.Close()
+	SQL2 := fmt.Sprintf("SELECT COUNT(*) FROM %s_device_command WHERE master_did = ? AND status IN (%d, %d) AND expire_time > NOW()",
+		domain, COMMAND_PENDING, COMMAND_DELIVERED)
+	stmt2, err := this.store.db.Prepare(SQL2)
+	if err != nil {
+		log.Errorf("prepare count command failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return -1, err
+	}
+	defer stmt2.Close()
+
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], did[%d], err[%v]", domain, device.GetDid(), err)
+		return -1, err
+	}
+	defer rollback(&err, tx)
+	err = lockHome(tx, domain, hid)
+	if err != nil {
+		return -1, err
+	}
+	var count int64
+	err = tx.Stmt(stmt2).QueryRow(masterDid).Scan(&count)
+	if err != nil {
+		log.Errorf("count command failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return -1, err
+	} else if count >= MAX_PENDING_COMMANDS {
+		log.Warningf("check the pending commands count failed:domain[%s], master[%d], count[%d]", domain, masterDid, count)
+		err = ErrQuotaExceeded
+		return -1, err
+	}
+	result, err := tx.Stmt(stmt1).Exec(hid, masterDid, device.GetDid(), uid, payload, COMMAND_PENDING, int64(ttl.Seconds()))
+	if err != nil {
+		log.Errorf("insert command failed:domain[%s], did[%d], uid[%d], err[%v]", domain, device.GetDid(), uid, err)
+		return -1, err
+	}
+	id, err = result.LastInsertId()
+	if err != nil {
+		log.Errorf("get insert id failed:domain[%s], did[%d], err[%v]", domain, device.GetDid(), err)
+		return -1, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], did[%d], err[%v]", domain, device.GetDid(), err)
+		return -1, err
+	}
+	return id, nil
+}
+
+// lock the pending commands and the delivered commands not acked in the timeout under the
+// max attempts in the transaction, the oldest first
+func getDeliverableCommands(tx *sql.Tx, domain string, masterDid int64, limit int) ([]DeviceCommand, error) {
+	SQL := fmt.Sprintf("SELECT id, hid, master_did, did, uid, payload, status, attempts, expire_time, create_time FROM %s_device_command "+
+		"WHERE master_did = ? AND expire_time > NOW() AND (status = %d OR (status = %d AND attempts < %d AND "+
+		"modify_time <= DATE_SUB(NOW(), INTERVAL ? SECOND))) ORDER BY id LIMIT ? FOR UPDATE",
+		domain, COMMAND_PENDING, COMMAND_DELIVERED, MAX_COMMAND_ATTEMPTS)
+	rows, err := tx.Query(SQL, masterDid, int64(COMMAND_ACK_TIMEOUT.Seconds()), limit)
+	if err != nil {
+		log.Errorf("query commands failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var command DeviceCommand
+	list := make([]DeviceCommand, 0)
+	for rows.Next() {
+		err = rows.Scan(&command.id, &command.hid, &command.masterDid, &command.did, &command.uid, &command.payload,
+			&command.status, &command.attempts, &command.expireTime, &command.createTime)
+		if err != nil {
+			log.Errorf("parse the command failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+			return nil, err
+		}
+		list = append(list, command)
+	}
+	return list, nil
+}
+
+// mark the locked command delivered and increase the attempts, or failed if the user lost the access
+func deliverCommand(tx *sql.Tx, domain string, masterDid, id int64, status int8) error {
+	SQL := fmt.Sprintf("UPDATE %s_device_command SET status = ?, attempts = attempts + 1, modify_time = NOW() WHERE id = ? AND master_did = ?", domain)
+	_, err := tx.Exec(SQL, status, id, masterDid)
+	if err != nil {
+		log.Errorf("update command failed:domain[%s], id[%d], status[%d], err[%v]", domain, id, status, err)
+		return err
+	}
+	return nil
+}
+
+// the acked command finished, the nacked command pending again or failed after max attempts
+func (this *CommandManager) finishCommand(domain string, masterDid, id int64, ack bool) error {
+	var SQL string
+	if ack {
+		SQL = fmt.Sprintf("UPDATE %s_device_command SET status = %d, modify_time = NOW() WHERE id = ? AND master_did = ? AND status = %d",
+			domain, COMMAND_ACKED, COMMAND_DELIVERED)
+	} else {
+		SQL = fmt.Sprintf("UPDATE %s_device_command SET status = IF(attempts >= %d, %d, %d), modify_time = NOW() WHERE id = ? AND master_did = ? AND status = %d",
+			domain, MAX_COMMAND_ATTEMPTS, COMMAND_FAILED, COMMAND_PENDING, COMMAND_DELIVERED)
+	}
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare update command failed:domain[%s], id[%d], err[%v]", domain, id, err)
+		return err
+	}
+	defer stmt.Close()
+	result, err := stmt.Exec(id, masterDid)
+	if err != nil {
+		log.Errorf("update command failed:domain[%s], id[%d], err[%v]", domain, id, err)
+		return err
+	}
+	affect, err := result.RowsAffected()
+	if err != nil {
+		log.Warningf("get affected rows failed:err[%v]", err)
+		return err
+	} else if affect != 1 {
+		log.Warningf("the delivered command not exist:domain[%s], master[%d], id[%d]", domain, masterDid, id)
+		return common.ErrEntryNotExist
+	}
+	return nil
+}
+
+// mark the unfinished commands expired, the delivered commands not acked in the timeout after
+// the max attempts failed, and delete the finished commands older than the max ttl
+func (this *CommandManager) expireCommands(domain string, masterDid int64) (err error) {
+	SQL1 := fmt.Sprintf("UPDATE %s_device_command SET status = %d, modify_time = NOW() WHERE master_did = ? AND status IN (%d, %d) AND expire_time <= NOW()",
+		domain, COMMAND_EXPIRED, COMMAND_PENDING, COMMAND_DELIVERED)
+	stmt1, err := this.store.db.Prepare(SQL1)
+	if err != nil {
+		log.Errorf("prepare expire commands failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return err
+	}
+	defer stmt1.Close()
+	SQL3 := fmt.Sprintf("UPDATE %s_device_command SET status = %d, modify_time = NOW() WHERE master_did = ? AND status = %d AND attempts >= %d "+
+		"AND modify_time <= DATE_SUB(NOW(), INTERVAL ? SECOND)", domain, COMMAND_FAILED, COMMAND_DELIVERED, MAX_COMMAND_ATTEMPTS)
+	stmt3, err := this.store.db.Prepare(SQL3)
+	if err != nil {
+		log.Errorf("prepare fail commands failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return err
+	}
+	defer stmt3.Close()
+	SQL2 := fmt.Sprintf("DELETE FROM %s_device_command WHERE master_did = ? AND status NOT IN (%d, %d) AND modify_time <= DATE_SUB(NOW(), INTERVAL ? SECOND)",
+		domain, COMMAND_PENDING, COMMAND_DELIVERED)
+	stmt2, err := this.store.db.Prepare(SQL2)
+	if err != nil {
+		log.Errorf("prepare delete commands failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return err
+	}
+	defer stmt2.Close()
+
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return err
+	}
+	defer rollback(&err, tx)
+	_, err = tx.Stmt(stmt1).Exec(masterDid)
+	if err != nil {
+		log.Errorf("expire commands failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return err
+	}
+	_, err = tx.Stmt(stmt3).Exec(masterDid, int64(COMMAND_ACK_TIMEOUT.Seconds()))
+	if err != nil {
+		log.Errorf("fail the max attempts commands failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return err
+	}
+	_, err = tx.Stmt(stmt2).Exec(masterDid, int64(MAX_COMMAND_TTL.Seconds()))
+	if err != nil {
+		log.Errorf("delete finished commands failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return err
+	}
+	return nil
+}
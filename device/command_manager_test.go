@@ -0,0 +1,120 @@
+package device
+
+import (
+	"testing"
+	"time"
+	"zc-common-go/common"
+)
+
+func TestDeviceCommand(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	prepare(store)
+	home := NewHomeManager(store)
+	var uid int64 = 100
+	list, err := home.GetAllHome(domain, uid)
+	if err != nil || len(list) != 5 {
+		t.Errorf("get user all home failed:err[%v], len[%d]", err, len(list))
+	}
+	hid := list[0].hid
+	device := NewDeviceManager(store)
+	devList, err := device.GetAllDevices(domain, hid)
+	if err != nil || len(devList) != 8 {
+		t.Errorf("get all devices failed:err[%v], len[%d]", err, len(devList))
+	}
+	var slave *DeviceInfo
+	for i := range devList {
+		if !devList[i].IsMasterDevice() {
+			slave = &devList[i]
+			break
+		}
+	}
+	mapping := NewBindingManager(store)
+	bind, err := mapping.Get(domain, slave.GetMasterDid())
+	if err != nil || bind == nil {
+		t.Fatal("get master binding failed", err)
+	}
+	manager := NewCommandManager(store)
+	// the invalid command and the user not member
+	_, err = manager.Enqueue(uid, domain, slave.did, "", 0)
+	if err != common.ErrInvalidParam {
+		t.Error("enqueue empty command succ", err)
+	}
+	_, err = manager.Enqueue(uid, domain, slave.did, "on", 2*MAX_COMMAND_TTL)
+	if err != common.ErrInvalidParam {
+		t.Error("enqueue invalid ttl command succ", err)
+	}
+	_, err = manager.Enqueue(10000000, domain, slave.did, "on", 0)
+	if err != ErrNotHomeMember {
+		t.Error("enqueue command by not member succ", err)
+	}
+	first, err := manager.Enqueue(uid, domain, slave.did, "on", 0)
+	if err != nil {
+		t.Fatal("enqueue command failed", err)
+	}
+	second, err := manager.Enqueue(uid, domain, slave.did, "off", time.Minute)
+	if err != nil {
+		t.Fatal("enqueue command failed", err)
+	}
+	// the slave can not fetch the commands
+	slaveBind, err := mapping.Get(domain, slave.did)
+	if err != nil || slaveBind == nil {
+		t.Fatal("get slave binding failed", err)
+	}
+	_, err = manager.Fetch(domain, slaveBind.subDomain, slaveBind.deviceId, 0)
+	if err != common.ErrInvalidDevice {
+		t.Error("slave fetch commands succ", err)
+	}
+	commands, err := manager.Fetch(domain, bind.subDomain, bind.deviceId, 0)
+	if err != nil || len(commands) != 2 {
+		t.Fatalf("fetch commands failed:err[%v], len[%d]", err, len(commands))
+	} else if commands[0].GetId() != first || commands[0].GetPayload() != "on" || commands[0].GetDid() != slave.did ||
+		commands[0].GetAttempts() != 1 {
+		t.Error("check command failed", commands[0])
+	}
+	// the delivered commands not fetched again before the ack timeout
+	commands, err = manager.Fetch(domain, bind.subDomain, bind.deviceId, 0)
+	if err != nil || len(commands) != 0 {
+		t.Errorf("fetch delivered commands failed:err[%v], len[%d]", err, len(commands))
+	}
+	err = manager.Ack(domain, bind.subDomain, bind.deviceId, first)
+	if err != nil {
+		t.Error("ack command failed", err)
+	}
+	err = manager.Ack(domain, bind.subDomain, bind.deviceId, first)
+	if err != common.ErrEntryNotExist {
+		t.Error("ack command again succ", err)
+	}
+	// the nacked command delivered again
+	err = manager.Nack(domain, bind.subDomain, bind.deviceId, second)
+	if err != nil {
+		t.Error("nack command failed", err)
+	}
+	commands, err = manager.Fetch(domain, bind.subDomain, bind.deviceId, 0)
+	if err != nil || len(commands) != 1 || commands[0].GetId() != second || commands[0].GetAttempts() != 2 {
+		t.Errorf("fetch nacked command failed:err[%v], len[%d]", err, len(commands))
+	}
+	// the command of the frozen member not delivered
+	var guest int64 = 200
+	member := NewMemberManager(store)
+	err = member.AddMember(domain, hid, guest, "guest")
+	if err != nil {
+		t.Error("add member failed", err)
+	}
+	_, err = manager.Enqueue(guest, domain, slave.did, "on", 0)
+	if err != nil {
+		t.Error("enqueue member command failed", err)
+	}
+	err = member.Disable(domain, hid, guest)
+	if err != nil {
+		t.Error("disable member failed", err)
+	}
+	commands, err = manager.Fetch(domain, bind.subDomain, bind.deviceId, 0)
+	if err != nil || len(commands) != 0 {
+		t.Errorf("fetch frozen member command failed:err[%v], len[%d]", err, len(commands))
+	}
+	cleanAll(store)
+}
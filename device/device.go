@@ -62,6 +62,37 @@ func NewBindingInfo() *BindingInfo {
 	return &BindingInfo{did: -1}
 }
 
+// one slave device of the batch binding request, did and err set by the binding result
+type BindingEntry struct {
+	subDomain  string
+	deviceId   string
+	deviceName string
+	did        int64
+	err        error
+}
+
+func NewBindingEntry(subDomain, deviceId, deviceName string) *BindingEntry {
+	return &BindingEntry{subDomain: subDomain, deviceId: deviceId, deviceName: deviceName, did: -1}
+}
+
+func (this *BindingEntry) GetSubDomain() string {
+	return this.subDomain
+}
+
+func (this *BindingEntry) GetDeviceId() string {
+	return this.deviceId
+}
+
+// the binded device did, -1 if binding failed
+func (this *BindingEntry) GetDid() int64 {
+	return this.did
+}
+
+// the binding failed reason, nil if succ
+func (this *BindingEntry) GetError() error {
+	return this.err
+}
+
 // if masterDid = did, it is master device, else it's normal device
 type DeviceInfo struct {
 	did        int64
@@ -69,6 +100,7 @@ type DeviceInfo struct {
 	deviceName string
 	status     int8
 	masterDid  int64
+	roomId     int64
 }
 
 // default invalid device info
@@ -101,10 +133,21 @@ func (this *DeviceInfo) IsMasterDevice() bool {
 	return this.masterDid == this.did
 }
 
+// the master did of the device, 0 if the slave device detached from the master
 func (this *DeviceInfo) GetMasterDid() int64 {
 	return this.masterDid
 }
 
+// the room of the device in its home, 0 if not assigned to any room
+func (this *DeviceInfo) GetRoomId() int64 {
+	return this.roomId
+}
+
+// slave device detached from the master device
+func (this *DeviceInfo) IsDetached() bool {
+	return this.masterDid <= 0
+}
+
 // whole info
 type Device struct {
 	_ BasicInfo
@@ -12,6 +12,9 @@ type DeviceManager struct {
 	store *DeviceStorage
 }
 
+// default max slave devices count of one master device, configured by the domain quota
+const MAX_SLAVE_COUNT int64 = 64
+
 func NewDeviceManager(store *DeviceStorage) *DeviceManager {
 	return &DeviceManager{store: store}
 }
@@ -38,14 +41,135 @@ func (this *DeviceManager) GetAllDevices(domain string, hid int64) ([]DeviceInfo
 	return this.getAllDevices(domain, hid)
 }
 
-// delete one device from home, if it is master device delete all the related slave devices from the home
-func (this *DeviceManager) DeleteDevice(domain string, hid int64, did int64) error {
-	return this.deleteDeviceInfo(domain, hid, did)
+// get all devices in the room of one home, rid 0 for the devices not assigned to any room
+func (this *DeviceManager) GetRoomDevices(domain string, hid, rid int64) ([]DeviceInfo, error) {
+	return this.getRoomDevices(domain, hid, rid)
+}
+
+// assign the device to the room in the same home, rid 0 for unassigned
+func (this *DeviceManager) ChangeDeviceRoom(domain string, did, rid int64) error {
+	if rid < 0 {
+		log.Warningf("check the room id failed:domain[%s], did[%d], rid[%d]", domain, did, rid)
+		return common.ErrInvalidParam
+	}
+	device, err := this.Get(domain, did)
+	if err != nil {
+		log.Warningf("get device failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	} else if device == nil {
+		log.Warningf("device not exist:domain[%s], did[%d]", domain, did)
+		return common.ErrEntryNotExist
+	}
+	if rid > 0 {
+		roomManager := NewRoomManager(this.store)
+		room, err := roomManager.Get(domain, rid)
+		if err != nil {
+			log.Warningf("get room failed:domain[%s], rid[%d], err[%v]", domain, rid, err)
+			return err
+		} else if room == nil || room.GetHid() != device.GetHid() {
+			log.Warningf("check the room of the device home failed:domain[%s], did[%d], rid[%d]", domain, did, rid)
+			return common.ErrEntryNotExist
+		}
+	}
+	return this.modifyDeviceInfo(false, domain, did, "room_id", rid)
+}
+
+// delete one device from home, if it is master device detach all the related slave devices
+func (this *DeviceManager) DeleteDevice(uid int64, domain string, hid int64, did int64) error {
+	_, err := NewMemberManager(this.store).CheckPermission(domain, hid, uid, PERM_BIND)
+	if err != nil {
+		log.Warningf("check the unbinding permission failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, uid, err)
+		return err
+	}
+	err = this.deleteDeviceInfo(uid, domain, hid, did)
+	if err != nil {
+		return err
+	}
+	// the access grants of the device and its slaves issued before unbinded are revoked
+	return NewRevocationManager(this.store).RevokeDevice(domain, did)
+}
+
+// get all the slave devices of the master device, if no one return empty list not nil
+func (this *DeviceManager) GetAllSlaves(domain string, masterDid int64) ([]DeviceInfo, error) {
+	master, err := this.Get(domain, masterDid)
+	if err != nil {
+		log.Warningf("get master device failed:domain[%s], did[%d], err[%v]", domain, masterDid, err)
+		return nil, err
+	} else if master == nil || !master.IsMasterDevice() {
+		log.Warningf("check the master device failed:domain[%s], did[%d]", domain, masterDid)
+		return nil, common.ErrMasterNotExist
+	}
+	return this.getAllSlaves(domain, masterDid)
+}
+
+// move the slave device to another master device in the same home
+func (this *DeviceManager) MoveSlave(uid int64, domain string, did, masterDid int64) error {
+	slave, err := this.Get(domain, did)
+	if err != nil {
+		log.Warningf("get slave device failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	} else if slave == nil {
+		log.Warningf("slave device not exist:domain[%s], did[%d]", domain, did)
+		return common.ErrEntryNotExist
+	} else if slave.IsMasterDevice() {
+		log.Warningf("check the slave device failed:domain[%s], did[%d]", domain, did)
+		return common.ErrInvalidDevice
+	} else if slave.GetMasterDid() == masterDid {
+		return nil
+	}
+	// both the old and new master must be active in the same home
+	if !slave.IsDetached() {
+		err = this.checkMaster(domain, slave.GetHid(), slave.GetMasterDid())
+		if err != nil {
+			log.Warningf("check the old master failed:domain[%s], did[%d], master[%d], err[%v]",
+				domain, did, slave.GetMasterDid(), err)
+			return err
+		}
+	}
+	err = this.checkMaster(domain, slave.GetHid(), masterDid)
+	if err != nil {
+		log.Warningf("check the new master failed:domain[%s], did[%d], master[%d], err[%v]", domain, did, masterDid, err)
+		return err
+	}
+	err = this.moveSlaveDevice(uid, domain, slave.GetHid(), did, slave.GetMasterDid(), masterDid)
+	if err != nil {
+		return err
+	}
+	// the access grants through the old master are revoked
+	return NewRevocationManager(this.store).RevokeDevice(domain, did)
+}
+
+// detach the slave device from its master, the device still in the home and listed
+// but can not be accessed until moved to another master by MoveSlave
+func (this *DeviceManager) DetachSlave(uid int64, domain string, did int64) error {
+	slave, err := this.Get(domain, did)
+	if err != nil {
+		log.Warningf("get slave device failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	} else if slave == nil {
+		log.Warningf("slave device not exist:domain[%s], did[%d]", domain, did)
+		return common.ErrEntryNotExist
+	} else if slave.IsMasterDevice() {
+		log.Warningf("check the slave device failed:domain[%s], did[%d]", domain, did)
+		return common.ErrInvalidDevice
+	} else if slave.IsDetached() {
+		return nil
+	}
+	err = this.moveSlaveDevice(uid, domain, slave.GetHid(), did, slave.GetMasterDid(), 0)
+	if err != nil {
+		return err
+	}
+	// the access grants through the master are revoked
+	return NewRevocationManager(this.store).RevokeDevice(domain, did)
 }
 
 // delete all devices from one home
-func (this *DeviceManager) DeleteAllDevices(domain string, hid int64) error {
-	return this.deleteAllDevices(domain, hid)
+func (this *DeviceManager) DeleteAllDevices(uid int64, domain string, hid int64) error {
+	err := this.deleteAllDevices(uid, domain, hid)
+	if err != nil {
+		return err
+	}
+	return NewRevocationManager(this.store).RevokeHome(domain, hid)
 }
 
 // only change device name
@@ -54,18 +178,47 @@ func (this *DeviceManager) ChangeDeviceName(domain string, did int64, name strin
 }
 
 func (this *DeviceManager) Disable(domain string, did int64) error {
-	return this.modifyDeviceInfo(false, domain, did, "status", FROZEN)
+	err := this.modifyDeviceInfo(false, domain, did, "status", FROZEN)
+	if err != nil {
+		return err
+	}
+	// the access grants issued before frozen are revoked
+	return NewRevocationManager(this.store).RevokeDevice(domain, did)
 }
 
 func (this *DeviceManager) Enable(domain string, did int64) error {
 	return this.modifyDeviceInfo(false, domain, did, "status", ACTIVE)
 }
 
+// get the binded master device by its physical id
+func (this *DeviceManager) getMappedMaster(domain, subDomain, deviceId string) (*DeviceInfo, error) {
+	bind, err := NewBindingManager(this.store).GetBindingInfo(domain, subDomain, deviceId)
+	if err == common.ErrEntryNotExist {
+		log.Warningf("device mapping not exist:domain[%s], subdomain[%s], deviceid[%s]", domain, subDomain, deviceId)
+		return nil, ErrBindingNotExist
+	} else if err != nil {
+		log.Warningf("get binding info failed:domain[%s], subdomain[%s], deviceid[%s], err[%v]", domain, subDomain, deviceId, err)
+		return nil, err
+	}
+	device, err := this.Get(domain, bind.did)
+	if err != nil {
+		log.Warningf("get device failed:domain[%s], did[%d], err[%v]", domain, bind.did, err)
+		return nil, err
+	} else if device == nil {
+		log.Warningf("device not exist:domain[%s], did[%d]", domain, bind.did)
+		return nil, ErrDeviceNotExist
+	} else if !device.IsMasterDevice() {
+		log.Warningf("the device not master:domain[%s], did[%d]", domain, bind.did)
+		return nil, common.ErrInvalidDevice
+	}
+	return device, nil
+}
+
 ////////////////////////////////////////////////////////////////////////////////////
 // private interface database related
 ////////////////////////////////////////////////////////////////////////////////////
 func (this *DeviceManager) getAllDevices(domain string, hid int64) ([]DeviceInfo, error) {
-	SQL := fmt.Sprintf("SELECT did, hid, name, status, master_did FROM %s_device_info WHERE hid = ?", domain)
+	SQL := fmt.Sprintf("SELECT did, hid, name, status, master_did, room_id FROM %s_device_info WHERE hid = ?", domain)
 	stmt, err := this.store.db.Prepare(SQL)
 	if err != nil {
 		log.Warningf("prepare query all home devices failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
@@ -79,7 +232,7 @@ func (this *DeviceManager) getAllDevices(domain string, hid int64) ([]DeviceInfo
 	var device DeviceInfo
 	list := make([]DeviceInfo, 0)
 	for rows.Next() {
-		err = rows.Scan(&device.did, &device.hid, &device.deviceName, &device.status, &device.masterDid)
+		err = rows.Scan(&device.did, &device.hid, &device.deviceName, &device.status, &device.masterDid, &device.roomId)
 		if err != nil {
 			log.Warningf("parse the result failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
 			return nil, err
@@ -89,8 +242,196 @@ func (this *DeviceManager) getAllDevices(domain string, hid int64) ([]DeviceInfo
 	return list, nil
 }
 
+func (this *DeviceManager) getRoomDevices(domain string, hid, rid int64) ([]DeviceInfo, error) {
+	SQL := fmt.Sprintf("SELECT did, hid, name, status, master_did, room_id FROM %s_device_info WHERE hid = ? AND room_id = ?", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Warningf("prepare query room devices failed:domain[%s], hid[%d], rid[%d], err[%v]", domain, hid, rid, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(hid, rid)
+	if err != nil {
+		log.Warningf("query the room devices failed:domain[%s], hid[%d], rid[%d], err[%v]", domain, hid, rid, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var device DeviceInfo
+	list := make([]DeviceInfo, 0)
+	for rows.Next() {
+		err = rows.Scan(&device.did, &device.hid, &device.deviceName, &device.status, &device.masterDid, &device.roomId)
+		if err != nil {
+			log.Warningf("parse the result failed:domain[%s], hid[%d], rid[%d], err[%v]", domain, hid, rid, err)
+			return nil, err
+		}
+		list = append(list, device)
+	}
+	return list, nil
+}
+
+func (this *DeviceManager) getAllSlaves(domain string, masterDid int64) ([]DeviceInfo, error) {
+	SQL := fmt.Sprintf("SELECT did, hid, name, status, master_did, room_id FROM %s_device_info WHERE master_did = ? AND did != master_did", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Warningf("prepare query all slave devices failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(masterDid)
+	if err != nil {
+		log.Warningf("query the slave devices failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var device DeviceInfo
+	list := make([]DeviceInfo, 0)
+	for rows.Next() {
+		err = rows.Scan(&device.did, &device.hid, &device.deviceName, &device.status, &device.masterDid, &device.roomId)
+		if err != nil {
+			log.Warningf("parse the result failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+			return nil, err
+		}
+		list = append(list, device)
+	}
+	return list, nil
+}
+
+// the master device must be an active master in the home
+func (this *DeviceManager) checkMaster(domain string, hid, masterDid int64) error {
+	master, err := this.Get(domain, masterDid)
+	if err != nil {
+		log.Warningf("get master device failed:domain[%s], did[%d], err[%v]", domain, masterDid, err)
+		return err
+	} else if master == nil || !master.IsMasterDevice() {
+		log.Warningf("check the master device failed:domain[%s], did[%d]", domain, masterDid)
+		return common.ErrMasterNotExist
+	} else if master.GetHid() != hid {
+		log.Warningf("check the master device home failed:domain[%s], did[%d], hid[%d], master[%d]",
+			domain, masterDid, hid, master.GetHid())
+		return common.ErrNotAllowed
+	} else if master.GetStatus() != ACTIVE {
+		log.Warningf("check the master device status failed:domain[%s], did[%d], status[%d]",
+			domain, masterDid, master.GetStatus())
+		return common.ErrInvalidStatus
+	}
+	return nil
+}
+
+// count the slave devices of the master
+func (this *DeviceManager) countSlaves(domain string, masterDid int64) (int64, error) {
+	SQL := fmt.Sprintf("SELECT COUNT(*) FROM %s_device_info WHERE master_did = ? AND did != master_did", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare count slave devices failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return -1, err
+	}
+	defer stmt.Close()
+	var count int64
+	err = stmt.QueryRow(masterDid).Scan(&count)
+	if err != nil {
+		log.Errorf("count slave devices failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+		return -1, err
+	}
+	return count, nil
+}
+
+// move the slave to the new master in a transaction with the slaves quota checked, the slave
+// detached if the new master did is 0, and the move or detach history recorded, the unfinished
+// commands of the slave queued to the new master or deleted if detached
+func (this *DeviceManager) moveSlaveDevice(uid int64, domain string, hid, did, oldMasterDid, masterDid int64) error {
+	SQL := fmt.Sprintf("UPDATE %s_device_info SET master_did = ? WHERE did = ? AND master_did = ?", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare move slave failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	defer stmt.Close()
+	stmt2, err := this.store.db.Prepare(copyHistorySQL(domain, "i.did = ?"))
+	if err != nil {
+		log.Errorf("prepare insert history failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	defer stmt2.Close()
+	var SQL3 string
+	if masterDid > 0 {
+		SQL3 = fmt.Sprintf("UPDATE %s_device_command SET status = %d, master_did = ?, modify_time = NOW() WHERE did = ? AND master_did = ? AND status IN (%d, %d)",
+			domain, COMMAND_PENDING, COMMAND_PENDING, COMMAND_DELIVERED)
+	} else {
+		SQL3 = fmt.Sprintf("DELETE FROM %s_device_command WHERE did = ? AND master_did = ? AND status IN (%d, %d)",
+			domain, COMMAND_PENDING, COMMAND_DELIVERED)
+	}
+	stmt3, err := this.store.db.Prepare(SQL3)
+	if err != nil {
+		log.Errorf("prepare move slave commands failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	defer stmt3.Close()
+	quota, err := NewQuotaManager(this.store).Get(domain)
+	if err != nil {
+		log.Warningf("get domain quota failed:domain[%s], err[%v]", domain, err)
+		return err
+	}
+
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	defer rollback(&err, tx)
+	// lock the home at first as the binding does for counting the slaves
+	err = lockHome(tx, domain, hid)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Stmt(stmt).Exec(masterDid, did, oldMasterDid)
+	if err != nil {
+		log.Errorf("move slave failed:domain[%s], did[%d], master[%d], err[%v]", domain, did, masterDid, err)
+		return err
+	}
+	affect, err := result.RowsAffected()
+	if err != nil {
+		log.Warningf("get affected rows failed:err[%v]", err)
+		return err
+	}
+	if affect != 1 {
+		log.Warningf("check affected rows failed:domain[%s], did[%d], master[%d], row[%d]", domain, did, oldMasterDid, affect)
+		err = common.ErrEntryNotExist
+		return err
+	}
+	event := HISTORY_MOVE
+	if masterDid <= 0 {
+		event = HISTORY_DETACH
+	}
+	_, err = tx.Stmt(stmt2).Exec(event, uid, did)
+	if err != nil {
+		log.Errorf("insert %s history failed:domain[%s], did[%d], err[%v]", event, domain, did, err)
+		return err
+	}
+	if masterDid > 0 {
+		_, err = tx.Stmt(stmt3).Exec(masterDid, did, oldMasterDid)
+	} else {
+		_, err = tx.Stmt(stmt3).Exec(did, oldMasterDid)
+	}
+	if err != nil {
+		log.Errorf("move slave commands failed:domain[%s], did[%d], master[%d], err[%v]", domain, did, masterDid, err)
+		return err
+	}
+	if masterDid > 0 {
+		err = checkQuota(tx, domain, QUOTA_SLAVES, masterDid, quota.GetSlaves())
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], did[%d], master[%d], err[%v]", domain, did, masterDid, err)
+		return err
+	}
+	return nil
+}
+
 // delete all device info in home
-func (this *DeviceManager) deleteAllDevices(domain string, hid int64) error {
+func (this *DeviceManager) deleteAllDevices(uid int64, domain string, hid int64) error {
 	SQL := fmt.Sprintf("DELETE FROM %s_device_info WHERE hid = ?", domain)
 	stmt, err := this.store.db.Prepare(SQL)
 	if err != nil {
@@ -98,24 +439,100 @@ func (this *DeviceManager) deleteAllDevices(domain string, hid int64) error {
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(hid)
+	// record all the devices unbind history
+	stmt2, err := this.store.db.Prepare(copyHistorySQL(domain, "i.hid = ?"))
+	if err != nil {
+		log.Warningf("prepare insert history failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	defer stmt2.Close()
+	// delete all the acl entries of the home devices
+	SQL3 := fmt.Sprintf("DELETE FROM %s_device_acl WHERE hid = ?", domain)
+	stmt3, err := this.store.db.Prepare(SQL3)
+	if err != nil {
+		log.Warningf("prepare delete all acls of home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	defer stmt3.Close()
+	// delete the presence of the home devices
+	SQL4 := fmt.Sprintf("DELETE p FROM %s_device_presence p, %s_device_info i WHERE p.did = i.did AND i.hid = ?", domain, domain)
+	stmt4, err := this.store.db.Prepare(SQL4)
+	if err != nil {
+		log.Warningf("prepare delete all presences of home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	defer stmt4.Close()
+	// delete the shadow of the home devices
+	SQL5 := fmt.Sprintf("DELETE s FROM %s_device_shadow s, %s_device_info i WHERE s.did = i.did AND i.hid = ?", domain, domain)
+	stmt5, err := this.store.db.Prepare(SQL5)
+	if err != nil {
+		log.Warningf("prepare delete all shadows of home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	defer stmt5.Close()
+	// delete the queued commands of the home devices
+	SQL6 := fmt.Sprintf("DELETE FROM %s_device_command WHERE hid = ?", domain)
+	stmt6, err := this.store.db.Prepare(SQL6)
+	if err != nil {
+		log.Warningf("prepare delete all commands of home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	defer stmt6.Close()
+
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	defer rollback(&err, tx)
+	_, err = tx.Stmt(stmt2).Exec(HISTORY_UNBIND, uid, hid)
+	if err != nil {
+		log.Errorf("insert unbind history failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	_, err = tx.Stmt(stmt3).Exec(hid)
+	if err != nil {
+		log.Errorf("delete all acls of home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	_, err = tx.Stmt(stmt4).Exec(hid)
+	if err != nil {
+		log.Errorf("delete all presences of home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	_, err = tx.Stmt(stmt5).Exec(hid)
+	if err != nil {
+		log.Errorf("delete all shadows of home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	_, err = tx.Stmt(stmt6).Exec(hid)
+	if err != nil {
+		log.Errorf("delete all commands of home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	_, err = tx.Stmt(stmt).Exec(hid)
 	if err != nil {
 		log.Errorf("delete all device of home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
 		return err
 	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
 	return nil
 }
 
 // get device info
 func (this *DeviceManager) getDeviceInfo(domain string, did int64, device *DeviceInfo) error {
-	SQL := fmt.Sprintf("SELECT did, hid, name, status, master_did FROM %s_device_info WHERE did = ?", domain)
+	SQL := fmt.Sprintf("SELECT did, hid, name, status, master_did, room_id FROM %s_device_info WHERE did = ?", domain)
 	stmt, err := this.store.db.Prepare(SQL)
 	if err != nil {
 		log.Errorf("prepare query failed:domain[%s], did[%d], err[%v]", domain, did, err)
 		return err
 	}
 	defer stmt.Close()
-	err = stmt.QueryRow(did).Scan(&device.did, &device.hid, &device.deviceName, &device.status, &device.masterDid)
+	err = stmt.QueryRow(did).Scan(&device.did, &device.hid, &device.deviceName, &device.status, &device.masterDid, &device.roomId)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return common.ErrEntryNotExist
@@ -160,7 +577,7 @@ func (this *DeviceManager) modifyDeviceInfo(checkStatus bool, domain string, did
 }
 
 // delete master or normal device
-func (this *DeviceManager) deleteDeviceInfo(domain string, hid, did int64) error {
+func (this *DeviceManager) deleteDeviceInfo(uid int64, domain string, hid, did int64) error {
 	// at first delete the device from the device info
 	SQL1 := fmt.Sprintf("DELETE FROM %s_device_info WHERE did = ? AND hid = ?", domain)
 	stmt1, err := this.store.db.Prepare(SQL1)
@@ -177,6 +594,47 @@ func (this *DeviceManager) deleteDeviceInfo(domain string, hid, did int64) error
 		return err
 	}
 	defer stmt2.Close()
+	// record the delete history of the device and all the normal devices
+	stmt3, err := this.store.db.Prepare(copyHistorySQL(domain, "i.hid = ? AND (i.did = ? OR i.master_did = ?)"))
+	if err != nil {
+		log.Errorf("prepare insert history failed:domain[%s], hid[%d], did[%d], err[%v]", domain, hid, did, err)
+		return err
+	}
+	defer stmt3.Close()
+	// delete all the acl entries of the device and all the normal devices
+	SQL4 := fmt.Sprintf("DELETE FROM %s_device_acl WHERE hid = ? AND did IN (SELECT did FROM %s_device_info "+
+		"WHERE hid = ? AND (did = ? OR master_did = ?))", domain, domain)
+	stmt4, err := this.store.db.Prepare(SQL4)
+	if err != nil {
+		log.Errorf("prepare delete acl failed:domain[%s], hid[%d], did[%d], err[%v]", domain, hid, did, err)
+		return err
+	}
+	defer stmt4.Close()
+	// delete the presence of the device
+	SQL5 := fmt.Sprintf("DELETE FROM %s_device_presence WHERE did = ?", domain)
+	stmt5, err := this.store.db.Prepare(SQL5)
+	if err != nil {
+		log.Errorf("prepare delete presence failed:domain[%s], hid[%d], did[%d], err[%v]", domain, hid, did, err)
+		return err
+	}
+	defer stmt5.Close()
+	// delete the shadow of the device and all the normal devices
+	SQL6 := fmt.Sprintf("DELETE FROM %s_device_shadow WHERE did IN (SELECT did FROM %s_device_info "+
+		"WHERE hid = ? AND (did = ? OR master_did = ?))", domain, domain)
+	stmt6, err := this.store.db.Prepare(SQL6)
+	if err != nil {
+		log.Errorf("prepare delete shadow failed:domain[%s], hid[%d], did[%d], err[%v]", domain, hid, did, err)
+		return err
+	}
+	defer stmt6.Close()
+	// delete the queued commands of the device or the master device
+	SQL7 := fmt.Sprintf("DELETE FROM %s_device_command WHERE hid = ? AND (did = ? OR master_did = ?)", domain)
+	stmt7, err := this.store.db.Prepare(SQL7)
+	if err != nil {
+		log.Errorf("prepare delete commands failed:domain[%s], hid[%d], did[%d], err[%v]", domain, hid, did, err)
+		return err
+	}
+	defer stmt7.Close()
 
 	// begin in a transaction
 	tx, err := this.store.db.Begin()
@@ -186,6 +644,31 @@ func (this *DeviceManager) deleteDeviceInfo(domain string, hid, did int64) error
 	}
 	defer rollback(&err, tx)
 
+	_, err = tx.Stmt(stmt3).Exec(HISTORY_DELETE, uid, hid, did, did)
+	if err != nil {
+		log.Errorf("insert delete history failed:domain[%s], hid[%d], did[%d], err[%v]", domain, hid, did, err)
+		return err
+	}
+	_, err = tx.Stmt(stmt4).Exec(hid, hid, did, did)
+	if err != nil {
+		log.Errorf("delete device acl failed:domain[%s], hid[%d], did[%d], err[%v]", domain, hid, did, err)
+		return err
+	}
+	_, err = tx.Stmt(stmt5).Exec(did)
+	if err != nil {
+		log.Errorf("delete device presence failed:domain[%s], hid[%d], did[%d], err[%v]", domain, hid, did, err)
+		return err
+	}
+	_, err = tx.Stmt(stmt6).Exec(hid, did, did)
+	if err != nil {
+		log.Errorf("delete device shadow failed:domain[%s], hid[%d], did[%d], err[%v]", domain, hid, did, err)
+		return err
+	}
+	_, err = tx.Stmt(stmt7).Exec(hid, did, did)
+	if err != nil {
+		log.Errorf("delete device commands failed:domain[%s], hid[%d], did[%d], err[%v]", domain, hid, did, err)
+		return err
+	}
 	_, err = tx.Stmt(stmt1).Exec(did, hid)
 	if err != nil {
 		log.Errorf("delete did failed:domain[%s], hid[%d], did[%d], err[%v]", domain, hid, did, err)
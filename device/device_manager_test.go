@@ -3,6 +3,7 @@ package device
 import (
 	"fmt"
 	"testing"
+	"zc-common-go/common"
 )
 
 func prepare(store *DeviceStorage) {
@@ -48,7 +49,7 @@ func prepare(store *DeviceStorage) {
 	for i := 0; i < 10; i++ {
 		id := fmt.Sprintf("20141017%d", i)
 		name := fmt.Sprintf("master%d", i)
-		err = binding.Binding(domain, subDomain, id, name, list[i%5].hid, -1)
+		err = binding.Binding(uid, domain, subDomain, id, name, "", list[i%5].hid, -1)
 		if err != nil {
 			panic("binding master device failed")
 		}
@@ -63,7 +64,7 @@ func prepare(store *DeviceStorage) {
 	for i := 0; i < 30; i++ {
 		id := fmt.Sprintf("20151017%d", i)
 		name := fmt.Sprintf("slave%d", i)
-		err = binding.Binding(domain, subDomain, id, name, list[i%5].hid, master[i%10])
+		err = binding.Binding(uid, domain, subDomain, id, name, "", list[i%5].hid, master[i%10])
 		if err != nil {
 			panic("binding slave device failed")
 		}
@@ -158,7 +159,7 @@ func TestDeleteAll(t *testing.T) {
 		for _, dev := range devList {
 			// only delete the master device and all the normal binding deleted
 			if dev.IsMasterDevice() {
-				err := device.DeleteDevice(domain, home.hid, dev.GetDid())
+				err := device.DeleteDevice(uid, domain, home.hid, dev.GetDid())
 				if err != nil {
 					t.Error("delete did failed", dev.GetDid(), err)
 				}
@@ -193,7 +194,7 @@ func TestDeleteAll(t *testing.T) {
 		for _, dev := range devList {
 			// only delete the normal device
 			if !dev.IsMasterDevice() {
-				err := device.DeleteDevice(domain, home.hid, dev.GetDid())
+				err := device.DeleteDevice(uid, domain, home.hid, dev.GetDid())
 				if err != nil {
 					t.Error("delete did failed", dev.GetDid(), err)
 				}
@@ -212,7 +213,7 @@ func TestDeleteAll(t *testing.T) {
 
 	// invalid did
 	var invalidDid int64
-	err = device.DeleteDevice(domain, invalidHid, invalidDid)
+	err = device.DeleteDevice(uid, domain, invalidHid, invalidDid)
 	if err != nil {
 		t.Error("delete invalid did succ")
 	}
@@ -306,3 +307,206 @@ func TestChangeDeviceInfo(t *testing.T) {
 	}
 	cleanAll(store)
 }
+
+// delete the master device with all its slave devices, the detached slave kept in the home
+func TestDeleteMasterDevice(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	// 5 home, 2 master/home, 3 slave/master
+	prepare(store)
+	home := NewHomeManager(store)
+	var uid int64 = 100
+	list, err := home.GetAllHome(domain, uid)
+	if err != nil || len(list) != 5 {
+		t.Errorf("get user all home failed:err[%v], len[%d]", err, len(list))
+	}
+	device := NewDeviceManager(store)
+	binding := NewBindingManager(store)
+	history := NewHistoryManager(store)
+	router := NewAccessRouter(store)
+	devList, err := device.GetAllDevices(domain, list[0].hid)
+	if err != nil {
+		t.Error("get all devices failed", err)
+	}
+	masters := make([]DeviceInfo, 0)
+	for _, dev := range devList {
+		if dev.IsMasterDevice() {
+			masters = append(masters, dev)
+		}
+	}
+	if len(masters) != 2 {
+		t.Fatal("check master count failed", len(masters))
+	}
+	slaves, err := device.GetAllSlaves(domain, masters[0].did)
+	if err != nil || len(slaves) != 3 {
+		t.Fatalf("list slaves failed:err[%v], len[%d]", err, len(slaves))
+	}
+	// the detached slave can not be accessed until moved to a master
+	err = device.DetachSlave(uid, domain, slaves[0].did)
+	if err != nil {
+		t.Error("detach slave failed", err)
+	}
+	_, _, _, err = router.GetAccessPoint(uid, domain, slaves[0].did)
+	if err != common.ErrMasterNotExist {
+		t.Error("get detached slave access point succ", err)
+	}
+	err = device.DeleteDevice(uid, domain, list[0].hid, masters[0].did)
+	if err != nil {
+		t.Error("delete master failed", err)
+	}
+	devList, err = device.GetAllDevices(domain, list[0].hid)
+	if err != nil || len(devList) != 5 {
+		t.Errorf("check all devices count failed:err[%v], len[%d]", err, len(devList))
+	}
+	// the slave devices deleted with the delete history
+	for _, slave := range slaves[1:] {
+		dev, err := device.Get(domain, slave.did)
+		if err != nil || dev != nil {
+			t.Errorf("check slave deleted failed:did[%d], err[%v]", slave.did, err)
+		}
+		bind, err := binding.Get(domain, slave.did)
+		if err != nil || bind == nil {
+			t.Errorf("get slave binding failed:did[%d], err[%v]", slave.did, err)
+			continue
+		}
+		logs, err := history.GetAll(domain, bind.subDomain, bind.deviceId)
+		if err != nil || len(logs) == 0 {
+			t.Errorf("get slave history failed:did[%d], err[%v]", slave.did, err)
+		} else if logs[len(logs)-1].GetEvent() != HISTORY_DELETE || logs[len(logs)-1].GetUid() != uid {
+			t.Error("check slave delete history failed", logs[len(logs)-1])
+		}
+	}
+	// the detached slave moved to the other master can be accessed
+	err = device.MoveSlave(uid, domain, slaves[0].did, masters[1].did)
+	if err != nil {
+		t.Error("move detached slave failed", err)
+	}
+	_, _, _, err = router.GetAccessPoint(uid, domain, slaves[0].did)
+	if err != nil {
+		t.Error("get moved slave access point failed", err)
+	}
+	cleanAll(store)
+}
+
+func TestSlaveTopology(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	// 5 home, 2 master/home, 3 slave/master
+	prepare(store)
+	home := NewHomeManager(store)
+	var uid int64 = 100
+	list, err := home.GetAllHome(domain, uid)
+	if err != nil || len(list) != 5 {
+		t.Errorf("get user all home failed:err[%v], len[%d]", err, len(list))
+	}
+	device := NewDeviceManager(store)
+	masters := make([]DeviceInfo, 0)
+	devList, err := device.GetAllDevices(domain, list[0].hid)
+	if err != nil {
+		t.Error("get all devices failed", err)
+	}
+	for _, dev := range devList {
+		if dev.IsMasterDevice() {
+			masters = append(masters, dev)
+		}
+	}
+	if len(masters) != 2 {
+		t.Fatal("check master count failed", len(masters))
+	}
+	slaves, err := device.GetAllSlaves(domain, masters[0].did)
+	if err != nil || len(slaves) != 3 {
+		t.Errorf("list slaves failed:err[%v], len[%d]", err, len(slaves))
+	}
+	// slave is not a master
+	_, err = device.GetAllSlaves(domain, slaves[0].did)
+	if err == nil {
+		t.Error("list slaves of slave device succ")
+	}
+	// master in other home
+	other, err := device.GetAllDevices(domain, list[1].hid)
+	if err != nil {
+		t.Error("get all devices failed", err)
+	}
+	for _, dev := range other {
+		if dev.IsMasterDevice() {
+			err = device.MoveSlave(uid, domain, slaves[0].did, dev.did)
+			if err == nil {
+				t.Error("move slave to other home master succ")
+			}
+		}
+	}
+	// frozen master
+	err = device.Disable(domain, masters[1].did)
+	if err != nil {
+		t.Error("disable master failed", err)
+	}
+	err = device.MoveSlave(uid, domain, slaves[0].did, masters[1].did)
+	if err == nil {
+		t.Error("move slave to frozen master succ")
+	}
+	err = device.Enable(domain, masters[1].did)
+	if err != nil {
+		t.Error("enable master failed", err)
+	}
+	command := NewCommandManager(store)
+	_, err = command.Enqueue(uid, domain, slaves[0].did, "on", 0)
+	if err != nil {
+		t.Error("enqueue command failed", err)
+	}
+	err = device.MoveSlave(uid, domain, slaves[0].did, masters[1].did)
+	if err != nil {
+		t.Error("move slave failed", err)
+	}
+	moved, err := device.GetAllSlaves(domain, masters[1].did)
+	if err != nil || len(moved) != 4 {
+		t.Errorf("list moved slaves failed:err[%v], len[%d]", err, len(moved))
+	}
+	// the pending command of the slave fetched by the new master only
+	mapping := NewBindingManager(store)
+	for i, master := range masters {
+		bind, err := mapping.Get(domain, master.did)
+		if err != nil || bind == nil {
+			t.Fatal("get master binding failed", err)
+		}
+		commands, err := command.Fetch(domain, bind.subDomain, bind.deviceId, 0)
+		if err != nil || len(commands) != i {
+			t.Errorf("fetch the moved slave commands failed:err[%v], master[%d], len[%d]", err, master.did, len(commands))
+		}
+	}
+	// detach and move back
+	err = device.DetachSlave(uid, domain, slaves[0].did)
+	if err != nil {
+		t.Error("detach slave failed", err)
+	}
+	dev, err := device.Get(domain, slaves[0].did)
+	if err != nil || dev == nil || !dev.IsDetached() {
+		t.Errorf("check detached slave failed:err[%v]", err)
+	}
+	err = device.MoveSlave(uid, domain, slaves[0].did, masters[0].did)
+	if err != nil {
+		t.Error("move detached slave failed", err)
+	}
+	// the move and detach history recorded
+	bind, err := mapping.Get(domain, slaves[0].did)
+	if err != nil || bind == nil {
+		t.Fatal("get slave binding failed", err)
+	}
+	logs, err := NewHistoryManager(store).GetAll(domain, bind.subDomain, bind.deviceId)
+	if err != nil || len(logs) != 4 {
+		t.Errorf("get slave history failed:err[%v], len[%d]", err, len(logs))
+	} else if logs[1].GetEvent() != HISTORY_MOVE || logs[2].GetEvent() != HISTORY_DETACH ||
+		logs[3].GetEvent() != HISTORY_MOVE || logs[3].GetMasterDid() != masters[0].did {
+		t.Error("check slave history failed", logs)
+	}
+	slaves, err = device.GetAllSlaves(domain, masters[0].did)
+	if err != nil || len(slaves) != 3 {
+		t.Errorf("list slaves failed:err[%v], len[%d]", err, len(slaves))
+	}
+	cleanAll(store)
+}
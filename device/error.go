@@ -0,0 +1,29 @@
+package device
+
+import "errors"
+
+// the device manager special errors not defined in common
+var (
+	ErrBindedByOtherHome = errors.New("device already binded by other home")
+	ErrQuotaExceeded     = errors.New("quota exceeded")
+	ErrInvalidGrant      = errors.New("invalid access grant")
+	ErrGrantExpired      = errors.New("access grant expired")
+	ErrVersionConflict   = errors.New("version conflict")
+)
+
+// the distinct access point errors of every access check step
+var (
+	ErrDeviceNotExist      = errors.New("device not exist")
+	ErrDeviceNotActive     = errors.New("device not active")
+	ErrMasterNotActive     = errors.New("master device not active")
+	ErrBindingNotExist     = errors.New("master device binding not exist")
+	ErrHomeNotExist        = errors.New("home not exist")
+	ErrHomeNotActive       = errors.New("home not active")
+	ErrNotHomeMember       = errors.New("not home member")
+	ErrMemberNotActive     = errors.New("member not active")
+	ErrNoControlPermission = errors.New("no control permission")
+	ErrMemberExpired       = errors.New("member access expired")
+	ErrMemberOutOfTime     = errors.New("member not in valid time")
+	ErrAccessDenied        = errors.New("device access denied by acl")
+	ErrDeviceOffline       = errors.New("master device offline")
+)
@@ -0,0 +1,212 @@
+package device
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+	"zc-common-go/mysql"
+)
+
+const (
+	// the default and max lifetime of the access grant
+	DEFAULT_GRANT_TTL = 5 * time.Minute
+	MAX_GRANT_TTL     = time.Hour
+	// the max clock skew between the service issuing the grant and the database
+	// recording the revoke time
+	GRANT_CLOCK_SKEW = 30 * time.Second
+)
+
+// grant revocation subject type
+const (
+	REVOKE_SUBJECT_USER   = 1
+	REVOKE_SUBJECT_DEVICE = 2
+	REVOKE_SUBJECT_HOME   = 3
+)
+
+// the short-lived signed grant of the user controlling the device through the master
+// device, the gateway verify it offline by the shared service key
+type AccessGrant struct {
+	uid       int64
+	did       int64
+	hid       int64
+	masterDid int64
+	subDomain string
+	deviceId  string
+	perms     int
+	issueTime int64
+	expire    int64
+}
+
+// the signed payload of the grant
+type grantPayload struct {
+	Uid       int64  `json:"uid"`
+	Did       int64  `json:"did"`
+	Hid       int64  `json:"hid"`
+	MasterDid int64  `json:"master"`
+	SubDomain string `json:"subdomain"`
+	DeviceId  string `json:"deviceid"`
+	Perms     int    `json:"perms"`
+	IssueTime int64  `json:"iat"`
+	Expire    int64  `json:"exp"`
+}
+
+func (this *AccessGrant) GetUid() int64 {
+	return this.uid
+}
+
+func (this *AccessGrant) GetDid() int64 {
+	return this.did
+}
+
+func (this *AccessGrant) GetHid() int64 {
+	return this.hid
+}
+
+func (this *AccessGrant) GetMasterDid() int64 {
+	return this.masterDid
+}
+
+// the master device subdomain
+func (this *AccessGrant) GetSubDomain() string {
+	return this.subDomain
+}
+
+// the master device physical id
+func (this *AccessGrant) GetDeviceId() string {
+	return this.deviceId
+}
+
+// the permissions of the member role
+func (this *AccessGrant) GetPermissions() int {
+	return this.perms
+}
+
+func (this *AccessGrant) GetIssueTime() time.Time {
+	return time.Unix(this.issueTime, 0)
+}
+
+func (this *AccessGrant) GetExpireTime() time.Time {
+	return time.Unix(this.expire, 0)
+}
+
+// check the grant revoked by any entry of the revocation list, the entry revokes the grants
+// of the user, the device and its slaves or the home devices issued not after it, the issue
+// time is taken from the service clock, so the grants issued inside the skew margin are revoked
+func (this *AccessGrant) IsRevokedBy(list []GrantRevocation) bool {
+	for _, revocation := range list {
+		if this.issueTime > revocation.revokeTime.Time.Add(GRANT_CLOCK_SKEW).Unix() {
+			continue
+		}
+		if revocation.subjectType == REVOKE_SUBJECT_USER && revocation.subject == this.uid {
+			return true
+		} else if revocation.subjectType == REVOKE_SUBJECT_DEVICE &&
+			(revocation.subject == this.did || revocation.subject == this.masterDid) {
+			return true
+		} else if revocation.subjectType == REVOKE_SUBJECT_HOME && revocation.subject == this.hid {
+			return true
+		}
+	}
+	return false
+}
+
+// sign the grant by the service key as the token "payload.signature"
+func signGrant(key []byte, grant *AccessGrant) (string, error) {
+	payload := grantPayload{Uid: grant.uid, Did: grant.did, Hid: grant.hid, MasterDid: grant.masterDid,
+		SubDomain: grant.subDomain, DeviceId: grant.deviceId, Perms: grant.perms,
+		IssueTime: grant.issueTime, Expire: grant.expire}
+	data, err := json.Marshal(&payload)
+	if err != nil {
+		return "", err
+	}
+	text := base64.RawURLEncoding.EncodeToString(data)
+	return text + "." + base64.RawURLEncoding.EncodeToString(grantSignature(key, text)), nil
+}
+
+func grantSignature(key []byte, text string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(text))
+	return mac.Sum(nil)
+}
+
+// verify the grant token signature and expire time offline, the caller should
+// also check the grant not revoked by the revocation list
+func VerifyAccessGrant(key []byte, token string, now time.Time) (*AccessGrant, error) {
+	parts := strings.Split(token, ".")
+	if len(key) == 0 || len(parts) != 2 {
+		return nil, ErrInvalidGrant
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, grantSignature(key, parts[0])) {
+		return nil, ErrInvalidGrant
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidGrant
+	}
+	var payload grantPayload
+	err = json.Unmarshal(data, &payload)
+	if err != nil {
+		return nil, ErrInvalidGrant
+	}
+	grant := &AccessGrant{uid: payload.Uid, did: payload.Did, hid: payload.Hid, masterDid: payload.MasterDid,
+		subDomain: payload.SubDomain, deviceId: payload.DeviceId, perms: payload.Perms,
+		issueTime: payload.IssueTime, expire: payload.Expire}
+	if now.Unix() >= grant.expire {
+		return nil, ErrGrantExpired
+	}
+	return grant, nil
+}
+
+// mint the access grants by the service key
+type GrantSigner struct {
+	key []byte
+	ttl time.Duration
+}
+
+// the key must not be empty and the ttl no more than the max grant ttl, the default ttl used if zero
+func NewGrantSigner(key []byte, ttl time.Duration) *GrantSigner {
+	if ttl == 0 {
+		ttl = DEFAULT_GRANT_TTL
+	}
+	if len(key) == 0 || ttl < time.Second || ttl > MAX_GRANT_TTL {
+		return nil
+	}
+	return &GrantSigner{key: key, ttl: ttl}
+}
+
+// mint the grant of the member controlling the device, the grant not live longer than the
+// member time-bound access and the current schedule window in the member home location
+func (this *GrantSigner) mint(member *Member, location *time.Location, device *DeviceInfo, bind *BindingInfo, now time.Time) (string, error) {
+	expire := now.Add(this.ttl)
+	if end := member.getValidEnd(now, location); !end.IsZero() && end.Before(expire) {
+		expire = end
+	}
+	grant := &AccessGrant{uid: member.GetUid(), did: device.GetDid(), hid: device.GetHid(), masterDid: device.GetMasterDid(),
+		subDomain: bind.subDomain, deviceId: bind.deviceId, perms: member.GetPermissions(),
+		issueTime: now.Unix(), expire: expire.Unix()}
+	return signGrant(this.key, grant)
+}
+
+// one entry of the revocation list, the grants of the subject issued not after the
+// revoke time are invalid, the entry can be dropped after the max grant ttl
+type GrantRevocation struct {
+	subjectType int8
+	subject     int64
+	revokeTime  mysql.NullTime
+}
+
+func (this *GrantRevocation) GetSubjectType() int8 {
+	return this.subjectType
+}
+
+// the user uid, the device did or the home hid according to the subject type
+func (this *GrantRevocation) GetSubject() int64 {
+	return this.subject
+}
+
+func (this *GrantRevocation) GetRevokeTime() time.Time {
+	return this.revokeTime.Time
+}
@@ -0,0 +1,195 @@
+package device
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+	"zc-common-go/mysql"
+)
+
+func TestAccessGrant(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	prepare(store)
+	home := NewHomeManager(store)
+	var uid int64 = 100
+	list, err := home.GetAllHome(domain, uid)
+	if err != nil || len(list) != 5 {
+		t.Errorf("get user all home failed:err[%v], len[%d]", err, len(list))
+	}
+	device := NewDeviceManager(store)
+	devList, err := device.GetAllDevices(domain, list[0].hid)
+	if err != nil || len(devList) != 8 {
+		t.Errorf("get all devices failed:err[%v], len[%d]", err, len(devList))
+	}
+	var slave *DeviceInfo
+	for i := range devList {
+		if !devList[i].IsMasterDevice() {
+			slave = &devList[i]
+			break
+		}
+	}
+	if NewGrantSigner(nil, 0) != nil || NewGrantSigner([]byte("key"), 2*MAX_GRANT_TTL) != nil {
+		t.Error("new invalid grant signer succ")
+	}
+	key := []byte("grant service key")
+	router := NewAccessRouter(store)
+	// no grant minted without signer
+	_, _, token, err := router.GetAccessPoint(uid, domain, slave.did)
+	if err != nil || len(token) != 0 {
+		t.Errorf("get access point without signer failed:err[%v], grant[%s]", err, token)
+	}
+	router.SetGrantSigner(NewGrantSigner(key, time.Minute))
+	subDomain, deviceId, token, err := router.GetAccessPoint(uid, domain, slave.did)
+	if err != nil || len(token) == 0 {
+		t.Fatalf("get access grant failed:err[%v]", err)
+	}
+	grant, err := VerifyAccessGrant(key, token, time.Now())
+	if err != nil {
+		t.Fatal("verify access grant failed", err)
+	} else if grant.GetUid() != uid || grant.GetDid() != slave.did || grant.GetMasterDid() != slave.GetMasterDid() ||
+		grant.GetSubDomain() != subDomain || grant.GetDeviceId() != deviceId ||
+		grant.GetPermissions() != rolePermissions[ROLE_OWNER] {
+		t.Error("check access grant failed", grant)
+	}
+	// the wrong key, the tampered token and the expired grant
+	_, err = VerifyAccessGrant([]byte("other key"), token, time.Now())
+	if err != ErrInvalidGrant {
+		t.Error("verify grant by other key succ", err)
+	}
+	_, err = VerifyAccessGrant(key, "x"+token, time.Now())
+	if err != ErrInvalidGrant {
+		t.Error("verify tampered grant succ", err)
+	}
+	_, err = VerifyAccessGrant(key, strings.Split(token, ".")[0], time.Now())
+	if err != ErrInvalidGrant {
+		t.Error("verify unsigned grant succ", err)
+	}
+	_, err = VerifyAccessGrant(key, token, time.Now().Add(2*time.Minute))
+	if err != ErrGrantExpired {
+		t.Error("verify expired grant succ", err)
+	}
+	// the frozen master revoke the grants of its slaves
+	revocation := NewRevocationManager(store)
+	revocations, err := revocation.GetAll(domain)
+	if err != nil || len(revocations) != 0 || grant.IsRevokedBy(revocations) {
+		t.Errorf("get revocations failed:err[%v], len[%d]", err, len(revocations))
+	}
+	err = device.Disable(domain, slave.GetMasterDid())
+	if err != nil {
+		t.Error("disable master failed", err)
+	}
+	revocations, err = revocation.GetAll(domain)
+	if err != nil || len(revocations) != 1 {
+		t.Errorf("get revocations failed:err[%v], len[%d]", err, len(revocations))
+	} else if revocations[0].GetSubjectType() != REVOKE_SUBJECT_DEVICE || revocations[0].GetSubject() != slave.GetMasterDid() {
+		t.Error("check device revocation failed", revocations[0])
+	} else if !grant.IsRevokedBy(revocations) {
+		t.Error("check slave grant revoked failed")
+	}
+	err = device.Enable(domain, slave.GetMasterDid())
+	if err != nil {
+		t.Error("enable master failed", err)
+	}
+	// the frozen member revoke the user grants
+	var guest int64 = 200
+	member := NewMemberManager(store)
+	err = member.AddMember(domain, list[0].hid, guest, "guest")
+	if err != nil {
+		t.Error("add member failed", err)
+	}
+	_, _, token, err = router.GetAccessPoint(guest, domain, slave.did)
+	if err != nil {
+		t.Fatal("get member access grant failed", err)
+	}
+	grant, err = VerifyAccessGrant(key, token, time.Now())
+	if err != nil {
+		t.Fatal("verify member access grant failed", err)
+	}
+	err = member.Disable(domain, list[0].hid, guest)
+	if err != nil {
+		t.Error("disable member failed", err)
+	}
+	revocations, err = revocation.GetAll(domain)
+	if err != nil || len(revocations) != 2 {
+		t.Errorf("get revocations failed:err[%v], len[%d]", err, len(revocations))
+	} else if !grant.IsRevokedBy(revocations) {
+		t.Error("check member grant revoked failed")
+	}
+	// the frozen home revoke the grants of its devices
+	_, _, token, err = router.GetAccessPoint(uid, domain, slave.did)
+	if err != nil {
+		t.Fatal("get owner access grant failed", err)
+	}
+	grant, err = VerifyAccessGrant(key, token, time.Now())
+	if err != nil {
+		t.Fatal("verify owner access grant failed", err)
+	}
+	err = home.Disable(domain, list[0].hid)
+	if err != nil {
+		t.Error("disable home failed", err)
+	}
+	revocations, err = revocation.GetAll(domain)
+	if err != nil || len(revocations) != 3 {
+		t.Errorf("get revocations failed:err[%v], len[%d]", err, len(revocations))
+	}
+	for i := range revocations {
+		if revocations[i].GetSubjectType() == REVOKE_SUBJECT_HOME &&
+			(revocations[i].GetSubject() != list[0].hid || !grant.IsRevokedBy(revocations[i:i+1])) {
+			t.Error("check home grant revoked failed", revocations[i])
+		}
+	}
+	cleanAll(store)
+}
+
+func TestScheduledGrant(t *testing.T) {
+	signer := NewGrantSigner([]byte("grant service key"), MAX_GRANT_TTL)
+	member := &Member{uid: 200, schedule: sql.NullString{String: "1@09:00-17:00;6@22:00-02:00", Valid: true}}
+	// 2015-10-19 is monday, the grant not live longer than the current window
+	cases := map[string]string{"2015-10-19 16:30": "2015-10-19 17:00", "2015-10-19 09:00": "2015-10-19 10:00",
+		"2015-10-24 23:30": "2015-10-25 00:30", "2015-10-25 01:45": "2015-10-25 02:00"}
+	for value, expect := range cases {
+		now, _ := time.ParseInLocation("2006-01-02 15:04", value, time.UTC)
+		end, _ := time.ParseInLocation("2006-01-02 15:04", expect, time.UTC)
+		token, err := signer.mint(member, time.UTC, &DeviceInfo{}, &BindingInfo{}, now)
+		if err != nil {
+			t.Fatal("mint grant failed", err)
+		}
+		grant, err := VerifyAccessGrant([]byte("grant service key"), token, now)
+		if err != nil {
+			t.Error("verify grant failed", value, err)
+		} else if !grant.GetExpireTime().Equal(end) {
+			t.Error("check the grant expire time failed", value, grant.GetExpireTime())
+		}
+	}
+	// the valid until before the window end
+	now, _ := time.ParseInLocation("2006-01-02 15:04", "2015-10-19 16:30", time.UTC)
+	member.validUntil = mysql.NullTime{Time: now.Add(10 * time.Minute), Valid: true}
+	token, err := signer.mint(member, time.UTC, &DeviceInfo{}, &BindingInfo{}, now)
+	if err != nil {
+		t.Fatal("mint grant failed", err)
+	}
+	grant, err := VerifyAccessGrant([]byte("grant service key"), token, now)
+	if err != nil || !grant.GetExpireTime().Equal(now.Add(10*time.Minute)) {
+		t.Error("check the time-bound grant expire time failed", err)
+	}
+}
+
+func TestGrantClockSkew(t *testing.T) {
+	now := time.Now()
+	revocations := []GrantRevocation{{subjectType: REVOKE_SUBJECT_USER, subject: 200,
+		revokeTime: mysql.NullTime{Time: now, Valid: true}}}
+	// the service clock ahead of the database inside the skew margin
+	grant := &AccessGrant{uid: 200, issueTime: now.Add(GRANT_CLOCK_SKEW / 2).Unix()}
+	if !grant.IsRevokedBy(revocations) {
+		t.Error("check the grant issued inside the skew margin revoked failed")
+	}
+	grant.issueTime = now.Add(2 * GRANT_CLOCK_SKEW).Unix()
+	if grant.IsRevokedBy(revocations) {
+		t.Error("check the grant issued after the skew margin not revoked failed")
+	}
+}
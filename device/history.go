@@ -0,0 +1,68 @@
+package device
+
+import (
+	"time"
+	"zc-common-go/mysql"
+)
+
+// binding history event types
+const (
+	HISTORY_BIND   = "bind"
+	HISTORY_REBIND = "rebind"
+	HISTORY_CHANGE = "change"
+	HISTORY_UNBIND = "unbind"
+	HISTORY_DELETE = "delete"
+	HISTORY_MOVE   = "move"
+	HISTORY_DETACH = "detach"
+)
+
+// one binding event of the device(subdomain + deviceid), append only
+type BindingHistory struct {
+	id         int64
+	subDomain  string
+	deviceId   string
+	did        int64
+	event      string
+	hid        int64
+	masterDid  int64
+	uid        int64
+	createTime mysql.NullTime
+}
+
+func (this *BindingHistory) GetId() int64 {
+	return this.id
+}
+
+func (this *BindingHistory) GetSubDomain() string {
+	return this.subDomain
+}
+
+func (this *BindingHistory) GetDeviceId() string {
+	return this.deviceId
+}
+
+func (this *BindingHistory) GetDid() int64 {
+	return this.did
+}
+
+func (this *BindingHistory) GetEvent() string {
+	return this.event
+}
+
+// the home id when the event happened
+func (this *BindingHistory) GetHid() int64 {
+	return this.hid
+}
+
+func (this *BindingHistory) GetMasterDid() int64 {
+	return this.masterDid
+}
+
+// the user who did the binding action, 0 if unknown
+func (this *BindingHistory) GetUid() int64 {
+	return this.uid
+}
+
+func (this *BindingHistory) GetCreateTime() time.Time {
+	return this.createTime.Time
+}
@@ -0,0 +1,118 @@
+package device
+
+import (
+	"fmt"
+	"zc-common-go/common"
+	log "zc-common-go/glog"
+	_ "zc-common-go/mysql"
+)
+
+type HistoryManager struct {
+	store *DeviceStorage
+}
+
+func NewHistoryManager(store *DeviceStorage) *HistoryManager {
+	return &HistoryManager{store: store}
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// public interface
+////////////////////////////////////////////////////////////////////////////////////
+// get all the binding history of the device order by time, if no one return empty list
+func (this *HistoryManager) GetAll(domain, subDomain, deviceId string) ([]BindingHistory, error) {
+	common.CheckParam(this.store != nil)
+	if len(subDomain) <= 0 || len(deviceId) <= 0 {
+		log.Warningf("check device failed:domain[%s], device[%s:%s]", domain, subDomain, deviceId)
+		return nil, common.ErrInvalidParam
+	}
+	list, err := this.getAllHistory(domain, subDomain, deviceId)
+	if err != nil {
+		log.Warningf("get device binding history failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return nil, err
+	}
+	return list, nil
+}
+
+// get all the binding history done by the user order by time, if no one return empty list
+func (this *HistoryManager) GetUserAll(domain string, uid int64) ([]BindingHistory, error) {
+	common.CheckParam(this.store != nil)
+	list, err := this.getUserHistory(domain, uid)
+	if err != nil {
+		log.Warningf("get user binding history failed:domain[%s], uid[%d], err[%v]", domain, uid, err)
+		return nil, err
+	}
+	return list, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// database related private interface
+////////////////////////////////////////////////////////////////////////////////////
+func (this *HistoryManager) getAllHistory(domain, subDomain, deviceId string) ([]BindingHistory, error) {
+	SQL := fmt.Sprintf("SELECT id, did, event, hid, master_did, uid, create_time FROM %s_device_history WHERE sub_domain = ? AND device_id = ? ORDER BY id", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(subDomain, deviceId)
+	if err != nil {
+		log.Errorf("query binding history failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var history BindingHistory
+	list := make([]BindingHistory, 0)
+	for rows.Next() {
+		err = rows.Scan(&history.id, &history.did, &history.event, &history.hid, &history.masterDid, &history.uid, &history.createTime)
+		if err != nil {
+			log.Errorf("parse the binding history failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+			return nil, err
+		}
+		history.subDomain = subDomain
+		history.deviceId = deviceId
+		list = append(list, history)
+	}
+	return list, nil
+}
+
+func (this *HistoryManager) getUserHistory(domain string, uid int64) ([]BindingHistory, error) {
+	SQL := fmt.Sprintf("SELECT id, sub_domain, device_id, did, event, hid, master_did, uid, create_time FROM %s_device_history WHERE uid = ? ORDER BY id", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], uid[%d], err[%v]", domain, uid, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(uid)
+	if err != nil {
+		log.Errorf("query binding history failed:domain[%s], uid[%d], err[%v]", domain, uid, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var history BindingHistory
+	list := make([]BindingHistory, 0)
+	for rows.Next() {
+		err = rows.Scan(&history.id, &history.subDomain, &history.deviceId, &history.did, &history.event, &history.hid,
+			&history.masterDid, &history.uid, &history.createTime)
+		if err != nil {
+			log.Errorf("parse the binding history failed:domain[%s], uid[%d], err[%v]", domain, uid, err)
+			return nil, err
+		}
+		list = append(list, history)
+	}
+	return list, nil
+}
+
+// insert one history record, params(subdomain, deviceid, did, event, hid, master_did, uid)
+func insertHistorySQL(domain string) string {
+	return fmt.Sprintf("INSERT INTO %s_device_history(sub_domain, device_id, did, event, hid, master_did, uid, create_time) VALUES(?,?,?,?,?,?,?,NOW())", domain)
+}
+
+// copy the current binding of the devices matched by the device info condition to history,
+// params(event, uid, condition params...)
+func copyHistorySQL(domain, condition string) string {
+	return fmt.Sprintf("INSERT INTO %s_device_history(sub_domain, device_id, did, event, hid, master_did, uid, create_time) "+
+		"SELECT m.sub_domain, m.device_id, i.did, ?, i.hid, i.master_did, ?, NOW() FROM %s_device_info i "+
+		"JOIN %s_device_mapping m ON i.did = m.did WHERE %s", domain, domain, domain, condition)
+}
@@ -0,0 +1,71 @@
+package device
+
+import (
+	"testing"
+	"zc-common-go/common"
+)
+
+func TestBindingHistory(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	// 5 home, 2 master/home, 3 slave/master
+	prepare(store)
+	var uid int64 = 100
+	subDomain := "flying"
+	id := "201410170"
+	history := NewHistoryManager(store)
+	binding := NewBindingManager(store)
+	device := NewDeviceManager(store)
+	// invalid device
+	_, err := history.GetAll(domain, subDomain, "")
+	if err == nil {
+		t.Error("get invalid device history succ")
+	}
+	list, err := history.GetAll(domain, subDomain, "notexist")
+	if err != nil || len(list) != 0 {
+		t.Errorf("get not exist device history failed:err[%v], len[%d]", err, len(list))
+	}
+	list, err = history.GetAll(domain, subDomain, id)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("get device history failed:err[%v], len[%d]", err, len(list))
+	} else if list[0].GetEvent() != HISTORY_BIND || list[0].GetUid() != uid || list[0].GetDid() != list[0].GetMasterDid() {
+		t.Error("check bind history failed")
+	}
+	hid := list[0].GetHid()
+	did := list[0].GetDid()
+	// rebind in the same home
+	err = binding.Binding(uid, domain, subDomain, id, "master", "", hid, -1)
+	if err != nil {
+		t.Error("rebinding device failed", err)
+	}
+	// delete the device by other member
+	err = device.DeleteDevice(uid+1, domain, hid, did)
+	if err != common.ErrNoPrivelige {
+		t.Error("delete device by not member", err)
+	}
+	err = NewMemberManager(store).AddMember(domain, hid, uid+1, "member")
+	if err != nil {
+		t.Error("add member failed", err)
+	}
+	err = device.DeleteDevice(uid+1, domain, hid, did)
+	if err != nil {
+		t.Error("delete device failed", err)
+	}
+	list, err = history.GetAll(domain, subDomain, id)
+	if err != nil || len(list) != 3 {
+		t.Fatalf("get device history failed:err[%v], len[%d]", err, len(list))
+	}
+	events := []string{HISTORY_BIND, HISTORY_REBIND, HISTORY_DELETE}
+	for i, event := range events {
+		if list[i].GetEvent() != event || list[i].GetDid() != did || list[i].GetHid() != hid {
+			t.Errorf("check history event failed:index[%d], event[%s]", i, list[i].GetEvent())
+		}
+	}
+	if list[2].GetUid() != uid+1 {
+		t.Error("check delete history uid failed", list[2].GetUid())
+	}
+	cleanAll(store)
+}
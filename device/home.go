@@ -1,10 +1,20 @@
 package device
 
+import (
+	"time"
+)
+
+// the home can be one node of the site hierarchy, e.g. building > floor > room
 type Home struct {
 	hid       int64
 	name      string
 	createUid int64
 	status    int8
+	parentHid int64
+	timezone  string
+	address   string
+	latitude  float64
+	longitude float64
 }
 
 func NewHome(hid int64, name string, uid int64, status int8) *Home {
@@ -26,3 +36,93 @@ func (this *Home) GetCreateUid() int64 {
 func (this *Home) GetStatus() int8 {
 	return this.status
 }
+
+// the parent node of the site hierarchy, 0 if it is a root home
+func (this *Home) GetParentHid() int64 {
+	return this.parentHid
+}
+
+// the IANA timezone name of the home location, empty if not set
+func (this *Home) GetTimezone() string {
+	return this.timezone
+}
+
+// the home timezone location, UTC if not set or invalid
+func (this *Home) GetLocation() *time.Location {
+	location, err := time.LoadLocation(this.timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+func (this *Home) GetAddress() string {
+	return this.address
+}
+
+// the geolocation of the home in degrees
+func (this *Home) GetLatitude() float64 {
+	return this.latitude
+}
+
+func (this *Home) GetLongitude() float64 {
+	return this.longitude
+}
+
+// the partial update of the home attributes, the not set attributes keep unchanged
+type HomeUpdate struct {
+	name      *string
+	timezone  *string
+	address   *string
+	latitude  *float64
+	longitude *float64
+	metadata  map[string]string
+}
+
+func NewHomeUpdate() *HomeUpdate {
+	return &HomeUpdate{}
+}
+
+func (this *HomeUpdate) SetName(name string) {
+	this.name = &name
+}
+
+func (this *HomeUpdate) SetTimezone(timezone string) {
+	this.timezone = &timezone
+}
+
+func (this *HomeUpdate) SetAddress(address string) {
+	this.address = &address
+}
+
+func (this *HomeUpdate) SetLatitude(latitude float64) {
+	this.latitude = &latitude
+}
+
+func (this *HomeUpdate) SetLongitude(longitude float64) {
+	this.longitude = &longitude
+}
+
+// the metadata key with empty value will be deleted
+func (this *HomeUpdate) SetMetadata(metadata map[string]string) {
+	this.metadata = metadata
+}
+
+// merge the update with the current home attributes
+func (this *HomeUpdate) apply(home *Home) {
+	if this.name != nil {
+		home.name = *this.name
+	}
+	if this.timezone != nil {
+		home.timezone = *this.timezone
+	}
+	if this.address != nil {
+		home.address = *this.address
+	}
+	if this.latitude != nil {
+		home.latitude = *this.latitude
+	}
+	if this.longitude != nil {
+		home.longitude = *this.longitude
+	}
+}
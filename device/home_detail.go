@@ -0,0 +1,50 @@
+package device
+
+// the home with its members and devices structure read from one consistent snapshot
+type HomeDetail struct {
+	home     Home
+	members  []Member
+	masters  []DeviceInfo
+	slaves   map[int64][]DeviceInfo
+	detached []DeviceInfo
+}
+
+func newHomeDetail() *HomeDetail {
+	return &HomeDetail{members: make([]Member, 0), masters: make([]DeviceInfo, 0),
+		slaves: make(map[int64][]DeviceInfo), detached: make([]DeviceInfo, 0)}
+}
+
+func (this *HomeDetail) GetHome() *Home {
+	return &this.home
+}
+
+// the direct members of the home not expired
+func (this *HomeDetail) GetMembers() []Member {
+	return this.members
+}
+
+// the master devices of the home
+func (this *HomeDetail) GetMasters() []DeviceInfo {
+	return this.masters
+}
+
+// the slave devices of the master, if no one return nil
+func (this *HomeDetail) GetSlaves(masterDid int64) []DeviceInfo {
+	return this.slaves[masterDid]
+}
+
+// the slave devices detached from the deleted master
+func (this *HomeDetail) GetDetached() []DeviceInfo {
+	return this.detached
+}
+
+// add the device to the master/slave structure
+func (this *HomeDetail) addDevice(device DeviceInfo) {
+	if device.IsMasterDevice() {
+		this.masters = append(this.masters, device)
+	} else if device.IsDetached() {
+		this.detached = append(this.detached, device)
+	} else {
+		this.slaves[device.masterDid] = append(this.slaves[device.masterDid], device)
+	}
+}
@@ -3,6 +3,8 @@ package device
 import (
 	"database/sql"
 	"fmt"
+	"strings"
+	"time"
 	"zc-common-go/common"
 	log "zc-common-go/glog"
 	_ "zc-common-go/mysql"
@@ -12,6 +14,17 @@ type HomeManager struct {
 	store *DeviceStorage
 }
 
+// max depth of the site hierarchy
+const MAX_SITE_DEPTH = 8
+
+// the home attributes and metadata limits
+const (
+	MAX_ADDRESS_LEN        = 256
+	MAX_HOME_METADATA      = 32
+	MAX_METADATA_KEY_LEN   = 32
+	MAX_METADATA_VALUE_LEN = 256
+)
+
 // not create the db instance
 func NewHomeManager(store *DeviceStorage) *HomeManager {
 	return &HomeManager{store: store}
@@ -43,7 +56,12 @@ func (this *HomeManager) Create(domain string, uid int64, name string) error {
 		log.Warningf("check the home name failed:uid[%d], name[%s]", uid, name)
 		return common.ErrInvalidParam
 	}
-	hid, err := this.insertHome(domain, uid, name)
+	quota, err := NewQuotaManager(this.store).Get(domain)
+	if err != nil {
+		log.Warningf("get domain quota failed:domain[%s], err[%v]", domain, err)
+		return err
+	}
+	hid, err := this.insertHome(domain, uid, name, quota.GetHomes())
 	if err != nil {
 		log.Warningf("insert home failed:domain[%s], createUid[%d], name[%s]", domain, uid, name)
 		return err
@@ -59,11 +77,32 @@ func (this *HomeManager) Create(domain string, uid int64, name string) error {
 }
 
 // TODO do not really delete the home info from the storage
-func (this *HomeManager) Delete(domain string, hid int64) error {
+func (this *HomeManager) Delete(uid int64, domain string, hid int64) error {
 	common.CheckParam(this.store != nil)
+	// step 0. only the owner can delete the home without child nodes
+	home, err := this.Get(domain, hid)
+	if err != nil {
+		log.Warningf("get home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	} else if home == nil {
+		// delete not exist home return succ
+		log.Warningf("home not exist:domain[%s], hid[%d]", domain, hid)
+		return nil
+	} else if home.GetCreateUid() != uid {
+		log.Warningf("check the home owner failed:domain[%s], hid[%d], uid[%d]", domain, hid, uid)
+		return common.ErrNoPrivelige
+	}
+	children, err := this.GetChildren(domain, hid)
+	if err != nil {
+		log.Warningf("get the home children failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	} else if len(children) > 0 {
+		log.Warningf("the home has children:domain[%s], hid[%d], count[%d]", domain, hid, len(children))
+		return common.ErrNotAllowed
+	}
 	// step 1.delete all the devices not in a transaction
 	device := NewDeviceManager(this.store)
-	err := device.DeleteAllDevices(domain, hid)
+	err = device.DeleteAllDevices(uid, domain, hid)
 	if err != nil {
 		log.Warningf("delete the home devices failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
 		return err
@@ -75,7 +114,26 @@ func (this *HomeManager) Delete(domain string, hid int64) error {
 		log.Errorf("delete the home all members failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
 		return err
 	}
-	// step 3. delete the home info from
+	// step 3. delete all the rooms not in a transaction
+	room := NewRoomManager(this.store)
+	err = room.DeleteAllRooms(domain, hid)
+	if err != nil {
+		log.Errorf("delete the home all rooms failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	// step 4. delete all the invites not in a transaction
+	invite := NewInviteManager(this.store)
+	err = invite.DeleteAllInvites(domain, hid)
+	if err != nil {
+		log.Errorf("delete the home all invites failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	// step 5. delete the home info and metadata
+	err = this.deleteAllMetadata(domain, hid)
+	if err != nil {
+		log.Errorf("delete the home metadata failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
 	err = this.deleteHome(domain, hid)
 	if err != nil {
 		log.Warningf("delete home info failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
@@ -111,7 +169,12 @@ func (this *HomeManager) GetAllHome(domain string, uid int64) ([]Home, error) {
 // enable/disable home member control
 func (this *HomeManager) Disable(domain string, hid int64) error {
 	common.CheckParam(this.store != nil)
-	return this.modifyHome(domain, hid, "status", FROZEN)
+	err := this.modifyHome(domain, hid, "status", FROZEN)
+	if err != nil {
+		return err
+	}
+	// the access grants of the home and the descendant homes devices issued before frozen are revoked
+	return this.revokeSite(domain, hid)
 }
 
 func (this *HomeManager) Enable(domain string, hid int64) error {
@@ -135,6 +198,342 @@ func (this *HomeManager) ModifyName(domain string, hid int64, name string) error
 	return this.modifyHome(domain, hid, "name", name)
 }
 
+// modify the home location, the timezone must be an IANA name like Asia/Shanghai if not empty
+func (this *HomeManager) ModifyLocation(domain string, hid int64, timezone, address string, latitude, longitude float64) error {
+	common.CheckParam(this.store != nil)
+	update := NewHomeUpdate()
+	update.SetTimezone(timezone)
+	update.SetAddress(address)
+	update.SetLatitude(latitude)
+	update.SetLongitude(longitude)
+	if !checkHomeUpdate(update) {
+		log.Warningf("check the home location failed:domain[%s], hid[%d], timezone[%s], address[%s], latitude[%f], longitude[%f]",
+			domain, hid, timezone, address, latitude, longitude)
+		return common.ErrInvalidParam
+	}
+	err := this.modifyAttributes(domain, hid, update)
+	if err != nil {
+		log.Warningf("modify home location failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	return nil
+}
+
+// get the custom key/value metadata of the home, if no metadata return empty map
+func (this *HomeManager) GetMetadata(domain string, hid int64) (map[string]string, error) {
+	common.CheckParam(this.store != nil)
+	metadata, err := this.getMetadata(domain, hid)
+	if err != nil {
+		log.Warningf("get home metadata failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// set the custom metadata of the home, the key with empty value will be deleted,
+// the keys count of one home can not exceed the max metadata count
+func (this *HomeManager) SetMetadata(domain string, hid int64, metadata map[string]string) error {
+	common.CheckParam(this.store != nil)
+	update := NewHomeUpdate()
+	update.SetMetadata(metadata)
+	if len(metadata) <= 0 || !checkHomeUpdate(update) {
+		log.Warningf("check the metadata failed:domain[%s], hid[%d], count[%d]", domain, hid, len(metadata))
+		return common.ErrInvalidParam
+	}
+	home, err := this.Get(domain, hid)
+	if err != nil {
+		log.Warningf("get home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	} else if home == nil {
+		log.Warningf("home not exist:domain[%s], hid[%d]", domain, hid)
+		return common.ErrEntryNotExist
+	} else if home.GetStatus() != ACTIVE {
+		log.Warningf("home is not active:domain[%s], hid[%d]", domain, hid)
+		return common.ErrInvalidStatus
+	}
+	err = this.setMetadata(domain, hid, metadata)
+	if err != nil {
+		log.Warningf("set home metadata failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	return nil
+}
+
+// get the metadata of all the homes in one query, the home without metadata mapped to empty map
+func (this *HomeManager) GetAllMetadata(domain string, hids []int64) (map[int64]map[string]string, error) {
+	common.CheckParam(this.store != nil)
+	metadata, err := this.getAllMetadata(domain, hids)
+	if err != nil {
+		log.Warningf("get all homes metadata failed:domain[%s], count[%d], err[%v]", domain, len(hids), err)
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// modify the home name, location and metadata set in the update in one transaction,
+// the home row locked for the merge with the current attributes
+func (this *HomeManager) Modify(domain string, hid int64, update *HomeUpdate) error {
+	common.CheckParam(this.store != nil && update != nil)
+	if !checkHomeUpdate(update) {
+		log.Warningf("check the home update failed:domain[%s], hid[%d]", domain, hid)
+		return common.ErrInvalidParam
+	}
+	err := this.modifyAttributes(domain, hid, update)
+	if err != nil {
+		log.Warningf("modify home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	return nil
+}
+
+// check the location and metadata set in the update, the timezone must be an IANA
+// name like Asia/Shanghai if not empty
+func checkHomeUpdate(update *HomeUpdate) bool {
+	if update.address != nil && len(*update.address) > MAX_ADDRESS_LEN {
+		return false
+	} else if update.latitude != nil && (*update.latitude < -90 || *update.latitude > 90) {
+		return false
+	} else if update.longitude != nil && (*update.longitude < -180 || *update.longitude > 180) {
+		return false
+	}
+	if update.timezone != nil && len(*update.timezone) > 0 {
+		_, err := time.LoadLocation(*update.timezone)
+		if err != nil {
+			return false
+		}
+	}
+	if len(update.metadata) > MAX_HOME_METADATA {
+		return false
+	}
+	for key, value := range update.metadata {
+		if len(key) <= 0 || len(key) > MAX_METADATA_KEY_LEN || len(value) > MAX_METADATA_VALUE_LEN {
+			return false
+		}
+	}
+	return true
+}
+
+// transfer the home owner to an active member, the old owner demoted to normal member
+// if keepOld is true, otherwise removed from the home
+func (this *HomeManager) Transfer(domain string, hid, uid, newUid int64, keepOld bool) error {
+	common.CheckParam(this.store != nil)
+	if uid == newUid {
+		log.Warningf("check the new owner failed:domain[%s], hid[%d], uid[%d]", domain, hid, uid)
+		return common.ErrInvalidParam
+	}
+	// step 1. only the current owner can transfer an active home
+	home, err := this.Get(domain, hid)
+	if err != nil {
+		log.Warningf("get home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	} else if home == nil {
+		log.Warningf("home not exist:domain[%s], hid[%d]", domain, hid)
+		return common.ErrEntryNotExist
+	} else if home.GetStatus() != ACTIVE {
+		log.Warningf("home is not active:domain[%s], hid[%d]", domain, hid)
+		return common.ErrInvalidStatus
+	}
+	return this.transferOwner(domain, home, uid, newUid, keepOld)
+}
+
+// transfer the home without the status checked, the frozen home keeps frozen
+func (this *HomeManager) transferOwner(domain string, home *Home, uid, newUid int64, keepOld bool) error {
+	hid := home.GetHid()
+	if home.GetCreateUid() != uid {
+		log.Warningf("check the home owner failed:domain[%s], hid[%d], uid[%d], owner[%d]", domain, hid, uid, home.GetCreateUid())
+		return common.ErrNoPrivelige
+	}
+	// step 2. the new owner must be an active member
+	memberManager := NewMemberManager(this.store)
+	member, err := memberManager.Get(domain, hid, newUid)
+	if err != nil {
+		log.Warningf("get member failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, newUid, err)
+		return err
+	} else if member == nil {
+		log.Warningf("the new owner not member:domain[%s], hid[%d], uid[%d]", domain, hid, newUid)
+		return common.ErrEntryNotExist
+	} else if member.GetStatus() != ACTIVE {
+		log.Warningf("the new owner not active:domain[%s], hid[%d], uid[%d]", domain, hid, newUid)
+		return common.ErrInvalidStatus
+	}
+	// step 3. change the owner and member types in one transaction
+	quota, err := NewQuotaManager(this.store).Get(domain)
+	if err != nil {
+		log.Warningf("get domain quota failed:domain[%s], err[%v]", domain, err)
+		return err
+	}
+	err = this.transferHome(domain, hid, uid, newUid, keepOld, quota.GetHomes())
+	if err != nil {
+		log.Warningf("transfer home failed:domain[%s], hid[%d], uid[%d], new[%d], err[%v]", domain, hid, uid, newUid, err)
+		return err
+	}
+	// step 4. the acl entries of the removed old owner deleted and the old grants revoked
+	if !keepOld {
+		err = NewAclManager(this.store).DeleteUser(domain, hid, uid)
+		if err != nil {
+			return err
+		}
+	}
+	return NewRevocationManager(this.store).RevokeUser(domain, uid)
+}
+
+// set the parent of the home in the site hierarchy, the user must be the owner of both,
+// if parentHid is 0 the home become a root home
+func (this *HomeManager) SetParent(domain string, uid, hid, parentHid int64) error {
+	common.CheckParam(this.store != nil)
+	home, err := this.Get(domain, hid)
+	if err != nil {
+		log.Warningf("get home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	} else if home == nil {
+		log.Warningf("home not exist:domain[%s], hid[%d]", domain, hid)
+		return common.ErrEntryNotExist
+	} else if home.GetCreateUid() != uid {
+		log.Warningf("check the home owner failed:domain[%s], hid[%d], uid[%d]", domain, hid, uid)
+		return common.ErrNoPrivelige
+	}
+	if parentHid > 0 {
+		parent, err := this.Get(domain, parentHid)
+		if err != nil {
+			log.Warningf("get parent home failed:domain[%s], hid[%d], err[%v]", domain, parentHid, err)
+			return err
+		} else if parent == nil {
+			log.Warningf("parent home not exist:domain[%s], hid[%d]", domain, parentHid)
+			return common.ErrEntryNotExist
+		} else if parent.GetCreateUid() != uid {
+			log.Warningf("check the parent home owner failed:domain[%s], hid[%d], uid[%d]", domain, parentHid, uid)
+			return common.ErrNoPrivelige
+		} else if parent.GetStatus() != ACTIVE {
+			log.Warningf("parent home is not active:domain[%s], hid[%d]", domain, parentHid)
+			return common.ErrInvalidStatus
+		}
+		// the new parent path must not contain the home itself
+		path, err := this.GetAncestors(domain, parentHid)
+		if err != nil {
+			log.Warningf("get parent ancestors failed:domain[%s], hid[%d], err[%v]", domain, parentHid, err)
+			return err
+		}
+		for _, node := range path {
+			if node.hid == hid {
+				log.Warningf("check the site cycle failed:domain[%s], hid[%d], parent[%d]", domain, hid, parentHid)
+				return common.ErrInvalidParam
+			}
+		}
+		// the subtree of the home moved with it under the parent
+		height, err := this.getSiteHeight(domain, hid)
+		if err != nil {
+			log.Warningf("get the site height failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+			return err
+		} else if len(path)+height > MAX_SITE_DEPTH {
+			log.Warningf("check the site depth failed:domain[%s], hid[%d], parent[%d], depth[%d], height[%d]",
+				domain, hid, parentHid, len(path), height)
+			return common.ErrNotAllowed
+		}
+	}
+	err = this.modifyHome(domain, hid, "parent_hid", parentHid)
+	if err != nil {
+		return err
+	}
+	// the members of the old ancestors lost the inherited access to the subtree
+	if home.GetParentHid() > 0 && home.GetParentHid() != parentHid {
+		return this.revokeSite(domain, hid)
+	}
+	return nil
+}
+
+// get the home and all its ancestors from the home to the root
+func (this *HomeManager) GetAncestors(domain string, hid int64) ([]Home, error) {
+	common.CheckParam(this.store != nil)
+	list := make([]Home, 0)
+	for hid > 0 {
+		home, err := this.Get(domain, hid)
+		if err != nil {
+			log.Warningf("get home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+			return nil, err
+		} else if home == nil {
+			break
+		} else if len(list) > MAX_SITE_DEPTH {
+			log.Errorf("check the site depth failed:domain[%s], hid[%d]", domain, hid)
+			return nil, common.ErrUnknown
+		}
+		list = append(list, *home)
+		hid = home.GetParentHid()
+	}
+	return list, nil
+}
+
+// get all the direct children of the home, if no one return empty list
+func (this *HomeManager) GetChildren(domain string, hid int64) ([]Home, error) {
+	common.CheckParam(this.store != nil)
+	list, err := this.getChildren(domain, hid)
+	if err != nil {
+		log.Warningf("get home children failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	return list, nil
+}
+
+// revoke the access grants of the devices in the home and all the descendant homes
+func (this *HomeManager) revokeSite(domain string, hid int64) error {
+	revocation := NewRevocationManager(this.store)
+	nodes := []int64{hid}
+	for depth := 0; len(nodes) > 0 && depth < MAX_SITE_DEPTH; depth++ {
+		next := make([]int64, 0)
+		for _, node := range nodes {
+			err := revocation.RevokeHome(domain, node)
+			if err != nil {
+				return err
+			}
+			children, err := this.getChildren(domain, node)
+			if err != nil {
+				log.Warningf("get home children failed:domain[%s], hid[%d], err[%v]", domain, node, err)
+				return err
+			}
+			for _, child := range children {
+				next = append(next, child.GetHid())
+			}
+		}
+		nodes = next
+	}
+	return nil
+}
+
+// get the height of the site subtree under the home, the home itself is 1, stop counting
+// once it exceed the max site depth
+func (this *HomeManager) getSiteHeight(domain string, hid int64) (int, error) {
+	height := 0
+	level := []int64{hid}
+	for len(level) > 0 && height <= MAX_SITE_DEPTH {
+		height++
+		next := make([]int64, 0)
+		for _, node := range level {
+			children, err := this.getChildren(domain, node)
+			if err != nil {
+				return -1, err
+			}
+			for _, child := range children {
+				next = append(next, child.hid)
+			}
+		}
+		level = next
+	}
+	return height, nil
+}
+
+// get the home, its members and devices in one consistent snapshot, if not exist return nil + nil
+func (this *HomeManager) GetDetail(domain string, hid int64) (*HomeDetail, error) {
+	common.CheckParam(this.store != nil)
+	detail, err := this.getHomeDetail(domain, hid)
+	if err != nil {
+		if err == common.ErrEntryNotExist {
+			return nil, nil
+		}
+		log.Warningf("get home detail failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	return detail, nil
+}
+
 ////////////////////////////////////////////////////////////////////////////////////
 // database related private interface
 ////////////////////////////////////////////////////////////////////////////////////
@@ -167,15 +566,200 @@ func (this *HomeManager) modifyHome(domain string, hid int64, key string, value
 	return nil
 }
 
+func (this *HomeManager) getMetadata(domain string, hid int64) (map[string]string, error) {
+	SQL := fmt.Sprintf("SELECT meta_key, meta_value FROM %s_home_metadata WHERE hid = ?", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:err[%v]", err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(hid)
+	if err != nil {
+		log.Errorf("query metadata failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var key, value string
+	metadata := make(map[string]string)
+	for rows.Next() {
+		err = rows.Scan(&key, &value)
+		if err != nil {
+			log.Errorf("parse the metadata failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+			return nil, err
+		}
+		metadata[key] = value
+	}
+	return metadata, nil
+}
+
+// replace or delete the metadata in a transaction with the metadata count checked
+func (this *HomeManager) setMetadata(domain string, hid int64, metadata map[string]string) (err error) {
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	defer rollback(&err, tx)
+	err = lockHome(tx, domain, hid)
+	if err != nil {
+		return err
+	}
+	err = modifyMetadata(tx, domain, hid, metadata)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	return nil
+}
+
+// lock the home and merge the update with the current attributes, then modify the
+// name, location and metadata in one transaction
+func (this *HomeManager) modifyAttributes(domain string, hid int64, update *HomeUpdate) (err error) {
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	defer rollback(&err, tx)
+	var home Home
+	SQL1 := fmt.Sprintf("SELECT name, status, timezone, address, latitude, longitude FROM %s_home_info WHERE hid = ? FOR UPDATE", domain)
+	err = tx.QueryRow(SQL1, hid).Scan(&home.name, &home.status, &home.timezone, &home.address, &home.latitude, &home.longitude)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Warningf("home not exist:domain[%s], hid[%d]", domain, hid)
+			err = common.ErrEntryNotExist
+			return err
+		}
+		log.Errorf("lock the home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	} else if home.status != ACTIVE {
+		log.Warningf("home is not active:domain[%s], hid[%d]", domain, hid)
+		err = common.ErrInvalidStatus
+		return err
+	}
+	update.apply(&home)
+	SQL2 := fmt.Sprintf("UPDATE %s_home_info SET name = ?, timezone = ?, address = ?, latitude = ?, longitude = ? WHERE hid = ?", domain)
+	_, err = tx.Exec(SQL2, home.name, home.timezone, home.address, home.latitude, home.longitude, hid)
+	if err != nil {
+		log.Errorf("modify home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	if len(update.metadata) > 0 {
+		err = modifyMetadata(tx, domain, hid, update.metadata)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	return nil
+}
+
+// replace or delete the metadata of the locked home in the transaction, if the
+// metadata count exceed the limit return quota exceeded error for rollback
+func modifyMetadata(tx *sql.Tx, domain string, hid int64, metadata map[string]string) error {
+	SQL1 := fmt.Sprintf("REPLACE INTO %s_home_metadata(hid, meta_key, meta_value, modify_time) VALUES(?,?,?,?)", domain)
+	SQL2 := fmt.Sprintf("DELETE FROM %s_home_metadata WHERE hid = ? AND meta_key = ?", domain)
+	SQL3 := fmt.Sprintf("SELECT COUNT(*) FROM %s_home_metadata WHERE hid = ?", domain)
+	var err error
+	now := time.Now()
+	for key, value := range metadata {
+		if len(value) > 0 {
+			_, err = tx.Exec(SQL1, hid, key, value, now)
+		} else {
+			_, err = tx.Exec(SQL2, hid, key)
+		}
+		if err != nil {
+			log.Errorf("modify metadata failed:domain[%s], hid[%d], key[%s], err[%v]", domain, hid, key, err)
+			return err
+		}
+	}
+	var count int64
+	err = tx.QueryRow(SQL3, hid).Scan(&count)
+	if err != nil {
+		log.Errorf("count metadata failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	} else if count > MAX_HOME_METADATA {
+		log.Warningf("check the metadata count failed:domain[%s], hid[%d], count[%d]", domain, hid, count)
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// query the metadata of the homes by one IN query
+func (this *HomeManager) getAllMetadata(domain string, hids []int64) (map[int64]map[string]string, error) {
+	all := make(map[int64]map[string]string, len(hids))
+	if len(hids) == 0 {
+		return all, nil
+	}
+	args := make([]interface{}, 0, len(hids))
+	for _, hid := range hids {
+		all[hid] = make(map[string]string)
+		args = append(args, hid)
+	}
+	SQL := fmt.Sprintf("SELECT hid, meta_key, meta_value FROM %s_home_metadata WHERE hid IN (?%s)",
+		domain, strings.Repeat(",?", len(hids)-1))
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:err[%v]", err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		log.Errorf("query all metadata failed:domain[%s], count[%d], err[%v]", domain, len(hids), err)
+		return nil, err
+	}
+	defer rows.Close()
+	var hid int64
+	var key, value string
+	for rows.Next() {
+		err = rows.Scan(&hid, &key, &value)
+		if err != nil {
+			log.Errorf("parse the metadata failed:domain[%s], err[%v]", domain, err)
+			return nil, err
+		}
+		if metadata, ok := all[hid]; ok {
+			metadata[key] = value
+		}
+	}
+	return all, nil
+}
+
+func (this *HomeManager) deleteAllMetadata(domain string, hid int64) error {
+	SQL := fmt.Sprintf("DELETE FROM %s_home_metadata WHERE hid = ?", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:err[%v]", err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(hid)
+	if err != nil {
+		log.Errorf("delete home metadata failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	return nil
+}
+
 func (this *HomeManager) getHome(domain string, hid int64, home *Home) error {
-	SQL := fmt.Sprintf("SELECT hid, name, status, create_uid FROM %s_home_info WHERE hid = ?", domain)
+	SQL := fmt.Sprintf("SELECT hid, name, status, create_uid, parent_hid, timezone, address, latitude, longitude FROM %s_home_info WHERE hid = ?", domain)
 	stmt, err := this.store.db.Prepare(SQL)
 	if err != nil {
 		log.Errorf("prepare query failed:err[%v]", err)
 		return err
 	}
 	defer stmt.Close()
-	err = stmt.QueryRow(hid).Scan(&home.hid, &home.name, &home.status, &home.createUid)
+	err = stmt.QueryRow(hid).Scan(&home.hid, &home.name, &home.status, &home.createUid, &home.parentHid,
+		&home.timezone, &home.address, &home.latitude, &home.longitude)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return common.ErrEntryNotExist
@@ -187,6 +771,119 @@ func (this *HomeManager) getHome(domain string, hid int64, home *Home) error {
 	return nil
 }
 
+// read the home info, members and devices in one transaction for the consistent snapshot
+func (this *HomeManager) getHomeDetail(domain string, hid int64) (detail *HomeDetail, err error) {
+	SQL1 := fmt.Sprintf("SELECT hid, name, status, create_uid, parent_hid, timezone, address, latitude, longitude FROM %s_home_info WHERE hid = ?", domain)
+	stmt1, err := this.store.db.Prepare(SQL1)
+	if err != nil {
+		log.Errorf("prepare query home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	defer stmt1.Close()
+	SQL2 := fmt.Sprintf("SELECT uid, hid, name, type, status, valid_from, valid_until, schedule FROM %s_home_members WHERE hid = ?", domain)
+	stmt2, err := this.store.db.Prepare(SQL2)
+	if err != nil {
+		log.Errorf("prepare query members failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	defer stmt2.Close()
+	SQL3 := fmt.Sprintf("SELECT did, hid, name, status, master_did, room_id FROM %s_device_info WHERE hid = ? ORDER BY did", domain)
+	stmt3, err := this.store.db.Prepare(SQL3)
+	if err != nil {
+		log.Errorf("prepare query devices failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	defer stmt3.Close()
+
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	defer rollback(&err, tx)
+	detail = newHomeDetail()
+	home := &detail.home
+	err = tx.Stmt(stmt1).QueryRow(hid).Scan(&home.hid, &home.name, &home.status, &home.createUid, &home.parentHid,
+		&home.timezone, &home.address, &home.latitude, &home.longitude)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = common.ErrEntryNotExist
+			return nil, err
+		}
+		log.Errorf("query home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	rows, err := tx.Stmt(stmt2).Query(hid)
+	if err != nil {
+		log.Errorf("query members failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	now := time.Now()
+	var member Member
+	for rows.Next() {
+		err = rows.Scan(&member.uid, &member.hid, &member.memberName, &member.memberType, &member.status,
+			&member.validFrom, &member.validUntil, &member.schedule)
+		if err != nil {
+			rows.Close()
+			log.Errorf("parse the member failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+			return nil, err
+		} else if !member.IsExpired(now) {
+			detail.members = append(detail.members, member)
+		}
+	}
+	rows.Close()
+	rows, err = tx.Stmt(stmt3).Query(hid)
+	if err != nil {
+		log.Errorf("query devices failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	var device DeviceInfo
+	for rows.Next() {
+		err = rows.Scan(&device.did, &device.hid, &device.deviceName, &device.status, &device.masterDid, &device.roomId)
+		if err != nil {
+			rows.Close()
+			log.Errorf("parse the device failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+			return nil, err
+		}
+		detail.addDevice(device)
+	}
+	rows.Close()
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	return detail, nil
+}
+
+func (this *HomeManager) getChildren(domain string, hid int64) ([]Home, error) {
+	SQL := fmt.Sprintf("SELECT hid, name, status, create_uid, parent_hid, timezone, address, latitude, longitude FROM %s_home_info WHERE parent_hid = ?", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:err[%v]", err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(hid)
+	if err != nil {
+		log.Errorf("query children failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var home Home
+	list := make([]Home, 0)
+	for rows.Next() {
+		err = rows.Scan(&home.hid, &home.name, &home.status, &home.createUid, &home.parentHid,
+			&home.timezone, &home.address, &home.latitude, &home.longitude)
+		if err != nil {
+			log.Errorf("parse the home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+			return nil, err
+		}
+		list = append(list, home)
+	}
+	return list, nil
+}
+
 func (this *HomeManager) deleteHome(domain string, hid int64) error {
 	SQL := fmt.Sprintf("DELETE FROM %s_home_info WHERE hid = ?", domain)
 	stmt, err := this.store.db.Prepare(SQL)
@@ -203,8 +900,8 @@ func (this *HomeManager) deleteHome(domain string, hid int64) error {
 	return nil
 }
 
-func (this *HomeManager) insertHome(domain string, uid int64, name string) (int64, error) {
-	// TODO modify this in one transaction
+// insert the home in a transaction with the user homes quota checked
+func (this *HomeManager) insertHome(domain string, uid int64, name string, limit int64) (hid int64, err error) {
 	SQL := fmt.Sprintf("INSERT INTO %s_home_info(name, status, create_uid) VALUES(?,?,?)", domain)
 	stmt, err := this.store.db.Prepare(SQL)
 	if err != nil {
@@ -212,15 +909,108 @@ func (this *HomeManager) insertHome(domain string, uid int64, name string) (int6
 		return -1, err
 	}
 	defer stmt.Close()
-	result, err := stmt.Exec(name, ACTIVE, uid)
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], createUid[%d], err[%v]", domain, uid, err)
+		return -1, err
+	}
+	defer rollback(&err, tx)
+	result, err := tx.Stmt(stmt).Exec(name, ACTIVE, uid)
 	if err != nil {
 		log.Errorf("create new home failed:domain[%s], createUid[%d], name[%s], err[%v]", domain, uid, name, err)
 		return -1, err
 	}
-	hid, err := result.LastInsertId()
+	hid, err = result.LastInsertId()
 	if err != nil {
 		log.Errorf("get last insert id failed:domain[%s], createUid[%d], name[%s], err[%v]", domain, uid, name, err)
 		return -1, err
 	}
+	err = checkQuota(tx, domain, QUOTA_HOMES, uid, limit)
+	if err != nil {
+		return -1, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], createUid[%d], name[%s], err[%v]", domain, uid, name, err)
+		return -1, err
+	}
 	return hid, nil
 }
+
+func (this *HomeManager) transferHome(domain string, hid, uid, newUid int64, keepOld bool, limit int64) error {
+	SQL1 := fmt.Sprintf("UPDATE %s_home_info SET create_uid = ? WHERE hid = ? AND create_uid = ?", domain)
+	stmt1, err := this.store.db.Prepare(SQL1)
+	if err != nil {
+		log.Errorf("prepare update owner failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	defer stmt1.Close()
+	SQL2 := fmt.Sprintf("UPDATE %s_home_members SET type = ? WHERE hid = ? AND uid = ?", domain)
+	stmt2, err := this.store.db.Prepare(SQL2)
+	if err != nil {
+		log.Errorf("prepare update member type failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	defer stmt2.Close()
+	SQL3 := fmt.Sprintf("DELETE FROM %s_home_members WHERE hid = ? AND uid = ?", domain)
+	stmt3, err := this.store.db.Prepare(SQL3)
+	if err != nil {
+		log.Errorf("prepare delete old owner failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	defer stmt3.Close()
+	// the new owner not limited by the time range and the schedule any more
+	SQL4 := fmt.Sprintf("UPDATE %s_home_members SET type = ?, valid_from = NULL, valid_until = NULL, schedule = NULL WHERE hid = ? AND uid = ?", domain)
+	stmt4, err := this.store.db.Prepare(SQL4)
+	if err != nil {
+		log.Errorf("prepare update new owner failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	defer stmt4.Close()
+
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	defer rollback(&err, tx)
+	result, err := tx.Stmt(stmt1).Exec(newUid, hid, uid)
+	if err != nil {
+		log.Errorf("update home owner failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, newUid, err)
+		return err
+	}
+	affect, err := result.RowsAffected()
+	if err != nil {
+		log.Warningf("get affected rows failed:err[%v]", err)
+		return err
+	} else if affect != 1 {
+		log.Warningf("check the home owner changed:domain[%s], hid[%d], uid[%d]", domain, hid, uid)
+		err = common.ErrNoPrivelige
+		return err
+	}
+	_, err = tx.Stmt(stmt4).Exec(MASTER, hid, newUid)
+	if err != nil {
+		log.Errorf("update new owner type failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, newUid, err)
+		return err
+	}
+	if keepOld {
+		_, err = tx.Stmt(stmt2).Exec(NORMAL, hid, uid)
+	} else {
+		_, err = tx.Stmt(stmt3).Exec(hid, uid)
+	}
+	if err != nil {
+		log.Errorf("demote old owner failed:domain[%s], hid[%d], uid[%d], keep[%t], err[%v]", domain, hid, uid, keepOld, err)
+		return err
+	}
+	// the new owner homes count can not exceed the quota
+	err = checkQuota(tx, domain, QUOTA_HOMES, newUid, limit)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	return nil
+}
@@ -2,7 +2,10 @@ package device
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+	"time"
+	"zc-common-go/common"
 )
 
 func TestCreatemanager(t *testing.T) {
@@ -74,13 +77,13 @@ func TestDeletemanager(t *testing.T) {
 
 	// delete all managers
 	for _, home := range list {
-		err = manager.Delete(domain, home.hid)
+		err = manager.Delete(uid, domain, home.hid)
 		if err != nil {
 			t.Errorf("delete home failed:hid[%d], err[%v]", home.hid, err)
 		}
 
 		// delete not exist return nil
-		err = manager.Delete(domain, home.hid)
+		err = manager.Delete(uid, domain, home.hid)
 		if err != nil {
 			t.Errorf("delete not exist home failed:hid[%d], err[%v]", home.hid, err)
 		}
@@ -155,3 +158,327 @@ func TestDisable(t *testing.T) {
 	store.Clean(domain, "home_info")
 	store.Clean(domain, "home_members")
 }
+
+func TestTransferHome(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	manager := NewHomeManager(store)
+	member := NewMemberManager(store)
+	defer store.Destory()
+	var uid int64 = 1
+	hid, err := CreateHome(uid, store)
+	if err != nil {
+		t.Error("create home failed", err)
+	}
+	var newUid int64 = 2
+	// not a member
+	err = manager.Transfer(domain, hid, uid, newUid, true)
+	if err == nil {
+		t.Error("transfer home to not member succ")
+	}
+	err = member.AddMember(domain, hid, newUid, "guest")
+	if err != nil {
+		t.Error("add member failed", err)
+	}
+	// not the owner
+	err = manager.Transfer(domain, hid, newUid, uid, true)
+	if err == nil {
+		t.Error("transfer home by not owner succ")
+	}
+	// frozen member
+	err = member.Disable(domain, hid, newUid)
+	if err != nil {
+		t.Error("disable member failed", err)
+	}
+	err = manager.Transfer(domain, hid, uid, newUid, true)
+	if err == nil {
+		t.Error("transfer home to frozen member succ")
+	}
+	err = member.Enable(domain, hid, newUid)
+	if err != nil {
+		t.Error("enable member failed", err)
+	}
+	// the time limit of the new owner cleared
+	err = member.SetValidity(domain, hid, uid, newUid, time.Time{}, time.Now().Add(time.Hour), "1@09:00-17:00")
+	if err != nil {
+		t.Error("set member validity failed", err)
+	}
+	// keep the old owner as normal member
+	err = manager.Transfer(domain, hid, uid, newUid, true)
+	if err != nil {
+		t.Error("transfer home failed", err)
+	}
+	home, err := manager.Get(domain, hid)
+	if err != nil || home == nil || home.GetCreateUid() != newUid {
+		t.Errorf("check home owner failed:err[%v]", err)
+	}
+	owner, err := member.Get(domain, hid, newUid)
+	if err != nil || owner == nil || owner.GetMemberType() != MASTER {
+		t.Errorf("check new owner type failed:err[%v]", err)
+	} else if !owner.GetValidUntil().IsZero() || len(owner.GetSchedule()) != 0 {
+		t.Error("check new owner validity cleared failed")
+	}
+	old, err := member.Get(domain, hid, uid)
+	if err != nil || old == nil || old.GetMemberType() != NORMAL {
+		t.Errorf("check old owner type failed:err[%v]", err)
+	}
+	// transfer back and remove the old owner
+	err = manager.Transfer(domain, hid, newUid, uid, false)
+	if err != nil {
+		t.Error("transfer home back failed", err)
+	}
+	old, err = member.Get(domain, hid, newUid)
+	if err != nil || old != nil {
+		t.Errorf("check old owner removed failed:err[%v]", err)
+	}
+	store.Clean(domain, "home_info")
+	store.Clean(domain, "home_members")
+}
+
+func TestSiteHierarchy(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	manager := NewHomeManager(store)
+	defer store.Destory()
+	store.Clean(domain, "grant_revocation")
+	var uid int64 = 1
+	for i := 0; i < 3; i++ {
+		err := manager.Create(domain, uid, fmt.Sprintf("node%d", i))
+		if err != nil {
+			t.Error("create home failed", err)
+		}
+	}
+	list, err := manager.GetAllHome(domain, uid)
+	if err != nil || len(list) != 3 {
+		t.Fatalf("get user all home failed:err[%v], len[%d]", err, len(list))
+	}
+	// node0 > node1 > node2
+	err = manager.SetParent(domain, uid, list[1].hid, list[0].hid)
+	if err != nil {
+		t.Error("set parent failed", err)
+	}
+	err = manager.SetParent(domain, uid, list[2].hid, list[1].hid)
+	if err != nil {
+		t.Error("set parent failed", err)
+	}
+	// not the owner
+	err = manager.SetParent(domain, uid+1, list[2].hid, list[0].hid)
+	if err == nil {
+		t.Error("set parent by not owner succ")
+	}
+	// cycle
+	err = manager.SetParent(domain, uid, list[0].hid, list[2].hid)
+	if err == nil {
+		t.Error("set parent with cycle succ")
+	}
+	path, err := manager.GetAncestors(domain, list[2].hid)
+	if err != nil || len(path) != 3 {
+		t.Errorf("get ancestors failed:err[%v], len[%d]", err, len(path))
+	} else if path[0].hid != list[2].hid || path[2].hid != list[0].hid {
+		t.Error("check ancestors order failed")
+	}
+	children, err := manager.GetChildren(domain, list[0].hid)
+	if err != nil || len(children) != 1 || children[0].hid != list[1].hid {
+		t.Errorf("get children failed:err[%v], len[%d]", err, len(children))
+	}
+	// can not delete the home with children
+	err = manager.Delete(uid, domain, list[1].hid)
+	if err == nil {
+		t.Error("delete home with children succ")
+	}
+	err = manager.SetParent(domain, uid, list[2].hid, 0)
+	if err != nil {
+		t.Error("reset parent failed", err)
+	}
+	// the members of the old ancestors lost the access to the detached home
+	revocations, err := NewRevocationManager(store).GetAll(domain)
+	if err != nil || len(revocations) != 1 || revocations[0].GetSubjectType() != REVOKE_SUBJECT_HOME ||
+		revocations[0].GetSubject() != list[2].hid {
+		t.Errorf("check the detached home revoked failed:err[%v], len[%d]", err, len(revocations))
+	}
+	err = manager.Delete(uid, domain, list[1].hid)
+	if err != nil {
+		t.Error("delete home failed", err)
+	}
+	// the site depth include the subtree of the home
+	for i := 0; i < MAX_SITE_DEPTH-1; i++ {
+		err = manager.Create(domain, uid, fmt.Sprintf("chain%d", i))
+		if err != nil {
+			t.Error("create home failed", err)
+		}
+	}
+	homes, err := manager.GetAllHome(domain, uid)
+	if err != nil || len(homes) != MAX_SITE_DEPTH+1 {
+		t.Fatalf("get user all home failed:err[%v], len[%d]", err, len(homes))
+	}
+	chain := make([]int64, 0)
+	for _, home := range homes {
+		if strings.HasPrefix(home.GetName(), "chain") {
+			chain = append(chain, home.hid)
+		}
+	}
+	for i := 1; i < len(chain); i++ {
+		err = manager.SetParent(domain, uid, chain[i], chain[i-1])
+		if err != nil {
+			t.Error("set chain parent failed", err)
+		}
+	}
+	err = manager.SetParent(domain, uid, list[2].hid, list[0].hid)
+	if err != nil {
+		t.Error("set parent failed", err)
+	}
+	err = manager.SetParent(domain, uid, chain[0], list[2].hid)
+	if err != common.ErrNotAllowed {
+		t.Error("set parent exceed the site depth succ", err)
+	}
+	err = manager.SetParent(domain, uid, chain[0], list[0].hid)
+	if err != nil {
+		t.Error("set parent at the max site depth failed", err)
+	}
+	store.Clean(domain, "home_info")
+	store.Clean(domain, "home_members")
+	store.Clean(domain, "grant_revocation")
+}
+
+func TestHomeAttributes(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	manager := NewHomeManager(store)
+	defer store.Destory()
+	var uid int64 = 1
+	err := manager.Create(domain, uid, "home")
+	if err != nil {
+		t.Error("create home failed", err)
+	}
+	list, err := manager.GetAllHome(domain, uid)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("get user all home failed:err[%v], len[%d]", err, len(list))
+	}
+	hid := list[0].hid
+	err = manager.ModifyLocation(domain, hid, "Invalid/Zone", "", 0, 0)
+	if err == nil {
+		t.Error("modify invalid timezone succ")
+	}
+	err = manager.ModifyLocation(domain, hid, "", "", 91, 0)
+	if err == nil {
+		t.Error("modify invalid latitude succ")
+	}
+	err = manager.ModifyLocation(domain, hid, "Asia/Shanghai", "Beijing", 39.9, 116.4)
+	if err != nil {
+		t.Error("modify home location failed", err)
+	}
+	home, err := manager.Get(domain, hid)
+	if err != nil || home == nil {
+		t.Error("get home failed", err)
+	} else if home.GetTimezone() != "Asia/Shanghai" || home.GetAddress() != "Beijing" ||
+		home.GetLatitude() != 39.9 || home.GetLongitude() != 116.4 {
+		t.Error("check home location failed")
+	}
+	err = manager.SetMetadata(domain, hid, map[string]string{"partner": "zc", "floor": "3"})
+	if err != nil {
+		t.Error("set home metadata failed", err)
+	}
+	err = manager.SetMetadata(domain, hid, map[string]string{"floor": ""})
+	if err != nil {
+		t.Error("delete home metadata failed", err)
+	}
+	metadata, err := manager.GetMetadata(domain, hid)
+	if err != nil || len(metadata) != 1 || metadata["partner"] != "zc" {
+		t.Errorf("get home metadata failed:err[%v], len[%d]", err, len(metadata))
+	}
+	// exceed the max metadata count
+	values := make(map[string]string)
+	for i := 0; i < MAX_HOME_METADATA; i++ {
+		values[fmt.Sprintf("key%d", i)] = "value"
+	}
+	err = manager.SetMetadata(domain, hid, values)
+	if err != ErrQuotaExceeded {
+		t.Error("set metadata exceed the max count", err)
+	}
+	// modify the name, part of the location and metadata at once, rollback all if failed
+	update := NewHomeUpdate()
+	update.SetName("modified")
+	update.SetAddress("Shanghai")
+	update.SetMetadata(map[string]string{"floor": "5"})
+	err = manager.Modify(domain, hid, update)
+	if err != nil {
+		t.Error("modify home failed", err)
+	}
+	home, err = manager.Get(domain, hid)
+	if err != nil || home == nil {
+		t.Error("get home failed", err)
+	} else if home.GetName() != "modified" || home.GetAddress() != "Shanghai" || home.GetTimezone() != "Asia/Shanghai" {
+		t.Error("check the modified home failed")
+	}
+	update = NewHomeUpdate()
+	update.SetName("rollback")
+	update.SetMetadata(values)
+	err = manager.Modify(domain, hid, update)
+	if err != ErrQuotaExceeded {
+		t.Error("modify metadata exceed the max count", err)
+	}
+	all, err := manager.GetAllMetadata(domain, []int64{hid, hid + 1000})
+	if err != nil || len(all) != 2 || len(all[hid]) != 2 || all[hid]["floor"] != "5" || len(all[hid+1000]) != 0 {
+		t.Errorf("get all metadata failed:err[%v], len[%d]", err, len(all))
+	}
+	home, err = manager.Get(domain, hid)
+	if err != nil || home == nil || home.GetName() != "modified" {
+		t.Error("check the rollback home name failed", err)
+	}
+	err = manager.Delete(uid, domain, hid)
+	if err != nil {
+		t.Error("delete home failed", err)
+	}
+	metadata, err = manager.GetMetadata(domain, hid)
+	if err != nil || len(metadata) != 0 {
+		t.Errorf("check the deleted home metadata failed:err[%v], len[%d]", err, len(metadata))
+	}
+	store.Clean(domain, "home_info")
+	store.Clean(domain, "home_members")
+}
+
+func TestHomeDetail(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	prepare(store)
+	home := NewHomeManager(store)
+	var uid int64 = 100
+	list, err := home.GetAllHome(domain, uid)
+	if err != nil || len(list) != 5 {
+		t.Fatalf("get user all home failed:err[%v], len[%d]", err, len(list))
+	}
+	detail, err := home.GetDetail(domain, list[0].hid)
+	if err != nil || detail == nil {
+		t.Fatal("get home detail failed", err)
+	}
+	if detail.GetHome().GetHid() != list[0].hid || detail.GetHome().GetCreateUid() != uid {
+		t.Error("check the home failed")
+	}
+	if len(detail.GetMembers()) != 1 || detail.GetMembers()[0].GetMemberType() != ROLE_OWNER {
+		t.Error("check the members failed", len(detail.GetMembers()))
+	}
+	// 2 master/home, 3 slave/master
+	if len(detail.GetMasters()) != 2 || len(detail.GetDetached()) != 0 {
+		t.Error("check the masters failed", len(detail.GetMasters()))
+	}
+	for _, master := range detail.GetMasters() {
+		if len(detail.GetSlaves(master.GetDid())) != 3 {
+			t.Error("check the slaves failed", master.GetDid())
+		}
+	}
+	// not exist home
+	detail, err = home.GetDetail(domain, 1000000)
+	if err != nil || detail != nil {
+		t.Error("get not exist home detail", err)
+	}
+	cleanAll(store)
+}
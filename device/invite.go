@@ -0,0 +1,79 @@
+package device
+
+import (
+	"database/sql"
+	"time"
+	"zc-common-go/mysql"
+)
+
+// invite status
+const (
+	INVITE_PENDING  = 1
+	INVITE_ACCEPTED = 2
+	INVITE_DECLINED = 3
+	INVITE_REVOKED  = 4
+)
+
+// the invitation of joining a home, sent to one invitee uid or shared
+// as a code which can be used by max uses users before expired
+type Invite struct {
+	id         int64
+	hid        int64
+	uid        int64
+	invitee    int64
+	role       int8
+	code       sql.NullString
+	maxUses    int64
+	used       int64
+	status     int8
+	expireTime mysql.NullTime
+}
+
+func (this *Invite) GetId() int64 {
+	return this.id
+}
+
+func (this *Invite) GetHid() int64 {
+	return this.hid
+}
+
+// the inviter uid
+func (this *Invite) GetUid() int64 {
+	return this.uid
+}
+
+// the invitee uid, 0 if it is a shareable code
+func (this *Invite) GetInvitee() int64 {
+	return this.invitee
+}
+
+// the role of the member created by accepting the invite
+func (this *Invite) GetRole() int8 {
+	return this.role
+}
+
+func (this *Invite) GetCode() string {
+	return this.code.String
+}
+
+func (this *Invite) GetMaxUses() int64 {
+	return this.maxUses
+}
+
+func (this *Invite) GetUsed() int64 {
+	return this.used
+}
+
+func (this *Invite) GetStatus() int8 {
+	return this.status
+}
+
+func (this *Invite) GetExpireTime() time.Time {
+	return this.expireTime.Time
+}
+
+// the pending invite not expired and not used up
+func (this *Invite) IsValid() bool {
+	return this.status == INVITE_PENDING && this.used < this.maxUses &&
+		this.expireTime.Valid && time.Now().Before(this.expireTime.Time)
+}
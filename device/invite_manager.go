@@ -0,0 +1,472 @@
+package device
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+	"zc-common-go/common"
+	log "zc-common-go/glog"
+	_ "zc-common-go/mysql"
+)
+
+const (
+	// default and max expire duration of the invite
+	INVITE_EXPIRE     = 72 * time.Hour
+	MAX_INVITE_EXPIRE = 30 * 24 * time.Hour
+	// max uses of one shareable invite code
+	MAX_INVITE_USES = 100
+)
+
+type InviteManager struct {
+	store *DeviceStorage
+}
+
+func NewInviteManager(store *DeviceStorage) *InviteManager {
+	return &InviteManager{store: store}
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// public interface
+////////////////////////////////////////////////////////////////////////////////////
+// if find the record return invite + nil, else if no record return nil + nil
+func (this *InviteManager) Get(domain string, id int64) (*Invite, error) {
+	common.CheckParam(this.store != nil)
+	var invite Invite
+	err := this.getInvite(domain, "id", id, &invite)
+	if err != nil {
+		if err == common.ErrEntryNotExist {
+			return nil, nil
+		}
+		log.Warningf("get invite failed:domain[%s], id[%d], err[%v]", domain, id, err)
+		return nil, err
+	}
+	return &invite, nil
+}
+
+// get the invite by the shareable code, if no record return nil + nil
+func (this *InviteManager) GetByCode(domain, code string) (*Invite, error) {
+	common.CheckParam(this.store != nil)
+	var invite Invite
+	err := this.getInvite(domain, "code", code, &invite)
+	if err != nil {
+		if err == common.ErrEntryNotExist {
+			return nil, nil
+		}
+		log.Warningf("get invite failed:domain[%s], code[%s], err[%v]", domain, code, err)
+		return nil, err
+	}
+	return &invite, nil
+}
+
+// the user who can manage members invite one user to join the home as the role,
+// return the invite id
+func (this *InviteManager) Invite(domain string, uid, hid, invitee int64, role int8, expire time.Duration) (int64, error) {
+	common.CheckParam(this.store != nil)
+	if invitee <= 0 || invitee == uid || expire <= 0 || expire > MAX_INVITE_EXPIRE {
+		log.Warningf("check the invite param failed:domain[%s], hid[%d], invitee[%d], expire[%v]", domain, hid, invitee, expire)
+		return -1, common.ErrInvalidParam
+	}
+	err := this.checkManager(domain, uid, hid, role)
+	if err != nil {
+		return -1, err
+	}
+	member, err := NewMemberManager(this.store).Get(domain, hid, invitee)
+	if err != nil {
+		log.Warningf("get member failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, invitee, err)
+		return -1, err
+	} else if member != nil {
+		log.Warningf("the invitee already member:domain[%s], hid[%d], uid[%d]", domain, hid, invitee)
+		return -1, common.ErrNotAllowed
+	}
+	id, err := this.insertInvite(domain, uid, hid, invitee, role, nil, 1, time.Now().Add(expire))
+	if err != nil {
+		log.Warningf("insert invite failed:domain[%s], hid[%d], invitee[%d], err[%v]", domain, hid, invitee, err)
+		return -1, err
+	}
+	return id, nil
+}
+
+// the user who can manage members create a shareable invite code which can be accepted
+// by max uses users as the role
+func (this *InviteManager) CreateCode(domain string, uid, hid int64, role int8, maxUses int64, expire time.Duration) (*Invite, error) {
+	common.CheckParam(this.store != nil)
+	if maxUses <= 0 || maxUses > MAX_INVITE_USES || expire <= 0 || expire > MAX_INVITE_EXPIRE {
+		log.Warningf("check the invite param failed:domain[%s], hid[%d], uses[%d], expire[%v]", domain, hid, maxUses, expire)
+		return nil, common.ErrInvalidParam
+	}
+	err := this.checkManager(domain, uid, hid, role)
+	if err != nil {
+		return nil, err
+	}
+	code, err := newBindToken()
+	if err != nil {
+		log.Errorf("generate invite code failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	id, err := this.insertInvite(domain, uid, hid, 0, role, code, maxUses, time.Now().Add(expire))
+	if err != nil {
+		log.Warningf("insert invite code failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	return this.Get(domain, id)
+}
+
+// get all the invites of the home for the user who can manage members, if no invite
+// return empty list
+func (this *InviteManager) GetAll(domain string, uid, hid int64) ([]Invite, error) {
+	common.CheckParam(this.store != nil)
+	err := this.checkManager(domain, uid, hid, ROLE_MEMBER)
+	if err != nil {
+		return nil, err
+	}
+	list, err := this.getInvites(domain, "hid", hid)
+	if err != nil {
+		log.Warningf("get home all invites failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	return list, nil
+}
+
+// get all the valid invites sent to the user, if no invite return empty list
+func (this *InviteManager) GetPending(domain string, uid int64) ([]Invite, error) {
+	common.CheckParam(this.store != nil)
+	all, err := this.getInvites(domain, "invitee", uid)
+	if err != nil {
+		log.Warningf("get user all invites failed:domain[%s], uid[%d], err[%v]", domain, uid, err)
+		return nil, err
+	}
+	list := make([]Invite, 0, len(all))
+	for _, invite := range all {
+		if invite.IsValid() {
+			list = append(list, invite)
+		}
+	}
+	return list, nil
+}
+
+// accept the invite sent to the user, the member inserted as the name
+func (this *InviteManager) Accept(domain string, uid, id int64, name string) error {
+	common.CheckParam(this.store != nil)
+	invite, err := this.Get(domain, id)
+	if err != nil {
+		return err
+	} else if invite == nil {
+		log.Warningf("invite not exist:domain[%s], id[%d]", domain, id)
+		return common.ErrEntryNotExist
+	} else if invite.GetInvitee() != uid {
+		log.Warningf("check the invitee failed:domain[%s], id[%d], uid[%d]", domain, id, uid)
+		return common.ErrNoPrivelige
+	}
+	return this.accept(domain, uid, invite, name)
+}
+
+// accept the shareable invite code, the member inserted as the name
+func (this *InviteManager) AcceptCode(domain string, uid int64, code, name string) error {
+	common.CheckParam(this.store != nil)
+	if len(code) <= 0 {
+		return common.ErrInvalidParam
+	}
+	invite, err := this.GetByCode(domain, code)
+	if err != nil {
+		return err
+	} else if invite == nil {
+		log.Warningf("invite code not exist:domain[%s], code[%s]", domain, code)
+		return common.ErrEntryNotExist
+	}
+	return this.accept(domain, uid, invite, name)
+}
+
+// the invitee decline the invite sent to the user
+func (this *InviteManager) Decline(domain string, uid, id int64) error {
+	common.CheckParam(this.store != nil)
+	invite, err := this.Get(domain, id)
+	if err != nil {
+		return err
+	} else if invite == nil {
+		log.Warningf("invite not exist:domain[%s], id[%d]", domain, id)
+		return common.ErrEntryNotExist
+	} else if invite.GetInvitee() != uid {
+		log.Warningf("check the invitee failed:domain[%s], id[%d], uid[%d]", domain, id, uid)
+		return common.ErrNoPrivelige
+	}
+	return this.modifyInviteStatus(domain, id, INVITE_PENDING, INVITE_DECLINED)
+}
+
+// the user who can manage members revoke the pending invite
+func (this *InviteManager) Revoke(domain string, uid, id int64) error {
+	common.CheckParam(this.store != nil)
+	invite, err := this.Get(domain, id)
+	if err != nil {
+		return err
+	} else if invite == nil {
+		log.Warningf("invite not exist:domain[%s], id[%d]", domain, id)
+		return common.ErrEntryNotExist
+	}
+	err = this.checkManager(domain, uid, invite.GetHid(), invite.GetRole())
+	if err != nil {
+		return err
+	}
+	return this.modifyInviteStatus(domain, id, INVITE_PENDING, INVITE_REVOKED)
+}
+
+// delete all the invites of the home
+func (this *InviteManager) DeleteAllInvites(domain string, hid int64) error {
+	common.CheckParam(this.store != nil)
+	err := this.deleteAllInvites(domain, hid)
+	if err != nil {
+		log.Warningf("delete home all invites failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	return nil
+}
+
+// the home must be active and the user can manage members, only the owner can invite admin
+func (this *InviteManager) checkManager(domain string, uid, hid int64, role int8) error {
+	if !IsValidRole(role) || role == ROLE_OWNER {
+		log.Warningf("check the invite role failed:domain[%s], hid[%d], role[%d]", domain, hid, role)
+		return common.ErrInvalidParam
+	}
+	home, err := NewHomeManager(this.store).Get(domain, hid)
+	if err != nil {
+		log.Warningf("get home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	} else if home == nil {
+		log.Warningf("home not exist:domain[%s], hid[%d]", domain, hid)
+		return common.ErrEntryNotExist
+	} else if home.GetStatus() != ACTIVE {
+		log.Warningf("home is not active:domain[%s], hid[%d]", domain, hid)
+		return common.ErrInvalidStatus
+	}
+	member, err := NewMemberManager(this.store).CheckPermission(domain, hid, uid, PERM_MANAGE_MEMBER)
+	if err != nil {
+		return err
+	} else if role == ROLE_ADMIN && member.GetMemberType() != ROLE_OWNER {
+		log.Warningf("only the owner can invite admin:domain[%s], hid[%d], uid[%d]", domain, hid, uid)
+		return common.ErrNoPrivelige
+	}
+	return nil
+}
+
+// check the invite and the home, then insert the member with the invite used
+func (this *InviteManager) accept(domain string, uid int64, invite *Invite, name string) error {
+	if len(name) <= 0 {
+		log.Warningf("check member name failed:domain[%s], id[%d], uid[%d]", domain, invite.GetId(), uid)
+		return common.ErrInvalidName
+	} else if !invite.IsValid() {
+		log.Warningf("check the invite failed:domain[%s], id[%d], status[%d], used[%d]",
+			domain, invite.GetId(), invite.GetStatus(), invite.GetUsed())
+		return common.ErrInvalidStatus
+	}
+	home, err := NewHomeManager(this.store).Get(domain, invite.GetHid())
+	if err != nil {
+		log.Warningf("get home failed:domain[%s], hid[%d], err[%v]", domain, invite.GetHid(), err)
+		return err
+	} else if home == nil {
+		log.Warningf("home not exist:domain[%s], hid[%d]", domain, invite.GetHid())
+		return common.ErrEntryNotExist
+	} else if home.GetStatus() != ACTIVE {
+		log.Warningf("home is not active:domain[%s], hid[%d]", domain, invite.GetHid())
+		return common.ErrInvalidStatus
+	}
+	// the expired members deleted at first not to occupy the quota
+	manager := NewMemberManager(this.store)
+	err = manager.DeleteExpired(domain, invite.GetHid())
+	if err != nil {
+		return err
+	}
+	member, err := manager.Get(domain, invite.GetHid(), uid)
+	if err != nil {
+		log.Warningf("get member failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, invite.GetHid(), uid, err)
+		return err
+	} else if member != nil {
+		log.Warningf("the user already member:domain[%s], hid[%d], uid[%d]", domain, invite.GetHid(), uid)
+		return common.ErrNotAllowed
+	}
+	quota, err := NewQuotaManager(this.store).Get(domain)
+	if err != nil {
+		log.Warningf("get domain quota failed:domain[%s], err[%v]", domain, err)
+		return err
+	}
+	err = this.acceptInvite(domain, uid, invite.GetHid(), invite.GetId(), invite.GetRole(), name, quota.GetMembers())
+	if err != nil {
+		log.Warningf("accept invite failed:domain[%s], id[%d], uid[%d], err[%v]", domain, invite.GetId(), uid, err)
+		return err
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// database related private interface
+////////////////////////////////////////////////////////////////////////////////////
+func (this *InviteManager) getInvite(domain, key string, value interface{}, invite *Invite) error {
+	SQL := fmt.Sprintf("SELECT id, hid, uid, invitee, role, code, max_uses, used, status, expire_time FROM %s_home_invite WHERE %s = ?",
+		domain, key)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], err[%v]", domain, err)
+		return err
+	}
+	defer stmt.Close()
+	err = stmt.QueryRow(value).Scan(&invite.id, &invite.hid, &invite.uid, &invite.invitee, &invite.role, &invite.code,
+		&invite.maxUses, &invite.used, &invite.status, &invite.expireTime)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return common.ErrEntryNotExist
+		}
+		log.Warningf("query invite failed:domain[%s], key[%s], value[%v], err[%v]", domain, key, value, err)
+		return err
+	}
+	return nil
+}
+
+func (this *InviteManager) getInvites(domain, key string, value int64) ([]Invite, error) {
+	SQL := fmt.Sprintf("SELECT id, hid, uid, invitee, role, code, max_uses, used, status, expire_time FROM %s_home_invite WHERE %s = ? ORDER BY id",
+		domain, key)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], err[%v]", domain, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(value)
+	if err != nil {
+		log.Errorf("query invites failed:domain[%s], key[%s], value[%d], err[%v]", domain, key, value, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var invite Invite
+	list := make([]Invite, 0)
+	for rows.Next() {
+		err = rows.Scan(&invite.id, &invite.hid, &invite.uid, &invite.invitee, &invite.role, &invite.code,
+			&invite.maxUses, &invite.used, &invite.status, &invite.expireTime)
+		if err != nil {
+			log.Errorf("parse the invite failed:domain[%s], key[%s], value[%d], err[%v]", domain, key, value, err)
+			return nil, err
+		}
+		list = append(list, invite)
+	}
+	return list, nil
+}
+
+// the code is nil for the invite sent to the invitee
+func (this *InviteManager) insertInvite(domain string, uid, hid, invitee int64, role int8, code interface{}, maxUses int64, expire time.Time) (int64, error) {
+	SQL := fmt.Sprintf("INSERT INTO %s_home_invite(hid, uid, invitee, role, code, max_uses, used, status, expire_time, create_time) VALUES(?,?,?,?,?,?,0,?,?,NOW())",
+		domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], err[%v]", domain, err)
+		return -1, err
+	}
+	defer stmt.Close()
+	result, err := stmt.Exec(hid, uid, invitee, role, code, maxUses, INVITE_PENDING, expire)
+	if err != nil {
+		log.Errorf("insert invite failed:domain[%s], hid[%d], uid[%d], invitee[%d], err[%v]", domain, hid, uid, invitee, err)
+		return -1, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Errorf("get last insert id failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return -1, err
+	}
+	return id, nil
+}
+
+func (this *InviteManager) modifyInviteStatus(domain string, id int64, from, to int8) error {
+	SQL := fmt.Sprintf("UPDATE %s_home_invite SET status = ? WHERE id = ? AND status = ?", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], err[%v]", domain, err)
+		return err
+	}
+	defer stmt.Close()
+	result, err := stmt.Exec(to, id, from)
+	if err != nil {
+		log.Errorf("update invite status failed:domain[%s], id[%d], status[%d], err[%v]", domain, id, to, err)
+		return err
+	}
+	affect, err := result.RowsAffected()
+	if err != nil {
+		log.Warningf("get affected rows failed:err[%v]", err)
+		return err
+	} else if affect != 1 {
+		log.Warningf("check the invite status failed:domain[%s], id[%d], status[%d]", domain, id, from)
+		return common.ErrInvalidStatus
+	}
+	return nil
+}
+
+// use the invite and insert the member in a transaction with the home members quota checked
+func (this *InviteManager) acceptInvite(domain string, uid, hid, id int64, role int8, name string, limit int64) (err error) {
+	// set the status at first for the used is the old value
+	SQL1 := fmt.Sprintf("UPDATE %s_home_invite SET status = IF(used + 1 >= max_uses, ?, status), used = used + 1 "+
+		"WHERE id = ? AND status = ? AND used < max_uses AND expire_time > NOW()", domain)
+	stmt1, err := this.store.db.Prepare(SQL1)
+	if err != nil {
+		log.Errorf("prepare use invite failed:domain[%s], id[%d], err[%v]", domain, id, err)
+		return err
+	}
+	defer stmt1.Close()
+	SQL2 := fmt.Sprintf("INSERT INTO %s_home_members(uid, hid, type, name, status) VALUES(?,?,?,?,?)", domain)
+	stmt2, err := this.store.db.Prepare(SQL2)
+	if err != nil {
+		log.Errorf("prepare insert member failed:domain[%s], id[%d], err[%v]", domain, id, err)
+		return err
+	}
+	defer stmt2.Close()
+
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], id[%d], err[%v]", domain, id, err)
+		return err
+	}
+	defer rollback(&err, tx)
+	err = lockHome(tx, domain, hid)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Stmt(stmt1).Exec(INVITE_ACCEPTED, id, INVITE_PENDING)
+	if err != nil {
+		log.Errorf("use invite failed:domain[%s], id[%d], err[%v]", domain, id, err)
+		return err
+	}
+	affect, err := result.RowsAffected()
+	if err != nil {
+		log.Warningf("get affected rows failed:err[%v]", err)
+		return err
+	} else if affect != 1 {
+		log.Warningf("check the invite changed:domain[%s], id[%d]", domain, id)
+		err = common.ErrInvalidStatus
+		return err
+	}
+	_, err = tx.Stmt(stmt2).Exec(uid, hid, role, name, ACTIVE)
+	if err != nil {
+		log.Warningf("insert the member failed:domain[%s], uid[%d], hid[%d], err[%v]", domain, uid, hid, err)
+		return err
+	}
+	err = checkQuota(tx, domain, QUOTA_MEMBERS, hid, limit)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], id[%d], uid[%d], err[%v]", domain, id, uid, err)
+		return err
+	}
+	return nil
+}
+
+func (this *InviteManager) deleteAllInvites(domain string, hid int64) error {
+	SQL := fmt.Sprintf("DELETE FROM %s_home_invite WHERE hid = ?", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], err[%v]", domain, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(hid)
+	if err != nil {
+		log.Errorf("delete home all invites failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	return nil
+}
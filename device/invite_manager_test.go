@@ -0,0 +1,136 @@
+package device
+
+import (
+	"testing"
+	"time"
+	"zc-common-go/common"
+)
+
+func TestInviteManager(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	var owner int64 = 1
+	home := NewHomeManager(store)
+	err := home.Create(domain, owner, "home")
+	if err != nil {
+		t.Error("create home failed", err)
+	}
+	list, err := home.GetAllHome(domain, owner)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("get user all home failed:err[%v], len[%d]", err, len(list))
+	}
+	hid := list[0].hid
+	manager := NewInviteManager(store)
+	member := NewMemberManager(store)
+	// only the owner can invite
+	_, err = manager.Invite(domain, 2, hid, 3, ROLE_MEMBER, INVITE_EXPIRE)
+	if err == nil {
+		t.Error("invite by not owner succ")
+	}
+	id, err := manager.Invite(domain, owner, hid, 2, ROLE_MEMBER, INVITE_EXPIRE)
+	if err != nil {
+		t.Error("invite member failed", err)
+	}
+	pending, err := manager.GetPending(domain, 2)
+	if err != nil || len(pending) != 1 || pending[0].GetId() != id {
+		t.Errorf("get pending invites failed:err[%v], len[%d]", err, len(pending))
+	}
+	// not the member before accepted
+	info, err := member.Get(domain, hid, 2)
+	if err != nil || info != nil {
+		t.Error("check the member before accepted failed", err)
+	}
+	err = manager.Accept(domain, 3, id, "other")
+	if err != common.ErrNoPrivelige {
+		t.Error("accept other user invite", err)
+	}
+	err = manager.Accept(domain, 2, id, "member")
+	if err != nil {
+		t.Error("accept invite failed", err)
+	}
+	info, err = member.Get(domain, hid, 2)
+	if err != nil || info == nil || info.GetMemberName() != "member" {
+		t.Error("check the member after accepted failed", err)
+	}
+	err = manager.Accept(domain, 2, id, "member")
+	if err == nil {
+		t.Error("accept the used invite succ")
+	}
+	// declined and revoked invite can not be accepted
+	id, err = manager.Invite(domain, owner, hid, 3, ROLE_MEMBER, INVITE_EXPIRE)
+	if err != nil {
+		t.Error("invite member failed", err)
+	}
+	err = manager.Decline(domain, 3, id)
+	if err != nil {
+		t.Error("decline invite failed", err)
+	}
+	err = manager.Accept(domain, 3, id, "member")
+	if err == nil {
+		t.Error("accept the declined invite succ")
+	}
+	id, err = manager.Invite(domain, owner, hid, 3, ROLE_MEMBER, INVITE_EXPIRE)
+	if err != nil {
+		t.Error("invite member failed", err)
+	}
+	err = manager.Revoke(domain, 3, id)
+	if err == nil {
+		t.Error("revoke invite by not owner succ")
+	}
+	err = manager.Revoke(domain, owner, id)
+	if err != nil {
+		t.Error("revoke invite failed", err)
+	}
+	err = manager.Accept(domain, 3, id, "member")
+	if err == nil {
+		t.Error("accept the revoked invite succ")
+	}
+	// the shareable code used up by max uses
+	invite, err := manager.CreateCode(domain, owner, hid, ROLE_GUEST, 2, time.Hour)
+	if err != nil || invite == nil || len(invite.GetCode()) == 0 {
+		t.Fatal("create invite code failed", err)
+	}
+	for _, uid := range []int64{4, 5} {
+		err = manager.AcceptCode(domain, uid, invite.GetCode(), "member")
+		if err != nil {
+			t.Error("accept invite code failed", err)
+		}
+	}
+	err = manager.AcceptCode(domain, 6, invite.GetCode(), "member")
+	if err == nil {
+		t.Error("accept the used up invite code succ")
+	}
+	invites, err := manager.GetAll(domain, owner, hid)
+	if err != nil || len(invites) != 4 {
+		t.Errorf("get home all invites failed:err[%v], len[%d]", err, len(invites))
+	}
+	members, err := member.GetAllMembers(domain, hid)
+	if err != nil || len(members) != 4 {
+		t.Errorf("get home all members failed:err[%v], len[%d]", err, len(members))
+	}
+	info, err = member.Get(domain, hid, 5)
+	if err != nil || info == nil || info.GetMemberType() != ROLE_GUEST {
+		t.Error("check the invite code member role failed", err)
+	}
+	// the member can not invite, and only the owner can invite admin
+	_, err = manager.Invite(domain, 2, hid, 6, ROLE_MEMBER, INVITE_EXPIRE)
+	if err != common.ErrNoPrivelige {
+		t.Error("invite by normal member", err)
+	}
+	err = member.ModifyRole(domain, hid, owner, 2, ROLE_ADMIN)
+	if err != nil {
+		t.Error("modify member role failed", err)
+	}
+	_, err = manager.Invite(domain, 2, hid, 6, ROLE_ADMIN, INVITE_EXPIRE)
+	if err != common.ErrNoPrivelige {
+		t.Error("invite admin by admin", err)
+	}
+	_, err = manager.Invite(domain, 2, hid, 6, ROLE_GUEST, INVITE_EXPIRE)
+	if err != nil {
+		t.Error("invite guest by admin failed", err)
+	}
+	cleanAll(store)
+}
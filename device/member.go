@@ -1,11 +1,55 @@
 package device
 
+import (
+	"database/sql"
+	"time"
+	"zc-common-go/mysql"
+)
+
+// the member role stored as the member type, the owner and member
+// roles are compatible with the old master and normal member types
+const (
+	ROLE_MEMBER = NORMAL
+	ROLE_OWNER  = MASTER
+	ROLE_ADMIN  = 2
+	ROLE_GUEST  = 3
+)
+
+// the member permissions
+const (
+	PERM_BIND = 1 << iota
+	PERM_MANAGE_MEMBER
+	PERM_RENAME
+	PERM_FREEZE
+	PERM_CONTROL
+)
+
+// the permission matrix of the roles
+var rolePermissions = map[int8]int{
+	ROLE_OWNER:  PERM_BIND | PERM_MANAGE_MEMBER | PERM_RENAME | PERM_FREEZE | PERM_CONTROL,
+	ROLE_ADMIN:  PERM_BIND | PERM_MANAGE_MEMBER | PERM_RENAME | PERM_FREEZE | PERM_CONTROL,
+	ROLE_MEMBER: PERM_BIND | PERM_RENAME | PERM_CONTROL,
+	ROLE_GUEST:  PERM_CONTROL,
+}
+
+// the role names used by the request and response
+var roleNames = map[int8]string{
+	ROLE_OWNER:  "owner",
+	ROLE_ADMIN:  "admin",
+	ROLE_MEMBER: "member",
+	ROLE_GUEST:  "guest",
+}
+
 type Member struct {
 	uid        int64
 	hid        int64
 	status     int8
 	memberType int8
 	memberName string
+	// the time-bound and scheduled access of the member
+	validFrom  mysql.NullTime
+	validUntil mysql.NullTime
+	schedule   sql.NullString
 }
 
 func NewMember(uid int64, hid int64, name string, memberType, status int8) *Member {
@@ -28,6 +72,103 @@ func (this *Member) GetMemberName() string {
 	return this.memberName
 }
 
+// the member type is the role of the member
 func (this *Member) GetMemberType() int8 {
 	return this.memberType
 }
+
+// check the role of the member has all the permissions
+func (this *Member) HasPermission(perm int) bool {
+	return rolePermissions[this.memberType]&perm == perm
+}
+
+// all the permissions of the member role
+func (this *Member) GetPermissions() int {
+	return rolePermissions[this.memberType]
+}
+
+// the access start time, zero if not limited
+func (this *Member) GetValidFrom() time.Time {
+	return this.validFrom.Time
+}
+
+// the access end time, zero if not limited
+func (this *Member) GetValidUntil() time.Time {
+	return this.validUntil.Time
+}
+
+// the recurring access windows text, empty if not limited
+func (this *Member) GetSchedule() string {
+	return this.schedule.String
+}
+
+// the time-bound member passed its end time
+func (this *Member) IsExpired(now time.Time) bool {
+	return this.validUntil.Valid && !now.Before(this.validUntil.Time)
+}
+
+// check the member access valid at the time, the schedule windows in the home location
+func (this *Member) IsValidAt(now time.Time, location *time.Location) bool {
+	if (this.validFrom.Valid && now.Before(this.validFrom.Time)) || this.IsExpired(now) {
+		return false
+	}
+	windows, err := ParseSchedule(this.schedule.String)
+	if err != nil {
+		return false
+	} else if len(windows) == 0 {
+		return true
+	}
+	local := now.In(location)
+	for _, window := range windows {
+		if window.contains(local) {
+			return true
+		}
+	}
+	return false
+}
+
+// the end time of the member access valid at the time, the end of the valid time range or
+// the current schedule window whichever comes first, zero time if not limited
+func (this *Member) getValidEnd(now time.Time, location *time.Location) time.Time {
+	var end time.Time
+	if this.validUntil.Valid {
+		end = this.validUntil.Time
+	}
+	windows, err := ParseSchedule(this.schedule.String)
+	if err != nil || len(windows) == 0 {
+		return end
+	}
+	local := now.In(location)
+	var windowEnd time.Time
+	for _, window := range windows {
+		if window.contains(local) {
+			if value := window.endOf(local); value.After(windowEnd) {
+				windowEnd = value
+			}
+		}
+	}
+	if end.IsZero() || (!windowEnd.IsZero() && windowEnd.Before(end)) {
+		end = windowEnd
+	}
+	return end
+}
+
+func IsValidRole(role int8) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// get the role name, empty if it is invalid
+func GetRoleName(role int8) string {
+	return roleNames[role]
+}
+
+// parse the role name, return false if it is invalid
+func ParseRole(name string) (int8, bool) {
+	for role, value := range roleNames {
+		if value == name {
+			return role, true
+		}
+	}
+	return ROLE_MEMBER, false
+}
@@ -3,6 +3,7 @@ package device
 import (
 	"database/sql"
 	"fmt"
+	"time"
 	"zc-common-go/common"
 	log "zc-common-go/glog"
 	_ "zc-common-go/mysql"
@@ -35,6 +36,59 @@ func (this *MemberManager) Get(domain string, hid, uid int64) (*Member, error) {
 	return &member, nil
 }
 
+// get the member of the home or inherited from the nearest ancestor home in the site
+// hierarchy, if not exist return nil + nil
+func (this *MemberManager) GetInherited(domain string, hid, uid int64) (*Member, error) {
+	common.CheckParam(this.store != nil)
+	member, _, err := this.getInherited(domain, hid, uid)
+	return member, err
+}
+
+// check the user is an active member of the home or inherited from the ancestor homes
+// in its valid time and the role has all the permissions, return the member if passed
+func (this *MemberManager) CheckPermission(domain string, hid, uid int64, perm int) (*Member, error) {
+	common.CheckParam(this.store != nil)
+	member, home, err := this.getInherited(domain, hid, uid)
+	if err != nil {
+		log.Warningf("get member failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, uid, err)
+		return nil, err
+	} else if member == nil {
+		log.Warningf("the user not member:domain[%s], hid[%d], uid[%d]", domain, hid, uid)
+		return nil, common.ErrNoPrivelige
+	} else if member.GetStatus() != ACTIVE {
+		log.Warningf("the member not active:domain[%s], hid[%d], uid[%d]", domain, hid, uid)
+		return nil, common.ErrNoPrivelige
+	} else if !member.IsValidAt(time.Now(), home.GetLocation()) {
+		log.Warningf("the member not in valid time:domain[%s], hid[%d], uid[%d]", domain, hid, uid)
+		return nil, common.ErrNoPrivelige
+	} else if !member.HasPermission(perm) {
+		log.Warningf("check the member permission failed:domain[%s], hid[%d], uid[%d], role[%d], perm[%d]",
+			domain, hid, uid, member.GetMemberType(), perm)
+		return nil, common.ErrNoPrivelige
+	}
+	return member, nil
+}
+
+// get the member and the home it belongs to in the site hierarchy
+func (this *MemberManager) getInherited(domain string, hid, uid int64) (*Member, *Home, error) {
+	homeManager := NewHomeManager(this.store)
+	path, err := homeManager.GetAncestors(domain, hid)
+	if err != nil {
+		log.Warningf("get home ancestors failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, nil, err
+	}
+	for i := range path {
+		member, err := this.Get(domain, path[i].GetHid(), uid)
+		if err != nil {
+			log.Warningf("get member info failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, path[i].GetHid(), uid, err)
+			return nil, nil, err
+		} else if member != nil {
+			return member, &path[i], nil
+		}
+	}
+	return nil, nil, nil
+}
+
 // get all homeids belong to this member, if no hid return empty list
 func (this *MemberManager) GetAllHomeIds(domain string, uid int64) ([]int64, error) {
 	common.CheckParam(this.store != nil)
@@ -83,8 +137,18 @@ func (this *MemberManager) AddMember(domain string, hid, uid int64, member strin
 		log.Warningf("the user is creator:domain[%s], hid[%d], uid[%d]", domain, hid, home.createUid)
 		return nil
 	}
-	// step 2. add member, if exist return error
-	err = this.insertMemberInfo(domain, member, hid, uid)
+	// step 2. add member, if exist return error, the expired members deleted at first
+	// not to occupy the quota
+	err = this.DeleteExpired(domain, hid)
+	if err != nil {
+		return err
+	}
+	quota, err := NewQuotaManager(this.store).Get(domain)
+	if err != nil {
+		log.Warningf("get domain quota failed:domain[%s], err[%v]", domain, err)
+		return err
+	}
+	err = this.insertMemberInfo(domain, member, hid, uid, quota.GetMembers())
 	if err != nil {
 		log.Warningf("insert one member to home faileddomain[%s], hid[%d], uid[%d]", domain, hid, uid)
 		return err
@@ -96,7 +160,7 @@ func (this *MemberManager) AddMember(domain string, hid, uid int64, member strin
 func (this *MemberManager) Delete(domain string, hid, uid int64) error {
 	common.CheckParam(this.store != nil)
 	homeManager := NewHomeManager(this.store)
-	// step 1. check home info
+	// step 1. check home info, the owner can not be deleted
 	home, err := homeManager.Get(domain, hid)
 	if err != nil {
 		log.Warningf("get home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
@@ -107,29 +171,139 @@ func (this *MemberManager) Delete(domain string, hid, uid int64) error {
 	} else if home.GetStatus() != ACTIVE {
 		log.Warningf("check home status failed:domain[%s], hid[%d]", domain, hid)
 		return common.ErrInvalidStatus
+	} else if home.GetCreateUid() == uid {
+		log.Warningf("the owner can not be deleted:domain[%s], hid[%d], uid[%d]", domain, hid, uid)
+		return common.ErrNotAllowed
 	}
 	// step 2. delete member, if not exist return succ
-	err = this.deleteOneMember(domain, hid, uid)
+	return this.removeMember(domain, hid, uid)
+}
+
+// the member leave the home by self, the owner must transfer the home at first
+func (this *MemberManager) Leave(domain string, hid, uid int64) error {
+	common.CheckParam(this.store != nil)
+	member, err := this.Get(domain, hid, uid)
+	if err != nil {
+		log.Warningf("get member failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, uid, err)
+		return err
+	} else if member == nil {
+		log.Warningf("the user not member:domain[%s], hid[%d], uid[%d]", domain, hid, uid)
+		return common.ErrEntryNotExist
+	} else if member.GetMemberType() == ROLE_OWNER {
+		log.Warningf("the owner can not leave the home:domain[%s], hid[%d], uid[%d]", domain, hid, uid)
+		return common.ErrNotAllowed
+	}
+	return this.removeMember(domain, hid, uid)
+}
+
+// delete the member and its device acl entries of the home, revoke the member grants
+func (this *MemberManager) removeMember(domain string, hid, uid int64) error {
+	err := this.deleteOneMember(domain, hid, uid)
 	if err != nil {
 		log.Warningf("delete one member of home failed:domain[%s], hid[%d], err[%s]", domain, hid, err)
 		return err
 	}
-	return nil
+	err = NewAclManager(this.store).DeleteUser(domain, hid, uid)
+	if err != nil {
+		log.Warningf("delete the member acls failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, uid, err)
+		return err
+	}
+	// the access grants issued before removed are revoked
+	return NewRevocationManager(this.store).RevokeUser(domain, uid)
 }
 
-// get all members of the home, if (hid) not exist,
-// return empty list, not nil + nil
+// get all members of the home, the expired members not yet swept are not listed, if (hid)
+// not exist, return empty list, not nil + nil
 func (this *MemberManager) GetAllMembers(domain string, hid int64) ([]Member, error) {
 	common.CheckParam(this.store != nil)
 	// if home not exist, return empty list
-	list, err := this.getAllMembers(domain, hid)
+	members, err := this.getAllMembers(domain, hid)
 	if err != nil {
 		log.Warningf("get one home all members failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
 		return nil, err
 	}
+	now := time.Now()
+	list := make([]Member, 0, len(members))
+	for _, member := range members {
+		if !member.IsExpired(now) {
+			list = append(list, member)
+		}
+	}
 	return list, nil
 }
 
+// limit the member access in the time range and the recurring schedule windows by the user
+// who can manage members, the zero time means not limited, the member deleted after the until
+func (this *MemberManager) SetValidity(domain string, hid, uid, memberUid int64, from, until time.Time, schedule string) error {
+	common.CheckParam(this.store != nil)
+	if (!from.IsZero() && !until.IsZero() && !from.Before(until)) || (!until.IsZero() && !time.Now().Before(until)) {
+		log.Warningf("check the valid time failed:domain[%s], hid[%d], uid[%d], from[%v], until[%v]", domain, hid, memberUid, from, until)
+		return common.ErrInvalidParam
+	}
+	_, err := ParseSchedule(schedule)
+	if err != nil {
+		log.Warningf("parse the schedule failed:domain[%s], hid[%d], uid[%d], schedule[%s]", domain, hid, memberUid, schedule)
+		return err
+	}
+	_, _, err = this.checkManaged(domain, hid, uid, memberUid, PERM_MANAGE_MEMBER)
+	if err != nil {
+		return err
+	}
+	err = this.modifyMemberValidity(domain, hid, memberUid, toNullTime(from), toNullTime(until),
+		sql.NullString{String: schedule, Valid: len(schedule) > 0})
+	if err != nil {
+		log.Warningf("modify member validity failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, memberUid, err)
+		return err
+	}
+	return nil
+}
+
+// delete all the time-bound members passed the valid until time of the home with
+// their device acl entries
+func (this *MemberManager) DeleteExpired(domain string, hid int64) error {
+	common.CheckParam(this.store != nil)
+	_, err := this.deleteExpired(domain, hid)
+	if err != nil {
+		log.Warningf("delete home expired members failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	return nil
+}
+
+// sweep the expired members of all the homes in the domain, return the deleted count
+func (this *MemberManager) SweepExpired(domain string) (int, error) {
+	common.CheckParam(this.store != nil)
+	count, err := this.deleteExpired(domain, 0)
+	if err != nil {
+		log.Warningf("sweep expired members failed:domain[%s], count[%d], err[%v]", domain, count, err)
+		return count, err
+	}
+	return count, nil
+}
+
+// delete the expired members of the home or all the homes if hid is zero
+func (this *MemberManager) deleteExpired(domain string, hid int64) (int, error) {
+	list, err := this.getExpiredMembers(domain, hid, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	for i, member := range list {
+		err = this.removeMember(domain, member.GetHid(), member.GetUid())
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(list), nil
+}
+
+// the zero time stored as NULL
+func toNullTime(value time.Time) interface{} {
+	if value.IsZero() {
+		return nil
+	}
+	return value
+}
+
 // delete the home and delete all the members
 func (this *MemberManager) DeleteAllMembers(domain string, hid int64) error {
 	common.CheckParam(this.store != nil)
@@ -149,7 +323,101 @@ func (this *MemberManager) Enable(domain string, hid, uid int64) error {
 
 // frozen a member
 func (this *MemberManager) Disable(domain string, hid, uid int64) error {
-	return this.modifyMemberInfo(domain, hid, uid, "status", 0)
+	err := this.modifyMemberInfo(domain, hid, uid, "status", 0)
+	if err != nil {
+		return err
+	}
+	// the access grants issued before frozen are revoked
+	return NewRevocationManager(this.store).RevokeUser(domain, uid)
+}
+
+// change the role of the member by the user who can manage members, the owner role can only
+// be changed by transfer home, and only the owner can grant or revoke the admin role
+func (this *MemberManager) ModifyRole(domain string, hid, uid, memberUid int64, role int8) error {
+	common.CheckParam(this.store != nil)
+	if !IsValidRole(role) || role == ROLE_OWNER {
+		log.Warningf("check the role failed:domain[%s], hid[%d], uid[%d], role[%d]", domain, hid, memberUid, role)
+		return common.ErrInvalidParam
+	}
+	operator, member, err := this.checkManaged(domain, hid, uid, memberUid, PERM_MANAGE_MEMBER)
+	if err != nil {
+		return err
+	} else if role == ROLE_ADMIN && operator.GetMemberType() != ROLE_OWNER {
+		log.Warningf("only the owner can change the admin:domain[%s], hid[%d], uid[%d], member[%d]", domain, hid, uid, memberUid)
+		return common.ErrNoPrivelige
+	}
+	err = this.modifyMemberInfo(domain, hid, memberUid, "type", role)
+	if err != nil {
+		return err
+	}
+	// the access grants issued before downgraded are revoked
+	if rolePermissions[member.GetMemberType()]&^rolePermissions[role] != 0 {
+		return NewRevocationManager(this.store).RevokeUser(domain, memberUid)
+	}
+	return nil
+}
+
+// delete the member by the user who can manage members, the owner can not be deleted
+// and only the owner can delete the admin, the caller delete itself without check
+func (this *MemberManager) Remove(domain string, hid, uid, memberUid int64) error {
+	common.CheckParam(this.store != nil)
+	if uid != memberUid {
+		_, _, err := this.checkManaged(domain, hid, uid, memberUid, PERM_MANAGE_MEMBER)
+		if err != nil {
+			return err
+		}
+	}
+	return this.Delete(domain, hid, memberUid)
+}
+
+// rename the member by the user who can manage members, the caller rename itself without check
+func (this *MemberManager) Rename(domain string, hid, uid, memberUid int64, name string) error {
+	common.CheckParam(this.store != nil)
+	if uid != memberUid {
+		_, _, err := this.checkManaged(domain, hid, uid, memberUid, PERM_MANAGE_MEMBER)
+		if err != nil {
+			return err
+		}
+	}
+	return this.ModifyName(domain, hid, memberUid, name)
+}
+
+// frozen/defrozen the member by the user who can freeze, the owner can not be frozen
+// and only the owner can freeze the admin
+func (this *MemberManager) Freeze(domain string, hid, uid, memberUid int64, frozen bool) error {
+	common.CheckParam(this.store != nil)
+	_, _, err := this.checkManaged(domain, hid, uid, memberUid, PERM_FREEZE)
+	if err != nil {
+		return err
+	}
+	if frozen {
+		return this.Disable(domain, hid, memberUid)
+	}
+	return this.Enable(domain, hid, memberUid)
+}
+
+// check the caller has the permission to manage the member, the owner is not managed
+// by others and only the owner can manage the admin, return the caller and the member
+func (this *MemberManager) checkManaged(domain string, hid, uid, memberUid int64, perm int) (*Member, *Member, error) {
+	operator, err := this.CheckPermission(domain, hid, uid, perm)
+	if err != nil {
+		return nil, nil, err
+	}
+	member, err := this.Get(domain, hid, memberUid)
+	if err != nil {
+		log.Warningf("get member failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, memberUid, err)
+		return nil, nil, err
+	} else if member == nil {
+		log.Warningf("member not exist:domain[%s], hid[%d], uid[%d]", domain, hid, memberUid)
+		return nil, nil, common.ErrEntryNotExist
+	} else if member.GetMemberType() == ROLE_OWNER {
+		log.Warningf("the owner can not be managed:domain[%s], hid[%d], uid[%d]", domain, hid, memberUid)
+		return nil, nil, common.ErrNotAllowed
+	} else if member.GetMemberType() == ROLE_ADMIN && operator.GetMemberType() != ROLE_OWNER {
+		log.Warningf("only the owner can manage the admin:domain[%s], hid[%d], uid[%d], member[%d]", domain, hid, uid, memberUid)
+		return nil, nil, common.ErrNoPrivelige
+	}
+	return operator, member, nil
 }
 
 // modify member name in this home
@@ -161,14 +429,15 @@ func (this *MemberManager) ModifyName(domain string, hid, uid int64, name string
 // database related private interface
 ////////////////////////////////////////////////////////////////////////////////////
 func (this *MemberManager) getMemberInfo(domain string, hid, uid int64, member *Member) error {
-	SQL := fmt.Sprintf("SELECT uid, hid, name, type, status FROM %s_home_members WHERE uid = ? AND hid = ?", domain)
+	SQL := fmt.Sprintf("SELECT uid, hid, name, type, status, valid_from, valid_until, schedule FROM %s_home_members WHERE uid = ? AND hid = ?", domain)
 	stmt, err := this.store.db.Prepare(SQL)
 	if err != nil {
 		log.Errorf("prepare query failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
 		return err
 	}
 	defer stmt.Close()
-	err = stmt.QueryRow(uid, hid).Scan(&member.uid, &member.hid, &member.memberName, &member.memberType, &member.status)
+	err = stmt.QueryRow(uid, hid).Scan(&member.uid, &member.hid, &member.memberName, &member.memberType, &member.status,
+		&member.validFrom, &member.validUntil, &member.schedule)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return common.ErrEntryNotExist
@@ -240,6 +509,49 @@ func (this *MemberManager) modifyMemberInfo(domain string, hid, uid int64, key s
 	return nil
 }
 
+func (this *MemberManager) modifyMemberValidity(domain string, hid, uid int64, from, until interface{}, schedule sql.NullString) error {
+	SQL := fmt.Sprintf("UPDATE %s_home_members SET valid_from = ?, valid_until = ?, schedule = ? WHERE uid = ? AND hid = ?", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(from, until, schedule, uid, hid)
+	if err != nil {
+		log.Errorf("update member validity failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, uid, err)
+		return err
+	}
+	return nil
+}
+
+func (this *MemberManager) getExpiredMembers(domain string, hid int64, now time.Time) ([]Member, error) {
+	SQL := fmt.Sprintf("SELECT uid, hid FROM %s_home_members WHERE (hid = ? OR ? = 0) AND type != ? AND valid_until IS NOT NULL AND valid_until <= ?", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(hid, hid, ROLE_OWNER, now)
+	if err != nil {
+		log.Errorf("query expired members failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var member Member
+	list := make([]Member, 0)
+	for rows.Next() {
+		err = rows.Scan(&member.uid, &member.hid)
+		if err != nil {
+			log.Errorf("parse the expired member failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+			return nil, err
+		}
+		list = append(list, member)
+	}
+	return list, nil
+}
+
 func (this *MemberManager) addOwnerMember(domain, owner string, hid, uid int64) error {
 	SQL := fmt.Sprintf("INSERT INTO %s_home_members(uid, hid, type, name, status) VALUES(?,?,?,?,?)",
 		domain)
@@ -258,7 +570,7 @@ func (this *MemberManager) addOwnerMember(domain, owner string, hid, uid int64)
 }
 
 func (this *MemberManager) getAllMembers(domain string, hid int64) ([]Member, error) {
-	SQL := fmt.Sprintf("SELECT uid, hid, name, type, status FROM %s_home_members WHERE hid = ?", domain)
+	SQL := fmt.Sprintf("SELECT uid, hid, name, type, status, valid_from, valid_until, schedule FROM %s_home_members WHERE hid = ?", domain)
 	stmt, err := this.store.db.Prepare(SQL)
 	if err != nil {
 		log.Errorf("prepare query failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
@@ -275,7 +587,8 @@ func (this *MemberManager) getAllMembers(domain string, hid int64) ([]Member, er
 	var member Member
 	list := make([]Member, 0)
 	for rows.Next() {
-		err := rows.Scan(&member.uid, &member.hid, &member.memberName, &member.memberType, &member.status)
+		err := rows.Scan(&member.uid, &member.hid, &member.memberName, &member.memberType, &member.status,
+			&member.validFrom, &member.validUntil, &member.schedule)
 		if err != nil {
 			log.Errorf("parse the uid failed:domain[%s], hid[%d], err[%v]",
 				domain, hid, err)
@@ -321,7 +634,8 @@ func (this *MemberManager) deleteAllMembers(domain string, hid int64) error {
 	return nil
 }
 
-func (this *MemberManager) insertMemberInfo(domain, member string, hid, uid int64) error {
+// insert the member in a transaction with the home members quota checked
+func (this *MemberManager) insertMemberInfo(domain, member string, hid, uid, limit int64) (err error) {
 	SQL := fmt.Sprintf("INSERT INTO %s_home_members(uid, hid, type, name, status) VALUES(?,?,?,?,?)",
 		domain)
 	stmt, err := this.store.db.Prepare(SQL)
@@ -330,10 +644,29 @@ func (this *MemberManager) insertMemberInfo(domain, member string, hid, uid int6
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(uid, hid, NORMAL, member, ACTIVE)
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	defer rollback(&err, tx)
+	err = lockHome(tx, domain, hid)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Stmt(stmt).Exec(uid, hid, NORMAL, member, ACTIVE)
 	if err != nil {
 		log.Warningf("insert the member failed:domain[%s], name[%s], uid[%d], hid[%d]", domain, member, uid, hid)
 		return err
 	}
+	err = checkQuota(tx, domain, QUOTA_MEMBERS, hid, limit)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], uid[%d], hid[%d], err[%v]", domain, uid, hid, err)
+		return err
+	}
 	return nil
 }
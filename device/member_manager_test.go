@@ -1,8 +1,11 @@
 package device
 
 import (
+	"database/sql"
 	"fmt"
 	"testing"
+	"time"
+	"zc-common-go/common"
 )
 
 func TearDown(store *DeviceStorage) {
@@ -279,6 +282,19 @@ func TestModifyMemberName(t *testing.T) {
 			t.Error("check member or new name failed", member.GetMemberName())
 		}
 	}
+	// the guest only rename itself, the owner rename the others
+	err = manager.Rename(domain, validHid, 1, 2, "renamed")
+	if err != common.ErrNoPrivelige {
+		t.Error("rename other member by guest succ", err)
+	}
+	err = manager.Rename(domain, validHid, 1, 1, "renamed")
+	if err != nil {
+		t.Error("rename self failed", err)
+	}
+	err = manager.Rename(domain, validHid, fakeUid, 2, "renamed")
+	if err != nil {
+		t.Error("rename member by owner failed", err)
+	}
 }
 
 func TestEnableMember(t *testing.T) {
@@ -355,3 +371,187 @@ func TestEnableMember(t *testing.T) {
 		}
 	}
 }
+
+func TestMemberRole(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	manager := NewMemberManager(store)
+	defer TearDown(store)
+	var owner int64 = 1
+	hid, err := CreateHome(owner, store)
+	if err != nil {
+		t.Fatal("create home failed", err)
+	}
+	for i := 2; i <= 3; i++ {
+		err = manager.AddMember(domain, hid, int64(i), "member")
+		if err != nil {
+			t.Error("add member failed", err)
+		}
+	}
+	// the normal member can not manage members
+	err = manager.ModifyRole(domain, hid, 2, 3, ROLE_GUEST)
+	if err != common.ErrNoPrivelige {
+		t.Error("modify role by normal member", err)
+	}
+	// the owner role can not be granted
+	err = manager.ModifyRole(domain, hid, owner, 2, ROLE_OWNER)
+	if err != common.ErrInvalidParam {
+		t.Error("grant the owner role", err)
+	}
+	err = manager.ModifyRole(domain, hid, owner, 2, ROLE_ADMIN)
+	if err != nil {
+		t.Error("grant the admin role failed", err)
+	}
+	err = manager.ModifyRole(domain, hid, 2, 3, ROLE_GUEST)
+	if err != nil {
+		t.Error("modify role by admin failed", err)
+	}
+	err = manager.ModifyRole(domain, hid, 2, 3, ROLE_ADMIN)
+	if err != common.ErrNoPrivelige {
+		t.Error("grant the admin role by admin", err)
+	}
+	err = manager.ModifyRole(domain, hid, 2, owner, ROLE_MEMBER)
+	if err != common.ErrNotAllowed {
+		t.Error("modify the owner role", err)
+	}
+	// the guest can only control the devices
+	_, err = manager.CheckPermission(domain, hid, 3, PERM_CONTROL)
+	if err != nil {
+		t.Error("check the guest control permission failed", err)
+	}
+	_, err = manager.CheckPermission(domain, hid, 3, PERM_BIND)
+	if err != common.ErrNoPrivelige {
+		t.Error("check the guest bind permission", err)
+	}
+	_, err = manager.CheckPermission(domain, hid, 2, PERM_MANAGE_MEMBER|PERM_FREEZE)
+	if err != nil {
+		t.Error("check the admin permission failed", err)
+	}
+	// the admin can not freeze or delete the owner and other admins
+	err = manager.Freeze(domain, hid, 2, owner, true)
+	if err != common.ErrNotAllowed {
+		t.Error("freeze the owner by admin", err)
+	}
+	err = manager.Remove(domain, hid, 2, owner)
+	if err != common.ErrNotAllowed {
+		t.Error("delete the owner by admin", err)
+	}
+	err = manager.AddMember(domain, hid, 4, "member")
+	if err != nil {
+		t.Error("add member failed", err)
+	}
+	err = manager.ModifyRole(domain, hid, owner, 4, ROLE_ADMIN)
+	if err != nil {
+		t.Error("grant the admin role failed", err)
+	}
+	err = manager.Freeze(domain, hid, 2, 4, true)
+	if err != common.ErrNoPrivelige {
+		t.Error("freeze the admin by admin", err)
+	}
+	err = manager.Remove(domain, hid, 2, 4)
+	if err != common.ErrNoPrivelige {
+		t.Error("delete the admin by admin", err)
+	}
+	err = manager.Freeze(domain, hid, 2, 3, true)
+	if err != nil {
+		t.Error("freeze the guest by admin failed", err)
+	}
+	err = manager.Remove(domain, hid, owner, 4)
+	if err != nil {
+		t.Error("delete the admin by owner failed", err)
+	}
+	// the frozen member has no permission
+	err = manager.Disable(domain, hid, 2)
+	if err != nil {
+		t.Error("disable member failed", err)
+	}
+	_, err = manager.CheckPermission(domain, hid, 2, PERM_CONTROL)
+	if err != common.ErrNoPrivelige {
+		t.Error("check the frozen member permission", err)
+	}
+}
+
+func TestMemberValidity(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	manager := NewMemberManager(store)
+	defer TearDown(store)
+	var owner, guest int64 = 1, 2
+	hid, err := CreateHome(owner, store)
+	if err != nil {
+		t.Fatal("create home failed", err)
+	}
+	err = manager.AddMember(domain, hid, guest, "cleaner")
+	if err != nil {
+		t.Error("add member failed", err)
+	}
+	// invalid schedule and time range
+	err = manager.SetValidity(domain, hid, owner, guest, time.Time{}, time.Time{}, "7@09:00-17:00")
+	if err != common.ErrInvalidParam {
+		t.Error("set invalid weekday", err)
+	}
+	now := time.Now()
+	err = manager.SetValidity(domain, hid, owner, guest, now.Add(time.Hour), now.Add(time.Minute), "")
+	if err != common.ErrInvalidParam {
+		t.Error("set invalid time range", err)
+	}
+	err = manager.SetValidity(domain, hid, owner, owner, time.Time{}, now.Add(time.Hour), "")
+	if err != common.ErrNotAllowed {
+		t.Error("limit the owner access", err)
+	}
+	// not started yet
+	err = manager.SetValidity(domain, hid, owner, guest, now.Add(time.Hour), time.Time{}, "")
+	if err != nil {
+		t.Error("set valid from failed", err)
+	}
+	_, err = manager.CheckPermission(domain, hid, guest, PERM_CONTROL)
+	if err != common.ErrNoPrivelige {
+		t.Error("check not started member permission", err)
+	}
+	// the schedule windows in the home timezone
+	windows, err := ParseSchedule("1,2,3,4,5@09:00-17:00;6@22:00-02:00")
+	if err != nil || len(windows) != 2 {
+		t.Fatalf("parse schedule failed:err[%v], len[%d]", err, len(windows))
+	}
+	member := &Member{schedule: sql.NullString{String: "1,2,3,4,5@09:00-17:00;6@22:00-02:00", Valid: true}}
+	// 2015-10-19 is monday
+	cases := map[string]bool{"2015-10-19 08:59": false, "2015-10-19 09:00": true, "2015-10-23 16:59": true,
+		"2015-10-24 12:00": false, "2015-10-24 23:00": true, "2015-10-25 01:59": true, "2015-10-25 02:00": false}
+	for value, expect := range cases {
+		local, _ := time.ParseInLocation("2006-01-02 15:04", value, time.UTC)
+		if member.IsValidAt(local, time.UTC) != expect {
+			t.Error("check the schedule failed", value)
+		}
+	}
+	// the expired member not listed and deleted by the sweep
+	err = manager.SetValidity(domain, hid, owner, guest, time.Time{}, now.Add(time.Second), "")
+	if err != nil {
+		t.Error("set valid until failed", err)
+	}
+	time.Sleep(2 * time.Second)
+	list, err := manager.GetAllMembers(domain, hid)
+	if err != nil {
+		t.Error("get all members failed", err)
+	}
+	for _, member := range list {
+		if member.GetUid() == guest {
+			t.Error("the expired member listed")
+		}
+	}
+	member, err = manager.Get(domain, hid, guest)
+	if err != nil || member == nil {
+		t.Error("the expired member deleted by listing", err)
+	}
+	count, err := manager.SweepExpired(domain)
+	if err != nil || count != 1 {
+		t.Errorf("sweep expired members failed:err[%v], count[%d]", err, count)
+	}
+	member, err = manager.Get(domain, hid, guest)
+	if err != nil || member != nil {
+		t.Error("the expired member not deleted", err)
+	}
+}
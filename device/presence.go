@@ -0,0 +1,44 @@
+package device
+
+import (
+	"time"
+	"zc-common-go/mysql"
+)
+
+// the master device offline if no heartbeat received in the timeout
+const DEVICE_ONLINE_TIMEOUT = 90 * time.Second
+
+// the presence of the master device recorded by the heartbeat, the slave
+// devices share the presence of their master
+type Presence struct {
+	did      int64
+	lastSeen mysql.NullTime
+	address  string
+	server   string
+	online   bool
+}
+
+func (this *Presence) GetDid() int64 {
+	return this.did
+}
+
+// the last heartbeat time
+func (this *Presence) GetLastSeen() time.Time {
+	return this.lastSeen.Time
+}
+
+// the remote address of the device connection
+func (this *Presence) GetAddress() string {
+	return this.address
+}
+
+// the access server the device connected to
+func (this *Presence) GetServer() string {
+	return this.server
+}
+
+// the heartbeat received in the online timeout, judged by the database clock which
+// records the last seen time
+func (this *Presence) IsOnline() bool {
+	return this.online
+}
@@ -0,0 +1,142 @@
+package device
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+	"zc-common-go/common"
+	log "zc-common-go/glog"
+	_ "zc-common-go/mysql"
+)
+
+const (
+	// max length of the connection info
+	MAX_PRESENCE_ADDRESS_LEN = 64
+	MAX_PRESENCE_SERVER_LEN  = 64
+)
+
+type PresenceManager struct {
+	store *DeviceStorage
+}
+
+func NewPresenceManager(store *DeviceStorage) *PresenceManager {
+	return &PresenceManager{store: store}
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// public interface
+////////////////////////////////////////////////////////////////////////////////////
+// record the heartbeat of the binded master device with its connection info, return the did
+func (this *PresenceManager) Heartbeat(domain, subDomain, deviceId, address, server string) (int64, error) {
+	common.CheckParam(this.store != nil)
+	if len(address) > MAX_PRESENCE_ADDRESS_LEN || len(server) > MAX_PRESENCE_SERVER_LEN {
+		log.Warningf("check the connection info failed:domain[%s], deviceid[%s], address[%s], server[%s]",
+			domain, deviceId, address, server)
+		return -1, common.ErrInvalidParam
+	}
+	device, err := NewDeviceManager(this.store).getMappedMaster(domain, subDomain, deviceId)
+	if err != nil {
+		return -1, err
+	}
+	did := device.GetDid()
+	err = this.replacePresence(domain, did, address, server)
+	if err != nil {
+		log.Warningf("replace presence failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return -1, err
+	}
+	return did, nil
+}
+
+// get the presence of the master device, if no heartbeat received return nil + nil
+func (this *PresenceManager) Get(domain string, masterDid int64) (*Presence, error) {
+	common.CheckParam(this.store != nil)
+	var presence Presence
+	err := this.getPresence(domain, masterDid, &presence)
+	if err != nil {
+		if err == common.ErrEntryNotExist {
+			return nil, nil
+		}
+		log.Warningf("get presence failed:domain[%s], did[%d], err[%v]", domain, masterDid, err)
+		return nil, err
+	}
+	return &presence, nil
+}
+
+// get the presence of all the master devices of the home by the master did
+func (this *PresenceManager) GetHomeAll(domain string, hid int64) (map[int64]Presence, error) {
+	common.CheckParam(this.store != nil)
+	presences, err := this.getHomePresences(domain, hid)
+	if err != nil {
+		log.Warningf("get home presences failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	return presences, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// database related private interface
+////////////////////////////////////////////////////////////////////////////////////
+func (this *PresenceManager) getPresence(domain string, did int64, presence *Presence) error {
+	SQL := fmt.Sprintf("SELECT did, last_seen, address, server, last_seen > DATE_SUB(NOW(), INTERVAL ? SECOND) "+
+		"FROM %s_device_presence WHERE did = ?", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	defer stmt.Close()
+	err = stmt.QueryRow(int64(DEVICE_ONLINE_TIMEOUT/time.Second), did).Scan(&presence.did, &presence.lastSeen,
+		&presence.address, &presence.server, &presence.online)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return common.ErrEntryNotExist
+		}
+		log.Errorf("get presence failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	return nil
+}
+
+func (this *PresenceManager) getHomePresences(domain string, hid int64) (map[int64]Presence, error) {
+	SQL := fmt.Sprintf("SELECT p.did, p.last_seen, p.address, p.server, p.last_seen > DATE_SUB(NOW(), INTERVAL ? SECOND) "+
+		"FROM %s_device_presence p, %s_device_info i WHERE p.did = i.did AND i.hid = ?", domain, domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(int64(DEVICE_ONLINE_TIMEOUT/time.Second), hid)
+	if err != nil {
+		log.Errorf("query home presences failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var presence Presence
+	presences := make(map[int64]Presence)
+	for rows.Next() {
+		err = rows.Scan(&presence.did, &presence.lastSeen, &presence.address, &presence.server, &presence.online)
+		if err != nil {
+			log.Errorf("parse the presence failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+			return nil, err
+		}
+		presences[presence.did] = presence
+	}
+	return presences, nil
+}
+
+func (this *PresenceManager) replacePresence(domain string, did int64, address, server string) error {
+	SQL := fmt.Sprintf("REPLACE INTO %s_device_presence(did, last_seen, address, server) VALUES(?,NOW(),?,?)", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare replace presence failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(did, address, server)
+	if err != nil {
+		log.Errorf("replace presence failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package device
+
+import (
+	"testing"
+	"zc-common-go/common"
+)
+
+func TestDevicePresence(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	prepare(store)
+	home := NewHomeManager(store)
+	var uid int64 = 100
+	list, err := home.GetAllHome(domain, uid)
+	if err != nil || len(list) != 5 {
+		t.Errorf("get user all home failed:err[%v], len[%d]", err, len(list))
+	}
+	hid := list[0].hid
+	device := NewDeviceManager(store)
+	devList, err := device.GetAllDevices(domain, hid)
+	if err != nil || len(devList) != 8 {
+		t.Errorf("get all devices failed:err[%v], len[%d]", err, len(devList))
+	}
+	var masters []int64
+	var slave int64
+	for _, dev := range devList {
+		if dev.IsMasterDevice() {
+			masters = append(masters, dev.did)
+		} else if slave <= 0 {
+			slave = dev.did
+		}
+	}
+	if len(masters) != 2 {
+		t.Fatal("check master count failed", len(masters))
+	}
+	mapping := NewBindingManager(store)
+	bind, err := mapping.Get(domain, masters[0])
+	if err != nil || bind == nil {
+		t.Fatal("get master binding failed", err)
+	}
+	presence := NewPresenceManager(store)
+	// no heartbeat received
+	info, err := presence.Get(domain, masters[0])
+	if err != nil || info != nil {
+		t.Error("get presence not exist failed", err)
+	}
+	did, err := presence.Heartbeat(domain, bind.subDomain, bind.deviceId, "10.0.0.1:5000", "gateway-1")
+	if err != nil || did != masters[0] {
+		t.Errorf("master heartbeat failed:err[%v], did[%d]", err, did)
+	}
+	info, err = presence.Get(domain, masters[0])
+	if err != nil || info == nil {
+		t.Fatal("get presence failed", err)
+	} else if !info.IsOnline() || info.GetAddress() != "10.0.0.1:5000" || info.GetServer() != "gateway-1" {
+		t.Error("check presence failed", info)
+	}
+	presences, err := presence.GetHomeAll(domain, hid)
+	if err != nil || len(presences) != 1 {
+		t.Errorf("get home presences failed:err[%v], len[%d]", err, len(presences))
+	}
+	// the slave and not exist device heartbeat
+	slaveBind, err := mapping.Get(domain, slave)
+	if err != nil || slaveBind == nil {
+		t.Fatal("get slave binding failed", err)
+	}
+	_, err = presence.Heartbeat(domain, slaveBind.subDomain, slaveBind.deviceId, "", "")
+	if err != common.ErrInvalidDevice {
+		t.Error("slave heartbeat succ", err)
+	}
+	_, err = presence.Heartbeat(domain, bind.subDomain, "not exist device", "", "")
+	if err != ErrBindingNotExist {
+		t.Error("not exist device heartbeat succ", err)
+	}
+	// the slaves online with their master
+	router := NewAccessRouter(store)
+	for _, dev := range devList {
+		_, _, _, err = router.GetOnlineAccessPoint(uid, domain, dev.did)
+		if dev.GetMasterDid() == masters[0] && err != nil {
+			t.Error("get online access point failed", err)
+		} else if dev.GetMasterDid() == masters[1] && err != ErrDeviceOffline {
+			t.Error("get offline access point succ", err)
+		}
+		_, _, _, err = router.GetAccessPoint(uid, domain, dev.did)
+		if err != nil {
+			t.Error("get access point failed", err)
+		}
+	}
+	// the presence deleted with the factory reset
+	other, err := mapping.Get(domain, masters[1])
+	if err != nil || other == nil {
+		t.Fatal("get master binding failed", err)
+	}
+	_, err = presence.Heartbeat(domain, other.subDomain, other.deviceId, "10.0.0.2:5000", "gateway-1")
+	if err != nil {
+		t.Error("master heartbeat failed", err)
+	}
+	_, err = mapping.ResetDevice(domain, other.subDomain, other.deviceId)
+	if err != nil {
+		t.Error("reset device failed", err)
+	}
+	info, err = presence.Get(domain, masters[1])
+	if err != nil || info != nil {
+		t.Error("check presence deleted by reset failed", err)
+	}
+	// the presence deleted with the device
+	err = device.DeleteDevice(uid, domain, hid, masters[0])
+	if err != nil {
+		t.Error("delete master failed", err)
+	}
+	info, err = presence.Get(domain, masters[0])
+	if err != nil || info != nil {
+		t.Error("check presence deleted failed", err)
+	}
+	cleanAll(store)
+}
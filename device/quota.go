@@ -0,0 +1,59 @@
+package device
+
+// the configured quotas of one domain
+type Quota struct {
+	homes   int64
+	members int64
+	devices int64
+	slaves  int64
+}
+
+// max homes created by one user
+func (this *Quota) GetHomes() int64 {
+	return this.homes
+}
+
+// max members of one home including the owner
+func (this *Quota) GetMembers() int64 {
+	return this.members
+}
+
+// max devices binded to one home including the slaves
+func (this *Quota) GetDevices() int64 {
+	return this.devices
+}
+
+// max slaves binded to one master
+func (this *Quota) GetSlaves() int64 {
+	return this.slaves
+}
+
+// the current usage of the quotas, the home and master related count
+// is 0 if the hid or master did is not specified
+type QuotaUsage struct {
+	quota   Quota
+	homes   int64
+	members int64
+	devices int64
+	slaves  int64
+}
+
+func (this *QuotaUsage) GetQuota() *Quota {
+	return &this.quota
+}
+
+func (this *QuotaUsage) GetHomes() int64 {
+	return this.homes
+}
+
+func (this *QuotaUsage) GetMembers() int64 {
+	return this.members
+}
+
+func (this *QuotaUsage) GetDevices() int64 {
+	return this.devices
+}
+
+func (this *QuotaUsage) GetSlaves() int64 {
+	return this.slaves
+}
@@ -0,0 +1,240 @@
+package device
+
+import (
+	"database/sql"
+	"fmt"
+	"zc-common-go/common"
+	log "zc-common-go/glog"
+	_ "zc-common-go/mysql"
+)
+
+// the quota names stored in the domain quota config table
+const (
+	QUOTA_HOMES   = "homes"
+	QUOTA_MEMBERS = "members"
+	QUOTA_DEVICES = "devices"
+	QUOTA_SLAVES  = "slaves"
+)
+
+// the default quotas if not configured for the domain
+const (
+	DEFAULT_HOME_QUOTA   int64 = 16
+	DEFAULT_MEMBER_QUOTA int64 = 32
+	DEFAULT_DEVICE_QUOTA int64 = 1024
+	DEFAULT_SLAVE_QUOTA  int64 = MAX_SLAVE_COUNT
+)
+
+type QuotaManager struct {
+	store *DeviceStorage
+}
+
+func NewQuotaManager(store *DeviceStorage) *QuotaManager {
+	return &QuotaManager{store: store}
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// public interface
+////////////////////////////////////////////////////////////////////////////////////
+// get the domain quotas, the not configured quota set to the default value
+func (this *QuotaManager) Get(domain string) (*Quota, error) {
+	common.CheckParam(this.store != nil)
+	quota := Quota{homes: DEFAULT_HOME_QUOTA, members: DEFAULT_MEMBER_QUOTA,
+		devices: DEFAULT_DEVICE_QUOTA, slaves: DEFAULT_SLAVE_QUOTA}
+	err := this.getQuota(domain, &quota)
+	if err != nil {
+		log.Warningf("get domain quota failed:domain[%s], err[%v]", domain, err)
+		return nil, err
+	}
+	return &quota, nil
+}
+
+// set one quota of the domain
+func (this *QuotaManager) Set(domain, name string, value int64) error {
+	common.CheckParam(this.store != nil)
+	if value <= 0 {
+		log.Warningf("check the quota value failed:domain[%s], name[%s], value[%d]", domain, name, value)
+		return common.ErrInvalidParam
+	}
+	switch name {
+	case QUOTA_HOMES, QUOTA_MEMBERS, QUOTA_DEVICES, QUOTA_SLAVES:
+	default:
+		log.Warningf("check the quota name failed:domain[%s], name[%s]", domain, name)
+		return common.ErrInvalidParam
+	}
+	err := this.setQuota(domain, name, value)
+	if err != nil {
+		log.Warningf("set domain quota failed:domain[%s], name[%s], value[%d], err[%v]", domain, name, value, err)
+		return err
+	}
+	return nil
+}
+
+// get the current usage of the user homes, the home members and devices if hid > 0,
+// and the master slaves if masterDid > 0, the master must be in the home
+func (this *QuotaManager) GetUsage(domain string, uid, hid, masterDid int64) (*QuotaUsage, error) {
+	common.CheckParam(this.store != nil)
+	quota, err := this.Get(domain)
+	if err != nil {
+		return nil, err
+	}
+	usage := QuotaUsage{quota: *quota}
+	err = this.countUsage(domain, QUOTA_HOMES, uid, &usage.homes)
+	if err != nil {
+		log.Warningf("count the user homes failed:domain[%s], uid[%d], err[%v]", domain, uid, err)
+		return nil, err
+	}
+	if hid > 0 {
+		err = this.countUsage(domain, QUOTA_MEMBERS, hid, &usage.members)
+		if err != nil {
+			log.Warningf("count the home members failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+			return nil, err
+		}
+		err = this.countUsage(domain, QUOTA_DEVICES, hid, &usage.devices)
+		if err != nil {
+			log.Warningf("count the home devices failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+			return nil, err
+		}
+	}
+	if masterDid > 0 {
+		// the master must be in the home
+		master, err := NewDeviceManager(this.store).Get(domain, masterDid)
+		if err != nil {
+			log.Warningf("get master device failed:domain[%s], did[%d], err[%v]", domain, masterDid, err)
+			return nil, err
+		} else if hid <= 0 || master == nil || !master.IsMasterDevice() || master.GetHid() != hid {
+			log.Warningf("check the master of the home failed:domain[%s], hid[%d], master[%d]", domain, hid, masterDid)
+			return nil, common.ErrMasterNotExist
+		}
+		err = this.countUsage(domain, QUOTA_SLAVES, masterDid, &usage.slaves)
+		if err != nil {
+			log.Warningf("count the master slaves failed:domain[%s], master[%d], err[%v]", domain, masterDid, err)
+			return nil, err
+		}
+	}
+	return &usage, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// database related private interface
+////////////////////////////////////////////////////////////////////////////////////
+func (this *QuotaManager) getQuota(domain string, quota *Quota) error {
+	SQL := fmt.Sprintf("SELECT name, value FROM %s_quota_config", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], err[%v]", domain, err)
+		return err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err != nil {
+		log.Errorf("query quota config failed:domain[%s], err[%v]", domain, err)
+		return err
+	}
+	defer rows.Close()
+	var name string
+	var value int64
+	for rows.Next() {
+		err = rows.Scan(&name, &value)
+		if err != nil {
+			log.Errorf("parse the quota failed:domain[%s], err[%v]", domain, err)
+			return err
+		}
+		switch name {
+		case QUOTA_HOMES:
+			quota.homes = value
+		case QUOTA_MEMBERS:
+			quota.members = value
+		case QUOTA_DEVICES:
+			quota.devices = value
+		case QUOTA_SLAVES:
+			quota.slaves = value
+		default:
+			log.Warningf("unknown quota config:domain[%s], name[%s], value[%d]", domain, name, value)
+		}
+	}
+	return nil
+}
+
+func (this *QuotaManager) setQuota(domain, name string, value int64) error {
+	SQL := fmt.Sprintf("REPLACE INTO %s_quota_config(name, value) VALUES(?,?)", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], err[%v]", domain, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(name, value)
+	if err != nil {
+		log.Errorf("replace quota config failed:domain[%s], name[%s], value[%d], err[%v]", domain, name, value, err)
+		return err
+	}
+	return nil
+}
+
+func (this *QuotaManager) countUsage(domain, name string, key int64, count *int64) error {
+	stmt, err := this.store.db.Prepare(countQuotaSQL(domain, name, false))
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], name[%s], err[%v]", domain, name, err)
+		return err
+	}
+	defer stmt.Close()
+	err = stmt.QueryRow(key).Scan(count)
+	if err != nil {
+		log.Errorf("count the usage failed:domain[%s], name[%s], key[%d], err[%v]", domain, name, key, err)
+		return err
+	}
+	return nil
+}
+
+// the usage count sql of the quota, the param is uid for homes, hid for members and
+// devices, master did for slaves
+func countQuotaSQL(domain, name string, lock bool) string {
+	var SQL string
+	switch name {
+	case QUOTA_HOMES:
+		SQL = fmt.Sprintf("SELECT COUNT(*) FROM %s_home_info WHERE create_uid = ?", domain)
+	case QUOTA_MEMBERS:
+		SQL = fmt.Sprintf("SELECT COUNT(*) FROM %s_home_members WHERE hid = ?", domain)
+	case QUOTA_DEVICES:
+		SQL = fmt.Sprintf("SELECT COUNT(*) FROM %s_device_info WHERE hid = ?", domain)
+	case QUOTA_SLAVES:
+		SQL = fmt.Sprintf("SELECT COUNT(*) FROM %s_device_info WHERE master_did = ? AND did != master_did", domain)
+	default:
+		common.CheckParam(false)
+	}
+	if lock {
+		SQL += " FOR UPDATE"
+	}
+	return SQL
+}
+
+// lock the home row in the transaction for serializing the quota related modification
+func lockHome(tx *sql.Tx, domain string, hid int64) error {
+	var value int64
+	SQL := fmt.Sprintf("SELECT hid FROM %s_home_info WHERE hid = ? FOR UPDATE", domain)
+	err := tx.QueryRow(SQL, hid).Scan(&value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return common.ErrEntryNotExist
+		}
+		log.Errorf("lock the home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	return nil
+}
+
+// check the usage after modified in the transaction, if exceed the limit return
+// quota exceeded error for rollback
+func checkQuota(tx *sql.Tx, domain, name string, key, limit int64) error {
+	var count int64
+	err := tx.QueryRow(countQuotaSQL(domain, name, true), key).Scan(&count)
+	if err != nil {
+		log.Errorf("count the usage failed:domain[%s], name[%s], key[%d], err[%v]", domain, name, key, err)
+		return err
+	} else if count > limit {
+		log.Warningf("check the quota failed:domain[%s], name[%s], key[%d], count[%d], limit[%d]",
+			domain, name, key, count, limit)
+		return ErrQuotaExceeded
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package device
+
+import (
+	"testing"
+	"zc-common-go/common"
+)
+
+func TestQuotaManager(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	// 5 home, 2 master/home, 3 slave/master
+	prepare(store)
+	manager := NewQuotaManager(store)
+	quota, err := manager.Get(domain)
+	if err != nil || quota.GetHomes() != DEFAULT_HOME_QUOTA || quota.GetSlaves() != DEFAULT_SLAVE_QUOTA {
+		t.Error("get default quota failed", err)
+	}
+	err = manager.Set(domain, "unknown", 1)
+	if err == nil {
+		t.Error("set unknown quota succ")
+	}
+	err = manager.Set(domain, QUOTA_HOMES, 0)
+	if err == nil {
+		t.Error("set invalid quota value succ")
+	}
+	manager.Set(domain, QUOTA_HOMES, 5)
+	manager.Set(domain, QUOTA_MEMBERS, 2)
+	manager.Set(domain, QUOTA_SLAVES, 3)
+	home := NewHomeManager(store)
+	var uid int64 = 100
+	err = home.Create(domain, uid, "exceeded")
+	if err != ErrQuotaExceeded {
+		t.Error("create home exceed the quota", err)
+	}
+	list, err := home.GetAllHome(domain, uid)
+	if err != nil || len(list) != 5 {
+		t.Errorf("get user all home failed:err[%v], len[%d]", err, len(list))
+	}
+	hid := list[0].hid
+	member := NewMemberManager(store)
+	err = member.AddMember(domain, hid, 200, "member")
+	if err != nil {
+		t.Error("add member failed", err)
+	}
+	err = member.AddMember(domain, hid, 201, "exceeded")
+	if err != ErrQuotaExceeded {
+		t.Error("add member exceed the quota", err)
+	}
+	device := NewDeviceManager(store)
+	devices, err := device.GetAllDevices(domain, hid)
+	if err != nil || len(devices) != 8 {
+		t.Errorf("get all devices failed:err[%v], len[%d]", err, len(devices))
+	}
+	// move one slave to the other master with 3 slaves
+	var slave, target int64
+	for _, dev := range devices {
+		if !dev.IsMasterDevice() {
+			slave = dev.did
+			for _, master := range devices {
+				if master.IsMasterDevice() && master.did != dev.GetMasterDid() {
+					target = master.did
+				}
+			}
+			break
+		}
+	}
+	err = device.MoveSlave(uid, domain, slave, target)
+	if err != ErrQuotaExceeded {
+		t.Error("move slave exceed the quota", err)
+	}
+	usage, err := manager.GetUsage(domain, uid, hid, target)
+	if err != nil {
+		t.Error("get quota usage failed", err)
+	} else if usage.GetHomes() != 5 || usage.GetMembers() != 2 || usage.GetDevices() != 8 || usage.GetSlaves() != 3 {
+		t.Errorf("check the usage failed:homes[%d], members[%d], devices[%d], slaves[%d]",
+			usage.GetHomes(), usage.GetMembers(), usage.GetDevices(), usage.GetSlaves())
+	} else if usage.GetQuota().GetMembers() != 2 {
+		t.Error("check the usage quota failed")
+	}
+	// the master not in the home
+	_, err = manager.GetUsage(domain, uid, list[1].hid, target)
+	if err != common.ErrMasterNotExist {
+		t.Error("get other home master usage succ", err)
+	}
+	cleanAll(store)
+}
@@ -0,0 +1,133 @@
+package device
+
+import (
+	"fmt"
+	"zc-common-go/common"
+	log "zc-common-go/glog"
+	_ "zc-common-go/mysql"
+)
+
+type RevocationManager struct {
+	store *DeviceStorage
+}
+
+func NewRevocationManager(store *DeviceStorage) *RevocationManager {
+	return &RevocationManager{store: store}
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// public interface
+////////////////////////////////////////////////////////////////////////////////////
+// get all the revocation entries not expired, the gateway sync the list to check
+// the access grants offline, if no entry return empty list
+func (this *RevocationManager) GetAll(domain string) ([]GrantRevocation, error) {
+	common.CheckParam(this.store != nil)
+	list, err := this.getAllRevocations(domain)
+	if err != nil {
+		log.Warningf("get all revocations failed:domain[%s], err[%v]", domain, err)
+		return nil, err
+	}
+	return list, nil
+}
+
+// revoke all the access grants of the user issued before now
+func (this *RevocationManager) RevokeUser(domain string, uid int64) error {
+	common.CheckParam(this.store != nil)
+	return this.revoke(domain, REVOKE_SUBJECT_USER, uid)
+}
+
+// revoke all the access grants of the device or the slaves of the master device issued before now
+func (this *RevocationManager) RevokeDevice(domain string, did int64) error {
+	common.CheckParam(this.store != nil)
+	return this.revoke(domain, REVOKE_SUBJECT_DEVICE, did)
+}
+
+// revoke all the access grants of the home devices issued before now
+func (this *RevocationManager) RevokeHome(domain string, hid int64) error {
+	common.CheckParam(this.store != nil)
+	return this.revoke(domain, REVOKE_SUBJECT_HOME, hid)
+}
+
+func (this *RevocationManager) revoke(domain string, subjectType int8, subject int64) error {
+	if subject <= 0 {
+		log.Warningf("check the revocation subject failed:domain[%s], type[%d], subject[%d]", domain, subjectType, subject)
+		return common.ErrInvalidParam
+	}
+	err := this.insertRevocation(domain, subjectType, subject)
+	if err != nil {
+		log.Warningf("insert revocation failed:domain[%s], type[%d], subject[%d], err[%v]", domain, subjectType, subject, err)
+		return err
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// database related private interface
+////////////////////////////////////////////////////////////////////////////////////
+func (this *RevocationManager) getAllRevocations(domain string) ([]GrantRevocation, error) {
+	SQL := fmt.Sprintf("SELECT subject_type, subject, revoke_time FROM %s_grant_revocation WHERE expire_time > NOW()", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], err[%v]", domain, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err != nil {
+		log.Errorf("query all revocations failed:domain[%s], err[%v]", domain, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var revocation GrantRevocation
+	list := make([]GrantRevocation, 0)
+	for rows.Next() {
+		err = rows.Scan(&revocation.subjectType, &revocation.subject, &revocation.revokeTime)
+		if err != nil {
+			log.Errorf("parse the revocation failed:domain[%s], err[%v]", domain, err)
+			return nil, err
+		}
+		list = append(list, revocation)
+	}
+	return list, nil
+}
+
+// replace the entry of the subject with the new revoke time, the expired entries deleted at the same time
+func (this *RevocationManager) insertRevocation(domain string, subjectType int8, subject int64) (err error) {
+	SQL1 := fmt.Sprintf("REPLACE INTO %s_grant_revocation(subject_type, subject, revoke_time, expire_time) VALUES(?,?,NOW(),DATE_ADD(NOW(), INTERVAL ? SECOND))", domain)
+	stmt1, err := this.store.db.Prepare(SQL1)
+	if err != nil {
+		log.Errorf("prepare replace revocation failed:domain[%s], subject[%d], err[%v]", domain, subject, err)
+		return err
+	}
+	defer stmt1.Close()
+	SQL2 := fmt.Sprintf("DELETE FROM %s_grant_revocation WHERE expire_time <= NOW()", domain)
+	stmt2, err := this.store.db.Prepare(SQL2)
+	if err != nil {
+		log.Errorf("prepare delete revocation failed:domain[%s], subject[%d], err[%v]", domain, subject, err)
+		return err
+	}
+	defer stmt2.Close()
+
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], subject[%d], err[%v]", domain, subject, err)
+		return err
+	}
+	defer rollback(&err, tx)
+	_, err = tx.Stmt(stmt1).Exec(subjectType, subject, int64(MAX_GRANT_TTL.Seconds()))
+	if err != nil {
+		log.Errorf("replace revocation failed:domain[%s], type[%d], subject[%d], err[%v]", domain, subjectType, subject, err)
+		return err
+	}
+	_, err = tx.Stmt(stmt2).Exec()
+	if err != nil {
+		log.Errorf("delete expired revocations failed:domain[%s], err[%v]", domain, err)
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], subject[%d], err[%v]", domain, subject, err)
+		return err
+	}
+	return nil
+}
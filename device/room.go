@@ -0,0 +1,30 @@
+package device
+
+// the room of one home for grouping the devices
+type Room struct {
+	rid      int64
+	hid      int64
+	name     string
+	position int
+}
+
+func NewRoom(rid, hid int64, name string, position int) *Room {
+	return &Room{rid: rid, hid: hid, name: name, position: position}
+}
+
+func (this *Room) GetRid() int64 {
+	return this.rid
+}
+
+func (this *Room) GetHid() int64 {
+	return this.hid
+}
+
+func (this *Room) GetName() string {
+	return this.name
+}
+
+// the display order of the room in its home
+func (this *Room) GetPosition() int {
+	return this.position
+}
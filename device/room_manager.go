@@ -0,0 +1,317 @@
+package device
+
+import (
+	"database/sql"
+	"fmt"
+	"zc-common-go/common"
+	log "zc-common-go/glog"
+	_ "zc-common-go/mysql"
+)
+
+type RoomManager struct {
+	store *DeviceStorage
+}
+
+func NewRoomManager(store *DeviceStorage) *RoomManager {
+	return &RoomManager{store: store}
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// public interface
+////////////////////////////////////////////////////////////////////////////////////
+// if find the record return room + nil, else if no record return nil + nil
+func (this *RoomManager) Get(domain string, rid int64) (*Room, error) {
+	common.CheckParam(this.store != nil)
+	var room Room
+	err := this.getRoom(domain, rid, &room)
+	if err != nil {
+		if err == common.ErrEntryNotExist {
+			return nil, nil
+		}
+		log.Warningf("get room failed:domain[%s], rid[%d], err[%v]", domain, rid, err)
+		return nil, err
+	}
+	return &room, nil
+}
+
+// get all rooms of the home order by position, if no room return empty list not nil
+func (this *RoomManager) GetAll(domain string, hid int64) ([]Room, error) {
+	common.CheckParam(this.store != nil)
+	list, err := this.getAllRooms(domain, hid)
+	if err != nil {
+		log.Warningf("get home all rooms failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	return list, nil
+}
+
+// create a new room at the end of the home rooms, return the new room id
+func (this *RoomManager) Create(domain string, hid int64, name string) (int64, error) {
+	common.CheckParam(this.store != nil)
+	if len(name) <= 0 {
+		log.Warningf("check the room name failed:domain[%s], hid[%d], name[%s]", domain, hid, name)
+		return -1, common.ErrInvalidName
+	}
+	homeManager := NewHomeManager(this.store)
+	home, err := homeManager.Get(domain, hid)
+	if err != nil {
+		log.Warningf("get home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return -1, err
+	} else if home == nil {
+		log.Warningf("home not exist:domain[%s], hid[%d]", domain, hid)
+		return -1, common.ErrEntryNotExist
+	} else if home.GetStatus() != ACTIVE {
+		log.Warningf("home is not active:domain[%s], hid[%d]", domain, hid)
+		return -1, common.ErrInvalidStatus
+	}
+	rid, err := this.insertRoom(domain, hid, name)
+	if err != nil {
+		log.Warningf("insert room failed:domain[%s], hid[%d], name[%s], err[%v]", domain, hid, name, err)
+		return -1, err
+	}
+	return rid, nil
+}
+
+func (this *RoomManager) Rename(domain string, hid, rid int64, name string) error {
+	common.CheckParam(this.store != nil)
+	if len(name) <= 0 {
+		log.Warningf("check the room name failed:domain[%s], rid[%d], name[%s]", domain, rid, name)
+		return common.ErrInvalidName
+	}
+	return this.modifyRoom(domain, hid, rid, "name", name)
+}
+
+// delete the room, all the devices in the room become unassigned
+func (this *RoomManager) Delete(domain string, hid, rid int64) error {
+	common.CheckParam(this.store != nil)
+	err := this.deleteRoom(domain, hid, rid)
+	if err != nil {
+		log.Warningf("delete room failed:domain[%s], hid[%d], rid[%d], err[%v]", domain, hid, rid, err)
+		return err
+	}
+	return nil
+}
+
+// delete all the rooms of the home
+func (this *RoomManager) DeleteAllRooms(domain string, hid int64) error {
+	common.CheckParam(this.store != nil)
+	err := this.deleteAllRooms(domain, hid)
+	if err != nil {
+		log.Warningf("delete home all rooms failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	return nil
+}
+
+// reorder the rooms, the rids must be all the rooms of the home in the new order
+func (this *RoomManager) Reorder(domain string, hid int64, rids []int64) error {
+	common.CheckParam(this.store != nil)
+	list, err := this.getAllRooms(domain, hid)
+	if err != nil {
+		log.Warningf("get home all rooms failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	} else if len(list) != len(rids) {
+		log.Warningf("check the room count failed:domain[%s], hid[%d], count[%d], new[%d]", domain, hid, len(list), len(rids))
+		return common.ErrInvalidParam
+	}
+	exist := make(map[int64]bool)
+	for _, room := range list {
+		exist[room.rid] = true
+	}
+	for _, rid := range rids {
+		if !exist[rid] {
+			log.Warningf("check the room failed:domain[%s], hid[%d], rid[%d]", domain, hid, rid)
+			return common.ErrInvalidParam
+		}
+		delete(exist, rid)
+	}
+	err = this.reorderRooms(domain, hid, rids)
+	if err != nil {
+		log.Warningf("reorder rooms failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// database related private interface
+////////////////////////////////////////////////////////////////////////////////////
+func (this *RoomManager) getRoom(domain string, rid int64, room *Room) error {
+	SQL := fmt.Sprintf("SELECT rid, hid, name, position FROM %s_home_room WHERE rid = ?", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], rid[%d], err[%v]", domain, rid, err)
+		return err
+	}
+	defer stmt.Close()
+	err = stmt.QueryRow(rid).Scan(&room.rid, &room.hid, &room.name, &room.position)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return common.ErrEntryNotExist
+		}
+		log.Warningf("query room failed:domain[%s], rid[%d], err[%v]", domain, rid, err)
+		return err
+	}
+	return nil
+}
+
+func (this *RoomManager) getAllRooms(domain string, hid int64) ([]Room, error) {
+	SQL := fmt.Sprintf("SELECT rid, hid, name, position FROM %s_home_room WHERE hid = ? ORDER BY position, rid", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(hid)
+	if err != nil {
+		log.Errorf("query all rooms failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var room Room
+	list := make([]Room, 0)
+	for rows.Next() {
+		err = rows.Scan(&room.rid, &room.hid, &room.name, &room.position)
+		if err != nil {
+			log.Errorf("parse the room failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+			return nil, err
+		}
+		list = append(list, room)
+	}
+	return list, nil
+}
+
+func (this *RoomManager) insertRoom(domain string, hid int64, name string) (int64, error) {
+	SQL := fmt.Sprintf("INSERT INTO %s_home_room(hid, name, position, create_time) SELECT ?, ?, COUNT(*), NOW() FROM %s_home_room WHERE hid = ?",
+		domain, domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], err[%v]", domain, err)
+		return -1, err
+	}
+	defer stmt.Close()
+	result, err := stmt.Exec(hid, name, hid)
+	if err != nil {
+		log.Errorf("create new room failed:domain[%s], hid[%d], name[%s], err[%v]", domain, hid, name, err)
+		return -1, err
+	}
+	rid, err := result.LastInsertId()
+	if err != nil {
+		log.Errorf("get last insert id failed:domain[%s], hid[%d], name[%s], err[%v]", domain, hid, name, err)
+		return -1, err
+	}
+	return rid, nil
+}
+
+func (this *RoomManager) modifyRoom(domain string, hid, rid int64, key string, value interface{}) error {
+	SQL := fmt.Sprintf("UPDATE %s_home_room SET %s = ?, modify_time = NOW() WHERE rid = ? AND hid = ?", domain, key)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:err[%v]", err)
+		return err
+	}
+	defer stmt.Close()
+	result, err := stmt.Exec(value, rid, hid)
+	if err != nil {
+		log.Errorf("execute update failed:sql[%s], err[%v]", SQL, err)
+		return err
+	}
+	affect, err := result.RowsAffected()
+	if err != nil {
+		log.Warningf("get affected rows failed:err[%v]", err)
+		return err
+	}
+	if affect != 1 {
+		log.Warningf("check affected rows failed:domain[%s], hid[%d], rid[%d], row[%d]", domain, hid, rid, affect)
+		return common.ErrEntryNotExist
+	}
+	return nil
+}
+
+// delete the room and unassign all the devices of the room in a transaction
+func (this *RoomManager) deleteRoom(domain string, hid, rid int64) error {
+	SQL1 := fmt.Sprintf("UPDATE %s_device_info SET room_id = 0 WHERE hid = ? AND room_id = ?", domain)
+	stmt1, err := this.store.db.Prepare(SQL1)
+	if err != nil {
+		log.Errorf("prepare unassign devices failed:domain[%s], rid[%d], err[%v]", domain, rid, err)
+		return err
+	}
+	defer stmt1.Close()
+	SQL2 := fmt.Sprintf("DELETE FROM %s_home_room WHERE rid = ? AND hid = ?", domain)
+	stmt2, err := this.store.db.Prepare(SQL2)
+	if err != nil {
+		log.Errorf("prepare delete room failed:domain[%s], rid[%d], err[%v]", domain, rid, err)
+		return err
+	}
+	defer stmt2.Close()
+
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], rid[%d], err[%v]", domain, rid, err)
+		return err
+	}
+	defer rollback(&err, tx)
+	_, err = tx.Stmt(stmt1).Exec(hid, rid)
+	if err != nil {
+		log.Errorf("unassign room devices failed:domain[%s], hid[%d], rid[%d], err[%v]", domain, hid, rid, err)
+		return err
+	}
+	_, err = tx.Stmt(stmt2).Exec(rid, hid)
+	if err != nil {
+		log.Errorf("delete room failed:domain[%s], hid[%d], rid[%d], err[%v]", domain, hid, rid, err)
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], hid[%d], rid[%d], err[%v]", domain, hid, rid, err)
+		return err
+	}
+	return nil
+}
+
+func (this *RoomManager) deleteAllRooms(domain string, hid int64) error {
+	SQL := fmt.Sprintf("DELETE FROM %s_home_room WHERE hid = ?", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(hid)
+	if err != nil {
+		log.Errorf("delete all rooms failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	return nil
+}
+
+func (this *RoomManager) reorderRooms(domain string, hid int64, rids []int64) error {
+	SQL := fmt.Sprintf("UPDATE %s_home_room SET position = ? WHERE rid = ? AND hid = ?", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare reorder rooms failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	defer stmt.Close()
+
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	defer rollback(&err, tx)
+	for position, rid := range rids {
+		_, err = tx.Stmt(stmt).Exec(position, rid, hid)
+		if err != nil {
+			log.Errorf("update room position failed:domain[%s], hid[%d], rid[%d], err[%v]", domain, hid, rid, err)
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package device
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRoomManager(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	// 5 home, 2 master/home, 3 slave/master
+	prepare(store)
+	home := NewHomeManager(store)
+	var uid int64 = 100
+	list, err := home.GetAllHome(domain, uid)
+	if err != nil || len(list) != 5 {
+		t.Errorf("get user all home failed:err[%v], len[%d]", err, len(list))
+	}
+	hid := list[0].hid
+	manager := NewRoomManager(store)
+	// home not exist
+	var invalidHid int64 = 10000000
+	_, err = manager.Create(domain, invalidHid, "room")
+	if err == nil {
+		t.Error("create room in not exist home succ")
+	}
+	rids := make([]int64, 0)
+	for i := 0; i < 3; i++ {
+		rid, err := manager.Create(domain, hid, fmt.Sprintf("room%d", i))
+		if err != nil {
+			t.Error("create room failed", err)
+		}
+		rids = append(rids, rid)
+	}
+	err = manager.Rename(domain, hid, rids[0], "kitchen")
+	if err != nil {
+		t.Error("rename room failed", err)
+	}
+	err = manager.Rename(domain, invalidHid, rids[0], "bedroom")
+	if err == nil {
+		t.Error("rename room of other home succ")
+	}
+	// reorder
+	err = manager.Reorder(domain, hid, []int64{rids[2], rids[1]})
+	if err == nil {
+		t.Error("reorder part of rooms succ")
+	}
+	err = manager.Reorder(domain, hid, []int64{rids[2], rids[1], rids[0]})
+	if err != nil {
+		t.Error("reorder rooms failed", err)
+	}
+	rooms, err := manager.GetAll(domain, hid)
+	if err != nil || len(rooms) != 3 {
+		t.Errorf("get all rooms failed:err[%v], len[%d]", err, len(rooms))
+	} else if rooms[0].GetRid() != rids[2] || rooms[2].GetRid() != rids[0] || rooms[2].GetName() != "kitchen" {
+		t.Error("check rooms order failed")
+	}
+
+	// assign the devices to the room
+	device := NewDeviceManager(store)
+	devList, err := device.GetAllDevices(domain, hid)
+	if err != nil || len(devList) != 8 {
+		t.Errorf("get all devices failed:err[%v], len[%d]", err, len(devList))
+	}
+	for _, dev := range devList[:4] {
+		err = device.ChangeDeviceRoom(domain, dev.did, rids[0])
+		if err != nil {
+			t.Error("set device room failed", err)
+		}
+	}
+	other, err := manager.Create(domain, list[1].hid, "other")
+	if err != nil {
+		t.Error("create room failed", err)
+	}
+	err = device.ChangeDeviceRoom(domain, devList[4].did, other)
+	if err == nil {
+		t.Error("set device to other home room succ")
+	}
+	err = device.ChangeDeviceRoom(domain, devList[4].did, -1)
+	if err == nil {
+		t.Error("set device to invalid room succ")
+	}
+	// rebinding in the same home keep the room
+	binding := NewBindingManager(store)
+	bind, err := binding.Get(domain, devList[0].did)
+	if err != nil || bind == nil {
+		t.Fatal("get binding info failed", err)
+	}
+	masterDid := devList[0].GetMasterDid()
+	if devList[0].IsMasterDevice() {
+		masterDid = -1
+	}
+	err = binding.Binding(uid, domain, bind.subDomain, bind.deviceId, "rebind", "", hid, masterDid)
+	if err != nil {
+		t.Error("rebinding device failed", err)
+	}
+	dev, err := device.Get(domain, devList[0].did)
+	if err != nil || dev == nil || dev.GetRoomId() != rids[0] {
+		t.Errorf("check rebinding device room failed:err[%v]", err)
+	}
+	roomDevs, err := device.GetRoomDevices(domain, hid, rids[0])
+	if err != nil || len(roomDevs) != 4 {
+		t.Errorf("get room devices failed:err[%v], len[%d]", err, len(roomDevs))
+	}
+	// delete the room the devices unassigned
+	err = manager.Delete(domain, hid, rids[0])
+	if err != nil {
+		t.Error("delete room failed", err)
+	}
+	roomDevs, err = device.GetRoomDevices(domain, hid, 0)
+	if err != nil || len(roomDevs) != 8 {
+		t.Errorf("get unassigned devices failed:err[%v], len[%d]", err, len(roomDevs))
+	}
+	room, err := manager.Get(domain, rids[0])
+	if err != nil || room != nil {
+		t.Errorf("check deleted room failed:err[%v]", err)
+	}
+	cleanAll(store)
+}
@@ -0,0 +1,112 @@
+package device
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"zc-common-go/common"
+)
+
+const (
+	// max length of the member schedule text
+	MAX_SCHEDULE_LEN = 256
+	minutesOfDay     = 24 * 60
+)
+
+// one recurring access window, the weekdays mask of time.Weekday and the minutes
+// of the day in the home timezone, the window crosses the midnight if end before start
+type AccessWindow struct {
+	weekdays uint8
+	start    int
+	end      int
+}
+
+func (this *AccessWindow) HasWeekday(day time.Weekday) bool {
+	return this.weekdays&(1<<uint(day)) != 0
+}
+
+// the start minute of the day
+func (this *AccessWindow) GetStart() int {
+	return this.start
+}
+
+// the end minute of the day
+func (this *AccessWindow) GetEnd() int {
+	return this.end
+}
+
+// check the local time in the window, the part after the midnight belongs to the previous weekday
+func (this *AccessWindow) contains(local time.Time) bool {
+	minute := local.Hour()*60 + local.Minute()
+	day := local.Weekday()
+	if this.start < this.end {
+		return this.HasWeekday(day) && minute >= this.start && minute < this.end
+	}
+	return (this.HasWeekday(day) && minute >= this.start) || (this.HasWeekday((day+6)%7) && minute < this.end)
+}
+
+// the end time of the window containing the local time
+func (this *AccessWindow) endOf(local time.Time) time.Time {
+	minute := local.Hour()*60 + local.Minute()
+	year, month, day := local.Date()
+	// the window crossing the midnight ends tomorrow if the local time before the midnight
+	if this.start > this.end && minute >= this.start {
+		day++
+	}
+	return time.Date(year, month, day, 0, this.end, 0, 0, local.Location())
+}
+
+// parse the schedule text like "1,2,3,4,5@09:00-17:00;0,6@10:00-14:00", the weekday
+// 0 is sunday, the empty text means no schedule and return empty list
+func ParseSchedule(text string) ([]AccessWindow, error) {
+	list := make([]AccessWindow, 0)
+	if len(text) == 0 {
+		return list, nil
+	} else if len(text) > MAX_SCHEDULE_LEN {
+		return nil, common.ErrInvalidParam
+	}
+	for _, item := range strings.Split(text, ";") {
+		parts := strings.Split(item, "@")
+		if len(parts) != 2 {
+			return nil, common.ErrInvalidParam
+		}
+		var window AccessWindow
+		for _, day := range strings.Split(parts[0], ",") {
+			value, err := strconv.Atoi(strings.TrimSpace(day))
+			if err != nil || value < 0 || value > 6 {
+				return nil, common.ErrInvalidParam
+			}
+			window.weekdays |= 1 << uint(value)
+		}
+		times := strings.Split(parts[1], "-")
+		if len(times) != 2 {
+			return nil, common.ErrInvalidParam
+		}
+		var err error
+		window.start, err = parseMinute(times[0])
+		if err != nil {
+			return nil, err
+		} else if window.start == minutesOfDay {
+			return nil, common.ErrInvalidParam
+		}
+		window.end, err = parseMinute(times[1])
+		if err != nil {
+			return nil, err
+		} else if window.start == window.end {
+			return nil, common.ErrInvalidParam
+		}
+		list = append(list, window)
+	}
+	return list, nil
+}
+
+// parse the HH:MM to the minute of the day, 24:00 is valid as the end of the day
+func parseMinute(text string) (int, error) {
+	var hour, minute int
+	_, err := fmt.Sscanf(strings.TrimSpace(text), "%d:%d", &hour, &minute)
+	if err != nil || hour < 0 || minute < 0 || minute >= 60 || hour*60+minute > minutesOfDay {
+		return -1, common.ErrInvalidParam
+	}
+	return hour*60 + minute, nil
+}
@@ -0,0 +1,63 @@
+package device
+
+import (
+	"reflect"
+	"time"
+	"zc-common-go/mysql"
+)
+
+// max json length of the shadow reported or desired section
+const MAX_SHADOW_STATE_LEN = 8192
+
+// the shadow document of the device, the reported state is the last known state
+// reported by the device, the desired state is set by the apps, the version
+// increased on every update
+type DeviceShadow struct {
+	did        int64
+	reported   map[string]interface{}
+	desired    map[string]interface{}
+	version    int64
+	modifyTime mysql.NullTime
+}
+
+func (this *DeviceShadow) GetDid() int64 {
+	return this.did
+}
+
+func (this *DeviceShadow) GetReported() map[string]interface{} {
+	return this.reported
+}
+
+func (this *DeviceShadow) GetDesired() map[string]interface{} {
+	return this.desired
+}
+
+func (this *DeviceShadow) GetVersion() int64 {
+	return this.version
+}
+
+func (this *DeviceShadow) GetModifyTime() time.Time {
+	return this.modifyTime.Time
+}
+
+// the desired keys not reported or reported with a different value
+func (this *DeviceShadow) GetDelta() map[string]interface{} {
+	delta := make(map[string]interface{})
+	for key, value := range this.desired {
+		if reported, ok := this.reported[key]; !ok || !reflect.DeepEqual(reported, value) {
+			delta[key] = value
+		}
+	}
+	return delta
+}
+
+// merge the patch to the state, the key with null value removed
+func mergeState(state, patch map[string]interface{}) {
+	for key, value := range patch {
+		if value == nil {
+			delete(state, key)
+		} else {
+			state[key] = value
+		}
+	}
+}
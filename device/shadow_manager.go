@@ -0,0 +1,207 @@
+package device
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"zc-common-go/common"
+	log "zc-common-go/glog"
+	_ "zc-common-go/mysql"
+)
+
+type ShadowManager struct {
+	store  *DeviceStorage
+	router *AccessRouter
+}
+
+func NewShadowManager(store *DeviceStorage) *ShadowManager {
+	return &ShadowManager{store: store, router: NewAccessRouter(store)}
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// public interface
+////////////////////////////////////////////////////////////////////////////////////
+// get the device shadow by the user passing the access check of the access router,
+// if not exist return nil + nil
+func (this *ShadowManager) Get(uid int64, domain string, did int64) (*DeviceShadow, error) {
+	common.CheckParam(this.store != nil && this.router != nil)
+	_, _, _, err := this.router.checkAccess(newAccessCache(uid), domain, did)
+	if err != nil {
+		log.Warningf("check the device access failed:domain[%s], did[%d], uid[%d], err[%v]", domain, did, uid, err)
+		return nil, err
+	}
+	shadow, err := this.getShadow(domain, did)
+	if err != nil {
+		log.Warningf("get device shadow failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return nil, err
+	}
+	return shadow, nil
+}
+
+// merge the patch to the desired state by the user passing the access check of the access
+// router, the version checked if it is positive, return the updated shadow
+func (this *ShadowManager) UpdateDesired(uid int64, domain string, did int64, patch map[string]interface{}, version int64) (*DeviceShadow, error) {
+	common.CheckParam(this.store != nil && this.router != nil)
+	_, _, _, err := this.router.checkAccess(newAccessCache(uid), domain, did)
+	if err != nil {
+		log.Warningf("check the device access failed:domain[%s], did[%d], uid[%d], err[%v]", domain, did, uid, err)
+		return nil, err
+	}
+	shadow, err := this.updateShadow(domain, did, true, patch, version)
+	if err != nil {
+		log.Warningf("update shadow desired failed:domain[%s], did[%d], version[%d], err[%v]", domain, did, version, err)
+		return nil, err
+	}
+	return shadow, nil
+}
+
+// merge the patch to the reported state by the binded device, the version checked
+// if it is positive, return the updated shadow
+func (this *ShadowManager) Report(domain, subDomain, deviceId string, patch map[string]interface{}, version int64) (*DeviceShadow, error) {
+	common.CheckParam(this.store != nil)
+	bind, err := NewBindingManager(this.store).GetBindingInfo(domain, subDomain, deviceId)
+	if err == common.ErrEntryNotExist {
+		log.Warningf("device mapping not exist:domain[%s], subdomain[%s], deviceid[%s]", domain, subDomain, deviceId)
+		return nil, ErrBindingNotExist
+	} else if err != nil {
+		log.Warningf("get binding info failed:domain[%s], subdomain[%s], deviceid[%s], err[%v]", domain, subDomain, deviceId, err)
+		return nil, err
+	}
+	device, err := NewDeviceManager(this.store).Get(domain, bind.did)
+	if err != nil {
+		log.Warningf("get device failed:domain[%s], did[%d], err[%v]", domain, bind.did, err)
+		return nil, err
+	} else if device == nil {
+		log.Warningf("device not exist:domain[%s], did[%d]", domain, bind.did)
+		return nil, ErrDeviceNotExist
+	}
+	shadow, err := this.updateShadow(domain, bind.did, false, patch, version)
+	if err != nil {
+		log.Warningf("update shadow reported failed:domain[%s], did[%d], version[%d], err[%v]", domain, bind.did, version, err)
+		return nil, err
+	}
+	return shadow, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////
+// database related private interface
+////////////////////////////////////////////////////////////////////////////////////
+func (this *ShadowManager) getShadow(domain string, did int64) (*DeviceShadow, error) {
+	SQL := fmt.Sprintf("SELECT did, reported, desired, version, modify_time FROM %s_device_shadow WHERE did = ?", domain)
+	stmt, err := this.store.db.Prepare(SQL)
+	if err != nil {
+		log.Errorf("prepare query failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	shadow, err := scanShadow(stmt.QueryRow(did))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		log.Errorf("get shadow failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return nil, err
+	}
+	return shadow, nil
+}
+
+func scanShadow(row *sql.Row) (*DeviceShadow, error) {
+	var shadow DeviceShadow
+	var reported, desired string
+	err := row.Scan(&shadow.did, &reported, &desired, &shadow.version, &shadow.modifyTime)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(reported), &shadow.reported)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(desired), &shadow.desired)
+	if err != nil {
+		return nil, err
+	}
+	if shadow.reported == nil {
+		shadow.reported = make(map[string]interface{})
+	}
+	if shadow.desired == nil {
+		shadow.desired = make(map[string]interface{})
+	}
+	return &shadow, nil
+}
+
+// merge the patch to the desired or reported section and increase the version in a transaction
+func (this *ShadowManager) updateShadow(domain string, did int64, desired bool, patch map[string]interface{}, version int64) (shadow *DeviceShadow, err error) {
+	SQL1 := fmt.Sprintf("INSERT IGNORE INTO %s_device_shadow(did, reported, desired, version, modify_time) VALUES(?,'{}','{}',0,NOW())", domain)
+	stmt1, err := this.store.db.Prepare(SQL1)
+	if err != nil {
+		log.Errorf("prepare insert shadow failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return nil, err
+	}
+	defer stmt1.Close()
+	SQL2 := fmt.Sprintf("SELECT did, reported, desired, version, modify_time FROM %s_device_shadow WHERE did = ? FOR UPDATE", domain)
+	stmt2, err := this.store.db.Prepare(SQL2)
+	if err != nil {
+		log.Errorf("prepare query shadow failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return nil, err
+	}
+	defer stmt2.Close()
+	SQL3 := fmt.Sprintf("UPDATE %s_device_shadow SET reported = ?, desired = ?, version = ?, modify_time = NOW() WHERE did = ?", domain)
+	stmt3, err := this.store.db.Prepare(SQL3)
+	if err != nil {
+		log.Errorf("prepare update shadow failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return nil, err
+	}
+	defer stmt3.Close()
+
+	tx, err := this.store.db.Begin()
+	if err != nil {
+		log.Errorf("begin transaction failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return nil, err
+	}
+	defer rollback(&err, tx)
+	_, err = tx.Stmt(stmt1).Exec(did)
+	if err != nil {
+		log.Errorf("insert shadow failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return nil, err
+	}
+	shadow, err = scanShadow(tx.Stmt(stmt2).QueryRow(did))
+	if err != nil {
+		log.Errorf("get shadow failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return nil, err
+	} else if version > 0 && version != shadow.version {
+		log.Warningf("check the shadow version failed:domain[%s], did[%d], version[%d], current[%d]", domain, did, version, shadow.version)
+		err = ErrVersionConflict
+		return nil, err
+	}
+	if desired {
+		mergeState(shadow.desired, patch)
+	} else {
+		mergeState(shadow.reported, patch)
+	}
+	reportedText, err := json.Marshal(shadow.reported)
+	if err != nil {
+		return nil, err
+	}
+	desiredText, err := json.Marshal(shadow.desired)
+	if err != nil {
+		return nil, err
+	}
+	if len(reportedText) > MAX_SHADOW_STATE_LEN || len(desiredText) > MAX_SHADOW_STATE_LEN {
+		log.Warningf("check the shadow size failed:domain[%s], did[%d], reported[%d], desired[%d]",
+			domain, did, len(reportedText), len(desiredText))
+		err = common.ErrInvalidParam
+		return nil, err
+	}
+	shadow.version++
+	_, err = tx.Stmt(stmt3).Exec(string(reportedText), string(desiredText), shadow.version, did)
+	if err != nil {
+		log.Errorf("update shadow failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("commit failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return nil, err
+	}
+	return shadow, nil
+}
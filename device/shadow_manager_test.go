@@ -0,0 +1,106 @@
+package device
+
+import (
+	"strings"
+	"testing"
+	"zc-common-go/common"
+)
+
+func TestDeviceShadow(t *testing.T) {
+	store := NewDeviceStorage(host, user, password, database)
+	if store == nil {
+		t.Errorf("init storage failed")
+	}
+	defer store.Destory()
+	prepare(store)
+	home := NewHomeManager(store)
+	var uid int64 = 100
+	list, err := home.GetAllHome(domain, uid)
+	if err != nil || len(list) != 5 {
+		t.Errorf("get user all home failed:err[%v], len[%d]", err, len(list))
+	}
+	hid := list[0].hid
+	device := NewDeviceManager(store)
+	devList, err := device.GetAllDevices(domain, hid)
+	if err != nil || len(devList) != 8 {
+		t.Errorf("get all devices failed:err[%v], len[%d]", err, len(devList))
+	}
+	did := devList[0].did
+	bind, err := NewBindingManager(store).Get(domain, did)
+	if err != nil || bind == nil {
+		t.Fatal("get device binding failed", err)
+	}
+	manager := NewShadowManager(store)
+	shadow, err := manager.Get(uid, domain, did)
+	if err != nil || shadow != nil {
+		t.Error("get not exist shadow failed", err)
+	}
+	// the desired state set by the app
+	shadow, err = manager.UpdateDesired(uid, domain, did, map[string]interface{}{"power": "on", "level": 3.0}, 0)
+	if err != nil || shadow.GetVersion() != 1 || len(shadow.GetDelta()) != 2 {
+		t.Fatal("update desired failed", err)
+	}
+	_, err = manager.UpdateDesired(uid, domain, 1000000, map[string]interface{}{"power": "on"}, 0)
+	if err != ErrDeviceNotExist {
+		t.Error("update not exist device shadow succ", err)
+	}
+	// the reported state by the device
+	shadow, err = manager.Report(domain, bind.subDomain, bind.deviceId, map[string]interface{}{"power": "on", "level": 1.0}, 1)
+	if err != nil || shadow.GetVersion() != 2 {
+		t.Fatal("report state failed", err)
+	}
+	delta := shadow.GetDelta()
+	if len(delta) != 1 || delta["level"] != 3.0 {
+		t.Error("check shadow delta failed", delta)
+	}
+	_, err = manager.Report(domain, bind.subDomain, bind.deviceId, map[string]interface{}{"level": 3.0}, 1)
+	if err != ErrVersionConflict {
+		t.Error("report with old version succ", err)
+	}
+	_, err = manager.Report(domain, bind.subDomain, "not exist device", map[string]interface{}{"level": 3.0}, 0)
+	if err != ErrBindingNotExist {
+		t.Error("report not exist device succ", err)
+	}
+	// the null value remove the key
+	shadow, err = manager.UpdateDesired(uid, domain, did, map[string]interface{}{"level": nil}, 2)
+	if err != nil || len(shadow.GetDesired()) != 1 || len(shadow.GetDelta()) != 0 {
+		t.Error("remove desired key failed", err)
+	}
+	shadow, err = manager.Get(uid, domain, did)
+	if err != nil || shadow == nil || shadow.GetVersion() != 3 || shadow.GetReported()["level"] != 1.0 {
+		t.Error("get shadow failed", err)
+	}
+	// the oversized state
+	_, err = manager.UpdateDesired(uid, domain, did, map[string]interface{}{"text": strings.Repeat("a", MAX_SHADOW_STATE_LEN)}, 0)
+	if err != common.ErrInvalidParam {
+		t.Error("update oversized desired succ", err)
+	}
+	// the member denied by the device acl
+	var guest int64 = 200
+	err = NewMemberManager(store).AddMember(domain, hid, guest, "member")
+	if err != nil {
+		t.Error("add member failed", err)
+	}
+	err = NewAclManager(store).Grant(domain, uid, did, ACL_SUBJECT_USER, guest, false)
+	if err != nil {
+		t.Error("grant device acl failed", err)
+	}
+	_, err = manager.Get(guest, domain, did)
+	if err != ErrAccessDenied {
+		t.Error("get denied device shadow succ", err)
+	}
+	_, err = manager.UpdateDesired(guest, domain, did, map[string]interface{}{"power": "off"}, 0)
+	if err != ErrAccessDenied {
+		t.Error("update denied device shadow succ", err)
+	}
+	// the shadow deleted with the device
+	err = device.DeleteDevice(uid, domain, hid, did)
+	if err != nil {
+		t.Error("delete device failed", err)
+	}
+	shadow, err = manager.getShadow(domain, did)
+	if err != nil || shadow != nil {
+		t.Error("check shadow deleted failed", err)
+	}
+	cleanAll(store)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"zc-common-go/common"
 	log "zc-common-go/glog"
 	"zc-dm/device"
@@ -9,13 +10,14 @@ import (
 
 type DeviceAccessPointHandler struct {
 	accessPoint *device.AccessRouter
+	revocation  *device.RevocationManager
 }
 
-func NewDeviceAccessPointHandler(access *device.AccessRouter) *DeviceAccessPointHandler {
-	if access == nil {
+func NewDeviceAccessPointHandler(access *device.AccessRouter, revocation *device.RevocationManager) *DeviceAccessPointHandler {
+	if access == nil || revocation == nil {
 		return nil
 	}
-	return &DeviceAccessPointHandler{accessPoint: access}
+	return &DeviceAccessPointHandler{accessPoint: access, revocation: revocation}
 }
 
 // check privelige and return the access device keys
@@ -28,7 +30,14 @@ func (this *DeviceAccessPointHandler) handleGetAccessPoint(req *zc.ZMsg, resp *z
 		log.Warningf("check request invalid:domain[%s], uid[%d], did[%d]", domain, uid, did)
 		return
 	}
-	subDomain, deviceId, err := this.accessPoint.GetAccessPoint(uid, domain, did)
+	// fail fast if the master device offline when required
+	var subDomain, deviceId, grant string
+	var err error
+	if req.GetBool("online") {
+		subDomain, deviceId, grant, err = this.accessPoint.GetOnlineAccessPoint(uid, domain, did)
+	} else {
+		subDomain, deviceId, grant, err = this.accessPoint.GetAccessPoint(uid, domain, did)
+	}
 	if err != nil {
 		resp.SetErr(err.Error())
 		log.Warningf("get device ctrl access point failed:domain[%s], uid[%d], did[%d], err[%v]", domain, uid, did, err)
@@ -37,5 +46,134 @@ func (this *DeviceAccessPointHandler) handleGetAccessPoint(req *zc.ZMsg, resp *z
 	resp.AddString("domain", domain)
 	resp.AddString("submain", subDomain)
 	resp.AddString("deviceid", deviceId)
+	if len(grant) > 0 {
+		resp.AddString("grant", grant)
+	}
+	resp.SetAck()
+}
+
+// check privelige and return the access device keys of the dids json list, every
+// did has its own access point or error
+func (this *DeviceAccessPointHandler) handleGetAccessPoints(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	var dids []int64
+	err := json.Unmarshal([]byte(req.GetString("dids")), &dids)
+	if err != nil || len(domain) <= 0 || uid <= 0 {
+		resp.SetErr(common.ErrInvalidRequest.Error())
+		log.Warningf("check request invalid:domain[%s], uid[%d], err[%v]", domain, uid, err)
+		return
+	}
+	list, err := this.accessPoint.GetAccessPoints(uid, domain, dids)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("get device ctrl access points failed:domain[%s], uid[%d], count[%d], err[%v]", domain, uid, len(dids), err)
+		return
+	}
+	var failed int
+	for _, point := range list {
+		if point.GetError() != nil {
+			failed++
+			resp.AddObject("apoints", zc.ZObject{"did": point.GetDid(), "error": point.GetError().Error()})
+		} else {
+			object := zc.ZObject{"did": point.GetDid(), "domain": domain, "submain": point.GetSubDomain(),
+				"deviceid": point.GetDeviceId()}
+			if len(point.GetGrant()) > 0 {
+				object["grant"] = point.GetGrant()
+			}
+			resp.AddObject("apoints", object)
+		}
+	}
+	log.Infof("get device ctrl access points succ:domain[%s], uid[%d], count[%d], failed[%d]", domain, uid, len(list), failed)
+	resp.SetAck()
+}
+
+// explain the access decision of the request member to the device for the support, report
+// the outcome of every check step
+func (this *DeviceAccessPointHandler) handleExplainAccess(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("member")
+	did := req.GetInt("did")
+	if len(domain) <= 0 || uid <= 0 || did <= 0 {
+		resp.SetErr(common.ErrInvalidRequest.Error())
+		log.Warningf("check request invalid:domain[%s], uid[%d], did[%d]", domain, uid, did)
+		return
+	}
+	steps, err := this.accessPoint.ExplainAccess(uid, domain, did)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("explain device access failed:domain[%s], uid[%d], did[%d], err[%v]", domain, uid, did, err)
+		return
+	}
+	allowed := true
+	for _, step := range steps {
+		object := zc.ZObject{"step": step.GetName()}
+		if !step.IsChecked() {
+			allowed = false
+			object["result"] = "skipped"
+		} else if step.GetError() != nil {
+			allowed = false
+			object["result"] = "failed"
+			object["error"] = step.GetError().Error()
+		} else {
+			object["result"] = "ok"
+		}
+		resp.AddObject("steps", object)
+	}
+	resp.AddObject("decision", zc.ZObject{"uid": uid, "did": did, "allowed": allowed})
+	log.Infof("explain device access succ:domain[%s], uid[%d], did[%d], allowed[%t]", domain, uid, did, allowed)
+	resp.SetAck()
+}
+
+// return the members who can access the device by the physical id, used by the push
+// notifications and the alarms
+func (this *DeviceAccessPointHandler) handleGetDeviceAudience(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	subDomain := req.GetString("submain")
+	deviceId := req.GetString("deviceid")
+	if len(domain) <= 0 || len(subDomain) <= 0 || len(deviceId) <= 0 {
+		resp.SetErr(common.ErrInvalidRequest.Error())
+		log.Warningf("check request invalid:domain[%s], subdomain[%s], deviceid[%s]", domain, subDomain, deviceId)
+		return
+	}
+	list, err := this.accessPoint.GetAudience(domain, subDomain, deviceId)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("get device audience failed:domain[%s], subdomain[%s], deviceid[%s], err[%v]", domain, subDomain, deviceId, err)
+		return
+	}
+	for _, member := range list {
+		resp.AddObject("members", zc.ZObject{"id": member.GetUid(), "name": member.GetMemberName(), "hid": member.GetHid(),
+			"role": device.GetRoleName(member.GetMemberType())})
+	}
+	log.Infof("get device audience succ:domain[%s], subdomain[%s], deviceid[%s], count[%d]", domain, subDomain, deviceId, len(list))
+	resp.SetAck()
+}
+
+// return the access grant revocation list not expired, the gateway sync it periodically
+// to reject the grants of the frozen members or devices offline
+func (this *DeviceAccessPointHandler) handleGetRevocations(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	if len(domain) <= 0 {
+		resp.SetErr(common.ErrInvalidRequest.Error())
+		log.Warningf("check request invalid:domain[%s]", domain)
+		return
+	}
+	list, err := this.revocation.GetAll(domain)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("get grant revocations failed:domain[%s], err[%v]", domain, err)
+		return
+	}
+	for _, revocation := range list {
+		object := zc.ZObject{"time": revocation.GetRevokeTime().Unix()}
+		if revocation.GetSubjectType() == device.REVOKE_SUBJECT_USER {
+			object["member"] = revocation.GetSubject()
+		} else {
+			object["did"] = revocation.GetSubject()
+		}
+		resp.AddObject("revocations", object)
+	}
+	log.Infof("get grant revocations succ:domain[%s], count[%d]", domain, len(list))
 	resp.SetAck()
 }
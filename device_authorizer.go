@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"zc-common-go/common"
+	log "zc-common-go/glog"
+	"zc-dm/device"
+	"zc-service-go"
+)
+
+// the max clock skew of the signed request timestamp
+const CREDENTIAL_WINDOW = 5 * time.Minute
+
+// the labels separating the device key derivation from the request signature
+const (
+	DEVICE_KEY_LABEL = "device-key"
+	REQUEST_LABEL    = "request"
+)
+
+// the type of the signed request param
+const (
+	PARAM_STRING = iota
+	PARAM_INT
+	PARAM_BOOL
+)
+
+// the request params of the signed commands besides the credential fields, all the params
+// read by the command handler are covered by the signature so the captured request can not
+// be replayed with other params
+var signedParams = map[string]map[string]int{
+	"explainaccess":     {"did": PARAM_INT},
+	"getdeviceaudience": {"submain": PARAM_STRING, "deviceid": PARAM_STRING},
+	"getrevocations":    {},
+	"registdevice":      {"submain": PARAM_STRING, "deviceid": PARAM_STRING, "publickey": PARAM_STRING, "master": PARAM_BOOL},
+	"setquota":          {"name": PARAM_STRING, "value": PARAM_INT},
+	"sweepmembers":      {},
+	"devicehistory":     {"submain": PARAM_STRING, "deviceid": PARAM_STRING},
+	"heartbeat":         {"address": PARAM_STRING, "server": PARAM_STRING},
+	"resetdevice":       {},
+	"exportuser":        {},
+	"purgeuser":         {"policy": PARAM_STRING},
+	"reportshadow":      {"reported": PARAM_STRING, "version": PARAM_INT},
+	"fetchcommands":     {"limit": PARAM_INT},
+	"ackcommand":        {"id": PARAM_INT},
+	"nackcommand":       {"id": PARAM_INT},
+}
+
+// the uniform authorization of the mutating commands, the caller is the uid of the request,
+// the home is resolved by the did of the request device, or the hid if no device set
+type DeviceAuthorizer struct {
+	home   *device.HomeManager
+	member *device.MemberManager
+	device *device.DeviceManager
+	// the service key shared with the trusted services, the signed requests
+	// are all rejected if not configured
+	serviceKey []byte
+	// the signatures accepted in the credential window with their expire time,
+	// every signed request accepted only once
+	lock  sync.Mutex
+	seen  map[string]time.Time
+	prune time.Time
+}
+
+func NewDeviceAuthorizer(home *device.HomeManager, member *device.MemberManager, device *device.DeviceManager, serviceKey []byte) *DeviceAuthorizer {
+	if home == nil || member == nil || device == nil {
+		return nil
+	}
+	return &DeviceAuthorizer{home: home, member: member, device: device, serviceKey: serviceKey, seen: make(map[string]time.Time)}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+/// AUTHORIZATION
+////////////////////////////////////////////////////////////////////////////////////////////
+// the caller must be active member of the home with the permission
+func (this *DeviceAuthorizer) authorize(perm int, handler zc.ZServiceHandler) zc.ZServiceHandler {
+	return func(req *zc.ZMsg, resp *zc.ZMsg) {
+		if this.check(req, resp, perm, false) {
+			handler(req, resp)
+		}
+	}
+}
+
+// the caller must be the owner of the home
+func (this *DeviceAuthorizer) authorizeOwner(handler zc.ZServiceHandler) zc.ZServiceHandler {
+	return func(req *zc.ZMsg, resp *zc.ZMsg) {
+		if this.check(req, resp, 0, true) {
+			handler(req, resp)
+		}
+	}
+}
+
+// the member commands, the permission only required if the member is not the caller self
+func (this *DeviceAuthorizer) authorizeMember(perm int, handler zc.ZServiceHandler) zc.ZServiceHandler {
+	return func(req *zc.ZMsg, resp *zc.ZMsg) {
+		required := perm
+		member := req.GetInt("member")
+		if member <= 0 || member == req.GetInt("uid") {
+			required = 0
+		}
+		if this.check(req, resp, required, false) {
+			handler(req, resp)
+		}
+	}
+}
+
+// the user commands, the caller must be set, and also be active member of the home if the
+// request did or hid set
+func (this *DeviceAuthorizer) authorizeUser(handler zc.ZServiceHandler) zc.ZServiceHandler {
+	return func(req *zc.ZMsg, resp *zc.ZMsg) {
+		if req.GetInt("did") <= 0 && req.GetInt("hid") <= 0 {
+			if req.GetInt("uid") <= 0 {
+				resp.SetErr(common.ErrNoPrivelige.Error())
+				log.Warningf("check the caller failed:domain[%s]", req.GetString("domain"))
+				return
+			}
+			handler(req, resp)
+		} else if this.check(req, resp, 0, false) {
+			handler(req, resp)
+		}
+	}
+}
+
+// check the caller member role and permission, set the resp err if forbidden
+func (this *DeviceAuthorizer) check(req *zc.ZMsg, resp *zc.ZMsg, perm int, owner bool) bool {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	hid, err := this.getHome(domain, req)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("get the request home failed:domain[%s], uid[%d], err[%v]", domain, uid, err)
+		return false
+	}
+	member, err := this.member.CheckPermission(domain, hid, uid, perm)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("check the caller permission failed:domain[%s], hid[%d], uid[%d], perm[%d], err[%v]", domain, hid, uid, perm, err)
+		return false
+	} else if owner {
+		// the owner role may be inherited from the ancestor site, only the home creator is the owner
+		home, err := this.home.Get(domain, hid)
+		if err != nil {
+			resp.SetErr(err.Error())
+			log.Warningf("get the request home failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, uid, err)
+			return false
+		} else if home == nil || home.GetCreateUid() != uid || member.GetMemberType() != device.ROLE_OWNER {
+			resp.SetErr(common.ErrNoPrivelige.Error())
+			log.Warningf("the caller not the home owner:domain[%s], hid[%d], uid[%d]", domain, hid, uid)
+			return false
+		}
+	}
+	return true
+}
+
+// the device home is used if the did set, otherwise the request hid, the request
+// hid must be the device home if both set as the handlers act on the hid
+func (this *DeviceAuthorizer) getHome(domain string, req *zc.ZMsg) (int64, error) {
+	if uid := req.GetInt("uid"); uid <= 0 {
+		return -1, common.ErrNoPrivelige
+	}
+	did := req.GetInt("did")
+	if did <= 0 {
+		hid := req.GetInt("hid")
+		if hid <= 0 {
+			return -1, common.ErrInvalidParam
+		}
+		return hid, nil
+	}
+	dev, err := this.device.Get(domain, did)
+	if err != nil {
+		return -1, err
+	} else if dev == nil {
+		return -1, common.ErrEntryNotExist
+	} else if hid := req.GetInt("hid"); hid > 0 && hid != dev.GetHid() {
+		log.Warningf("the device not in the request home:domain[%s], did[%d], hid[%d], home[%d]", domain, did, hid, dev.GetHid())
+		return -1, common.ErrNoPrivelige
+	}
+	return dev.GetHid(), nil
+}
+
+// the device commands must be signed by the device key, the access server holding
+// the service key can also sign for the connected devices
+func (this *DeviceAuthorizer) authorizeDevice(name string, handler zc.ZServiceHandler) zc.ZServiceHandler {
+	return func(req *zc.ZMsg, resp *zc.ZMsg) {
+		domain := req.GetString("domain")
+		subDomain := req.GetString("submain")
+		deviceId := req.GetString("deviceid")
+		if len(subDomain) <= 0 || len(deviceId) <= 0 {
+			resp.SetErr(common.ErrInvalidParam.Error())
+			log.Warningf("check the request device failed:name[%s], domain[%s], device[%s:%s]", name, domain, subDomain, deviceId)
+			return
+		}
+		key := this.getDeviceKey(domain, subDomain, deviceId)
+		if !this.verify(key, req, name, map[string]string{"domain": domain, "submain": subDomain, "deviceid": deviceId}) {
+			resp.SetErr(common.ErrNoPrivelige.Error())
+			log.Warningf("check the device credential failed:name[%s], domain[%s], device[%s:%s]", name, domain, subDomain, deviceId)
+			return
+		}
+		handler(req, resp)
+	}
+}
+
+// the internal commands must be signed by the service key
+func (this *DeviceAuthorizer) authorizeService(name string, handler zc.ZServiceHandler) zc.ZServiceHandler {
+	return func(req *zc.ZMsg, resp *zc.ZMsg) {
+		domain := req.GetString("domain")
+		if !this.verify(this.serviceKey, req, name, map[string]string{"domain": domain}) {
+			resp.SetErr(common.ErrNoPrivelige.Error())
+			log.Warningf("check the service credential failed:name[%s], domain[%s]", name, domain)
+			return
+		}
+		handler(req, resp)
+	}
+}
+
+// the internal commands acting on the request member user, the service key signs the
+// member as well so the target can not be replaced
+func (this *DeviceAuthorizer) authorizeSubject(name string, handler zc.ZServiceHandler) zc.ZServiceHandler {
+	return func(req *zc.ZMsg, resp *zc.ZMsg) {
+		domain := req.GetString("domain")
+		member := req.GetInt("member")
+		if member <= 0 {
+			resp.SetErr(common.ErrInvalidParam.Error())
+			log.Warningf("check the request member failed:name[%s], domain[%s], member[%d]", name, domain, member)
+			return
+		}
+		if !this.verify(this.serviceKey, req, name, map[string]string{"domain": domain, "member": strconv.FormatInt(member, 10)}) {
+			resp.SetErr(common.ErrNoPrivelige.Error())
+			log.Warningf("check the service credential failed:name[%s], domain[%s], member[%d]", name, domain, member)
+			return
+		}
+		handler(req, resp)
+	}
+}
+
+// the user commands on the user self, or on the request member by the service
+func (this *DeviceAuthorizer) authorizeSelf(name string, handler zc.ZServiceHandler) zc.ZServiceHandler {
+	subject := this.authorizeSubject(name, handler)
+	return func(req *zc.ZMsg, resp *zc.ZMsg) {
+		uid := req.GetInt("uid")
+		if member := req.GetInt("member"); member > 0 && member != uid {
+			subject(req, resp)
+		} else if uid <= 0 {
+			resp.SetErr(common.ErrNoPrivelige.Error())
+			log.Warningf("check the caller failed:name[%s], domain[%s]", name, req.GetString("domain"))
+		} else {
+			handler(req, resp)
+		}
+	}
+}
+
+// the diagnostic commands on the request member, by the caller member of the home with
+// the permission or by the service signing the member
+func (this *DeviceAuthorizer) authorizeManager(name string, perm int, handler zc.ZServiceHandler) zc.ZServiceHandler {
+	subject := this.authorizeSubject(name, handler)
+	manager := this.authorize(perm, handler)
+	return func(req *zc.ZMsg, resp *zc.ZMsg) {
+		if req.GetInt("member") <= 0 {
+			resp.SetErr(common.ErrInvalidParam.Error())
+			log.Warningf("check the request member failed:name[%s], domain[%s]", name, req.GetString("domain"))
+		} else if len(req.GetString("signature")) > 0 {
+			subject(req, resp)
+		} else {
+			manager(req, resp)
+		}
+	}
+}
+
+// the device key derived from the service key with the device key label, provisioned
+// to the device when produced
+func (this *DeviceAuthorizer) getDeviceKey(domain, subDomain, deviceId string) []byte {
+	if len(this.serviceKey) <= 0 {
+		return nil
+	}
+	return sign(this.serviceKey, DEVICE_KEY_LABEL, domain, subDomain, deviceId)
+}
+
+// the request signature is the hex hmac of the request label, the command name, every
+// param name and value sorted by the name and the timestamp, the timestamp must be in the
+// credential window and the signature not accepted before
+func (this *DeviceAuthorizer) verify(key []byte, req *zc.ZMsg, name string, params map[string]string) bool {
+	if len(key) <= 0 {
+		return false
+	}
+	timestamp := req.GetInt("timestamp")
+	skew := time.Since(time.Unix(timestamp, 0))
+	if skew > CREDENTIAL_WINDOW || skew < -CREDENTIAL_WINDOW {
+		return false
+	}
+	signature, err := hex.DecodeString(req.GetString("signature"))
+	if err != nil {
+		return false
+	}
+	fields, ok := getSignedFields(req, name, params)
+	if !ok {
+		log.Warningf("the command params not signed:name[%s]", name)
+		return false
+	}
+	fields = append(fields, strconv.FormatInt(timestamp, 10))
+	if !hmac.Equal(signature, sign(key, fields...)) {
+		return false
+	}
+	return this.accept(string(signature), time.Unix(timestamp, 0).Add(CREDENTIAL_WINDOW))
+}
+
+// record the signature until it expired, return false if the signature replayed
+func (this *DeviceAuthorizer) accept(signature string, expire time.Time) bool {
+	now := time.Now()
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if now.Sub(this.prune) > CREDENTIAL_WINDOW {
+		for key, value := range this.seen {
+			if now.After(value) {
+				delete(this.seen, key)
+			}
+		}
+		this.prune = now
+	}
+	if _, ok := this.seen[signature]; ok {
+		log.Warningf("the signed request replayed:signature[%s]", hex.EncodeToString([]byte(signature)))
+		return false
+	}
+	this.seen[signature] = expire
+	return true
+}
+
+// the canonical fields of the request label, the command name and the credential params
+// with the command params as name value pairs sorted by the name
+func getSignedFields(req *zc.ZMsg, name string, params map[string]string) ([]string, bool) {
+	kinds, ok := signedParams[name]
+	if !ok {
+		return nil, false
+	}
+	values := make(map[string]string, len(params)+len(kinds))
+	for key, value := range params {
+		values[key] = value
+	}
+	for key, kind := range kinds {
+		switch kind {
+		case PARAM_INT:
+			values[key] = strconv.FormatInt(req.GetInt(key), 10)
+		case PARAM_BOOL:
+			values[key] = strconv.FormatBool(req.GetBool(key))
+		default:
+			values[key] = req.GetString(key)
+		}
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fields := []string{REQUEST_LABEL, name}
+	for _, key := range keys {
+		fields = append(fields, key, values[key])
+	}
+	return fields, true
+}
+
+// the hmac of the fields each prefixed by its length, so the fields can not be shifted
+func sign(key []byte, fields ...string) []byte {
+	mac := hmac.New(sha256.New, key)
+	var size [4]byte
+	for _, field := range fields {
+		binary.BigEndian.PutUint32(size[:], uint32(len(field)))
+		mac.Write(size[:])
+		mac.Write([]byte(field))
+	}
+	return mac.Sum(nil)
+}
@@ -1,21 +1,26 @@
 package main
 
 import (
+	"encoding/json"
+	"zc-common-go/common"
 	log "zc-common-go/glog"
 	"zc-dm/device"
 	"zc-service-go"
 )
 
 type DeviceManagerHandler struct {
-	device *device.DeviceManager
-	bind   *device.BindingManager
+	device   *device.DeviceManager
+	bind     *device.BindingManager
+	history  *device.HistoryManager
+	presence *device.PresenceManager
 }
 
-func NewDeviceManagerHandler(device *device.DeviceManager, bind *device.BindingManager) *DeviceManagerHandler {
-	if device == nil || bind == nil {
+func NewDeviceManagerHandler(device *device.DeviceManager, bind *device.BindingManager, history *device.HistoryManager,
+	presence *device.PresenceManager) *DeviceManagerHandler {
+	if device == nil || bind == nil || history == nil || presence == nil {
 		return nil
 	}
-	return &DeviceManagerHandler{device: device, bind: bind}
+	return &DeviceManagerHandler{device: device, bind: bind, history: history, presence: presence}
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////
@@ -25,14 +30,36 @@ func NewDeviceManagerHandler(device *device.DeviceManager, bind *device.BindingM
 func (this *DeviceManagerHandler) handleListDevices(req *zc.ZMsg, resp *zc.ZMsg) {
 	domain := req.GetString("domain")
 	hid := req.GetInt("hid")
-	list, err := this.device.GetAllDevices(domain, hid)
+	// filter by the room if rid set, or the unassigned devices
+	rid := req.GetInt("rid")
+	unassigned := req.GetBool("unassigned")
+	var list []device.DeviceInfo
+	var err error
+	if rid > 0 || unassigned {
+		list, err = this.device.GetRoomDevices(domain, hid, rid)
+	} else {
+		list, err = this.device.GetAllDevices(domain, hid)
+	}
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("list all home devices failed:domain[%s], hid[%d], rid[%d], err[%v]", domain, hid, rid, err)
+		return
+	}
+	// the slave devices online if their master online
+	presences, err := this.presence.GetHomeAll(domain, hid)
 	if err != nil {
 		resp.SetErr(err.Error())
-		log.Warningf("list all home devices failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		log.Warningf("get home devices presence failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
 		return
 	}
 	for _, device := range list {
-		resp.AddObject("devices", zc.ZObject{"id": device.GetDid(), "hid": device.GetHid(), "name": device.GetDeviceName(), "master": device.GetMasterDid()})
+		object := zc.ZObject{"id": device.GetDid(), "hid": device.GetHid(), "name": device.GetDeviceName(),
+			"master": device.GetMasterDid(), "room": device.GetRoomId(), "online": false}
+		if presence, ok := presences[device.GetMasterDid()]; ok {
+			object["online"] = presence.IsOnline()
+			object["lastseen"] = presence.GetLastSeen().Unix()
+		}
+		resp.AddObject("devices", object)
 	}
 	log.Warningf("list all home devices succ:domain[%s], hid[%d], count[%d]", domain, hid, len(list))
 	resp.SetAck()
@@ -41,53 +68,241 @@ func (this *DeviceManagerHandler) handleListDevices(req *zc.ZMsg, resp *zc.ZMsg)
 // binding device
 func (this *DeviceManagerHandler) handleBindDevice(req *zc.ZMsg, resp *zc.ZMsg) {
 	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
 	subDomain := req.GetString("submain")
 	deviceId := req.GetString("deviceid")
 	name := req.GetString("dname")
+	token := req.GetString("token")
+	hid := req.GetInt("hid")
+	master := req.GetInt("master")
+	err := this.bind.Binding(uid, domain, subDomain, deviceId, name, token, hid, master)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("bind device to home failed:uid[%d], domain[%s], device[%s:%s], dname[%s], hid[%d], master[%d], err[%v]",
+			uid, domain, subDomain, deviceId, name, hid, master, err)
+		return
+	}
+	log.Infof("bind device to home succ:uid[%d], domain[%s], device[%s:%s], dname[%s], hid[%d], master[%d]",
+		uid, domain, subDomain, deviceId, name, hid, master)
+	resp.SetAck()
+}
+
+// the current home owner approve the device transfer to another home
+func (this *DeviceManagerHandler) handleApproveTransfer(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	did := req.GetInt("did")
+	hid := req.GetInt("hid")
+	err := this.bind.ApproveTransfer(uid, domain, did, hid)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("approve device transfer failed:uid[%d], domain[%s], did[%d], hid[%d], err[%v]", uid, domain, did, hid, err)
+		return
+	}
+	log.Infof("approve device transfer succ:uid[%d], domain[%s], did[%d], hid[%d]", uid, domain, did, hid)
+	resp.SetAck()
+}
+
+// device factory reset return the rebinding token
+func (this *DeviceManagerHandler) handleResetDevice(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	subDomain := req.GetString("submain")
+	deviceId := req.GetString("deviceid")
+	token, err := this.bind.ResetDevice(domain, subDomain, deviceId)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("reset device failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return
+	}
+	log.Infof("reset device succ:domain[%s], device[%s:%s]", domain, subDomain, deviceId)
+	resp.PutString("token", token)
+	resp.SetAck()
+}
+
+// the heartbeat of the master device with its connection info
+func (this *DeviceManagerHandler) handleHeartbeat(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	subDomain := req.GetString("submain")
+	deviceId := req.GetString("deviceid")
+	address := req.GetString("address")
+	server := req.GetString("server")
+	did, err := this.presence.Heartbeat(domain, subDomain, deviceId, address, server)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("device heartbeat failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return
+	}
+	log.Infof("device heartbeat succ:domain[%s], device[%s:%s], did[%d], address[%s], server[%s]",
+		domain, subDomain, deviceId, did, address, server)
+	resp.SetAck()
+}
+
+// one slave device in the batch binding request
+type bindingDevice struct {
+	SubDomain string `json:"submain"`
+	DeviceId  string `json:"deviceid"`
+	Name      string `json:"dname"`
+}
+
+// binding a batch of slave devices to one master
+func (this *DeviceManagerHandler) handleBatchBindDevices(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
 	hid := req.GetInt("hid")
 	master := req.GetInt("master")
-	err := this.bind.Binding(domain, subDomain, deviceId, name, hid, master)
+	bestEffort := req.GetBool("besteffort")
+	var devices []bindingDevice
+	err := json.Unmarshal([]byte(req.GetString("devices")), &devices)
+	if err != nil {
+		resp.SetErr(common.ErrInvalidRequest.Error())
+		log.Warningf("parse the devices failed:domain[%s], hid[%d], master[%d], err[%v]", domain, hid, master, err)
+		return
+	}
+	entries := make([]*device.BindingEntry, 0, len(devices))
+	for _, dev := range devices {
+		entries = append(entries, device.NewBindingEntry(dev.SubDomain, dev.DeviceId, dev.Name))
+	}
+	err = this.bind.BatchBinding(uid, domain, hid, master, entries, bestEffort)
+	for _, entry := range entries {
+		result := zc.ZObject{"submain": entry.GetSubDomain(), "deviceid": entry.GetDeviceId(), "id": entry.GetDid()}
+		if entry.GetError() != nil {
+			result["error"] = entry.GetError().Error()
+		}
+		resp.AddObject("devices", result)
+	}
 	if err != nil {
 		resp.SetErr(err.Error())
-		log.Warningf("bind device to home failed:domain[%s], device[%s:%s], dname[%s], hid[%d], master[%d], err[%v]",
-			domain, subDomain, deviceId, name, hid, master, err)
+		log.Warningf("batch bind devices failed:uid[%d], domain[%s], hid[%d], master[%d], count[%d], err[%v]",
+			uid, domain, hid, master, len(entries), err)
 		return
 	}
-	log.Infof("bind device to home succ:domain[%s], device[%s:%s], dname[%s], hid[%d], master[%d]",
-		domain, subDomain, deviceId, name, hid, master)
+	log.Infof("batch bind devices succ:uid[%d], domain[%s], hid[%d], master[%d], count[%d], besteffort[%t]",
+		uid, domain, hid, master, len(entries), bestEffort)
 	resp.SetAck()
 }
 
 // change device
 func (this *DeviceManagerHandler) handleChangeDevice(req *zc.ZMsg, resp *zc.ZMsg) {
 	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
 	subDomain := req.GetString("submain")
 	deviceId := req.GetString("deviceid")
-	did := req.GetInt("hid")
-	err := this.bind.ChangeBinding(did, domain, subDomain, deviceId)
+	did := req.GetInt("did")
+	err := this.bind.ChangeBinding(uid, did, domain, subDomain, deviceId)
 	if err != nil {
 		resp.SetErr(err.Error())
-		log.Warningf("change device failed:old[%d], domain[%s], device[%s:%s], err[%v]",
+		log.Warningf("change device failed:uid[%d], old[%d], domain[%s], device[%s:%s], err[%v]",
+			uid, did, domain, subDomain, deviceId, err)
+		return
+	}
+	log.Infof("change device succ:uid[%d], old[%d], domain[%s], device[%s:%s]",
+		uid, did, domain, subDomain, deviceId)
+	resp.SetAck()
+}
+
+// replace the master gateway and move all the slave devices to the new one
+func (this *DeviceManagerHandler) handleReplaceGateway(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	subDomain := req.GetString("submain")
+	deviceId := req.GetString("deviceid")
+	did := req.GetInt("did")
+	newDid, slaves, err := this.bind.ReplaceGateway(uid, domain, did, subDomain, deviceId)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("replace gateway failed:old[%d], domain[%s], device[%s:%s], err[%v]",
 			did, domain, subDomain, deviceId, err)
 		return
 	}
-	log.Infof("change device failed:old[%d], domain[%s], device[%s:%s]",
-		did, domain, subDomain, deviceId)
+	resp.AddObject("master", zc.ZObject{"id": newDid, "submain": subDomain, "deviceid": deviceId})
+	for _, slave := range slaves {
+		resp.AddObject("slaves", zc.ZObject{"id": slave})
+	}
+	log.Infof("replace gateway succ:old[%d], new[%d], domain[%s], device[%s:%s], slaves[%d]",
+		did, newDid, domain, subDomain, deviceId, len(slaves))
 	resp.SetAck()
 }
 
 // delete device
 func (this *DeviceManagerHandler) handleDeleteDevice(req *zc.ZMsg, resp *zc.ZMsg) {
 	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
 	hid := req.GetInt("hid")
 	did := req.GetInt("did")
-	err := this.device.DeleteDevice(domain, hid, did)
+	err := this.device.DeleteDevice(uid, domain, hid, did)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("delete device from home failed:uid[%d], domain[%s], hid[%d], did[%d], err[%v]", uid, domain, hid, did, err)
+		return
+	}
+	log.Infof("delete device from home succ:uid[%d], domain[%s], hid[%d], did[%d]", uid, domain, hid, did)
+	resp.SetAck()
+}
+
+// list the binding history of the device across all the homes for the support service
+func (this *DeviceManagerHandler) handleDeviceHistory(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	subDomain := req.GetString("submain")
+	deviceId := req.GetString("deviceid")
+	list, err := this.history.GetAll(domain, subDomain, deviceId)
 	if err != nil {
 		resp.SetErr(err.Error())
-		log.Warningf("delete device from home failed:domain[%s], hid[%d], did[%d], err[%v]", domain, hid, did, err)
+		log.Warningf("list device binding history failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
 		return
 	}
-	log.Infof("delete device from home succ:domain[%s], hid[%d], did[%s]", domain, hid, did)
+	for _, history := range list {
+		resp.AddObject("history", zc.ZObject{"did": history.GetDid(), "event": history.GetEvent(), "hid": history.GetHid(),
+			"master": history.GetMasterDid(), "uid": history.GetUid(), "time": history.GetCreateTime().Unix()})
+	}
+	log.Infof("list device binding history succ:domain[%s], device[%s:%s], count[%d]", domain, subDomain, deviceId, len(list))
+	resp.SetAck()
+}
+
+// list all slave devices of the master
+func (this *DeviceManagerHandler) handleListSlaves(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	did := req.GetInt("did")
+	list, err := this.device.GetAllSlaves(domain, did)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("list all slave devices failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return
+	}
+	for _, device := range list {
+		resp.AddObject("devices", zc.ZObject{"id": device.GetDid(), "hid": device.GetHid(), "name": device.GetDeviceName(), "master": device.GetMasterDid()})
+	}
+	log.Infof("list all slave devices succ:domain[%s], did[%d], count[%d]", domain, did, len(list))
+	resp.SetAck()
+}
+
+// move slave device to another master
+func (this *DeviceManagerHandler) handleMoveSlave(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	did := req.GetInt("did")
+	master := req.GetInt("master")
+	err := this.device.MoveSlave(uid, domain, did, master)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("move slave device failed:uid[%d], domain[%s], did[%d], master[%d], err[%v]", uid, domain, did, master, err)
+		return
+	}
+	log.Infof("move slave device succ:uid[%d], domain[%s], did[%d], master[%d]", uid, domain, did, master)
+	resp.SetAck()
+}
+
+// detach slave device from its master
+func (this *DeviceManagerHandler) handleDetachSlave(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	did := req.GetInt("did")
+	err := this.device.DetachSlave(uid, domain, did)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("detach slave device failed:uid[%d], domain[%s], did[%d], err[%v]", uid, domain, did, err)
+		return
+	}
+	log.Infof("detach slave device succ:uid[%d], domain[%s], did[%d]", uid, domain, did)
 	resp.SetAck()
 }
 
@@ -106,6 +321,21 @@ func (this *DeviceManagerHandler) handleModifyDevice(req *zc.ZMsg, resp *zc.ZMsg
 	resp.SetAck()
 }
 
+// assign device to a room of its home
+func (this *DeviceManagerHandler) handleSetDeviceRoom(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	did := req.GetInt("did")
+	rid := req.GetInt("rid")
+	err := this.device.ChangeDeviceRoom(domain, did, rid)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("set device room failed:domain[%s], did[%d], rid[%d], err[%v]", domain, did, rid, err)
+		return
+	}
+	log.Infof("set device room succ:domain[%s], did[%d], rid[%d]", domain, did, rid)
+	resp.SetAck()
+}
+
 // frozen/defrozen device
 func (this *DeviceManagerHandler) handleFrozenDevice(req *zc.ZMsg, resp *zc.ZMsg) {
 	domain := req.GetString("domain")
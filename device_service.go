@@ -1,6 +1,7 @@
 package main
 
 import (
+	"os"
 	log "zc-common-go/glog"
 	"zc-dm/device"
 	"zc-service-go"
@@ -13,13 +14,28 @@ type DeviceService struct {
 	dev       *DeviceManagerHandler
 	warehouse *DeviceWarehouseHandler
 	access    *DeviceAccessPointHandler
+	room      *RoomManagerHandler
+	quota     *QuotaManagerHandler
+	acl       *AclManagerHandler
+	account   *AccountManagerHandler
+	shadow    *ShadowManagerHandler
+	command   *CommandManagerHandler
+	auth      *DeviceAuthorizer
 }
 
 func (this *DeviceService) Validate() bool {
 	return this.home != nil && this.member != nil && this.dev != nil &&
-		this.warehouse != nil && this.access != nil
+		this.warehouse != nil && this.access != nil && this.room != nil && this.quota != nil &&
+		this.acl != nil && this.account != nil && this.shadow != nil && this.command != nil &&
+		this.auth != nil
 }
 
+// the environment of the access grant service key shared with the gateway
+const grantKeyEnv string = "ZC_DM_GRANT_KEY"
+
+// the environment of the service key signing the device and internal service requests
+const serviceKeyEnv string = "ZC_DM_SERVICE_KEY"
+
 func NewDeviceService(database string, config *zc.ZServiceConfig) *DeviceService {
 	const host string = "101.251.106.4:3306"
 	const user string = "root"
@@ -29,84 +45,263 @@ func NewDeviceService(database string, config *zc.ZServiceConfig) *DeviceService
 		log.Fatalln("device storage init failed")
 		return nil
 	}
-	home := NewHomeManagerHandler(device.NewHomeManager(store))
-	member := NewMemberManagerHandler(device.NewMemberManager(store))
-	dev := NewDeviceManagerHandler(device.NewDeviceManager(store), device.NewBindingManager(store))
+	home := NewHomeManagerHandler(device.NewHomeManager(store), device.NewAuditManager(store))
+	member := NewMemberManagerHandler(device.NewMemberManager(store), device.NewInviteManager(store))
+	dev := NewDeviceManagerHandler(device.NewDeviceManager(store), device.NewBindingManager(store), device.NewHistoryManager(store),
+		device.NewPresenceManager(store))
 	warehouse := NewDeviceWarehouseHandler(device.NewDeviceWarehouse(store))
-	access := NewDeviceAccessPointHandler(device.NewAccessRouter(store))
-	service := &DeviceService{home: home, member: member, dev: dev, warehouse: warehouse, access: access}
+	router := device.NewAccessRouter(store)
+	// the access grants minted only if the service key configured
+	if key := os.Getenv(grantKeyEnv); len(key) > 0 {
+		signer := device.NewGrantSigner([]byte(key), device.DEFAULT_GRANT_TTL)
+		if signer == nil {
+			log.Fatalln("grant signer init failed")
+			return nil
+		}
+		router.SetGrantSigner(signer)
+	}
+	access := NewDeviceAccessPointHandler(router, device.NewRevocationManager(store))
+	room := NewRoomManagerHandler(device.NewRoomManager(store))
+	quota := NewQuotaManagerHandler(device.NewQuotaManager(store))
+	acl := NewAclManagerHandler(device.NewAclManager(store))
+	account := NewAccountManagerHandler(device.NewAccountManager(store))
+	shadow := NewShadowManagerHandler(device.NewShadowManager(store))
+	command := NewCommandManagerHandler(device.NewCommandManager(store))
+	auth := NewDeviceAuthorizer(device.NewHomeManager(store), device.NewMemberManager(store), device.NewDeviceManager(store), []byte(os.Getenv(serviceKeyEnv)))
+	service := &DeviceService{home: home, member: member, dev: dev, warehouse: warehouse, access: access, room: room, quota: quota,
+		acl: acl, account: account, shadow: shadow, command: command, auth: auth}
 	if !service.Validate() {
 		log.Fatalln("service init failed")
 		return nil
 	}
 	service.Init("zc-dm", config)
 
+	// all the commands are authorized by the caller member, the device or the service
+	// credential, the deliberate exceptions are:
+	// getapoint, getapoints and enqueuecommand checked by the access router with the
+	// distinct access errors, getpublickey only returns the master public key
+
 	// device ctrl access point handler
 	service.Handle("getapoint", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
 		access.handleGetAccessPoint(req, resp)
 	}))
+	service.Handle("getapoints", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		access.handleGetAccessPoints(req, resp)
+	}))
+	service.Handle("explainaccess", auth.authorizeManager("explainaccess", device.PERM_MANAGE_MEMBER, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		access.handleExplainAccess(req, resp)
+	})))
+	// the audience fanned out by the push service holding the service key
+	service.Handle("getdeviceaudience", auth.authorizeService("getdeviceaudience", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		access.handleGetDeviceAudience(req, resp)
+	})))
+	// the revocation list synced by the gateway holding the service key
+	service.Handle("getrevocations", auth.authorizeService("getrevocations", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		access.handleGetRevocations(req, resp)
+	})))
 
 	// device warehouse handler
-	service.Handle("registdevice", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+	service.Handle("registdevice", auth.authorizeService("registdevice", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
 		warehouse.handleRegistDevice(req, resp)
-	}))
+	})))
 	service.Handle("getpublickey", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
 		warehouse.handleGetPublicKey(req, resp)
 	}))
 
 	// home manager handler
-	service.Handle("listhomes", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+	service.Handle("listhomes", auth.authorizeUser(zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
 		home.handleListHomes(req, resp)
-	}))
-	service.Handle("createhome", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+	})))
+	service.Handle("gethome", auth.authorize(0, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		home.handleGetHome(req, resp)
+	})))
+	service.Handle("createhome", auth.authorizeUser(zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
 		home.handleCreateHome(req, resp)
-	}))
-	service.Handle("modifyhome", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+	})))
+	service.Handle("modifyhome", auth.authorize(device.PERM_RENAME, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
 		home.handleModifyHome(req, resp)
-	}))
-	service.Handle("deletehome", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+	})))
+	service.Handle("deletehome", auth.authorizeOwner(zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
 		home.handleDeleteHome(req, resp)
-	}))
-	service.Handle("frozenhome", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+	})))
+	service.Handle("frozenhome", auth.authorize(device.PERM_FREEZE, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
 		home.handleFrozenHome(req, resp)
-	}))
+	})))
+	service.Handle("transferhome", auth.authorizeOwner(zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		home.handleTransferHome(req, resp)
+	})))
+	service.Handle("sethomeparent", auth.authorizeOwner(zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		home.handleSetHomeParent(req, resp)
+	})))
+	service.Handle("listchildhomes", auth.authorize(0, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		home.handleListChildHomes(req, resp)
+	})))
+	service.Handle("listaudits", auth.authorizeOwner(zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		home.handleListAudits(req, resp)
+	})))
+
+	// room manager handler
+	service.Handle("listrooms", auth.authorize(0, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		room.handleListRooms(req, resp)
+	})))
+	service.Handle("createroom", auth.authorize(device.PERM_RENAME, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		room.handleCreateRoom(req, resp)
+	})))
+	service.Handle("renameroom", auth.authorize(device.PERM_RENAME, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		room.handleRenameRoom(req, resp)
+	})))
+	service.Handle("deleteroom", auth.authorize(device.PERM_RENAME, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		room.handleDeleteRoom(req, resp)
+	})))
+	service.Handle("reorderrooms", auth.authorize(device.PERM_RENAME, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		room.handleReorderRooms(req, resp)
+	})))
+
+	// quota manager handler
+	service.Handle("getquotausage", auth.authorizeUser(zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		quota.handleGetQuotaUsage(req, resp)
+	})))
+	// the domain quotas set by the domain administrator service
+	service.Handle("setquota", auth.authorizeService("setquota", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		quota.handleSetQuota(req, resp)
+	})))
 
 	// member manager handler
-	service.Handle("listmembers", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+	service.Handle("listmembers", auth.authorize(0, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
 		member.handleListMembers(req, resp)
-	}))
-	service.Handle("addmember", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
-		member.handleAddMember(req, resp)
-	}))
-	service.Handle("deletemember", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+	})))
+	service.Handle("leavehome", auth.authorize(0, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		member.handleLeaveHome(req, resp)
+	})))
+	service.Handle("deletemember", auth.authorizeMember(device.PERM_MANAGE_MEMBER, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
 		member.handleDeleteMember(req, resp)
-	}))
-	service.Handle("modifymember", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+	})))
+	service.Handle("modifymember", auth.authorizeMember(device.PERM_MANAGE_MEMBER, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
 		member.handleModifyMember(req, resp)
-	}))
-	service.Handle("frozenmember", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+	})))
+	service.Handle("frozenmember", auth.authorize(device.PERM_FREEZE, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
 		member.handleFrozenMember(req, resp)
-	}))
+	})))
+	service.Handle("setmembervalidity", auth.authorize(device.PERM_MANAGE_MEMBER, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		member.handleSetMemberValidity(req, resp)
+	})))
+	// the expired members swept by the scheduled domain service
+	service.Handle("sweepmembers", auth.authorizeService("sweepmembers", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		member.handleSweepMembers(req, resp)
+	})))
+	service.Handle("invitemember", auth.authorize(device.PERM_MANAGE_MEMBER, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		member.handleInviteMember(req, resp)
+	})))
+	service.Handle("createinvitecode", auth.authorize(device.PERM_MANAGE_MEMBER, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		member.handleCreateInviteCode(req, resp)
+	})))
+	service.Handle("acceptinvite", auth.authorizeUser(zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		member.handleAcceptInvite(req, resp)
+	})))
+	service.Handle("declineinvite", auth.authorizeUser(zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		member.handleDeclineInvite(req, resp)
+	})))
+	service.Handle("revokeinvite", auth.authorizeUser(zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		member.handleRevokeInvite(req, resp)
+	})))
+	service.Handle("listinvites", auth.authorizeUser(zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		member.handleListInvites(req, resp)
+	})))
 
 	// device manager handler
-	service.Handle("listdevices", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+	service.Handle("listdevices", auth.authorize(0, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
 		dev.handleListDevices(req, resp)
-	}))
-	service.Handle("binddevice", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+	})))
+	service.Handle("binddevice", auth.authorize(device.PERM_BIND, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
 		dev.handleBindDevice(req, resp)
-	}))
-	service.Handle("changedevice", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+	})))
+	service.Handle("binddevices", auth.authorize(device.PERM_BIND, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		dev.handleBatchBindDevices(req, resp)
+	})))
+	service.Handle("changedevice", auth.authorize(device.PERM_BIND, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
 		dev.handleChangeDevice(req, resp)
-	}))
-	service.Handle("deletedevice", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+	})))
+	service.Handle("replacegateway", auth.authorize(device.PERM_BIND, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		dev.handleReplaceGateway(req, resp)
+	})))
+	service.Handle("listslaves", auth.authorize(0, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		dev.handleListSlaves(req, resp)
+	})))
+	service.Handle("moveslave", auth.authorize(device.PERM_BIND, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		dev.handleMoveSlave(req, resp)
+	})))
+	service.Handle("detachslave", auth.authorize(device.PERM_BIND, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		dev.handleDetachSlave(req, resp)
+	})))
+	service.Handle("devicehistory", auth.authorizeService("devicehistory", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		dev.handleDeviceHistory(req, resp)
+	})))
+	service.Handle("deletedevice", auth.authorize(device.PERM_BIND, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
 		dev.handleDeleteDevice(req, resp)
-	}))
-	service.Handle("modifydevice", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+	})))
+	service.Handle("modifydevice", auth.authorize(device.PERM_RENAME, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
 		dev.handleModifyDevice(req, resp)
-	}))
-	service.Handle("frozendevice", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+	})))
+	service.Handle("frozendevice", auth.authorize(device.PERM_FREEZE, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
 		dev.handleFrozenDevice(req, resp)
+	})))
+	service.Handle("setdeviceroom", auth.authorize(device.PERM_RENAME, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		dev.handleSetDeviceRoom(req, resp)
+	})))
+	service.Handle("approvetransfer", auth.authorizeOwner(zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		dev.handleApproveTransfer(req, resp)
+	})))
+	service.Handle("heartbeat", auth.authorizeDevice("heartbeat", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		dev.handleHeartbeat(req, resp)
+	})))
+	service.Handle("resetdevice", auth.authorizeDevice("resetdevice", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		dev.handleResetDevice(req, resp)
+	})))
+
+	// account manager handler
+	service.Handle("exportuser", auth.authorizeSelf("exportuser", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		account.handleExportUser(req, resp)
+	})))
+	// the deleted user purged by the account service
+	service.Handle("purgeuser", auth.authorizeSubject("purgeuser", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		account.handlePurgeUser(req, resp)
+	})))
+
+	// device acl manager handler
+	service.Handle("listdeviceacl", auth.authorize(0, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		acl.handleListDeviceAcl(req, resp)
+	})))
+	service.Handle("grantdevice", auth.authorize(device.PERM_MANAGE_MEMBER, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		acl.handleGrantDevice(req, resp)
+	})))
+	service.Handle("revokedevice", auth.authorize(device.PERM_MANAGE_MEMBER, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		acl.handleRevokeDevice(req, resp)
+	})))
+
+	// device shadow manager handler
+	service.Handle("getshadow", auth.authorize(device.PERM_CONTROL, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		shadow.handleGetShadow(req, resp)
+	})))
+	service.Handle("updateshadow", auth.authorize(device.PERM_CONTROL, zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		shadow.handleUpdateShadow(req, resp)
+	})))
+	service.Handle("reportshadow", auth.authorizeDevice("reportshadow", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		shadow.handleReportShadow(req, resp)
+	})))
+
+	// device command queue handler
+	service.Handle("enqueuecommand", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		command.handleEnqueueCommand(req, resp)
 	}))
+	service.Handle("fetchcommands", auth.authorizeDevice("fetchcommands", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		command.handleFetchCommands(req, resp)
+	})))
+	service.Handle("ackcommand", auth.authorizeDevice("ackcommand", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		command.handleAckCommand(req, resp)
+	})))
+	service.Handle("nackcommand", auth.authorizeDevice("nackcommand", zc.ZServiceHandler(func(req *zc.ZMsg, resp *zc.ZMsg) {
+		command.handleNackCommand(req, resp)
+	})))
 	return service
 }
 
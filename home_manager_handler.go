@@ -1,20 +1,23 @@
 package main
 
 import (
+	"encoding/json"
+	"zc-common-go/common"
 	log "zc-common-go/glog"
 	"zc-dm/device"
 	"zc-service-go"
 )
 
 type HomeManagerHandler struct {
-	home *device.HomeManager
+	home  *device.HomeManager
+	audit *device.AuditManager
 }
 
-func NewHomeManagerHandler(home *device.HomeManager) *HomeManagerHandler {
-	if home == nil {
+func NewHomeManagerHandler(home *device.HomeManager, audit *device.AuditManager) *HomeManagerHandler {
+	if home == nil || audit == nil {
 		return nil
 	}
-	return &HomeManagerHandler{home: home}
+	return &HomeManagerHandler{home: home, audit: audit}
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////
@@ -30,13 +33,78 @@ func (this *HomeManagerHandler) handleListHomes(req *zc.ZMsg, resp *zc.ZMsg) {
 		log.Warningf("list all home failed:domain[%s], uid[%d], err[%v]", domain, uid, err)
 		return
 	}
-	for _, home := range list {
-		resp.AddObject("homes", zc.ZObject{"id": home.GetHid(), "name": home.GetName()})
+	err = this.addHomes(domain, list, resp)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("get homes metadata failed:domain[%s], count[%d], err[%v]", domain, len(list), err)
+		return
 	}
 	log.Warningf("list all home succ:domain[%s], uid[%d], count[%d]", domain, uid, len(list))
 	resp.SetAck()
 }
 
+// add the homes with their metadata queried at once to the response
+func (this *HomeManagerHandler) addHomes(domain string, list []device.Home, resp *zc.ZMsg) error {
+	hids := make([]int64, 0, len(list))
+	for _, home := range list {
+		hids = append(hids, home.GetHid())
+	}
+	metadata, err := this.home.GetAllMetadata(domain, hids)
+	if err != nil {
+		return err
+	}
+	for _, home := range list {
+		resp.AddObject("homes", zc.ZObject{"id": home.GetHid(), "name": home.GetName(), "parent": home.GetParentHid(),
+			"timezone": home.GetTimezone(), "address": home.GetAddress(), "latitude": home.GetLatitude(),
+			"longitude": home.GetLongitude(), "metadata": metadata[home.GetHid()]})
+	}
+	return nil
+}
+
+// get the home with its members and the master/slave devices in one consistent snapshot
+func (this *HomeManagerHandler) handleGetHome(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	hid := req.GetInt("hid")
+	detail, err := this.home.GetDetail(domain, hid)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("get home detail failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return
+	} else if detail == nil {
+		resp.SetErr(common.ErrEntryNotExist.Error())
+		log.Warningf("home not exist:domain[%s], hid[%d]", domain, hid)
+		return
+	}
+	home := detail.GetHome()
+	resp.AddObject("home", zc.ZObject{"id": home.GetHid(), "name": home.GetName(), "owner": home.GetCreateUid(),
+		"status": home.GetStatus(), "parent": home.GetParentHid(), "timezone": home.GetTimezone(), "address": home.GetAddress(),
+		"latitude": home.GetLatitude(), "longitude": home.GetLongitude()})
+	for _, member := range detail.GetMembers() {
+		resp.AddObject("members", zc.ZObject{"id": member.GetUid(), "name": member.GetMemberName(),
+			"role": device.GetRoleName(member.GetMemberType()), "status": member.GetStatus()})
+	}
+	for _, master := range detail.GetMasters() {
+		slaves := make([]zc.ZObject, 0)
+		for _, slave := range detail.GetSlaves(master.GetDid()) {
+			slaves = append(slaves, deviceObject(&slave))
+		}
+		object := deviceObject(&master)
+		object["slaves"] = slaves
+		resp.AddObject("devices", object)
+	}
+	for _, slave := range detail.GetDetached() {
+		resp.AddObject("detached", deviceObject(&slave))
+	}
+	log.Infof("get home detail succ:domain[%s], hid[%d], members[%d], masters[%d]",
+		domain, hid, len(detail.GetMembers()), len(detail.GetMasters()))
+	resp.SetAck()
+}
+
+func deviceObject(dev *device.DeviceInfo) zc.ZObject {
+	return zc.ZObject{"id": dev.GetDid(), "name": dev.GetDeviceName(), "status": dev.GetStatus(),
+		"master": dev.GetMasterDid(), "room": dev.GetRoomId()}
+}
+
 // create home
 func (this *HomeManagerHandler) handleCreateHome(req *zc.ZMsg, resp *zc.ZMsg) {
 	domain := req.GetString("domain")
@@ -55,32 +123,80 @@ func (this *HomeManagerHandler) handleCreateHome(req *zc.ZMsg, resp *zc.ZMsg) {
 	resp.SetAck()
 }
 
-// modify home
+// the optional location attributes of modify home, the not set ones keep unchanged
+type homeLocation struct {
+	Timezone  *string  `json:"timezone"`
+	Address   *string  `json:"address"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+}
+
+// modify home name, location with the json param location and the custom metadata
+// with the json param metadata, the metadata key with empty value will be deleted,
+// all the attributes modified in one transaction
 func (this *HomeManagerHandler) handleModifyHome(req *zc.ZMsg, resp *zc.ZMsg) {
 	domain := req.GetString("domain")
 	hid := req.GetInt("hid")
 	name := req.GetString("hname")
-	err := this.home.ModifyName(domain, hid, name)
+	location := req.GetString("location")
+	metadata := req.GetString("metadata")
+	update := device.NewHomeUpdate()
+	if len(name) > 0 || (len(location) == 0 && len(metadata) == 0) {
+		update.SetName(name)
+	}
+	if len(location) > 0 {
+		var param homeLocation
+		err := json.Unmarshal([]byte(location), &param)
+		if err != nil {
+			resp.SetErr(common.ErrInvalidRequest.Error())
+			log.Warningf("parse the location failed:domain[%s], hid[%d], location[%s], err[%v]", domain, hid, location, err)
+			return
+		}
+		if param.Timezone != nil {
+			update.SetTimezone(*param.Timezone)
+		}
+		if param.Address != nil {
+			update.SetAddress(*param.Address)
+		}
+		if param.Latitude != nil {
+			update.SetLatitude(*param.Latitude)
+		}
+		if param.Longitude != nil {
+			update.SetLongitude(*param.Longitude)
+		}
+	}
+	if len(metadata) > 0 {
+		values := make(map[string]string)
+		err := json.Unmarshal([]byte(metadata), &values)
+		if err != nil {
+			resp.SetErr(common.ErrInvalidRequest.Error())
+			log.Warningf("parse the metadata failed:domain[%s], hid[%d], metadata[%s], err[%v]", domain, hid, metadata, err)
+			return
+		}
+		update.SetMetadata(values)
+	}
+	err := this.home.Modify(domain, hid, update)
 	if err != nil {
 		resp.SetErr(err.Error())
-		log.Warningf("modify home name failed:domain[%s], hid[%d], name[%s], err[%v]", domain, hid, name, err)
+		log.Warningf("modify home failed:domain[%s], hid[%d], name[%s], err[%v]", domain, hid, name, err)
 		return
 	}
-	log.Infof("modify home name succ:domain[%s], hid[%d], name[%s]", domain, hid, name)
+	log.Infof("modify home succ:domain[%s], hid[%d], name[%s]", domain, hid, name)
 	resp.SetAck()
 }
 
 // delete home
 func (this *HomeManagerHandler) handleDeleteHome(req *zc.ZMsg, resp *zc.ZMsg) {
 	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
 	hid := req.GetInt("hid")
-	err := this.home.Delete(domain, hid)
+	err := this.home.Delete(uid, domain, hid)
 	if err != nil {
 		resp.SetErr(err.Error())
-		log.Warningf("delete home failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		log.Warningf("delete home failed:uid[%d], domain[%s], hid[%d], err[%v]", uid, domain, hid, err)
 		return
 	}
-	log.Infof("delete home succ:domain[%s], hid[%d]", domain, hid)
+	log.Infof("delete home succ:uid[%d], domain[%s], hid[%d]", uid, domain, hid)
 	resp.SetAck()
 }
 
@@ -103,3 +219,74 @@ func (this *HomeManagerHandler) handleFrozenHome(req *zc.ZMsg, resp *zc.ZMsg) {
 	log.Infof("frozen/defrozen home succ:domain[%s], hid[%d], frozen[%t]", domain, hid, frozen)
 	resp.SetAck()
 }
+
+// transfer the home to another member
+func (this *HomeManagerHandler) handleTransferHome(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	hid := req.GetInt("hid")
+	owner := req.GetInt("owner")
+	keep := req.GetBool("keep")
+	err := this.home.Transfer(domain, hid, uid, owner, keep)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("transfer home failed:domain[%s], hid[%d], uid[%d], owner[%d], keep[%t], err[%v]", domain, hid, uid, owner, keep, err)
+		return
+	}
+	log.Infof("transfer home succ:domain[%s], hid[%d], uid[%d], owner[%d], keep[%t]", domain, hid, uid, owner, keep)
+	resp.SetAck()
+}
+
+// set the parent home of the site hierarchy
+func (this *HomeManagerHandler) handleSetHomeParent(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	hid := req.GetInt("hid")
+	parent := req.GetInt("parent")
+	err := this.home.SetParent(domain, uid, hid, parent)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("set home parent failed:domain[%s], uid[%d], hid[%d], parent[%d], err[%v]", domain, uid, hid, parent, err)
+		return
+	}
+	log.Infof("set home parent succ:domain[%s], uid[%d], hid[%d], parent[%d]", domain, uid, hid, parent)
+	resp.SetAck()
+}
+
+// list all the child homes of the site hierarchy
+func (this *HomeManagerHandler) handleListChildHomes(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	hid := req.GetInt("hid")
+	list, err := this.home.GetChildren(domain, hid)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("list child homes failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return
+	}
+	err = this.addHomes(domain, list, resp)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("get homes metadata failed:domain[%s], count[%d], err[%v]", domain, len(list), err)
+		return
+	}
+	log.Infof("list child homes succ:domain[%s], hid[%d], count[%d]", domain, hid, len(list))
+	resp.SetAck()
+}
+
+// list all audit logs of the home
+func (this *HomeManagerHandler) handleListAudits(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	hid := req.GetInt("hid")
+	list, err := this.audit.GetAll(domain, hid)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("list all audit logs failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return
+	}
+	for _, audit := range list {
+		resp.AddObject("audits", zc.ZObject{"id": audit.GetId(), "uid": audit.GetUid(), "did": audit.GetDid(),
+			"action": audit.GetAction(), "detail": audit.GetDetail(), "time": audit.GetCreateTime().Unix()})
+	}
+	log.Infof("list all audit logs succ:domain[%s], hid[%d], count[%d]", domain, hid, len(list))
+	resp.SetAck()
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+	"zc-common-go/common"
 	log "zc-common-go/glog"
 	"zc-dm/device"
 	"zc-service-go"
@@ -8,13 +10,14 @@ import (
 
 type MemberManagerHandler struct {
 	member *device.MemberManager
+	invite *device.InviteManager
 }
 
-func NewMemberManagerHandler(member *device.MemberManager) *MemberManagerHandler {
-	if member == nil {
+func NewMemberManagerHandler(member *device.MemberManager, invite *device.InviteManager) *MemberManagerHandler {
+	if member == nil || invite == nil {
 		return nil
 	}
-	return &MemberManagerHandler{member: member}
+	return &MemberManagerHandler{member: member, invite: invite}
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////
@@ -31,76 +34,321 @@ func (this *MemberManagerHandler) handleListMembers(req *zc.ZMsg, resp *zc.ZMsg)
 		return
 	}
 	for _, member := range list {
-		resp.AddObject("homes", zc.ZObject{"hid": member.GetHid(), "id": member.GetUid(), "name": member.GetMemberName()})
+		object := zc.ZObject{"hid": member.GetHid(), "id": member.GetUid(), "name": member.GetMemberName(),
+			"role": device.GetRoleName(member.GetMemberType())}
+		if !member.GetValidFrom().IsZero() {
+			object["from"] = member.GetValidFrom().Unix()
+		}
+		if !member.GetValidUntil().IsZero() {
+			object["until"] = member.GetValidUntil().Unix()
+		}
+		if len(member.GetSchedule()) > 0 {
+			object["schedule"] = member.GetSchedule()
+		}
+		resp.AddObject("homes", object)
 	}
 	log.Warningf("list all members succ:domain[%s], hid[%d], count[%d]", domain, hid, len(list))
 	resp.SetAck()
 }
 
-// add member
-func (this *MemberManagerHandler) handleAddMember(req *zc.ZMsg, resp *zc.ZMsg) {
+// delete member, the uid is the caller and the member is the deleted one,
+// if the member not set delete the caller self
+func (this *MemberManagerHandler) handleDeleteMember(req *zc.ZMsg, resp *zc.ZMsg) {
 	domain := req.GetString("domain")
 	hid := req.GetInt("hid")
 	uid := req.GetInt("uid")
-	name := req.GetString("uname")
-	err := this.member.AddMember(domain, hid, uid, name)
+	member := req.GetInt("member")
+	if member <= 0 {
+		member = uid
+	}
+	err := this.member.Remove(domain, hid, uid, member)
 	if err != nil {
 		resp.SetErr(err.Error())
-		log.Warningf("add member failed:domain[%s], hid[%d], uid[%d], uname[%s], err[%v]", domain, hid, uid, name, err)
+		log.Warningf("delete member failed:domain[%s], hid[%d], uid[%d], member[%d], err[%v]", domain, hid, uid, member, err)
 		return
 	}
-	log.Infof("add member succ:domain[%s], hid[%d], uid[%d], uname[%s]", domain, hid, uid, name)
+	log.Infof("delete member succ:domain[%s], hid[%d], uid[%d], member[%d]", domain, hid, uid, member)
 	resp.SetAck()
 }
 
-// delete member
-func (this *MemberManagerHandler) handleDeleteMember(req *zc.ZMsg, resp *zc.ZMsg) {
+// the caller leave the home, the owner must transfer the home at first
+func (this *MemberManagerHandler) handleLeaveHome(req *zc.ZMsg, resp *zc.ZMsg) {
 	domain := req.GetString("domain")
 	hid := req.GetInt("hid")
 	uid := req.GetInt("uid")
-	err := this.member.Delete(domain, hid, uid)
+	err := this.member.Leave(domain, hid, uid)
 	if err != nil {
 		resp.SetErr(err.Error())
-		log.Warningf("delete member failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, uid, err)
+		log.Warningf("leave home failed:domain[%s], hid[%d], uid[%d], err[%v]", domain, hid, uid, err)
 		return
 	}
-	log.Infof("delete member succ:domain[%s], hid[%d], uid[%d]", domain, hid, uid)
+	log.Infof("leave home succ:domain[%s], hid[%d], uid[%d]", domain, hid, uid)
 	resp.SetAck()
 }
 
-// modify member name
+// modify member name and role, the uid is the caller and the member is the modified one,
+// if the member not set modify the caller self
 func (this *MemberManagerHandler) handleModifyMember(req *zc.ZMsg, resp *zc.ZMsg) {
 	domain := req.GetString("domain")
 	hid := req.GetInt("hid")
 	uid := req.GetInt("uid")
+	member := req.GetInt("member")
+	if member <= 0 {
+		member = uid
+	}
 	name := req.GetString("uname")
-	err := this.member.ModifyName(domain, hid, uid, name)
+	roleName := req.GetString("role")
+	// the role parsed and authorized at first, nothing modified if the role change denied
+	if len(roleName) > 0 {
+		role, ok := device.ParseRole(roleName)
+		if !ok {
+			resp.SetErr(common.ErrInvalidParam.Error())
+			log.Warningf("parse the role failed:domain[%s], hid[%d], member[%d], role[%s]", domain, hid, member, roleName)
+			return
+		}
+		err := this.member.ModifyRole(domain, hid, uid, member, role)
+		if err != nil {
+			resp.SetErr(err.Error())
+			log.Warningf("modify member role failed:domain[%s], hid[%d], uid[%d], member[%d], role[%s], err[%v]",
+				domain, hid, uid, member, roleName, err)
+			return
+		}
+	}
+	if len(name) > 0 || len(roleName) == 0 {
+		err := this.member.Rename(domain, hid, uid, member, name)
+		if err != nil {
+			resp.SetErr(err.Error())
+			log.Warningf("modify member name failed:domain[%s], hid[%d], uid[%d], member[%d], uname[%s], err[%v]",
+				domain, hid, uid, member, name, err)
+			return
+		}
+	}
+	log.Infof("modify member succ:domain[%s], hid[%d], member[%d], uname[%s], role[%s]", domain, hid, member, name, roleName)
+	resp.SetAck()
+}
+
+// frozen/defrozen member, the uid is the caller and the member is the frozen one
+func (this *MemberManagerHandler) handleFrozenMember(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	hid := req.GetInt("hid")
+	uid := req.GetInt("uid")
+	member := req.GetInt("member")
+	frozen := req.GetBool("frozen")
+	err := this.member.Freeze(domain, hid, uid, member, frozen)
 	if err != nil {
 		resp.SetErr(err.Error())
-		log.Warningf("modify member name failed:domain[%s], hid[%d], uid[%d], uname[%s], err[%v]", domain, hid, uid, name, err)
+		log.Warningf("frozen/defrozen member failed:domain[%s], hid[%d], uid[%d], member[%d], frozen[%t], err[%v]",
+			domain, hid, uid, member, frozen, err)
 		return
 	}
-	log.Infof("modify member name succ:domain[%s], hid[%d], uid[%d], uname[%s]", domain, hid, uid, name)
+	log.Infof("frozen/defrozen member succ:domain[%s], hid[%d], uid[%d], member[%d], frozen[%t]", domain, hid, uid, member, frozen)
 	resp.SetAck()
 }
 
-// frozen/defrozen member
-func (this *MemberManagerHandler) handleFrozenMember(req *zc.ZMsg, resp *zc.ZMsg) {
+// sweep the expired members of all the homes in the domain
+func (this *MemberManagerHandler) handleSweepMembers(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	count, err := this.member.SweepExpired(domain)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("sweep expired members failed:domain[%s], count[%d], err[%v]", domain, count, err)
+		return
+	}
+	log.Infof("sweep expired members succ:domain[%s], count[%d]", domain, count)
+	resp.AddObject("sweep", zc.ZObject{"count": count})
+	resp.SetAck()
+}
+
+// limit the member access in the time range and the weekly schedule, the from and until in
+// unix seconds and 0 means not limited, the schedule like "1,2,3,4,5@09:00-17:00" in the home timezone
+func (this *MemberManagerHandler) handleSetMemberValidity(req *zc.ZMsg, resp *zc.ZMsg) {
 	domain := req.GetString("domain")
 	hid := req.GetInt("hid")
 	uid := req.GetInt("uid")
-	frozen := req.GetBool("frozen")
+	member := req.GetInt("member")
+	from := getUnixTime(req.GetInt("from"))
+	until := getUnixTime(req.GetInt("until"))
+	schedule := req.GetString("schedule")
+	err := this.member.SetValidity(domain, hid, uid, member, from, until, schedule)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("set member validity failed:domain[%s], hid[%d], uid[%d], member[%d], from[%v], until[%v], schedule[%s], err[%v]",
+			domain, hid, uid, member, from, until, schedule, err)
+		return
+	}
+	log.Infof("set member validity succ:domain[%s], hid[%d], uid[%d], member[%d], from[%v], until[%v], schedule[%s]",
+		domain, hid, uid, member, from, until, schedule)
+	resp.SetAck()
+}
+
+// the unix seconds to time, zero time if not set
+func getUnixTime(seconds int64) time.Time {
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+// the time to unix seconds, 0 if it is zero time
+func getUnixSeconds(value time.Time) int64 {
+	if value.IsZero() {
+		return 0
+	}
+	return value.Unix()
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+/// MEMBER INVITATION
+////////////////////////////////////////////////////////////////////////////////////////////
+// the home owner invite one user, the member created only when the invitee accept it
+func (this *MemberManagerHandler) handleInviteMember(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	hid := req.GetInt("hid")
+	invitee := req.GetInt("invitee")
+	role, err := getInviteRole(req)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("parse the invite role failed:domain[%s], uid[%d], hid[%d], err[%v]", domain, uid, hid, err)
+		return
+	}
+	id, err := this.invite.Invite(domain, uid, hid, invitee, role, getInviteExpire(req))
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("invite member failed:domain[%s], uid[%d], hid[%d], invitee[%d], err[%v]", domain, uid, hid, invitee, err)
+		return
+	}
+	resp.AddObject("invites", zc.ZObject{"id": id, "hid": hid, "invitee": invitee})
+	log.Infof("invite member succ:domain[%s], uid[%d], hid[%d], invitee[%d], id[%d]", domain, uid, hid, invitee, id)
+	resp.SetAck()
+}
+
+// the home owner create a shareable invite code
+func (this *MemberManagerHandler) handleCreateInviteCode(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	hid := req.GetInt("hid")
+	maxUses := req.GetInt("maxuses")
+	if maxUses <= 0 {
+		maxUses = 1
+	}
+	role, err := getInviteRole(req)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("parse the invite role failed:domain[%s], uid[%d], hid[%d], err[%v]", domain, uid, hid, err)
+		return
+	}
+	invite, err := this.invite.CreateCode(domain, uid, hid, role, maxUses, getInviteExpire(req))
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("create invite code failed:domain[%s], uid[%d], hid[%d], err[%v]", domain, uid, hid, err)
+		return
+	}
+	resp.AddObject("invites", inviteObject(invite))
+	log.Infof("create invite code succ:domain[%s], uid[%d], hid[%d], id[%d]", domain, uid, hid, invite.GetId())
+	resp.SetAck()
+}
+
+// accept the invite by id or the shareable code
+func (this *MemberManagerHandler) handleAcceptInvite(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	id := req.GetInt("id")
+	code := req.GetString("code")
+	name := req.GetString("uname")
+	var err error
+	if len(code) > 0 {
+		err = this.invite.AcceptCode(domain, uid, code, name)
+	} else {
+		err = this.invite.Accept(domain, uid, id, name)
+	}
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("accept invite failed:domain[%s], uid[%d], id[%d], err[%v]", domain, uid, id, err)
+		return
+	}
+	log.Infof("accept invite succ:domain[%s], uid[%d], id[%d], uname[%s]", domain, uid, id, name)
+	resp.SetAck()
+}
+
+// decline the invite sent to the user
+func (this *MemberManagerHandler) handleDeclineInvite(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	id := req.GetInt("id")
+	err := this.invite.Decline(domain, uid, id)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("decline invite failed:domain[%s], uid[%d], id[%d], err[%v]", domain, uid, id, err)
+		return
+	}
+	log.Infof("decline invite succ:domain[%s], uid[%d], id[%d]", domain, uid, id)
+	resp.SetAck()
+}
+
+// the home owner revoke the pending invite
+func (this *MemberManagerHandler) handleRevokeInvite(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	id := req.GetInt("id")
+	err := this.invite.Revoke(domain, uid, id)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("revoke invite failed:domain[%s], uid[%d], id[%d], err[%v]", domain, uid, id, err)
+		return
+	}
+	log.Infof("revoke invite succ:domain[%s], uid[%d], id[%d]", domain, uid, id)
+	resp.SetAck()
+}
+
+// list all invites of the home for the owner if hid set, otherwise the pending invites of the user
+func (this *MemberManagerHandler) handleListInvites(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	hid := req.GetInt("hid")
+	var list []device.Invite
 	var err error
-	if frozen {
-		err = this.member.Disable(domain, hid, uid)
+	if hid > 0 {
+		list, err = this.invite.GetAll(domain, uid, hid)
 	} else {
-		err = this.member.Enable(domain, hid, uid)
+		list, err = this.invite.GetPending(domain, uid)
 	}
 	if err != nil {
 		resp.SetErr(err.Error())
-		log.Warningf("frozen/defrozen member failed:domain[%s], hid[%d], uid[%d], frozen[%t], err[%v]", domain, hid, uid, frozen, err)
+		log.Warningf("list invites failed:domain[%s], uid[%d], hid[%d], err[%v]", domain, uid, hid, err)
 		return
 	}
-	log.Infof("frozen/defrozen member succ:domain[%s], hid[%d], uid[%d], frozen[%t]", domain, hid, uid, frozen)
+	for i := range list {
+		resp.AddObject("invites", inviteObject(&list[i]))
+	}
+	log.Infof("list invites succ:domain[%s], uid[%d], hid[%d], count[%d]", domain, uid, hid, len(list))
 	resp.SetAck()
 }
+
+// the expire param in seconds, use the default if not set
+func getInviteExpire(req *zc.ZMsg) time.Duration {
+	expire := req.GetInt("expire")
+	if expire <= 0 {
+		return device.INVITE_EXPIRE
+	}
+	return time.Duration(expire) * time.Second
+}
+
+// the role param of the invite, the default role is member
+func getInviteRole(req *zc.ZMsg) (int8, error) {
+	name := req.GetString("role")
+	if len(name) == 0 {
+		return device.ROLE_MEMBER, nil
+	}
+	role, ok := device.ParseRole(name)
+	if !ok {
+		return role, common.ErrInvalidParam
+	}
+	return role, nil
+}
+
+func inviteObject(invite *device.Invite) zc.ZObject {
+	return zc.ZObject{"id": invite.GetId(), "hid": invite.GetHid(), "uid": invite.GetUid(),
+		"invitee": invite.GetInvitee(), "role": device.GetRoleName(invite.GetRole()), "code": invite.GetCode(), "maxuses": invite.GetMaxUses(),
+		"used": invite.GetUsed(), "status": invite.GetStatus(), "expire": invite.GetExpireTime().Unix()}
+}
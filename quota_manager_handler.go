@@ -0,0 +1,57 @@
+package main
+
+import (
+	log "zc-common-go/glog"
+	"zc-dm/device"
+	"zc-service-go"
+)
+
+type QuotaManagerHandler struct {
+	quota *device.QuotaManager
+}
+
+func NewQuotaManagerHandler(quota *device.QuotaManager) *QuotaManagerHandler {
+	if quota == nil {
+		return nil
+	}
+	return &QuotaManagerHandler{quota: quota}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+/// QUOTA MANAGER
+////////////////////////////////////////////////////////////////////////////////////////////
+// get the domain quotas and the current usage of the user, home and master
+func (this *QuotaManagerHandler) handleGetQuotaUsage(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	hid := req.GetInt("hid")
+	masterDid := req.GetInt("master")
+	usage, err := this.quota.GetUsage(domain, uid, hid, masterDid)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("get quota usage failed:domain[%s], uid[%d], hid[%d], master[%d], err[%v]", domain, uid, hid, masterDid, err)
+		return
+	}
+	quota := usage.GetQuota()
+	resp.AddObject("quota", zc.ZObject{"homes": quota.GetHomes(), "members": quota.GetMembers(),
+		"devices": quota.GetDevices(), "slaves": quota.GetSlaves()})
+	resp.AddObject("usage", zc.ZObject{"homes": usage.GetHomes(), "members": usage.GetMembers(),
+		"devices": usage.GetDevices(), "slaves": usage.GetSlaves()})
+	log.Infof("get quota usage succ:domain[%s], uid[%d], hid[%d], master[%d]", domain, uid, hid, masterDid)
+	resp.SetAck()
+}
+
+// set one quota of the domain
+func (this *QuotaManagerHandler) handleSetQuota(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	name := req.GetString("name")
+	value := req.GetInt("value")
+	err := this.quota.Set(domain, name, value)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("set domain quota failed:domain[%s], name[%s], value[%d], err[%v]", domain, name, value, err)
+		return
+	}
+	log.Infof("set domain quota succ:domain[%s], name[%s], value[%d]", domain, name, value)
+	resp.SetAck()
+}
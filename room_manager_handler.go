@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"zc-common-go/common"
+	log "zc-common-go/glog"
+	"zc-dm/device"
+	"zc-service-go"
+)
+
+type RoomManagerHandler struct {
+	room *device.RoomManager
+}
+
+func NewRoomManagerHandler(room *device.RoomManager) *RoomManagerHandler {
+	if room == nil {
+		return nil
+	}
+	return &RoomManagerHandler{room: room}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+/// ROOM MANAGER
+////////////////////////////////////////////////////////////////////////////////////////////
+// list all rooms of one home
+func (this *RoomManagerHandler) handleListRooms(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	hid := req.GetInt("hid")
+	list, err := this.room.GetAll(domain, hid)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("list all rooms failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return
+	}
+	for _, room := range list {
+		resp.AddObject("rooms", zc.ZObject{"id": room.GetRid(), "hid": room.GetHid(), "name": room.GetName(), "position": room.GetPosition()})
+	}
+	log.Infof("list all rooms succ:domain[%s], hid[%d], count[%d]", domain, hid, len(list))
+	resp.SetAck()
+}
+
+// create room
+func (this *RoomManagerHandler) handleCreateRoom(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	hid := req.GetInt("hid")
+	name := req.GetString("rname")
+	rid, err := this.room.Create(domain, hid, name)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("create room failed:domain[%s], hid[%d], name[%s], err[%v]", domain, hid, name, err)
+		return
+	}
+	resp.AddObject("rooms", zc.ZObject{"id": rid, "hid": hid, "name": name})
+	log.Infof("create room succ:domain[%s], hid[%d], rid[%d], name[%s]", domain, hid, rid, name)
+	resp.SetAck()
+}
+
+// rename room
+func (this *RoomManagerHandler) handleRenameRoom(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	hid := req.GetInt("hid")
+	rid := req.GetInt("rid")
+	name := req.GetString("rname")
+	err := this.room.Rename(domain, hid, rid, name)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("rename room failed:domain[%s], hid[%d], rid[%d], name[%s], err[%v]", domain, hid, rid, name, err)
+		return
+	}
+	log.Infof("rename room succ:domain[%s], hid[%d], rid[%d], name[%s]", domain, hid, rid, name)
+	resp.SetAck()
+}
+
+// delete room, the devices in the room become unassigned
+func (this *RoomManagerHandler) handleDeleteRoom(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	hid := req.GetInt("hid")
+	rid := req.GetInt("rid")
+	err := this.room.Delete(domain, hid, rid)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("delete room failed:domain[%s], hid[%d], rid[%d], err[%v]", domain, hid, rid, err)
+		return
+	}
+	log.Infof("delete room succ:domain[%s], hid[%d], rid[%d]", domain, hid, rid)
+	resp.SetAck()
+}
+
+// reorder all the rooms of one home
+func (this *RoomManagerHandler) handleReorderRooms(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	hid := req.GetInt("hid")
+	var rids []int64
+	err := json.Unmarshal([]byte(req.GetString("rooms")), &rids)
+	if err != nil {
+		resp.SetErr(common.ErrInvalidRequest.Error())
+		log.Warningf("parse the rooms failed:domain[%s], hid[%d], err[%v]", domain, hid, err)
+		return
+	}
+	err = this.room.Reorder(domain, hid, rids)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("reorder rooms failed:domain[%s], hid[%d], rooms[%v], err[%v]", domain, hid, rids, err)
+		return
+	}
+	log.Infof("reorder rooms succ:domain[%s], hid[%d], rooms[%v]", domain, hid, rids)
+	resp.SetAck()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"zc-common-go/common"
+	log "zc-common-go/glog"
+	"zc-dm/device"
+	"zc-service-go"
+)
+
+type ShadowManagerHandler struct {
+	shadow *device.ShadowManager
+}
+
+func NewShadowManagerHandler(shadow *device.ShadowManager) *ShadowManagerHandler {
+	if shadow == nil {
+		return nil
+	}
+	return &ShadowManagerHandler{shadow: shadow}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+/// DEVICE SHADOW MANAGER
+////////////////////////////////////////////////////////////////////////////////////////////
+// get the device shadow with the delta of the desired state, empty if not exist
+func (this *ShadowManagerHandler) handleGetShadow(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	did := req.GetInt("did")
+	shadow, err := this.shadow.Get(uid, domain, did)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("get device shadow failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return
+	}
+	if shadow == nil {
+		resp.AddObject("shadow", zc.ZObject{"did": did, "version": 0, "reported": zc.ZObject{},
+			"desired": zc.ZObject{}, "delta": zc.ZObject{}})
+	} else {
+		resp.AddObject("shadow", shadowObject(shadow))
+	}
+	log.Infof("get device shadow succ:domain[%s], did[%d]", domain, did)
+	resp.SetAck()
+}
+
+// update the desired state by the app, the keys with null value removed
+func (this *ShadowManagerHandler) handleUpdateShadow(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	uid := req.GetInt("uid")
+	did := req.GetInt("did")
+	version := req.GetInt("version")
+	var patch map[string]interface{}
+	err := json.Unmarshal([]byte(req.GetString("desired")), &patch)
+	if err != nil {
+		resp.SetErr(common.ErrInvalidRequest.Error())
+		log.Warningf("parse the desired state failed:domain[%s], did[%d], err[%v]", domain, did, err)
+		return
+	}
+	shadow, err := this.shadow.UpdateDesired(uid, domain, did, patch, version)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("update device shadow failed:domain[%s], did[%d], version[%d], err[%v]", domain, did, version, err)
+		return
+	}
+	resp.AddObject("shadow", shadowObject(shadow))
+	log.Infof("update device shadow succ:domain[%s], did[%d], version[%d]", domain, did, shadow.GetVersion())
+	resp.SetAck()
+}
+
+// report the state by the device, return the delta to apply
+func (this *ShadowManagerHandler) handleReportShadow(req *zc.ZMsg, resp *zc.ZMsg) {
+	domain := req.GetString("domain")
+	subDomain := req.GetString("submain")
+	deviceId := req.GetString("deviceid")
+	version := req.GetInt("version")
+	var patch map[string]interface{}
+	err := json.Unmarshal([]byte(req.GetString("reported")), &patch)
+	if err != nil {
+		resp.SetErr(common.ErrInvalidRequest.Error())
+		log.Warningf("parse the reported state failed:domain[%s], device[%s:%s], err[%v]", domain, subDomain, deviceId, err)
+		return
+	}
+	shadow, err := this.shadow.Report(domain, subDomain, deviceId, patch, version)
+	if err != nil {
+		resp.SetErr(err.Error())
+		log.Warningf("report device shadow failed:domain[%s], device[%s:%s], version[%d], err[%v]",
+			domain, subDomain, deviceId, version, err)
+		return
+	}
+	resp.AddObject("shadow", shadowObject(shadow))
+	log.Infof("report device shadow succ:domain[%s], device[%s:%s], did[%d], version[%d]",
+		domain, subDomain, deviceId, shadow.GetDid(), shadow.GetVersion())
+	resp.SetAck()
+}
+
+func shadowObject(shadow *device.DeviceShadow) zc.ZObject {
+	return zc.ZObject{"did": shadow.GetDid(), "version": shadow.GetVersion(), "reported": shadow.GetReported(),
+		"desired": shadow.GetDesired(), "delta": shadow.GetDelta(), "time": shadow.GetModifyTime().Unix()}
+}
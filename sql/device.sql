@@ -32,6 +32,7 @@ CREATE TABLE IF NOT EXISTS `domain_device_info` (
   `type` varchar(8) NOT NULL,
   `status` int(8) NOT NULL DEFAULT '1',
   `master_did` bigint(20) NOT NULL,
+  `room_id` bigint(20) NOT NULL DEFAULT '0',
   `create_time` datetime DEFAULT NULL,
   `modify_time` datetime DEFAULT NULL,
   PRIMARY KEY (`did`),
@@ -44,9 +45,16 @@ CREATE TABLE IF NOT EXISTS `domain_home_info` (
   `name` varchar(32) DEFAULT 'Default',
   `status` int(8) NOT NULL DEFAULT '1',
   `create_uid` bigint(20) NOT NULL,
+  `parent_hid` bigint(20) NOT NULL DEFAULT '0',
+  `timezone` varchar(64) NOT NULL DEFAULT '',
+  `address` varchar(256) NOT NULL DEFAULT '',
+  `latitude` double NOT NULL DEFAULT '0',
+  `longitude` double NOT NULL DEFAULT '0',
   `create_time` datetime DEFAULT NULL,
   `modify_time` datetime DEFAULT NULL,
-  PRIMARY KEY (`hid`)
+  PRIMARY KEY (`hid`),
+  KEY (`create_uid`) USING HASH,
+  KEY (`parent_hid`) USING HASH
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 
 CREATE TABLE IF NOT EXISTS `domain_home_members` (
@@ -55,8 +63,146 @@ CREATE TABLE IF NOT EXISTS `domain_home_members` (
   `name` varchar(32) NOT NULL,
   `type` int(8) NOT NULL DEFAULT '1',
   `status` int(8) NOT NULL DEFAULT '1',
+  `valid_from` datetime DEFAULT NULL,
+  `valid_until` datetime DEFAULT NULL,
+  `schedule` varchar(256) DEFAULT NULL,
   `create_time` datetime DEFAULT NULL,
   `modify_time` datetime DEFAULT NULL,
   PRIMARY KEY (`uid`,`hid`),
   KEY (`hid`) USING HASH
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `domain_device_transfer` (
+  `did` bigint(20) NOT NULL,
+  `from_hid` bigint(20) NOT NULL,
+  `to_hid` bigint(20) NOT NULL,
+  `approve_uid` bigint(20) NOT NULL,
+  `expire_time` datetime DEFAULT NULL,
+  `create_time` datetime DEFAULT NULL,
+  PRIMARY KEY (`did`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `domain_home_audit` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `hid` bigint(20) NOT NULL,
+  `uid` bigint(20) NOT NULL,
+  `did` bigint(20) NOT NULL DEFAULT '0',
+  `action` varchar(16) NOT NULL,
+  `detail` varchar(128) DEFAULT NULL,
+  `create_time` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY (`hid`) USING HASH,
+  KEY (`uid`) USING HASH
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `domain_device_history` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `sub_domain` varchar(32) NOT NULL,
+  `device_id` varchar(32) NOT NULL,
+  `did` bigint(20) NOT NULL,
+  `event` varchar(8) NOT NULL,
+  `hid` bigint(20) NOT NULL,
+  `master_did` bigint(20) NOT NULL,
+  `uid` bigint(20) NOT NULL DEFAULT '0',
+  `create_time` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY (`sub_domain`, `device_id`),
+  KEY (`uid`) USING HASH
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `domain_home_room` (
+  `rid` bigint(20) NOT NULL AUTO_INCREMENT,
+  `hid` bigint(20) NOT NULL,
+  `name` varchar(32) NOT NULL,
+  `position` int(8) NOT NULL DEFAULT '0',
+  `create_time` datetime DEFAULT NULL,
+  `modify_time` datetime DEFAULT NULL,
+  PRIMARY KEY (`rid`),
+  KEY (`hid`) USING HASH
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `domain_quota_config` (
+  `name` varchar(16) NOT NULL,
+  `value` bigint(20) NOT NULL,
+  PRIMARY KEY (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `domain_home_metadata` (
+  `hid` bigint(20) NOT NULL,
+  `meta_key` varchar(32) NOT NULL,
+  `meta_value` varchar(256) NOT NULL,
+  `modify_time` datetime DEFAULT NULL,
+  PRIMARY KEY (`hid`, `meta_key`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `domain_home_invite` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `hid` bigint(20) NOT NULL,
+  `uid` bigint(20) NOT NULL,
+  `invitee` bigint(20) NOT NULL DEFAULT '0',
+  `role` int(8) NOT NULL DEFAULT '0',
+  `code` varchar(32) DEFAULT NULL,
+  `max_uses` int(8) NOT NULL DEFAULT '1',
+  `used` int(8) NOT NULL DEFAULT '0',
+  `status` int(8) NOT NULL DEFAULT '1',
+  `expire_time` datetime DEFAULT NULL,
+  `create_time` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY (`code`),
+  KEY (`hid`) USING HASH,
+  KEY (`invitee`) USING HASH
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `domain_device_acl` (
+  `did` bigint(20) NOT NULL,
+  `hid` bigint(20) NOT NULL,
+  `subject_type` int(8) NOT NULL,
+  `subject` bigint(20) NOT NULL,
+  `allow` tinyint(1) NOT NULL DEFAULT '1',
+  `create_time` datetime DEFAULT NULL,
+  PRIMARY KEY (`did`, `subject_type`, `subject`),
+  KEY (`hid`) USING HASH
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `domain_grant_revocation` (
+  `subject_type` int(8) NOT NULL,
+  `subject` bigint(20) NOT NULL,
+  `revoke_time` datetime NOT NULL,
+  `expire_time` datetime NOT NULL,
+  PRIMARY KEY (`subject_type`, `subject`),
+  KEY (`expire_time`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `domain_device_presence` (
+  `did` bigint(20) NOT NULL,
+  `last_seen` datetime NOT NULL,
+  `address` varchar(64) NOT NULL DEFAULT '',
+  `server` varchar(64) NOT NULL DEFAULT '',
+  PRIMARY KEY (`did`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `domain_device_shadow` (
+  `did` bigint(20) NOT NULL,
+  `reported` text NOT NULL,
+  `desired` text NOT NULL,
+  `version` bigint(20) NOT NULL DEFAULT '0',
+  `modify_time` datetime DEFAULT NULL,
+  PRIMARY KEY (`did`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `domain_device_command` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `hid` bigint(20) NOT NULL,
+  `master_did` bigint(20) NOT NULL,
+  `did` bigint(20) NOT NULL,
+  `uid` bigint(20) NOT NULL,
+  `payload` text NOT NULL,
+  `status` int(8) NOT NULL DEFAULT '1',
+  `attempts` int(8) NOT NULL DEFAULT '0',
+  `expire_time` datetime NOT NULL,
+  `create_time` datetime DEFAULT NULL,
+  `modify_time` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY (`master_did`, `status`),
+  KEY (`hid`) USING HASH
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;